@@ -0,0 +1,98 @@
+package gaio
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+var ErrUnsupportedAddr = newKindError("unsupported address type", ErrUnsupported)
+
+// remoteAddr returns the address of the peer which sent the data, connected
+// sockets like vsock or tcp streams don't report the source address on
+// recvfrom, and we fallback to the peer name of the socket.
+func remoteAddr(fd int, from unix.Sockaddr) net.Addr {
+	if from != nil {
+		return sockaddrToAddr(from, false)
+	}
+
+	sa, err := unix.Getpeername(fd)
+	if err != nil {
+		return nil
+	}
+	return sockaddrToAddr(sa, true)
+}
+
+// sockaddrToAddr converts a unix.Sockaddr to net.Addr, stream indicates
+// whether the address belongs to a connection-oriented socket.
+func sockaddrToAddr(sa unix.Sockaddr, stream bool) net.Addr {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, sa.Addr[:])
+		if stream {
+			return &net.TCPAddr{IP: ip, Port: sa.Port}
+		}
+		return &net.UDPAddr{IP: ip, Port: sa.Port}
+	case *unix.SockaddrInet6:
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sa.Addr[:])
+		var zone string
+		if sa.ZoneId != 0 {
+			if ifi, err := net.InterfaceByIndex(int(sa.ZoneId)); err == nil {
+				zone = ifi.Name
+			}
+		}
+		if stream {
+			return &net.TCPAddr{IP: ip, Port: sa.Port, Zone: zone}
+		}
+		return &net.UDPAddr{IP: ip, Port: sa.Port, Zone: zone}
+	case *unix.SockaddrUnix:
+		if stream {
+			return &net.UnixAddr{Name: sa.Name, Net: "unix"}
+		}
+		return &net.UnixAddr{Name: sa.Name, Net: "unixgram"}
+	}
+	return sockaddrToAddrOS(sa)
+}
+
+// addrToSockaddr converts a net.Addr to unix.Sockaddr for sendto
+func addrToSockaddr(addr net.Addr) (unix.Sockaddr, error) {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return ipToSockaddr(addr.IP, addr.Port, addr.Zone)
+	case *net.TCPAddr:
+		return ipToSockaddr(addr.IP, addr.Port, addr.Zone)
+	case *net.IPAddr:
+		return ipToSockaddr(addr.IP, 0, addr.Zone)
+	case *net.UnixAddr:
+		return &unix.SockaddrUnix{Name: addr.Name}, nil
+	}
+
+	if sa := addrToSockaddrOS(addr); sa != nil {
+		return sa, nil
+	}
+	return nil, ErrUnsupportedAddr
+}
+
+func ipToSockaddr(ip net.IP, port int, zone string) (unix.Sockaddr, error) {
+	if ip4 := ip.To4(); ip4 != nil {
+		sa := &unix.SockaddrInet4{Port: port}
+		copy(sa.Addr[:], ip4)
+		return sa, nil
+	}
+
+	if ip6 := ip.To16(); ip6 != nil {
+		sa := &unix.SockaddrInet6{Port: port}
+		copy(sa.Addr[:], ip6)
+		if zone != "" {
+			ifi, err := net.InterfaceByName(zone)
+			if err != nil {
+				return nil, err
+			}
+			sa.ZoneId = uint32(ifi.Index)
+		}
+		return sa, nil
+	}
+	return nil, ErrUnsupportedAddr
+}
@@ -0,0 +1,13 @@
+// +build darwin netbsd freebsd openbsd dragonfly
+
+package gaio
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+func sockaddrToAddrOS(sa unix.Sockaddr) net.Addr { return nil }
+
+func addrToSockaddrOS(addr net.Addr) unix.Sockaddr { return nil }
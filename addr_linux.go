@@ -0,0 +1,37 @@
+// +build linux
+
+package gaio
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// VsockAddr represents the address of an AF_VSOCK end point
+type VsockAddr struct {
+	CID  uint32 // context id of the virtual machine
+	Port uint32
+}
+
+// Network returns the address's network name, "vsock"
+func (a *VsockAddr) Network() string { return "vsock" }
+
+func (a *VsockAddr) String() string { return fmt.Sprintf("vm(%d):%d", a.CID, a.Port) }
+
+func sockaddrToAddrOS(sa unix.Sockaddr) net.Addr {
+	switch sa := sa.(type) {
+	case *unix.SockaddrVM:
+		return &VsockAddr{CID: sa.CID, Port: sa.Port}
+	}
+	return nil
+}
+
+func addrToSockaddrOS(addr net.Addr) unix.Sockaddr {
+	switch addr := addr.(type) {
+	case *VsockAddr:
+		return &unix.SockaddrVM{CID: addr.CID, Port: addr.Port}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package gaio
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// VMADDR_CID_LOCAL provides vsock loopback on recent kernels
+const vmaddrCIDLocal = 1
+
+func TestVsockReadFrom(t *testing.T) {
+	ln, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Skip("vsock unsupported:", err)
+	}
+	defer unix.Close(ln)
+
+	if err := unix.Bind(ln, &unix.SockaddrVM{CID: unix.VMADDR_CID_ANY, Port: unix.VMADDR_PORT_ANY}); err != nil {
+		t.Skip("vsock bind:", err)
+	}
+	if err := unix.Listen(ln, 1); err != nil {
+		t.Skip("vsock listen:", err)
+	}
+	sa, err := unix.Getsockname(ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(client)
+	if err := unix.Connect(client, &unix.SockaddrVM{CID: vmaddrCIDLocal, Port: sa.(*unix.SockaddrVM).Port}); err != nil {
+		t.Skip("vsock loopback unsupported:", err)
+	}
+
+	nfd, _, err := unix.Accept(ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(nfd)
+
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, err := w.WatchFd(nfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan OpResult, 1)
+	if err := w.ReadFrom(fd, make([]byte, 64), done); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unix.Write(client, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-done
+	if res.Err != nil || res.Size != 5 {
+		t.Fatal("readfrom:", res.Err, res.Size)
+	}
+
+	local, err := unix.Getsockname(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, ok := res.Addr.(*VsockAddr)
+	if !ok {
+		t.Fatalf("unexpected address %v", res.Addr)
+	}
+	if addr.Port != local.(*unix.SockaddrVM).Port {
+		t.Fatal("incorrect port", addr.Port)
+	}
+}
@@ -0,0 +1,21 @@
+package gaio
+
+import "runtime"
+
+// pin locks the loop of s to its OS thread, and binds the thread to the CPU
+// assigned to s if any. The thread is never unlocked, so it exits with the
+// loop instead of returning to the scheduler with the affinity changed.
+func (s *shard) pin() error {
+	runtime.LockOSThread()
+	if s.cpu >= 0 {
+		return setAffinity(s.cpu)
+	}
+	return nil
+}
+
+// AffinityErr returns the first error binding the pollers to the CPUs of
+// WithCPUAffinity, such as a CPU outside of the cpuset of the container. The
+// pollers keep running unbound on errors.
+func (w *Watcher) AffinityErr() error {
+	return w.affinityErr
+}
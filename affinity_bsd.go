@@ -0,0 +1,9 @@
+// +build darwin netbsd freebsd openbsd dragonfly
+
+package gaio
+
+var errAffinityUnsupported = newKindError("cpu affinity is not supported", ErrUnsupported)
+
+func setAffinity(cpu int) error {
+	return errAffinityUnsupported
+}
@@ -0,0 +1,16 @@
+// +build linux
+
+package gaio
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// setAffinity binds the calling thread to cpu
+func setAffinity(cpu int) error {
+	var set unix.CPUSet
+	set.Set(cpu)
+	return os.NewSyscallError("sched_setaffinity", unix.SchedSetaffinity(0, &set))
+}
@@ -0,0 +1,69 @@
+package gaio
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCPUAffinity(t *testing.T) {
+	var allowed unix.CPUSet
+	if err := unix.SchedGetaffinity(0, &allowed); err != nil {
+		t.Skip(err)
+	}
+	cpu := -1
+	for i := 0; i < 1024; i++ {
+		if allowed.IsSet(i) {
+			cpu = i
+		}
+	}
+
+	w, err := CreateWatcher(WithCPUAffinity([]int{cpu}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.AffinityErr(); err != nil {
+		t.Skip(err)
+	}
+
+	// the poller thread is bound to cpu alone
+	tasks, _ := filepath.Glob("/proc/self/task/*/status")
+	want := strconv.Itoa(cpu)
+	for _, task := range tasks {
+		status, err := ioutil.ReadFile(task)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(status), "\n") {
+			if strings.HasPrefix(line, "Cpus_allowed_list:") && strings.TrimSpace(line[len("Cpus_allowed_list:"):]) == want {
+				return
+			}
+		}
+	}
+	t.Fatal("no thread bound to cpu", cpu)
+}
+
+func TestCPUAffinityInvalid(t *testing.T) {
+	w, err := CreateWatcher(WithCPUAffinity([]int{1023}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if w.AffinityErr() == nil {
+		t.Fatal("expected affinity error")
+	}
+
+	// not fatal, the watcher keeps working
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	done := make(chan OpResult, 1)
+	w.Write(fd, []byte("ping"), done)
+	if res := <-done; res.Err != nil {
+		t.Fatal(res.Err)
+	}
+}
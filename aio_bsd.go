@@ -5,12 +5,31 @@ package gaio
 import (
 	"sync"
 	"syscall"
+	"time"
 )
 
 type poller struct {
 	fd      int
 	changes []syscall.Kevent_t
 	sync.Mutex
+
+	sys sysCalls // see withSyscalls
+
+	maxEvents int // cap of the events buffer
+	budget    int // events processed per round, 0 is unlimited
+	spin      time.Duration
+	stats     *pollStats
+
+	// fd is closed by Wait on exit
+	closed   bool
+	closedMu sync.RWMutex
+
+	// buffers of Poll, reused by its calls like those of Wait, applied
+	// holds the changes of the last call for reuse
+	polled  []syscall.Kevent_t
+	applied []syscall.Kevent_t
+	policy  eventsPolicy
+	nowait  syscall.Timespec
 }
 
 func openPoll() (*poller, error) {
@@ -31,12 +50,25 @@ func openPoll() (*poller, error) {
 
 	p := new(poller)
 	p.fd = fd
+	p.sys = rawSyscalls{}
+	p.maxEvents = defaultMaxEvents
+	p.budget = defaultEventBudget
+	p.stats = new(pollStats)
 	return p, nil
 }
 
-func (p *poller) Close() error { return syscall.Close(p.fd) }
+// Close wakes up Wait, the fd is closed by Wait on exit
+func (p *poller) Close() error { return p.Wakeup() }
+
+// Wakeup makes Wait call wakeup
+func (p *poller) Wakeup() error { return p.trigger() }
 
 func (p *poller) trigger() error {
+	p.closedMu.RLock()
+	defer p.closedMu.RUnlock()
+	if p.closed {
+		return ErrWatcherClosed
+	}
 	_, err := syscall.Kevent(p.fd, []syscall.Kevent_t{{
 		Ident:  0,
 		Filter: syscall.EVFILT_USER,
@@ -55,6 +87,18 @@ func (p *poller) Watch(fd int) error {
 	return p.trigger()
 }
 
+// SetTimer makes Wait return from waiting once after d, replacing the
+// previous timer, it's called by the loop only so the change is applied by
+// the next kevent.
+func (p *poller) SetTimer(d time.Duration) error {
+	ms := (d + time.Millisecond - 1) / time.Millisecond
+	ev := syscall.Kevent_t{Ident: 0, Filter: syscall.EVFILT_TIMER, Flags: syscall.EV_ADD | syscall.EV_ONESHOT, Data: int64(ms)}
+	p.Lock()
+	p.changes = append(p.changes, ev)
+	p.Unlock()
+	return nil
+}
+
 func (p *poller) Unwatch(fd int) error {
 	p.Lock()
 	p.changes = append(p.changes,
@@ -65,35 +109,127 @@ func (p *poller) Unwatch(fd int) error {
 	return p.trigger()
 }
 
-func (p *poller) Wait(chReadableNotify chan int, chWriteableNotify chan int, die chan struct{}) error {
-	events := make([]syscall.Kevent_t, 128)
+// Wait calls event on readiness of fds and wakeup after each round of
+// events or Wakeup, until die. idle is called before blocking, it returns
+// false if there's work to do instead.
+func (p *poller) Wait(event func(fd int, readable, writable bool), wakeup func(), idle func() bool, die chan struct{}) error {
+	defer p.closeFds()
+
+	policy := newEventsPolicy(p.maxEvents, p.stats)
+	events := make([]syscall.Kevent_t, policy.size)
+	size := len(events)
+	sp := spinner{budget: p.spin, stats: p.stats}
+	var n, next int // events[next:n] are left over from the last round
 	for {
-		p.Lock()
-		changes := p.changes
-		p.changes = p.changes[:0]
-		p.Unlock()
-
-		n, err := syscall.Kevent(p.fd, changes, events, nil)
-		if err != nil && err != syscall.EINTR {
-			return err
-		}
+		if next >= n {
+			p.Lock()
+			changes := p.changes
+			p.changes = nil
+			p.Unlock()
+
+			var timeout *syscall.Timespec
+			if !idle() {
+				sp.busy()
+				timeout = new(syscall.Timespec)
+			} else if sp.spin() {
+				timeout = new(syscall.Timespec)
+			} else {
+				sp.park()
+			}
 
-		for i := 0; i < n; i++ {
-			if events[i].Ident != 0 {
-				if events[i].Filter == syscall.EVFILT_READ {
-					select {
-					case chReadableNotify <- int(events[i].Ident):
-					case <-die:
-					}
-
-				}
-				if events[i].Filter == syscall.EVFILT_WRITE {
-					select {
-					case chWriteableNotify <- int(events[i].Ident):
-					case <-die:
-					}
-				}
+			var err error
+			n, err = p.sys.Kevent(p.fd, changes, events, timeout)
+			sp.wake()
+			if n > 0 {
+				sp.busy()
+			}
+			if err != nil && err != syscall.EINTR {
+				return err
+			}
+			if n < 0 {
+				n = 0
+			} else {
+				size = policy.next(n)
 			}
+			next = 0
+		}
+
+		select {
+		case <-die:
+			return nil
+		default:
+		}
+
+		// at most budget events per round, the rest are processed after
+		// the submissions
+		end := n
+		if p.budget > 0 && end-next > p.budget {
+			end = next + p.budget
+		}
+		for i := next; i < end; i++ {
+			handleKevent(&events[i], event)
 		}
+		next = end
+		if next >= n && size != len(events) {
+			events = make([]syscall.Kevent_t, size)
+		}
+		wakeup()
+	}
+}
+
+// handleKevent calls event for ev
+func handleKevent(ev *syscall.Kevent_t, event func(fd int, readable, writable bool)) {
+	if ev.Filter == syscall.EVFILT_USER || ev.Filter == syscall.EVFILT_TIMER {
+		return
+	}
+	event(int(ev.Ident), ev.Filter == syscall.EVFILT_READ, ev.Filter == syscall.EVFILT_WRITE)
+}
+
+// pollFd returns the kqueue fd, see PollFd
+func (p *poller) pollFd() int { return p.fd }
+
+// Poll applies the changes and calls event on the readiness of fds without
+// waiting, for a watcher run by step
+func (p *poller) Poll(event func(fd int, readable, writable bool)) error {
+	p.Lock()
+	changes := p.changes
+	p.changes = p.applied[:0]
+	p.Unlock()
+	p.applied = changes
+
+	if p.polled == nil {
+		p.policy = newEventsPolicy(p.maxEvents, p.stats)
+		p.polled = make([]syscall.Kevent_t, p.policy.size)
+	}
+	n, err := p.sys.Kevent(p.fd, changes, p.polled, &p.nowait)
+	if err == syscall.EINTR {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	size := p.policy.next(n)
+	for i := 0; i < n; i++ {
+		handleKevent(&p.polled[i], event)
 	}
+	if size != len(p.polled) {
+		p.polled = make([]syscall.Kevent_t, size)
+	}
+	return nil
+}
+
+// closeFds closes the fd of the poller once it's done
+func (p *poller) closeFds() {
+	p.closedMu.Lock()
+	p.closed = true
+	syscall.Close(p.fd)
+	p.closedMu.Unlock()
+}
+
+// pollCalls are the syscalls of the poller
+type pollCalls interface {
+	Kevent(kq int, changes, events []syscall.Kevent_t, timeout *syscall.Timespec) (int, error)
+}
+
+func (rawSyscalls) Kevent(kq int, changes, events []syscall.Kevent_t, timeout *syscall.Timespec) (int, error) {
+	return syscall.Kevent(kq, changes, events, timeout)
 }
@@ -2,55 +2,286 @@
 
 package gaio
 
-import "golang.org/x/sys/unix"
+import (
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
 
 type poller struct {
-	pfd int // epoll fd
+	pfd  int      // epoll fd
+	file *os.File // pfd in the runtime netpoller, for waiting without a thread
+	efd  int      // eventfd for wakeup
+	tfd  int      // timerfd for deadlines
+
+	sys sysCalls // see withSyscalls
+
+	maxEvents int // cap of the events buffer
+	budget    int // events processed per round, 0 is unlimited
+	spin      time.Duration
+	stats     *pollStats
+
+	// efd is closed by Wait on exit
+	closed   bool
+	closedMu sync.RWMutex
+
+	// buffers of Poll, reused by its calls like those of Wait
+	polled  []unix.EpollEvent
+	policy  eventsPolicy
+	counter [8]byte
+
+	// the increment written to efd by Wakeup, read only
+	one [8]byte
 }
 
 func openPoll() (*poller, error) {
-	fd, err := unix.EpollCreate1(0)
+	fd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	efd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
 	if err != nil {
+		unix.Close(fd)
 		return nil, err
 	}
+
+	if err := unix.EpollCtl(fd, unix.EPOLL_CTL_ADD, efd, &unix.EpollEvent{Fd: int32(efd), Events: unix.EPOLLIN}); err != nil {
+		unix.Close(fd)
+		unix.Close(efd)
+		return nil, err
+	}
+
+	tfd, err := timerfdCreate()
+	if err != nil {
+		unix.Close(fd)
+		unix.Close(efd)
+		return nil, err
+	}
+
+	if err := unix.EpollCtl(fd, unix.EPOLL_CTL_ADD, tfd, &unix.EpollEvent{Fd: int32(tfd), Events: unix.EPOLLIN}); err != nil {
+		unix.Close(fd)
+		unix.Close(efd)
+		unix.Close(tfd)
+		return nil, err
+	}
+
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		unix.Close(efd)
+		unix.Close(tfd)
+		return nil, err
+	}
+
 	p := new(poller)
 	p.pfd = fd
-
+	p.file = os.NewFile(uintptr(fd), "epoll")
+	p.efd = efd
+	p.tfd = tfd
+	p.sys = rawSyscalls{}
+	p.maxEvents = defaultMaxEvents
+	p.budget = defaultEventBudget
+	p.stats = new(pollStats)
+	p.one[0] = 1
 	return p, err
 }
 
-func (p *poller) Close() error { return unix.Close(p.pfd) }
+// Close wakes up Wait, the fds are closed by Wait on exit
+func (p *poller) Close() error { return p.Wakeup() }
+
+// Wakeup makes Wait call wakeup
+func (p *poller) Wakeup() error {
+	p.closedMu.RLock()
+	defer p.closedMu.RUnlock()
+	if p.closed {
+		return ErrWatcherClosed
+	}
+	_, err := unix.Write(p.efd, p.one[:])
+	return err
+}
 
+// Watch registers fd for all events once, edge-triggered, so interest never
+// changes with requests and no EpollCtl is needed per request.
 func (p *poller) Watch(fd int) error {
-	return unix.EpollCtl(p.pfd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Fd: int32(fd), Events: unix.EPOLLIN | unix.EPOLLOUT | unix.EPOLLET})
+	return p.sys.EpollCtl(p.pfd, unix.EPOLL_CTL_ADD, fd, unix.EPOLLIN|unix.EPOLLPRI|unix.EPOLLOUT|unix.EPOLLET)
+}
+
+// SetTimer makes Wait return from waiting once after d, replacing the
+// previous timer, it's called by the loop only.
+func (p *poller) SetTimer(d time.Duration) error {
+	return timerfdSettime(p.tfd, d)
 }
 
 func (p *poller) Unwatch(fd int) error {
-	return unix.EpollCtl(p.pfd, unix.EPOLL_CTL_DEL, fd, &unix.EpollEvent{Fd: int32(fd), Events: unix.EPOLLIN | unix.EPOLLOUT})
+	// the event is ignored by DEL since linux 2.6.9
+	return p.sys.EpollCtl(p.pfd, unix.EPOLL_CTL_DEL, fd, 0)
 }
 
-func (p *poller) Wait(chReadableNotify chan int, chWriteableNotify chan int, die chan struct{}) error {
-	events := make([]unix.EpollEvent, 64)
-	for {
-		n, err := unix.EpollWait(p.pfd, events, -1)
-		if err != nil && err != unix.EINTR {
-			return err
-		}
+// Wait calls event on readiness of fds and wakeup after each round of
+// events or Wakeup, until die. idle is called before parking, it returns
+// false if there's work to do instead.
+func (p *poller) Wait(event func(fd int, readable, writable bool), wakeup func(), idle func() bool, die chan struct{}) error {
+	defer p.closeFds()
 
-		for i := 0; i < n; i++ {
-			if events[i].Events&unix.EPOLLIN > 0 {
-				select {
-				case chReadableNotify <- int(events[i].Fd):
-				case <-die:
-				}
+	rawconn, err := p.file.SyscallConn()
+	if err != nil {
+		return err
+	}
 
-			}
-			if events[i].Events&unix.EPOLLOUT > 0 {
-				select {
-				case chWriteableNotify <- int(events[i].Fd):
-				case <-die:
+	policy := newEventsPolicy(p.maxEvents, p.stats)
+	events := make([]unix.EpollEvent, policy.size)
+	counter := make([]byte, 8)
+	size := len(events)
+	sp := spinner{budget: p.spin, stats: p.stats}
+	var n, next int // events[next:n] are left over from the last round
+	for {
+		if next >= n {
+			// the epoll fd becomes readable with events pending, the goroutine
+			// is parked by the runtime instead of blocking a thread in epoll_wait
+			var err error
+			if rerr := rawconn.Read(func(uintptr) bool {
+				sp.wake()
+				n, err = p.sys.EpollWait(p.pfd, events, 0)
+				if err == nil {
+					size = policy.next(n)
 				}
+				if n > 0 || (err != nil && err != unix.EINTR) || !idle() {
+					sp.busy()
+					return true
+				} else if sp.spin() {
+					return true
+				}
+				sp.park()
+				return false
+			}); rerr != nil {
+				return rerr
+			}
+			if err != nil && err != unix.EINTR {
+				return err
+			}
+			if n < 0 {
+				n = 0
 			}
+			next = 0
+		}
+
+		select {
+		case <-die:
+			return nil
+		default:
 		}
+
+		// at most budget events per round, the rest are processed after
+		// the submissions
+		end := n
+		if p.budget > 0 && end-next > p.budget {
+			end = next + p.budget
+		}
+		for i := next; i < end; i++ {
+			p.handle(&events[i], counter, event)
+		}
+		next = end
+		if next >= n && size != len(events) {
+			events = make([]unix.EpollEvent, size)
+		}
+		wakeup()
+	}
+}
+
+// handle calls event for ev, the counters of the eventfd and the timerfd
+// are read into counter
+func (p *poller) handle(ev *unix.EpollEvent, counter []byte, event func(fd int, readable, writable bool)) {
+	if fd := int(ev.Fd); fd == p.efd || fd == p.tfd {
+		unix.Read(fd, counter)
+		return
+	}
+
+	// errors are delivered to both directions
+	event(int(ev.Fd),
+		ev.Events&(unix.EPOLLIN|unix.EPOLLPRI|unix.EPOLLERR|unix.EPOLLHUP) > 0,
+		ev.Events&(unix.EPOLLOUT|unix.EPOLLERR|unix.EPOLLHUP) > 0)
+}
+
+// pollFd returns the epoll fd, see PollFd
+func (p *poller) pollFd() int { return p.pfd }
+
+// Poll calls event on the readiness of fds without waiting, for a watcher
+// run by step
+func (p *poller) Poll(event func(fd int, readable, writable bool)) error {
+	if p.polled == nil {
+		p.policy = newEventsPolicy(p.maxEvents, p.stats)
+		p.polled = make([]unix.EpollEvent, p.policy.size)
+	}
+	n, err := p.sys.EpollWait(p.pfd, p.polled, 0)
+	if err == unix.EINTR {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	size := p.policy.next(n)
+	for i := 0; i < n; i++ {
+		p.handle(&p.polled[i], p.counter[:], event)
+	}
+	if size != len(p.polled) {
+		p.polled = make([]unix.EpollEvent, size)
+	}
+	return nil
+}
+
+// closeFds closes the fds of the poller once it's done
+func (p *poller) closeFds() {
+	p.closedMu.Lock()
+	p.closed = true
+	unix.Close(p.efd)
+	unix.Close(p.tfd)
+	p.closedMu.Unlock()
+	p.file.Close()
+}
+
+// pollCalls are the syscalls of the poller
+type pollCalls interface {
+	EpollCtl(epfd, op, fd int, events uint32) error
+	EpollWait(epfd int, events []unix.EpollEvent, msec int) (int, error)
+}
+
+// EpollCtl takes the events by value, so the event struct stays on the
+// stack
+func (rawSyscalls) EpollCtl(epfd, op, fd int, events uint32) error {
+	return unix.EpollCtl(epfd, op, fd, &unix.EpollEvent{Fd: int32(fd), Events: events})
+}
+
+func (rawSyscalls) EpollWait(epfd int, events []unix.EpollEvent, msec int) (int, error) {
+	return unix.EpollWait(epfd, events, msec)
+}
+
+// flags of timerfd_create, missing in x/sys
+const (
+	_TFD_NONBLOCK = unix.O_NONBLOCK
+	_TFD_CLOEXEC  = unix.O_CLOEXEC
+)
+
+type itimerspec struct {
+	interval unix.Timespec
+	value    unix.Timespec
+}
+
+func timerfdCreate() (int, error) {
+	fd, _, e := unix.Syscall(unix.SYS_TIMERFD_CREATE, unix.CLOCK_MONOTONIC, _TFD_NONBLOCK|_TFD_CLOEXEC, 0)
+	if e != 0 {
+		return -1, e
+	}
+	return int(fd), nil
+}
+
+// timerfdSettime arms fd to expire once after d, a zero d disarms it
+func timerfdSettime(fd int, d time.Duration) error {
+	spec := itimerspec{value: unix.NsecToTimespec(int64(d))}
+	_, _, e := unix.Syscall6(unix.SYS_TIMERFD_SETTIME, uintptr(fd), 0, uintptr(unsafe.Pointer(&spec)), 0, 0, 0)
+	if e != 0 {
+		return e
 	}
+	return nil
 }
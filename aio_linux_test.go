@@ -0,0 +1,719 @@
+package gaio
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestPollerNoAllocs(t *testing.T) {
+	p, err := openPoll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the epoll fd is owned by p.file
+	defer p.closeFds()
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fds[0])
+	defer unix.Close(fds[1])
+
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := p.Watch(fds[0]); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Unwatch(fds[0]); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatal("allocations on Watch/Unwatch:", allocs)
+	}
+
+	// interest mask registered for all events
+	p.Watch(fds[0])
+	unix.Write(fds[1], []byte("x"))
+	events := make([]unix.EpollEvent, 4)
+	n, err := unix.EpollWait(p.pfd, events, 1000)
+	if err != nil || n != 1 {
+		t.Fatal(n, err)
+	}
+	if events[0].Events&unix.EPOLLIN == 0 || events[0].Events&unix.EPOLLOUT == 0 {
+		t.Fatalf("incorrect events %x", events[0].Events)
+	}
+}
+
+func TestEventsBufferGrowth(t *testing.T) {
+	const N = 2048
+	p, err := openPoll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.maxEvents = N
+
+	var peers []int
+	for i := 0; i < N; i++ {
+		fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unix.Close(fds[0])
+		defer unix.Close(fds[1])
+		if err := p.Watch(fds[0]); err != nil {
+			t.Fatal(err)
+		}
+		unix.SetNonblock(fds[1], true)
+		peers = append(peers, fds[1])
+	}
+
+	// the loop is held in idle until all fds of a burst are ready
+	gate := make(chan struct{})
+	drained := make(chan struct{})
+	die := make(chan struct{})
+	go p.Wait(func(int, bool, bool) {}, func() {}, func() bool {
+		// the loop goes on idle until die once the test returns
+		select {
+		case drained <- struct{}{}:
+		case <-die:
+			return true
+		}
+		select {
+		case <-gate:
+		case <-die:
+		}
+		return true
+	}, die)
+	defer p.Close()
+	defer close(die)
+
+	// the first burst is the writability of all fds after Watch
+	<-drained
+	first := atomic.LoadUint64(&p.stats.waits)
+
+	for _, fd := range peers {
+		unix.Write(fd, []byte{0})
+	}
+	gate <- struct{}{}
+	<-drained
+	second := atomic.LoadUint64(&p.stats.waits) - first
+
+	t.Log("waits per burst:", first, second, "buffer:", atomic.LoadInt64(&p.stats.bufSize))
+	if second*2 > first {
+		t.Fatal("events buffer not grown")
+	}
+}
+
+func TestEventBudgetFairness(t *testing.T) {
+	const busy, light, budget = 4, 252, 16
+	p, err := openPoll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.budget = budget
+
+	fdIndex := make(map[int]int)
+	var peers []int
+	for i := 0; i < busy+light; i++ {
+		fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unix.Close(fds[0])
+		defer unix.Close(fds[1])
+		if err := p.Watch(fds[0]); err != nil {
+			t.Fatal(err)
+		}
+		fdIndex[fds[0]] = i
+		peers = append(peers, fds[1])
+	}
+
+	var started bool
+	var rounds, events, maxEvents int
+	seen := make(map[int]bool)
+	allSeen := 0
+	onEvent := func(fd int, readable, writable bool) {
+		if !started || !readable {
+			return
+		}
+		events++
+		if i := fdIndex[fd]; i >= busy {
+			seen[i] = true
+		}
+	}
+	wakeup := func() {
+		if !started {
+			return
+		}
+		rounds++
+		if events > maxEvents {
+			maxEvents = events
+		}
+		events = 0
+
+		// the busy fds are ready again on every round until all the
+		// light ones have been served
+		if len(seen) < light {
+			for _, fd := range peers[:busy] {
+				unix.Write(fd, []byte{0})
+			}
+		} else if allSeen == 0 {
+			allSeen = rounds
+		}
+	}
+
+	gate := make(chan struct{})
+	drained := make(chan struct{})
+	die := make(chan struct{})
+	go p.Wait(onEvent, wakeup, func() bool {
+		// the loop goes on idle until die once the test returns
+		select {
+		case drained <- struct{}{}:
+		case <-die:
+			return true
+		}
+		select {
+		case <-gate:
+		case <-die:
+		}
+		return true
+	}, die)
+	defer p.Close()
+	defer close(die)
+
+	<-drained // writability after Watch
+	started = true
+	for _, fd := range peers {
+		unix.Write(fd, []byte{0})
+	}
+	gate <- struct{}{}
+	<-drained
+
+	t.Log("rounds:", rounds, "light fds served by round:", allSeen, "max events per round:", maxEvents)
+	if maxEvents > budget {
+		t.Fatal("events per round exceeds budget:", maxEvents)
+	}
+	if allSeen == 0 || allSeen > 2*(busy+light)/budget {
+		t.Fatal("light fds starved")
+	}
+}
+
+// writeSyscalls returns the number of write syscalls of the process
+func writeSyscalls(t testing.TB) uint64 {
+	data, err := ioutil.ReadFile("/proc/self/io")
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "syscw:") {
+			n, _ := strconv.ParseUint(strings.TrimSpace(line[len("syscw:"):]), 10, 64)
+			return n
+		}
+	}
+	t.Skip("no syscw in /proc/self/io")
+	return 0
+}
+
+func TestWriteCoalescing(t *testing.T) {
+	w, err := CreateWatcher(WithShards(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	// small and large writes, the large ones end writevs mid-request
+	const n = 2000
+	var msgs [][]byte
+	var tx []byte
+	for i := 0; i < n; i++ {
+		size := 50
+		if i%100 == 99 {
+			size = 256 * 1024
+		}
+		msg := make([]byte, size)
+		io.ReadFull(rand.Reader, msg)
+		msgs = append(msgs, msg)
+		tx = append(tx, msg...)
+	}
+
+	syscw := writeSyscalls(t)
+	done := make(chan OpResult, n)
+	release := holdLoop(t, w)
+	for _, msg := range msgs {
+		if err := w.Write(fd, msg, done); err != nil {
+			t.Fatal(err)
+		}
+	}
+	release()
+
+	rx := make([]byte, len(tx))
+	if _, err := io.ReadFull(conn, rx); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tx, rx) {
+		t.Fatal("incorrect receiving")
+	}
+	for i := 0; i < n; i++ {
+		res := <-done
+		if res.Err != nil || res.Size != len(res.Buffer) {
+			t.Fatal(res.Err, res.Size)
+		}
+	}
+
+	syscalls := writeSyscalls(t) - syscw
+	t.Log("write syscalls for", n, "writes:", syscalls)
+	if syscalls > n/4 {
+		t.Fatal("writes not coalesced")
+	}
+}
+
+func BenchmarkWriteSmallBurst(b *testing.B) {
+	w, err := CreateWatcher(WithShards(1))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(b, w)
+	defer conn.Close()
+	go io.Copy(ioutil.Discard, conn)
+
+	// bursts of 16 messages of 50 bytes
+	const burst = 16
+	msg := make([]byte, 50)
+	done := make(chan OpResult, burst)
+	syscw := writeSyscalls(b)
+	b.SetBytes(burst * 50)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < burst; j++ {
+			w.Write(fd, msg, done)
+		}
+		for j := 0; j < burst; j++ {
+			<-done
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(writeSyscalls(b)-syscw)/float64(b.N*burst), "syscalls/msg")
+}
+
+func TestPollerFailure(t *testing.T) {
+	w, err := CreateWatcher(WithShards(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	done := make(chan OpResult, 1)
+	if err := w.Read(fd, make([]byte, 1), done); err != nil {
+		t.Fatal(err)
+	}
+	if w.Err() != nil {
+		t.Fatal("error before termination:", w.Err())
+	}
+
+	// the epoll fd is closed under the poller
+	w.shards[0].pfd.file.Close()
+	select {
+	case <-w.Done():
+	case <-time.After(time.Second):
+		t.Fatal("watcher not terminated")
+	}
+	if err := w.Err(); err == nil || err == ErrWatcherClosed {
+		t.Fatal("incorrect error:", err)
+	}
+	if res := <-done; !errors.Is(res.Err, w.Err()) {
+		t.Fatal("pending request not failed:", res.Err)
+	}
+	if err := w.Read(fd, make([]byte, 1), done); err != ErrWatcherClosed {
+		t.Fatal("submission accepted:", err)
+	}
+}
+
+func (f *faultSyscalls) EpollCtl(epfd, op, fd int, events uint32) error {
+	if ft := f.next("epoll_ctl"); ft.err != nil {
+		return ft.err
+	}
+	return f.sysCalls.EpollCtl(epfd, op, fd, events)
+}
+
+func (f *faultSyscalls) EpollWait(epfd int, events []unix.EpollEvent, msec int) (int, error) {
+	if ft := f.next("epoll_wait"); ft.err != nil {
+		return -1, ft.err
+	}
+	return f.sysCalls.EpollWait(epfd, events, msec)
+}
+
+func TestFaultPoller(t *testing.T) {
+	fs := newFaultSyscalls()
+	w, err := CreateWatcher(WithShards(1), withSyscalls(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// a fd failing to register is not watched, and can be watched again
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	fs.inject("epoll_ctl", fault{err: syscall.ENOMEM})
+	if _, err := w.Watch(server); err != syscall.ENOMEM || w.Len() != 0 {
+		t.Fatal("incorrect registration:", err, w.Len())
+	}
+	fd, err := w.Watch(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// interrupted waits are retried
+	fs.inject("epoll_wait", fault{err: syscall.EINTR}, fault{err: syscall.EINTR})
+	done := make(chan OpResult, 1)
+	w.Read(fd, make([]byte, 8), done)
+	conn.Write([]byte("x"))
+	if res := <-done; res.Err != nil || res.Size != 1 {
+		t.Fatal("incorrect read:", res.Err)
+	}
+	if n := fs.injected("epoll_wait"); n != 2 {
+		t.Fatal("epoll_wait not injected:", n)
+	}
+
+	// other failures are fatal, the pending requests fail with them
+	fs.inject("epoll_wait", fault{err: syscall.EBADF})
+	w.Read(fd, make([]byte, 8), done)
+	conn.Write([]byte("x"))
+	select {
+	case <-w.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher not terminated")
+	}
+	if !errors.Is(w.Err(), syscall.EBADF) {
+		t.Fatal("incorrect error:", w.Err())
+	}
+	if res := <-done; !errors.Is(res.Err, syscall.EBADF) {
+		t.Fatal("incorrect error of the pending read:", res.Err)
+	}
+}
+
+func TestWatchNotifyTaskQueue(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	efd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(efd)
+	done := make(chan OpResult, 64)
+	if _, err := w.WatchNotify(efd, done); err != nil {
+		t.Fatal(err)
+	}
+
+	// tasks queued by another goroutine, signaled by the eventfd
+	const tasks = 1000
+	var mu sync.Mutex
+	var queue []int
+	go func() {
+		one := []byte{1, 0, 0, 0, 0, 0, 0, 0}
+		for i := 0; i < tasks; i++ {
+			mu.Lock()
+			queue = append(queue, i)
+			mu.Unlock()
+			unix.Write(efd, one)
+		}
+	}()
+
+	sock, conn := tcpPair(t, w)
+	defer conn.Close()
+	go io.Copy(conn, conn)
+	const echoes = 100
+	w.Write(sock, []byte("ping"), done)
+
+	// the tasks and the echo traffic are handled by one loop
+	next, echoed := 0, 0
+	var signals uint64
+	for next < tasks || echoed < echoes {
+		res := <-done
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		switch {
+		case res.Fd == efd:
+			if res.Size != 8 || res.Count == 0 {
+				t.Fatal("incorrect counter:", res.Size, res.Count)
+			}
+			signals += res.Count
+			mu.Lock()
+			for _, task := range queue {
+				if task != next {
+					t.Fatal("task out of order:", task, next)
+				}
+				next++
+			}
+			queue = queue[:0]
+			mu.Unlock()
+		case res.Operation == OpWrite:
+			w.Read(sock, make([]byte, 4), done)
+		case res.Operation == OpRead:
+			if res.Size != 4 {
+				t.Fatal("incorrect echo:", res.Size)
+			}
+			if echoed++; echoed < echoes {
+				w.Write(sock, []byte("ping"), done)
+			}
+		}
+	}
+	if signals == 0 || signals > tasks {
+		t.Fatal("incorrect signals:", signals)
+	}
+	w.StopWatch(efd)
+}
+
+func TestWatchNotifyDefaults(t *testing.T) {
+	// the socket options don't apply to notification fds
+	w, err := CreateWatcher(WithSockBuf(64*1024, 64*1024), WithKeepAlive(time.Second, time.Second, 3),
+		WithBusyPoll(50), WithProbe(time.Millisecond, make(chan OpResult, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	efd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(efd)
+	done := make(chan OpResult, 1)
+	if _, err := w.WatchNotify(efd, done); err != nil {
+		t.Fatal(err)
+	}
+	unix.Write(efd, []byte{1, 0, 0, 0, 0, 0, 0, 0})
+	if res := <-done; res.Err != nil || res.Count != 1 {
+		t.Fatal("incorrect counter:", res.Err, res.Count)
+	}
+
+	// the armed read isn't waited for
+	start := time.Now()
+	if completed, aborted, err := w.CloseWait(5 * time.Second); err != nil || completed != 0 || aborted != 0 {
+		t.Fatal("close wait:", completed, aborted, err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("close wait waited for the notification read")
+	}
+}
+
+func TestWatchNotifyTimer(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	tfd, err := timerfdCreate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(tfd)
+	interval := unix.NsecToTimespec(int64(5 * time.Millisecond))
+	spec := itimerspec{interval: interval, value: interval}
+	if _, _, e := unix.Syscall6(unix.SYS_TIMERFD_SETTIME, uintptr(tfd), 0, uintptr(unsafe.Pointer(&spec)), 0, 0, 0); e != 0 {
+		t.Fatal(e)
+	}
+	done := make(chan OpResult, 16)
+	if _, err := w.WatchNotify(tfd, done); err != nil {
+		t.Fatal(err)
+	}
+
+	// the read is armed again after each expiration
+	var expirations uint64
+	for i := 0; i < 5; i++ {
+		res := <-done
+		if res.Err != nil || res.Count == 0 {
+			t.Fatal("incorrect expiration:", res.Err, res.Count)
+		}
+		expirations += res.Count
+	}
+	if expirations < 5 {
+		t.Fatal("missed expirations:", expirations)
+	}
+
+	writes := make(chan OpResult, 1)
+	w.Write(tfd, []byte{1, 0, 0, 0, 0, 0, 0, 0}, writes)
+	if res := <-writes; !errors.Is(res.Err, ErrReadOnly) || !errors.Is(res.Err, ErrInvalid) {
+		t.Fatal("write to a timerfd:", res.Err)
+	}
+	w.StopWatch(tfd)
+}
+
+func TestEmbedded(t *testing.T) {
+	if w, err := CreateWatcher(); err != nil {
+		t.Fatal(err)
+	} else if _, err := w.PollFd(); err != ErrNotEmbedded {
+		t.Fatal("poll fd of a watcher not embedded:", err)
+	} else {
+		w.Close()
+	}
+
+	w, err := CreateWatcher(WithEmbedded())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// the external loop
+	pfd, err := w.PollFd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(ep)
+	if err := unix.EpollCtl(ep, unix.EPOLL_CTL_ADD, pfd, &unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(pfd)}); err != nil {
+		t.Fatal(err)
+	}
+	events := make([]unix.EpollEvent, 1)
+	readable := func(msec int) bool {
+		for {
+			n, err := unix.EpollWait(ep, events, msec)
+			if err == unix.EINTR {
+				continue
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			return n > 0
+		}
+	}
+	run := func(n, max int) (results []OpResult) {
+		for len(results) < n {
+			if !readable(2000) {
+				t.Fatal("poll fd not readable with results left:", len(results))
+			}
+			res, err := w.Poll(max)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if max > 0 && len(res) > max {
+				t.Fatal("too many results:", len(res))
+			}
+			results = append(results, res...)
+		}
+		return results
+	}
+
+	// a read of the data of the peer, without a done channel
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	if err := w.Read(fd, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if res := run(1, 0); res[0].Operation != OpRead || res[0].Err != nil || string(res[0].Buffer[:res[0].Size]) != "hello" {
+		t.Fatal("incorrect read:", res[0].Err, string(res[0].Buffer[:res[0].Size]))
+	}
+
+	// results returned one by one
+	done := make(chan OpResult, 3)
+	for _, s := range []string{"a", "b", "c"} {
+		w.Write(fd, []byte(s), done)
+	}
+	for _, res := range run(3, 1) {
+		if res.Operation != OpWrite || res.Err != nil || res.Size != 1 {
+			t.Fatal("incorrect write:", res.Err, res.Size)
+		}
+	}
+	if len(done) != 0 {
+		t.Fatal("result sent to the done channel")
+	}
+	got := make([]byte, 3)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "abc" {
+		t.Fatal("incorrect writes:", string(got), err)
+	}
+
+	// a deadline wakes the external loop up
+	start := time.Now()
+	w.ReadTimeout(fd, make([]byte, 8), nil, start.Add(100*time.Millisecond))
+	if res := run(1, 0); !errors.Is(res[0].Err, ErrDeadline) || time.Since(start) < 100*time.Millisecond {
+		t.Fatal("incorrect deadline:", res[0].Err, time.Since(start))
+	}
+
+	// an idle watcher leaves the external loop waiting
+	w.Poll(0)
+	if readable(100) {
+		t.Fatal("poll fd of an idle watcher readable")
+	}
+}
+
+func TestEmbeddedNoAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector allocates")
+	}
+	w, err := CreateWatcher(WithEmbedded())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	go io.Copy(ioutil.Discard, conn)
+
+	// a write and the rounds until its result, once the buffers are sized
+	tx := []byte("ping")
+	cycle := func() {
+		if err := w.Write(fd, tx, nil); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			res, err := w.Poll(0)
+			if err != nil {
+				t.Fatal(err)
+			} else if len(res) > 0 {
+				return
+			}
+		}
+	}
+	for i := 0; i < 100; i++ {
+		cycle()
+	}
+	if allocs := testing.AllocsPerRun(100, cycle); allocs != 0 {
+		t.Fatal("allocations per write and Poll:", allocs)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { w.Poll(0) }); allocs != 0 {
+		t.Fatal("allocations per idle Poll:", allocs)
+	}
+}
@@ -2,13 +2,38 @@ package gaio
 
 import (
 	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/exec"
+	"reflect"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 func init() {
@@ -16,19 +41,21 @@ func init() {
 	go http.ListenAndServe(":6060", nil)
 }
 
-func echoServer(t testing.TB) net.Listener {
+func echoServer(t testing.TB, opts ...Option) net.Listener {
 	ln, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	w, err := CreateWatcher()
+	w, err := CreateWatcher(opts...)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	chRx := make(chan OpResult)
-	chTx := make(chan OpResult)
+	// buffered for the outstanding requests of all connections, so loops
+	// never block on completions while the echo goroutine submits
+	chRx := make(chan OpResult, 1024)
+	chTx := make(chan OpResult, 1024)
 	// ping-pong scheme echo server
 	go func() {
 		for {
@@ -125,7 +152,8 @@ func TestEchoHuge(t *testing.T) {
 	go func() {
 		n, err := conn.Write(tx)
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			return
 		}
 		t.Log("ping size", n)
 	}()
@@ -143,31 +171,6007 @@ func TestEchoHuge(t *testing.T) {
 	conn.Close()
 }
 
-func BenchmarkEcho(b *testing.B) {
-	ln := echoServer(b)
+func TestReadBufferSize(t *testing.T) {
+	w, err := CreateWatcher(WithReadBufferSize(1024, 16384))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
 
-	addr, _ := net.ResolveTCPAddr("tcp", ln.Addr().String())
-	tx := []byte("hello world")
-	rx := make([]byte, len(tx))
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
 
-	conn, err := net.DialTCP("tcp", nil, addr)
+	done := make(chan OpResult, 1)
+	read := func() OpResult {
+		if err := w.Read(fd, nil, done); err != nil {
+			t.Fatal(err)
+		}
+		res := <-done
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		return res
+	}
+
+	// bulk phase, reads fill the buffers
+	go conn.Write(make([]byte, 1024*1024))
+	for total := 0; total < 1024*1024; {
+		total += read().Size
+	}
+	if size, _ := w.ReadBufferSize(fd); size != 16384 {
+		t.Fatal("buffer not grown in bulk phase:", size)
+	}
+
+	// small messages
+	for i := 0; i < 64; i++ {
+		conn.Write([]byte("ping"))
+		if res := read(); res.Size != 4 || string(res.Buffer[:res.Size]) != "ping" {
+			t.Fatal("incorrect receiving", res.Size)
+		}
+	}
+	if size, _ := w.ReadBufferSize(fd); size != 1024 {
+		t.Fatal("buffer not shrunk after small reads:", size)
+	}
+}
+
+// holdLoop blocks the loop of a single shard watcher on a completion, so
+// the requests submitted until release are processed in one batch
+func holdLoop(t testing.TB, w *Watcher) (release func()) {
+	fd, conn := tcpPair(t, w)
+	conn.Write([]byte("hold"))
+	done := make(chan OpResult)
+	if err := w.Read(fd, make([]byte, 4), done); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		<-done
+		conn.Close()
+	}
+}
+
+func TestReadBudget(t *testing.T) {
+	w, err := CreateWatcher(WithShards(1))
 	if err != nil {
-		b.Fatal(err)
-		return
+		t.Fatal(err)
 	}
+	defer w.Close()
 
-	b.ResetTimer()
-	b.ReportAllocs()
-	for i := 0; i < b.N; i++ {
-		_, err := conn.Write(tx)
-		if err != nil {
-			b.Fatal(err)
+	busy, busyConn := tcpPair(t, w)
+	defer busyConn.Close()
+	interactive, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	// a saturating sender, with more data queued than the reads take, no
+	// more edges are triggered after it
+	if _, err := busyConn.Write(make([]byte, 64*1024)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("ping"))
+
+	const reads = 512
+	done := make(chan OpResult, reads+1)
+	release := holdLoop(t, w)
+	for i := 0; i < reads; i++ {
+		w.Read(busy, make([]byte, 100), done)
+	}
+	w.Read(interactive, make([]byte, 100), done)
+	release()
+
+	// the interactive read completes once the busy fd exhausted its budget
+	var before int
+	for res := range done {
+		if res.Err != nil {
+			t.Fatal(res.Err)
 		}
-		_, err = conn.Read(rx)
-		if err != nil {
-			b.Fatal(err)
+		if res.Fd == interactive {
+			break
 		}
-		//		log.Println(i, b.N)
+		before++
+	}
+	t.Log("busy reads before the interactive one:", before)
+	if before > 2*readBudgetOps {
+		t.Fatal("interactive fd starved by busy fd")
+	}
+
+	// the rest of the busy reads continue without a new edge
+	for i := before; i < reads; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("busy reads not continued")
+		}
+	}
+}
+
+func TestReadBufferPool(t *testing.T) {
+	w, err := CreateWatcher(WithReadBufferPool(2, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// mostly idle connections, each with a read pending
+	const conns, active = 256, 8
+	var fds []int
+	var peers []net.Conn
+	done := make(chan OpResult, conns)
+	for i := 0; i < conns; i++ {
+		fd, conn := tcpPair(t, w)
+		defer conn.Close()
+		fds = append(fds, fd)
+		peers = append(peers, conn)
+		w.Read(fd, nil, done)
+	}
+
+	// bursts on a few connections at a time
+	for round := 0; round < 32; round++ {
+		for i := 0; i < active; i++ {
+			peers[(round*active+i)%conns].Write([]byte("hello"))
+		}
+		for i := 0; i < active; i++ {
+			res := <-done
+			if res.Err != nil || string(res.Buffer[:res.Size]) != "hello" {
+				t.Fatal("incorrect receiving", res.Err)
+			}
+			res.Release()
+			w.Read(res.Fd, nil, done)
+		}
+	}
+
+	// memory follows the ready connections, not the watched ones
+	st := w.Stats()
+	t.Log("allocated:", st.PoolAllocated, "free:", st.PoolFree)
+	if st.PoolAllocated > 2*active {
+		t.Fatal("buffers allocated for idle connections:", st.PoolAllocated)
+	}
+
+	// the free buffers above the low watermark are released once idle
+	time.Sleep(poolIdle + 100*time.Millisecond)
+	wdone := make(chan OpResult, 1)
+	w.Write(fds[0], []byte("hello"), wdone)
+	<-wdone
+	time.Sleep(10 * time.Millisecond)
+	if st := w.Stats(); st.PoolFree > 2 {
+		t.Fatal("idle pool not trimmed:", st.PoolFree)
+	}
+}
+
+func TestDerivedDefaults(t *testing.T) {
+	for _, c := range []struct {
+		procs, conns               int
+		shards, maxEvents, workers int
+	}{
+		{1, 0, 1, 4096, 1},
+		{4, 0, 1, 4096, 4},
+		{64, 0, 1, 4096, 64},
+		{64, 100, 1, 256, 1},
+		{64, 4096, 16, 256, 64},
+		{8, 100000, 8, 4096, 8},
+		{16, 20000, 16, 1250, 16},
+		{16, 512, 2, 256, 8},
+	} {
+		shards, maxEvents, workers := deriveDefaults(c.procs, c.conns)
+		if shards != c.shards || maxEvents != c.maxEvents || workers != c.workers {
+			t.Errorf("GOMAXPROCS=%d conns=%d: got %d shards %d events %d workers, want %d %d %d",
+				c.procs, c.conns, shards, maxEvents, workers, c.shards, c.maxEvents, c.workers)
+		}
+	}
+
+	// options override the derived defaults
+	w, err := CreateWatcher(WithShards(3), WithExpectedConns(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if len(w.shards) != 3 || w.maxEvents != 256 {
+		t.Fatal(len(w.shards), w.maxEvents)
+	}
+
+	// a single shard unless the connections are given
+	w2, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w2.Close()
+	if len(w2.shards) != 1 || w2.numWorkers != 0 {
+		t.Fatal(len(w2.shards), w2.numWorkers)
+	}
+
+	// the workers enabled without a count are derived
+	w3, err := CreateWatcher(WithWorkers(0), WithExpectedConns(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w3.Close()
+	if w3.numWorkers != 1 || w3.parallelism != 1 {
+		t.Fatal(w3.numWorkers, w3.parallelism)
+	}
+}
+
+func TestBufferQuota(t *testing.T) {
+	const quota = 1024 * 1024
+	w, err := CreateWatcher(WithBufferQuota(4*quota, quota))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	// the peer doesn't read, writes queue up until the quota trips
+	buf := make([]byte, 64*1024)
+	done := make(chan OpResult, 1024)
+	var submitted int
+	for ; submitted < 1024; submitted++ {
+		if err = w.Write(fd, buf, done); err != nil {
+			break
+		}
+	}
+	if err != ErrBufferQuotaExceeded {
+		t.Fatal("quota not enforced:", err)
+	}
+	if pinned, _ := w.PinnedBytes(fd); pinned > quota || pinned < quota-int64(len(buf)) {
+		t.Fatal("incorrect pinned bytes:", pinned)
+	}
+
+	// recovers once the queue drains
+	go io.Copy(ioutil.Discard, conn)
+	for i := 0; i < submitted; i++ {
+		if res := <-done; res.Err != nil {
+			t.Fatal(res.Err)
+		}
+	}
+	if pinned, _ := w.PinnedBytes(fd); pinned != 0 {
+		t.Fatal("pinned bytes not released:", pinned)
+	}
+	if st := w.Stats(); st.PinnedBytes != 0 {
+		t.Fatal("pinned bytes not released:", st.PinnedBytes)
+	}
+	if err := w.Write(fd, buf, done); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	// dropped requests release their bytes too
+	w.Read(fd, buf, done)
+	w.StopWatch(fd)
+	time.Sleep(10 * time.Millisecond)
+	if st := w.Stats(); st.PinnedBytes != 0 {
+		t.Fatal("pinned bytes not released by StopWatch:", st.PinnedBytes)
+	}
+}
+
+func TestMaxPending(t *testing.T) {
+	w, err := CreateWatcher(WithMaxPending(6, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd1, conn1 := tcpPair(t, w)
+	defer conn1.Close()
+	fd2, conn2 := tcpPair(t, w)
+	defer conn2.Close()
+
+	done := make(chan OpResult, 8)
+	for i := 0; i < 4; i++ {
+		if err := w.Read(fd1, make([]byte, 1), done); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Read(fd1, make([]byte, 1), done); err != ErrMaxPending {
+		t.Fatal("per fd limit not enforced:", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := w.Read(fd2, make([]byte, 1), done); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Read(fd2, make([]byte, 1), done); err != ErrMaxPending {
+		t.Fatal("total limit not enforced:", err)
+	}
+
+	// capacity is released before the completion is delivered
+	conn1.Write([]byte("x"))
+	<-done
+	if err := w.Read(fd2, make([]byte, 1), done); err != nil {
+		t.Fatal(err)
+	}
+	if st := w.Stats(); st.Pending != 6 {
+		t.Fatal("incorrect pending:", st.Pending)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	w, err := CreateWatcher(WithMaxConns(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd1, conn1 := tcpPair(t, w)
+	defer conn1.Close()
+	_, conn2 := tcpPair(t, w)
+	defer conn2.Close()
+	if count, headroom := w.Conns(); count != 2 || headroom != 0 {
+		t.Fatal("incorrect conns:", count, headroom)
+	}
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := w.Watch(conn); err != ErrMaxConns {
+		t.Fatal("limit not enforced:", err)
+	}
+
+	w.StopWatch(fd1)
+	if count, headroom := w.Conns(); count != 1 || headroom != 1 {
+		t.Fatal("slot not released:", count, headroom)
+	}
+	if _, err := w.Watch(conn); err != nil {
+		t.Fatal(err)
+	}
+	if st := w.Stats(); st.Conns != 2 {
+		t.Fatal("incorrect conns:", st.Conns)
+	}
+}
+
+func TestMaxPendingWait(t *testing.T) {
+	w, err := CreateWatcher(WithMaxPending(2, 0), WithPendingWait())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	done := make(chan OpResult, 4)
+	w.Read(fd, make([]byte, 1), done)
+	w.Read(fd, make([]byte, 1), done)
+
+	submitted := make(chan error, 2)
+	go func() { submitted <- w.Read(fd, make([]byte, 1), done) }()
+	select {
+	case err := <-submitted:
+		t.Fatal("submission not blocked:", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// a completion wakes up the waiting submission
+	conn.Write([]byte("x"))
+	<-done
+	if err := <-submitted; err != nil {
+		t.Fatal(err)
+	}
+
+	// Close too
+	go func() { submitted <- w.Read(fd, make([]byte, 1), done) }()
+	time.Sleep(20 * time.Millisecond)
+	w.Close()
+	if err := <-submitted; err != ErrWatcherClosed {
+		t.Fatal("waiting submission not woken by Close:", err)
+	}
+}
+
+func TestEchoShards(t *testing.T) {
+	testEchoConcurrent(t, WithShards(4))
+}
+
+func TestEchoWorkers(t *testing.T) {
+	testEchoConcurrent(t, WithShards(2), WithWorkers(4))
+}
+
+func testEchoConcurrent(t *testing.T, opts ...Option) {
+	ln := echoServer(t, opts...)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+
+			tx := make([]byte, 64*1024)
+			io.ReadFull(rand.Reader, tx)
+			go conn.Write(tx)
+
+			rx := make([]byte, len(tx))
+			if _, err := io.ReadFull(conn, rx); err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(tx, rx) {
+				t.Error("incorrect receiving")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSpliceCrossShard(t *testing.T) { testSpliceCrossShard(t) }
+func TestSpliceCrossShardCopyBuffers(t *testing.T) {
+	testSpliceCrossShard(t, WithCopyBuffers())
+}
+
+// crossShardPair returns two watched fds on different shards of w
+func crossShardPair(t testing.TB, w *Watcher) (src int, upstream net.Conn, dst int, downstream net.Conn) {
+	src, upstream = tcpPair(t, w)
+	dst, downstream = tcpPair(t, w)
+	for w.shardOf(src) == w.shardOf(dst) {
+		// shift fd numbers to land on the other shard
+		f, _ := os.Open(os.DevNull)
+		t.Cleanup(func() { f.Close() })
+		stale := downstream
+		t.Cleanup(func() { stale.Close() })
+		dst, downstream = tcpPair(t, w)
+	}
+	return
+}
+
+func testSpliceCrossShard(t *testing.T, opts ...Option) {
+	w, err := CreateWatcher(append(opts, WithShards(2))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	src, upstream, dst, downstream := crossShardPair(t, w)
+	defer upstream.Close()
+	defer downstream.Close()
+
+	tx := make([]byte, 1024*1024)
+	io.ReadFull(rand.Reader, tx)
+
+	// run by the loop of src
+	goroutines := runtime.NumGoroutine()
+	done := make(chan OpResult, 1)
+	if err := w.Splice(src, dst, 0, done); err != nil {
+		t.Fatal(err)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Fatal("goroutines started by Splice", n-goroutines)
+	}
+	go func() {
+		upstream.Write(tx)
+		upstream.Close()
+	}()
+
+	rx := make([]byte, len(tx))
+	if _, err := io.ReadFull(downstream, rx); err != nil {
+		t.Fatal(err)
+	}
+	if res := <-done; res.Err != nil || res.Size != len(tx) {
+		t.Fatal("splice:", res.Err, res.Size)
+	}
+	if !bytes.Equal(tx, rx) {
+		t.Fatal("incorrect receiving")
+	}
+}
+
+func TestSpliceCrossShardClose(t *testing.T) {
+	w, err := CreateWatcher(WithShards(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src, upstream, dst, downstream := crossShardPair(t, w)
+	defer upstream.Close()
+	defer downstream.Close()
+
+	done := make(chan OpResult, 1)
+	if err := w.Splice(src, dst, 0, done); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	w.CloseWait(0)
+
+	select {
+	case res := <-done:
+		if !errors.Is(res.Err, ErrWatcherClosed) {
+			t.Fatal("incorrect error:", res.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("splice not delivered after CloseWait")
+	}
+}
+
+func benchmarkEcho(b *testing.B, shards int) {
+	ln := echoServer(b, WithShards(shards))
+	const conns = 64
+
+	var wg sync.WaitGroup
+	b.SetBytes(1024)
+	b.ResetTimer()
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			defer conn.Close()
+
+			buf := make([]byte, 1024)
+			for j := 0; j < n; j++ {
+				conn.Write(buf)
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}(b.N/conns + 1)
+	}
+	wg.Wait()
+}
+
+func BenchmarkEcho64Conns1Shard(b *testing.B)  { benchmarkEcho(b, 1) }
+func BenchmarkEcho64Conns4Shards(b *testing.B) { benchmarkEcho(b, 4) }
+
+func TestReadFromWriteTo(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	addr, _ := net.ResolveUDPAddr("udp", "localhost:0")
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	peer, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	fd, err := w.Watch(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan OpResult, 1)
+	tx := []byte("hello world")
+	if err := w.WriteTo(fd, tx, peer.LocalAddr(), done); err != nil {
+		t.Fatal(err)
+	}
+	if res := <-done; res.Err != nil || res.Size != len(tx) {
+		t.Fatal("writeto:", res.Err, res.Size)
+	}
+
+	rx := make([]byte, 64)
+	n, from, err := peer.ReadFrom(rx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rx[:n], tx) {
+		t.Fatal("incorrect receiving")
+	}
+
+	if err := w.ReadFrom(fd, make([]byte, 64), done); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.WriteTo(tx, from); err != nil {
+		t.Fatal(err)
+	}
+	res := <-done
+	if res.Err != nil || res.Size != len(tx) {
+		t.Fatal("readfrom:", res.Err, res.Size)
+	}
+	if res.Addr == nil || res.Addr.String() != peer.LocalAddr().String() {
+		t.Fatal("incorrect source address:", res.Addr)
+	}
+}
+
+// tcpPair returns a watched server side fd and the client side connection
+func tcpPair(t testing.TB, w *Watcher) (int, net.Conn) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := w.Watch(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd, client
+}
+
+func TestSendFile(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	f, err := ioutil.TempFile("", "gaio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	data := make([]byte, 16*1024*1024)
+	io.ReadFull(rand.Reader, data)
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	const offset = 1000
+	count := int64(len(data) - 2*offset)
+	done := make(chan OpResult, 1)
+	if err := w.SendFile(fd, f, offset, count, done); err != nil {
+		t.Fatal(err)
+	}
+
+	rx := make([]byte, count)
+	if _, err := io.ReadFull(conn, rx); err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-done
+	if res.Err != nil || int64(res.Size) != count {
+		t.Fatal("sendfile:", res.Err, res.Size)
+	}
+
+	if sha256.Sum256(rx) != sha256.Sum256(data[offset:offset+count]) {
+		t.Fatal("incorrect receiving")
+	}
+}
+
+func TestSendFileLarge(t *testing.T) {
+	if testing.Short() {
+		t.Skip("sends 2GiB")
+	}
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	f, err := ioutil.TempFile("", "gaio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// a sparse file with marks at both ends of the range, whose offset and
+	// length are past the range of int32
+	const offset = 4<<30 + 1000
+	const count = 2<<30 + 1000
+	if err := f.Truncate(offset + count + 1000); err != nil {
+		t.Skip("sparse file not supported:", err)
+	}
+	f.WriteAt([]byte("head"), offset)
+	f.WriteAt([]byte("tail"), offset+count-4)
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	done := make(chan OpResult, 1)
+	if err := w.SendFile(fd, f, offset, count, done); err != nil {
+		t.Fatal(err)
+	}
+
+	var head, tail []byte
+	var total int64
+	buf := make([]byte, 1<<20)
+	for total < count {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total < 4 {
+			head = append(head, buf[:n]...)
+		}
+		tail = append(tail, buf[:n]...)
+		if len(tail) > 4 {
+			tail = tail[len(tail)-4:]
+		}
+		total += int64(n)
+	}
+	if string(head[:4]) != "head" || string(tail) != "tail" {
+		t.Fatal("incorrect receiving", string(head[:4]), string(tail))
+	}
+
+	res := <-done
+	if res.Err != nil || res.Sent != count || res.Size != clampInt(count) {
+		t.Fatal("sendfile:", res.Err, res.Sent, res.Size)
+	}
+}
+
+func TestWriteZeroCopy(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	done := make(chan OpResult, 1)
+	for _, size := range []int{100, 8 * 1024 * 1024} {
+		tx := make([]byte, size)
+		io.ReadFull(rand.Reader, tx)
+		if err := w.WriteZeroCopy(fd, tx, done); err != nil {
+			t.Fatal(err)
+		}
+
+		rx := make([]byte, size)
+		if _, err := io.ReadFull(conn, rx); err != nil {
+			t.Fatal(err)
+		}
+		res := <-done
+		if res.Err != nil || res.Size != size {
+			t.Fatal("write:", res.Err, res.Size)
+		}
+		if !bytes.Equal(tx, rx) {
+			t.Fatal("incorrect receiving")
+		}
+	}
+}
+
+func TestCork(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	done := make(chan OpResult, 4)
+	rx := make([]byte, 64)
+	for _, uncork := range []bool{true, false} {
+		w.Cork(fd)
+		w.Write(fd, []byte("header"), done)
+		w.Write(fd, []byte("body"), done)
+		if uncork {
+			w.Uncork(fd)
+		}
+		<-done
+		<-done
+
+		// the pieces are coalesced, and flushed before the cork timeout
+		// once the queue drained without Uncork
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := io.ReadAtLeast(conn, rx, len("headerbody"))
+		if err != nil {
+			t.Fatal("uncork", uncork, err)
+		}
+		if string(rx[:n]) != "headerbody" {
+			t.Fatal("not coalesced:", string(rx[:n]))
+		}
+	}
+
+	// a cork alone holds until the writes after it
+	w.Cork(fd)
+	time.Sleep(20 * time.Millisecond)
+	w.Write(fd, []byte("a"), done)
+	<-done
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(rx); err != nil || string(rx[:n]) != "a" {
+		t.Fatal("write after a cork held:", string(rx[:n]), err)
+	}
+}
+
+func TestDial(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+
+	done := make(chan OpResult, 1)
+	fd, err := w.Dial("tcp", addr, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := <-done; res.Err != nil || res.Fd != fd {
+		t.Fatal("dial:", res.Err)
+	}
+	// the socket is created non-blocking and closed on exec
+	if flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0); err != nil || flags&unix.FD_CLOEXEC == 0 {
+		t.Fatal("socket not closed on exec:", flags, err)
+	}
+	if flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFL, 0); err != nil || flags&unix.O_NONBLOCK == 0 {
+		t.Fatal("socket blocking:", flags, err)
+	}
+	w.StopWatch(fd)
+	syscall.Close(fd)
+
+	// connection refused
+	ln.Close()
+	fd, err = w.Dial("tcp", addr, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := <-done; !errors.Is(res.Err, syscall.ECONNREFUSED) {
+		t.Fatal("unexpected error:", res.Err)
+	}
+	w.StopWatch(fd)
+	syscall.Close(fd)
+}
+
+func TestDialFastOpen(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	if err := EnableFastOpen(ln, 16); err == syscall.ENOPROTOOPT {
+		t.Log("tcp fast open unsupported, testing fallback")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ { // the second connection carries data in SYN with the cookie
+		done := make(chan OpResult, 1)
+		fd, err := w.DialFastOpen("tcp", ln.Addr().String(), []byte("hello"), done)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rx := make([]byte, 5)
+		if _, err := io.ReadFull(conn, rx); err != nil || string(rx) != "hello" {
+			t.Fatal("incorrect receiving", err)
+		}
+
+		if res := <-done; res.Err != nil || res.Size != 5 {
+			t.Fatal("write:", res.Err, res.Size)
+		}
+		conn.Close()
+		w.StopWatch(fd)
+		syscall.Close(fd)
+	}
+}
+
+func benchmarkWrite(b *testing.B, zerocopy bool, opts ...Option) {
+	w, err := CreateWatcher(opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(b, w)
+	defer conn.Close()
+	go io.Copy(ioutil.Discard, conn)
+
+	tx := make([]byte, 64*1024)
+	done := make(chan OpResult, 1)
+	b.SetBytes(int64(len(tx)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if zerocopy {
+			w.WriteZeroCopy(fd, tx, done)
+		} else {
+			w.Write(fd, tx, done)
+		}
+		res := <-done
+		if res.Err != nil {
+			b.Fatal(res.Err)
+		}
+		res.Release()
+	}
+}
+
+func BenchmarkWrite64K(b *testing.B)         { benchmarkWrite(b, false) }
+func BenchmarkWriteZeroCopy64K(b *testing.B) { benchmarkWrite(b, true) }
+func BenchmarkWriteCopy64K(b *testing.B)     { benchmarkWrite(b, false, WithCopyBuffers()) }
+
+// many goroutines submitting to the same watcher
+// submissions don't wait for the syscalls of other requests, the submit
+// latency is the same for large and small transfers in flight
+func BenchmarkSubmitDuringTransfer4K(b *testing.B) { benchmarkSubmitDuringTransfer(b, 4096) }
+func BenchmarkSubmitDuringTransfer4M(b *testing.B) { benchmarkSubmitDuringTransfer(b, 4<<20) }
+
+func benchmarkSubmitDuringTransfer(b *testing.B, size int) {
+	w, err := CreateWatcher()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer w.Close()
+
+	// large transfers in flight
+	for i := 0; i < 2; i++ {
+		fd, conn := tcpPair(b, w)
+		defer conn.Close()
+		go io.Copy(ioutil.Discard, conn)
+		go func() {
+			buf := make([]byte, size)
+			done := make(chan OpResult, 1)
+			for w.Write(fd, buf, done) == nil {
+				if res := <-done; res.Err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	var fds []int
+	for i := 0; i < 16; i++ {
+		fd, conn := tcpPair(b, w)
+		defer conn.Close()
+		go io.Copy(ioutil.Discard, conn)
+		fds = append(fds, fd)
+	}
+
+	var next int32
+	var submit int64
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		fd := fds[int(atomic.AddInt32(&next, 1)-1)%len(fds)]
+		buf := make([]byte, 64)
+		done := make(chan OpResult, 1)
+		for pb.Next() {
+			start := time.Now()
+			w.Write(fd, buf, done)
+			atomic.AddInt64(&submit, int64(time.Since(start)))
+			<-done
+		}
+	})
+	b.ReportMetric(float64(submit)/float64(b.N), "submit-ns/op")
+}
+
+// large writes on many fds, the syscalls are executed by workers if enabled
+func BenchmarkWriteLarge(b *testing.B)        { benchmarkWriteLarge(b) }
+func BenchmarkWriteLargeWorkers(b *testing.B) { benchmarkWriteLarge(b, WithWorkers(4)) }
+
+func benchmarkWriteLarge(b *testing.B, opts ...Option) {
+	w, err := CreateWatcher(opts...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer w.Close()
+
+	var fds []int
+	for i := 0; i < 8; i++ {
+		fd, conn := tcpPair(b, w)
+		defer conn.Close()
+		go io.Copy(ioutil.Discard, conn)
+		fds = append(fds, fd)
+	}
+
+	var next int32
+	b.SetBytes(256 * 1024)
+	b.SetParallelism(8)
+	b.RunParallel(func(pb *testing.PB) {
+		fd := fds[int(atomic.AddInt32(&next, 1)-1)%len(fds)]
+		buf := make([]byte, 256*1024)
+		done := make(chan OpResult, 1)
+		for pb.Next() {
+			w.Write(fd, buf, done)
+			<-done
+		}
+	})
+}
+
+func TestWriteOrderWorkers(t *testing.T) {
+	w, err := CreateWatcher(WithWorkers(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	// requests of a fd are executed in order by one worker at a time
+	const n = 256
+	tx := make([]byte, n*4096)
+	io.ReadFull(rand.Reader, tx)
+	done := make(chan OpResult, n)
+	for i := 0; i < n; i++ {
+		if err := w.Write(fd, tx[i*4096:(i+1)*4096], done); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rx := make([]byte, len(tx))
+	if _, err := io.ReadFull(conn, rx); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tx, rx) {
+		t.Fatal("incorrect receiving")
+	}
+	for i := 0; i < n; i++ {
+		if res := <-done; res.Err != nil || res.Size != 4096 {
+			t.Fatal(res.Err, res.Size)
+		}
+	}
+}
+
+func BenchmarkWriteParallel(b *testing.B) {
+	w, err := CreateWatcher()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer w.Close()
+
+	var fds []int
+	for i := 0; i < 16; i++ {
+		fd, conn := tcpPair(b, w)
+		defer conn.Close()
+		go io.Copy(ioutil.Discard, conn)
+		fds = append(fds, fd)
+	}
+
+	var next int32
+	b.SetBytes(64)
+	b.SetParallelism(16)
+	b.RunParallel(func(pb *testing.PB) {
+		fd := fds[int(atomic.AddInt32(&next, 1)-1)%len(fds)]
+		buf := make([]byte, 64)
+		done := make(chan OpResult, 1)
+		for pb.Next() {
+			w.Write(fd, buf, done)
+			<-done
+		}
+	})
+}
+
+func testCertificate(t testing.TB) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTLSHandshake(t *testing.T)            { testTLSHandshake(t) }
+func TestTLSHandshakeCopyBuffers(t *testing.T) { testTLSHandshake(t, WithCopyBuffers()) }
+
+func testTLSHandshake(t *testing.T, opts ...Option) {
+	w, err := CreateWatcher(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, raw := tcpPair(t, w)
+	client := tls.Client(raw, &tls.Config{InsecureSkipVerify: true})
+	defer client.Close()
+	go client.Handshake()
+
+	done := make(chan OpResult, 1)
+	tc, err := w.StartTLS(fd, &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}, false, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := <-done
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	if res.TLS == nil || !res.TLS.HandshakeComplete || res.TLS.Version != tls.VersionTLS13 {
+		t.Fatal("incorrect connection state")
+	}
+
+	// echo
+	for i := 0; i < 10; i++ {
+		tx := make([]byte, 1024*i+1)
+		io.ReadFull(rand.Reader, tx)
+		go client.Write(tx)
+
+		rx := make([]byte, len(tx))
+		for n := 0; n < len(rx); {
+			tc.ReadTLS(rx[n:], done)
+			res := <-done
+			if res.Err != nil {
+				t.Fatal(res.Err)
+			}
+			n += res.Size
+		}
+
+		tc.WriteTLS(rx, done)
+		if res := <-done; res.Err != nil {
+			t.Fatal(res.Err)
+		}
+
+		echo := make([]byte, len(tx))
+		if _, err := io.ReadFull(client, echo); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tx, echo) {
+			t.Fatal("incorrect echo")
+		}
+	}
+}
+
+func TestTLSClose(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the peer never answers
+	fd, raw := tcpPair(t, w)
+	defer raw.Close()
+
+	done := make(chan OpResult, 1)
+	if _, err := w.StartTLS(fd, &tls.Config{InsecureSkipVerify: true}, true, done); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	w.Close()
+
+	select {
+	case res := <-done:
+		if res.Err == nil {
+			t.Fatal("handshake succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handshake not delivered after Close")
+	}
+}
+
+// tlsServer completes the handshake of a TLSConn as server with a stock
+// client over a tcp pair
+func tlsServer(t *testing.T, w *Watcher) (*TLSConn, *tls.Conn) {
+	fd, raw := tcpPair(t, w)
+	client := tls.Client(raw, &tls.Config{InsecureSkipVerify: true})
+	t.Cleanup(func() { client.Close() })
+	go client.Handshake()
+
+	done := make(chan OpResult, 1)
+	tc, err := w.StartTLS(fd, &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}, false, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := <-done; res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	return tc, client
+}
+
+func TestTLSIdle(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// the goroutines of the watcher routing the results are started by the
+	// first connection
+	done := make(chan OpResult, 32)
+	tc, client := tlsServer(t, w)
+	tc.ReadTLS(make([]byte, 16), done)
+	time.Sleep(50 * time.Millisecond)
+	base := runtime.NumGoroutine()
+
+	const conns = 20
+	var clients []*tls.Conn
+	for i := 0; i < conns; i++ {
+		tc, client := tlsServer(t, w)
+		if err := tc.ReadTLS(make([]byte, 16), done); err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, client)
+	}
+	// the handshake goroutines end with their handshakes
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > base && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > base {
+		t.Fatal("goroutines held by idle connections", n-base)
+	}
+
+	// the pending reads complete as the records arrive
+	for _, c := range append(clients, client) {
+		go c.Write([]byte("hello"))
+	}
+	for i := 0; i <= conns; i++ {
+		res := <-done
+		if res.Err != nil || string(res.Buffer[:res.Size]) != "hello" {
+			t.Fatal("incorrect read", res.Size, res.Err)
+		}
+	}
+}
+
+func TestTLSConnClose(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if _, err := w.StartTLS(1<<20, &tls.Config{}, true, nil); err != ErrNotWatched {
+		t.Fatal("unexpected error", err)
+	}
+
+	tc, client := tlsServer(t, w)
+	done := make(chan OpResult, 1)
+	if err := tc.ReadTLS(make([]byte, 16), done); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the close_notify is received by the peer
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 16)); err != io.EOF {
+		t.Fatal("close_notify not received", err)
+	}
+	if res := <-done; res.Err != ErrTLSClosed {
+		t.Fatal("pending read not ended", res.Err)
+	}
+	if err := tc.ReadTLS(make([]byte, 16), done); err != ErrTLSClosed {
+		t.Fatal("unexpected error", err)
+	}
+	if err := tc.WriteTLS([]byte("hello"), done); err != ErrTLSClosed {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+// round trips through the echo server, p99 reports the 99th percentile
+func BenchmarkLatency(b *testing.B)     { benchmarkLatency(b) }
+func BenchmarkLatencySpin(b *testing.B) { benchmarkLatency(b, WithSpin(100*time.Microsecond)) }
+
+func benchmarkLatency(b *testing.B, opts ...Option) {
+	ln := echoServer(b, opts...)
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	tx := []byte("hello world")
+	rx := make([]byte, len(tx))
+	rtts := make([]time.Duration, b.N)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		start := time.Now()
+		if _, err := conn.Write(tx); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, rx); err != nil {
+			b.Fatal(err)
+		}
+		rtts[i] = time.Since(start)
+
+		// let the poller go idle between round trips
+		if i%16 == 0 {
+			time.Sleep(20 * time.Microsecond)
+		}
+	}
+	b.StopTimer()
+
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	b.ReportMetric(float64(rtts[len(rtts)*99/100].Nanoseconds()), "p99-ns")
+}
+
+func TestSpinStats(t *testing.T) {
+	w, err := CreateWatcher(WithSpin(10 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	done := make(chan OpResult, 1)
+	w.Write(fd, []byte("ping"), done)
+	<-done
+
+	// spins for the budget after the write, then blocks
+	time.Sleep(50 * time.Millisecond)
+	st := w.Stats()
+	if st.SpinTime < 10*time.Millisecond {
+		t.Fatal("spin time:", st.SpinTime)
+	}
+	w.Write(fd, []byte("ping"), done)
+	<-done
+	if st = w.Stats(); st.BlockTime < 20*time.Millisecond {
+		t.Fatal("block time:", st.BlockTime)
+	}
+}
+
+func BenchmarkEcho(b *testing.B) {
+	ln := echoServer(b)
+
+	addr, _ := net.ResolveTCPAddr("tcp", ln.Addr().String())
+	tx := []byte("hello world")
+	rx := make([]byte, len(tx))
+
+	conn, err := net.DialTCP("tcp", nil, addr)
+	if err != nil {
+		b.Fatal(err)
+		return
+	}
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, err := conn.Write(tx)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = conn.Read(rx)
+		if err != nil {
+			b.Fatal(err)
+		}
+		//		log.Println(i, b.N)
+	}
+	conn.Close()
+}
+
+func TestReadUrgent(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	urgent := make(chan OpResult, 1)
+	if err := w.ReadUrgent(fd, make([]byte, 1), urgent); err != nil {
+		t.Fatal(err)
+	}
+
+	// "abc" in-band, '!' out-of-band, then "def"
+	rawconn, _ := conn.(*net.TCPConn).SyscallConn()
+	conn.Write([]byte("abc"))
+	rawconn.Write(func(s uintptr) bool {
+		_, err = unix.SendmsgN(int(s), []byte("!"), nil, nil, unix.MSG_OOB)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case res := <-urgent:
+		if res.Operation != OpUrgent || res.Err != nil || res.Size != 1 || res.Buffer[0] != '!' {
+			t.Fatal("bad urgent completion", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no urgent notification")
+	}
+	conn.Write([]byte("def"))
+
+	done := make(chan OpResult, 1)
+	var inband []byte
+	for len(inband) < 6 {
+		w.Read(fd, make([]byte, 64), done)
+		res := <-done
+		if res.Operation != OpRead || res.Err != nil {
+			t.Fatal(res)
+		}
+		inband = append(inband, res.Buffer[:res.Size]...)
+	}
+	if string(inband) != "abcdef" {
+		t.Fatal("in-band data disturbed", string(inband))
+	}
+}
+
+// lookups of the descriptor table at 100k fds, compared to a map
+func BenchmarkFdTable100K(b *testing.B) {
+	var t fdTable
+	for fd := 0; fd < 100000; fd++ {
+		t.register(fd, nil, 0, 0)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if t.watched(i%100000) == nil {
+			b.Fatal("missing descriptor")
+		}
+	}
+}
+
+func BenchmarkFdMap100K(b *testing.B) {
+	m := make(map[int]*fdDesc)
+	var mu sync.Mutex
+	for fd := 0; fd < 100000; fd++ {
+		m[fd] = new(fdDesc)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mu.Lock()
+		d := m[i%100000]
+		mu.Unlock()
+		if d == nil {
+			b.Fatal("missing descriptor")
+		}
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	w, err := CreateWatcher(WithShards(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	// an expired request leaves the requests around it in order
+	done := make(chan OpResult, 4)
+	start := time.Now()
+	w.Read(fd, make([]byte, 1), done)
+	w.ReadTimeout(fd, make([]byte, 1), done, start.Add(50*time.Millisecond))
+	w.Read(fd, make([]byte, 1), done)
+	if res := <-done; !errors.Is(res.Err, ErrDeadline) {
+		t.Fatal("deadline not enforced:", res.Err)
+	} else if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatal("expired early:", elapsed)
+	}
+	conn.Write([]byte("ab"))
+	for _, want := range "ab" {
+		if res := <-done; res.Err != nil || string(res.Buffer[:res.Size]) != string(want) {
+			t.Fatal("incorrect read:", res.Err, string(res.Buffer[:res.Size]))
+		}
+	}
+
+	// completed requests leave no timers behind
+	for i := 0; i < 8; i++ {
+		w.ReadTimeout(fd, make([]byte, 1), done, time.Now().Add(time.Hour))
+		conn.Write([]byte("x"))
+		if res := <-done; res.Err != nil {
+			t.Fatal(res.Err)
+		}
+	}
+	if n := len(w.shards[0].timers); n != 0 {
+		t.Fatal("timers leaked:", n)
+	}
+}
+
+func TestReadTimeoutWorkers(t *testing.T) {
+	w, err := CreateWatcher(WithShards(1), WithWorkers(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	done := make(chan OpResult, 1)
+	for i := 0; i < 16; i++ {
+		w.ReadTimeout(fd, make([]byte, 1), done, time.Now().Add(time.Hour))
+		conn.Write([]byte("x"))
+		if res := <-done; res.Err != nil {
+			t.Fatal(res.Err)
+		}
+	}
+	w.ReadTimeout(fd, make([]byte, 1), done, time.Now().Add(20*time.Millisecond))
+	if res := <-done; !errors.Is(res.Err, ErrDeadline) {
+		t.Fatal("deadline not enforced:", res.Err)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// the peer never reads
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	buf := make([]byte, 64<<20)
+	done := make(chan OpResult, 1)
+	w.WriteTimeout(fd, buf, done, time.Now().Add(50*time.Millisecond))
+	res := <-done
+	if !errors.Is(res.Err, ErrDeadline) {
+		t.Fatal("deadline not enforced:", res.Err)
+	}
+	if res.Size == 0 || res.Size == len(buf) {
+		t.Fatal("incorrect size written:", res.Size)
+	}
+}
+
+// timed reads completed with pending timed reads outstanding, the cost per
+// read should not depend on the number of timers
+func BenchmarkReadTimeout1K(b *testing.B)   { benchmarkReadTimeout(b, 1000) }
+func BenchmarkReadTimeout100K(b *testing.B) { benchmarkReadTimeout(b, 100000) }
+
+func benchmarkReadTimeout(b *testing.B, pending int) {
+	w, err := CreateWatcher(WithShards(1))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(b, w)
+	defer conn.Close()
+
+	done := make(chan OpResult, pending)
+	deadline := time.Now().Add(time.Hour)
+	for i := 0; i < pending; i++ {
+		if err := w.ReadTimeout(fd, make([]byte, 1), done, deadline.Add(time.Duration(i))); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	buf := make([]byte, 1)
+	for i := 0; i < b.N; i++ {
+		conn.Write(buf)
+		res := <-done
+		if res.Err != nil {
+			b.Fatal(res.Err)
+		}
+		w.ReadTimeout(fd, res.Buffer, done, deadline.Add(time.Duration(pending+i)))
+	}
+}
+
+func TestCompletionBatching(t *testing.T) {
+	w, err := CreateWatcher(WithShards(1), WithCompletionBatching(4, time.Hour), withManualStep())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	// the results are held until the batch is full or flushed
+	done := make(chan OpResult, 8)
+	for i := 0; i < 3; i++ {
+		w.Read(fd, make([]byte, 1), done)
+	}
+	conn.Write([]byte("abc"))
+	stepUntil(t, w, func() bool { return len(w.shards[0].batch) == 3 })
+	w.step()
+	if len(done) != 0 {
+		t.Fatal("results delivered before the batch is full:", len(done))
+	}
+	w.Flush()
+	w.step()
+	for _, want := range "abc" {
+		if res := <-done; res.Err != nil || string(res.Buffer[:res.Size]) != string(want) {
+			t.Fatal("incorrect result:", res.Err, string(res.Buffer[:res.Size]))
+		}
+	}
+
+	// a full batch is delivered at once
+	for i := 0; i < 4; i++ {
+		w.Write(fd, []byte("x"), done)
+	}
+	w.step()
+	if len(done) != 4 {
+		t.Fatal("incorrect results:", len(done))
+	}
+}
+
+func TestCompletionBatchingWindow(t *testing.T) {
+	w, err := CreateWatcher(WithShards(1), WithCompletionBatching(64, 20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	done := make(chan OpResult, 1)
+	start := time.Now()
+	w.Write(fd, []byte("x"), done)
+	if res := <-done; res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatal("delivered before the window ended:", elapsed)
+	}
+}
+
+// completions of reads on 64 fds ready at once, wakeups/op counts the
+// receives which found no result ready
+func BenchmarkCompletionWakeups(b *testing.B) { benchmarkCompletionWakeups(b) }
+func BenchmarkCompletionWakeupsBatched(b *testing.B) {
+	benchmarkCompletionWakeups(b, WithCompletionBatching(64, 100*time.Microsecond))
+}
+
+func benchmarkCompletionWakeups(b *testing.B, opts ...Option) {
+	w, err := CreateWatcher(append([]Option{WithShards(1)}, opts...)...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer w.Close()
+
+	const conns = 64
+	fds := make([]int, conns)
+	clients := make([]net.Conn, conns)
+	for i := range fds {
+		fds[i], clients[i] = tcpPair(b, w)
+		defer clients[i].Close()
+	}
+
+	done := make(chan OpResult, conns)
+	for _, fd := range fds {
+		w.Read(fd, make([]byte, 1), done)
+	}
+
+	b.ResetTimer()
+	go func() {
+		buf := make([]byte, 1)
+		for i := 0; i < b.N; i++ {
+			for _, conn := range clients {
+				conn.Write(buf)
+			}
+		}
+	}()
+
+	var wakeups int
+	for i := 0; i < b.N*conns; i++ {
+		var res OpResult
+		select {
+		case res = <-done:
+		default:
+			wakeups++
+			res = <-done
+		}
+		w.Read(res.Fd, res.Buffer, done)
+	}
+	b.ReportMetric(float64(wakeups)/float64(b.N), "wakeups/op")
+}
+
+func TestCopyBuffers(t *testing.T) {
+	w, err := CreateWatcher(WithCopyBuffers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	// the buffer of a write is reusable once submitted
+	done := make(chan OpResult, 1)
+	tx := []byte("hello")
+	if err := w.Write(fd, tx, done); err != nil {
+		t.Fatal(err)
+	}
+	copy(tx, "XXXXX")
+	rx := make([]byte, 5)
+	if _, err := io.ReadFull(conn, rx); err != nil {
+		t.Fatal(err)
+	}
+	if string(rx) != "hello" {
+		t.Fatal("write corrupted:", string(rx))
+	}
+	res := <-done
+	if res.Err != nil || res.Size != 5 {
+		t.Fatal("incorrect write:", res.Err, res.Size)
+	}
+	res.Release()
+
+	// the buffer of a read is never written
+	buf := make([]byte, 16)
+	if err := w.Read(fd, buf, done); err != nil {
+		t.Fatal(err)
+	}
+	copy(buf, "scribbled")
+	conn.Write([]byte("world"))
+	res = <-done
+	if res.Err != nil || string(res.Buffer[:res.Size]) != "world" {
+		t.Fatal("incorrect read:", res.Err, string(res.Buffer[:res.Size]))
+	}
+	if string(buf[:9]) != "scribbled" {
+		t.Fatal("buffer of the caller written:", string(buf))
+	}
+	res.Release()
+}
+
+func TestDispatch(t *testing.T) {
+	w, err := CreateWatcher(WithShards(2), WithWorkers(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	const conns, writes = 16, 200
+	var fds []int
+	maxFd := 0
+	for i := 0; i < conns; i++ {
+		fd, conn := tcpPair(t, w)
+		defer conn.Close()
+		go io.Copy(ioutil.Discard, conn)
+		fds = append(fds, fd)
+		if fd > maxFd {
+			maxFd = fd
+		}
+	}
+
+	// a handler entered concurrently for a fd, or out of order, fails
+	inflight := make([]int32, maxFd+1)
+	last := make([]uint32, maxFd+1)
+	var violations int32
+	var wg sync.WaitGroup
+	wg.Add(conns * writes)
+	done := make(chan OpResult, 1024)
+	w.Dispatch(done, 4, func(res OpResult) {
+		defer wg.Done()
+		if atomic.AddInt32(&inflight[res.Fd], 1) != 1 {
+			atomic.StoreInt32(&violations, 1)
+		}
+		if seq := binary.BigEndian.Uint32(res.Buffer); res.Err != nil || seq != last[res.Fd]+1 {
+			atomic.StoreInt32(&violations, 1)
+		} else {
+			last[res.Fd] = seq
+		}
+		runtime.Gosched()
+		atomic.AddInt32(&inflight[res.Fd], -1)
+	})
+
+	for i := 1; i <= writes; i++ {
+		for _, fd := range fds {
+			buf := make([]byte, 4)
+			binary.BigEndian.PutUint32(buf, uint32(i))
+			if err := w.Write(fd, buf, done); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	wg.Wait()
+	if atomic.LoadInt32(&violations) != 0 {
+		t.Fatal("results of a fd handled concurrently or out of order")
+	}
+}
+
+func TestWriteWatermarks(t *testing.T) {
+	w, err := CreateWatcher(WithSockBuf(0, 64*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// the peer stalls until the high watermark is reported
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	const low, high = 256 * 1024, 1024 * 1024
+	water := make(chan OpResult, 2)
+	if err := w.SetWriteWatermarks(fd, low, high, water); err != nil {
+		t.Fatal(err)
+	}
+
+	const writes = 64
+	done := make(chan OpResult, writes)
+	for i := 0; i < writes; i++ {
+		if err := w.Write(fd, make([]byte, 64*1024), done); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res := <-water
+	if res.Operation != OpWatermarkHigh || res.Fd != fd || res.Size < high {
+		t.Fatal("incorrect high watermark:", res.Operation, res.Size)
+	}
+	select {
+	case res := <-water:
+		t.Fatal("low watermark reported while stalled:", res.Size)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	go io.Copy(ioutil.Discard, conn)
+	res = <-water
+	if res.Operation != OpWatermarkLow || res.Size > low {
+		t.Fatal("incorrect low watermark:", res.Operation, res.Size)
+	}
+	for i := 0; i < writes; i++ {
+		if res := <-done; res.Err != nil {
+			t.Fatal(res.Err)
+		}
+	}
+}
+
+func TestWriteRateLimit(t *testing.T) {
+	w, err := CreateWatcher(WithShards(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	limited, conn := tcpPair(t, w)
+	defer conn.Close()
+	go io.Copy(ioutil.Discard, conn)
+	other, otherConn := tcpPair(t, w)
+	defer otherConn.Close()
+	go io.Copy(ioutil.Discard, otherConn)
+
+	// 512KB at 256KB/s, the first 32KB is the burst
+	const size, rate, burst = 512 * 1024, 256 * 1024, 32 * 1024
+	if err := w.SetWriteRateLimit(limited, rate, burst); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	done := make(chan OpResult, 1)
+	for i := 0; i < size/(64*1024); i++ {
+		w.Write(limited, make([]byte, 64*1024), done)
+	}
+
+	// other fds are unaffected
+	otherDone := make(chan OpResult, 1)
+	w.Write(other, make([]byte, 4<<20), otherDone)
+	if res := <-otherDone; res.Err != nil || res.Size != 4<<20 {
+		t.Fatal("incorrect write:", res.Err, res.Size)
+	} else if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatal("unlimited fd slowed down:", elapsed)
+	}
+
+	total := 0
+	for i := 0; i < size/(64*1024); i++ {
+		res := <-done
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		total += res.Size
+	}
+	want := time.Duration(size-burst) * time.Second / rate
+	if elapsed := time.Since(start); total != size || elapsed < want*8/10 || elapsed > want*12/10 {
+		t.Fatal("incorrect rate:", total, elapsed, want)
+	}
+}
+
+// testLogger records the messages logged with their context
+type testLogger struct {
+	mu      sync.Mutex
+	entries []map[string]interface{}
+}
+
+func (l *testLogger) Log(msg string, keyvals ...interface{}) {
+	entry := map[string]interface{}{"msg": msg}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		entry[keyvals[i].(string)] = keyvals[i+1]
+	}
+	l.mu.Lock()
+	l.entries = append(l.entries, entry)
+	l.mu.Unlock()
+}
+
+func (l *testLogger) find(msg string) map[string]interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, entry := range l.entries {
+		if entry["msg"] == msg {
+			return entry
+		}
+	}
+	return nil
+}
+
+func TestLogger(t *testing.T) {
+	logger := new(testLogger)
+	w, err := CreateWatcher(WithShards(1), WithLogger(logger), WithSockBuf(0, 64*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// a stalled peer
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	w.SetWriteWatermarks(fd, 0, 512*1024, nil)
+	done := make(chan OpResult, 16)
+	for i := 0; i < 16; i++ {
+		w.Write(fd, make([]byte, 64*1024), done)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	entry := logger.find("write queue reached high watermark")
+	for entry == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+		entry = logger.find("write queue reached high watermark")
+	}
+	if entry == nil {
+		t.Fatal("slow consumer not logged")
+	}
+	if entry["fd"] != fd || entry["queued"].(int) < 512*1024 {
+		t.Fatal("incorrect context:", entry)
+	}
+}
+
+func TestStatsCounters(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	// echo 100 messages of 64 bytes
+	const rounds, size = 100, 64
+	done := make(chan OpResult, 1)
+	msg := make([]byte, size)
+	for i := 0; i < rounds; i++ {
+		conn.Write(msg)
+		w.Read(fd, make([]byte, size), done)
+		res := <-done
+		if res.Err != nil || res.Size != size {
+			t.Fatal("incorrect read:", res.Err, res.Size)
+		}
+		w.Write(fd, res.Buffer, done)
+		if res := <-done; res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.ReadTimeout(fd, make([]byte, size), done, time.Now().Add(10*time.Millisecond))
+	if res := <-done; !errors.Is(res.Err, ErrDeadline) {
+		t.Fatal("deadline not enforced:", res.Err)
+	}
+
+	st := w.Stats()
+	if st.Submitted != 2*rounds+1 || st.Reads != rounds+1 || st.Writes != rounds {
+		t.Fatal("incorrect requests:", st.Submitted, st.Reads, st.Writes)
+	}
+	if st.BytesRead != rounds*size || st.BytesWritten != rounds*size {
+		t.Fatal("incorrect bytes:", st.BytesRead, st.BytesWritten)
+	}
+	if st.Errors != 1 || st.Timeouts != 1 {
+		t.Fatal("incorrect errors:", st.Errors, st.Timeouts)
+	}
+	if st.Pending != 0 || st.Conns != 1 || st.Wakeups == 0 {
+		t.Fatal("incorrect state:", st.Pending, st.Conns, st.Wakeups)
+	}
+}
+
+func TestConnStats(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	go io.Copy(ioutil.Discard, conn)
+
+	start := time.Now()
+	done := make(chan OpResult, 1)
+	for i := 0; i < 10; i++ {
+		w.Write(fd, make([]byte, 1000), done)
+		<-done
+	}
+	for i := 0; i < 3; i++ {
+		conn.Write(make([]byte, 100))
+		w.Read(fd, make([]byte, 100), done)
+		if res := <-done; res.Size != 100 {
+			t.Fatal("short read:", res.Size)
+		}
+	}
+
+	st, err := w.ConnStats(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.BytesOut != 10000 || st.BytesIn != 300 || st.Ops != 13 || st.LastActive.Before(start) {
+		t.Fatal("incorrect stats:", st)
+	}
+
+	var ranged int
+	w.RangeStats(func(rfd int, rst ConnStats) bool {
+		if rfd == fd && reflect.DeepEqual(rst, st) {
+			ranged++
+		}
+		return true
+	})
+	if ranged != 1 {
+		t.Fatal("fd not ranged")
+	}
+
+	// reset by StopWatch
+	w.StopWatch(fd)
+	if _, err := w.ConnStats(fd); err != ErrNotWatched {
+		t.Fatal("stats of a stopped fd:", err)
+	}
+	if _, err := w.WatchFd(fd); err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := w.ConnStats(fd); !reflect.DeepEqual(st, ConnStats{}) {
+		t.Fatal("stats not reset:", st)
+	}
+}
+
+type testTracer struct {
+	mu    sync.Mutex
+	next  int
+	open  map[int]OpType
+	errs  map[error]int
+	dupes int
+}
+
+func (tr *testTracer) OnSubmit(fd int, op OpType, size int) interface{} {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.next++
+	tr.open[tr.next] = op
+	return tr.next
+}
+
+func (tr *testTracer) OnComplete(span interface{}, res OpResult) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	id := span.(int)
+	if op, ok := tr.open[id]; !ok || op != res.Operation {
+		tr.dupes++
+	}
+	delete(tr.open, id)
+	err := res.Err
+	if oe, ok := err.(*OpError); ok {
+		err = oe.Err
+	}
+	tr.errs[err]++
+}
+
+// waitOpen waits for the number of traces not ended to drop to n
+func (tr *testTracer) waitOpen(t *testing.T, n int) {
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		tr.mu.Lock()
+		open := len(tr.open)
+		tr.mu.Unlock()
+		if open == n {
+			return
+		} else if time.Since(start) > 5*time.Second {
+			t.Fatalf("%v traces not ended, want %v", open, n)
+		}
+	}
+}
+
+func TestTracer(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithWorkers(2)}} {
+		tr := &testTracer{open: make(map[int]OpType), errs: make(map[error]int)}
+		w, err := CreateWatcher(append(opts, WithTracer(tr))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fd, conn := tcpPair(t, w)
+		defer conn.Close()
+		done := make(chan OpResult, 1)
+
+		// success
+		w.Write(fd, make([]byte, 100), done)
+		<-done
+		conn.Write(make([]byte, 100))
+		w.Read(fd, make([]byte, 100), done)
+		<-done
+
+		// timeout
+		w.ReadTimeout(fd, make([]byte, 100), done, time.Now().Add(20*time.Millisecond))
+		if res := <-done; !errors.Is(res.Err, ErrDeadline) {
+			t.Fatal("read not timed out:", res.Err)
+		}
+
+		// canceled by StopWatch
+		w.Read(fd, make([]byte, 100), done)
+		tr.waitOpen(t, 1)
+		w.StopWatch(fd)
+		tr.waitOpen(t, 0)
+
+		// dropped by Close
+		fd2, conn2 := tcpPair(t, w)
+		defer conn2.Close()
+		w.Read(fd2, make([]byte, 100), done)
+		w.Close()
+		<-w.Done()
+		tr.waitOpen(t, 0)
+
+		tr.mu.Lock()
+		if tr.dupes != 0 || tr.next != 5 || tr.errs[nil] != 2 || tr.errs[ErrDeadline] != 1 ||
+			tr.errs[ErrNotWatched] != 1 || tr.errs[ErrWatcherClosed] != 1 {
+			t.Fatal("unbalanced traces:", tr.next, tr.dupes, tr.errs)
+		}
+		tr.mu.Unlock()
+	}
+}
+
+func TestDumpState(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	done := make(chan OpResult, 2)
+	w.Read(fd, make([]byte, 100), done)
+	w.Read(fd, make([]byte, 100), done)
+	time.Sleep(50 * time.Millisecond)
+
+	st, err := w.DumpState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Conns != 1 || st.Pending != 2 || len(st.Shards) != len(w.shards) || len(st.Fds) != 1 {
+		t.Fatal("incorrect state:", st)
+	}
+	if fs := st.Fds[0]; fs.Fd != fd || fs.Pending != 2 || fs.Reads != 2 || fs.Writes != 0 ||
+		fs.Oldest < 50*time.Millisecond || fs.Oldest > 5*time.Second {
+		t.Fatal("incorrect fd state:", fs)
+	}
+
+	var text bytes.Buffer
+	if _, err := st.WriteTo(&text); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text.String(), fmt.Sprintf("fd %v: shard=%v pending=2 reads=2", fd, fd%len(w.shards))) {
+		t.Fatal("incorrect text:", text.String())
+	}
+
+	w.StopWatch(fd)
+	if st, _ := w.DumpState(); st.Conns != 0 || len(st.Fds) != 0 {
+		t.Fatal("state after StopWatch:", st)
+	}
+}
+
+func TestRange(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	conns := make(map[int]net.Conn)
+	for i := 0; i < 10; i++ {
+		fd, client := tcpPair(t, w)
+		defer client.Close()
+		conns[fd] = w.fds.get(fd).conn
+	}
+	var churn []net.Conn
+	for i := 0; i < 10; i++ {
+		fd, client := tcpPair(t, w)
+		defer client.Close()
+		churn = append(churn, w.fds.get(fd).conn)
+		w.StopWatch(fd)
+	}
+	if w.Len() != len(conns) {
+		t.Fatal("incorrect len:", w.Len())
+	}
+
+	// the fds watched throughout are seen while others come and go
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			for _, conn := range churn {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if fd, err := w.Watch(conn); err == nil {
+					w.StopWatch(fd)
+				}
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		seen := 0
+		w.Range(func(fd int, conn net.Conn) bool {
+			if c, ok := conns[fd]; ok {
+				if c != conn {
+					t.Error("incorrect conn of fd", fd)
+				}
+				seen++
+			}
+			return true
+		})
+		if seen != len(conns) {
+			t.Fatal("fds seen:", seen)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	// StopWatch from the callback
+	visited := 0
+	w.Range(func(fd int, conn net.Conn) bool {
+		visited++
+		w.StopWatch(fd)
+		return true
+	})
+	if visited != len(conns) || w.Len() != 0 {
+		t.Fatal("incorrect drain:", visited, w.Len())
+	}
+}
+
+func TestSlowConsumer(t *testing.T) {
+	type slow struct {
+		fd   int
+		wait time.Duration
+	}
+	reports := make(chan slow, 10)
+	w, err := CreateWatcher(WithSlowConsumer(20*time.Millisecond, func(fd int, wait time.Duration) {
+		reports <- slow{fd, wait}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	done := make(chan OpResult)
+	w.Write(fd, make([]byte, 100), done)
+	time.Sleep(50 * time.Millisecond)
+	<-done
+
+	select {
+	case r := <-reports:
+		if r.fd != fd || r.wait < 20*time.Millisecond {
+			t.Fatal("incorrect report:", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("slow consumer not reported")
+	}
+
+	// a consumer keeping up is not reported
+	w.Write(fd, make([]byte, 100), done)
+	<-done
+	select {
+	case r := <-reports:
+		t.Fatal("unexpected report:", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDropOldest(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	done := make(chan OpResult, 2)
+	w.SetDropOldest(done, true)
+	for i := 1; i <= 5; i++ {
+		w.Write(fd, make([]byte, i), done)
+	}
+	for start := time.Now(); w.Stats().Dropped != 3; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("results dropped:", w.Stats().Dropped)
+		}
+	}
+	if a, b := <-done, <-done; a.Size != 4 || b.Size != 5 {
+		t.Fatal("oldest results not dropped:", a.Size, b.Size)
+	}
+
+	// waits for the receiver once disabled
+	w.SetDropOldest(done, false)
+	for i := 1; i <= 3; i++ {
+		w.Write(fd, make([]byte, i), done)
+	}
+	for i := 1; i <= 3; i++ {
+		if res := <-done; res.Size != i {
+			t.Fatal("result lost:", res.Size, i)
+		}
+	}
+	if w.Stats().Dropped != 3 {
+		t.Fatal("dropped when disabled")
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	for where, opts := range map[string][]Option{"poller": nil, "worker": {WithWorkers(1)}} {
+		w, err := CreateWatcher(append(opts, WithShards(1), WithLogger(new(testLogger)))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+
+		fd, conn := tcpPair(t, w)
+		defer conn.Close()
+		fd2, conn2 := tcpPair(t, w)
+		defer conn2.Close()
+		pending := make(chan OpResult, 1)
+		w.Read(fd2, make([]byte, 1), pending)
+
+		// a write with its progress past its buffer panics on slicing
+		done := make(chan OpResult, 1)
+		w.shardOf(fd).submit(aiocb{kind: kindWrite, fd: fd, buffer: make([]byte, 1), size: 2, done: done})
+		select {
+		case <-w.Done():
+		case <-time.After(time.Second):
+			t.Fatal("watcher not terminated")
+		}
+
+		perr, ok := w.Err().(*PanicError)
+		if !ok || perr.Where != where || !strings.Contains(string(perr.Stack), "tryWrite") {
+			t.Fatal("incorrect error:", w.Err())
+		}
+		if res := <-done; !errors.Is(res.Err, w.Err()) {
+			t.Fatal("panicking request not failed:", res.Err)
+		}
+		if res := <-pending; !errors.Is(res.Err, w.Err()) {
+			t.Fatal("pending request not failed:", res.Err)
+		}
+	}
+}
+
+type panicTracer struct{}
+
+func (panicTracer) OnSubmit(fd int, op OpType, size int) interface{} { return nil }
+func (panicTracer) OnComplete(span interface{}, res OpResult)        { panic("tracer") }
+
+func TestCallbackPanic(t *testing.T) {
+	logger := new(testLogger)
+	w, err := CreateWatcher(WithLogger(logger), WithTracer(panicTracer{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	done := make(chan OpResult)
+	handled := make(chan int, 2)
+	w.Dispatch(done, 1, func(res OpResult) {
+		handled <- res.Size
+		if res.Size == 1 {
+			panic("handler")
+		}
+	})
+
+	// the results are delivered and handled despite the panics
+	w.Write(fd, make([]byte, 1), done)
+	w.Write(fd, make([]byte, 2), done)
+	for i := 1; i <= 2; i++ {
+		select {
+		case n := <-handled:
+			if n != i {
+				t.Fatal("incorrect result:", n)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("result not handled")
+		}
+	}
+	if w.Err() != nil {
+		t.Fatal("watcher terminated:", w.Err())
+	}
+
+	for _, name := range []string{"dispatch handler", "Tracer.OnComplete"} {
+		var found bool
+		for start := time.Now(); !found && time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+			logger.mu.Lock()
+			for _, e := range logger.entries {
+				if e["msg"] == "callback panicked" && e["callback"] == name {
+					found = e["err"].(*PanicError).Where == name
+				}
+			}
+			logger.mu.Unlock()
+		}
+		if !found {
+			t.Fatal("panic not logged:", name)
+		}
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	logger := new(testLogger)
+	w, err := CreateWatcher(WithWatchdog(50*time.Millisecond), WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// waiting for events with requests pending is healthy
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	read := make(chan OpResult, 1)
+	w.Read(fd, make([]byte, 1), read)
+	time.Sleep(150 * time.Millisecond)
+	if err := w.Healthy(); err != nil || logger.find("poller stuck") != nil {
+		t.Fatal("idle loop reported:", err)
+	}
+
+	// the loop is blocked delivering to a done nobody receives
+	done := make(chan OpResult)
+	w.Write(fd, make([]byte, 1), done)
+	time.Sleep(150 * time.Millisecond)
+	if err := w.Healthy(); err == nil {
+		t.Fatal("stuck loop not detected")
+	}
+	entry := logger.find("poller stuck")
+	if entry == nil || entry["shard"] != fd%len(w.shards) || entry["stalled"].(time.Duration) < 50*time.Millisecond {
+		t.Fatal("stuck loop not logged:", entry)
+	}
+
+	<-done
+	time.Sleep(10 * time.Millisecond)
+	if err := w.Healthy(); err != nil {
+		t.Fatal("loop not recovered:", err)
+	}
+}
+
+func TestSyscallStats(t *testing.T) {
+	w, err := CreateWatcher(WithSockBuf(0, 64*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	done := make(chan OpResult, 2)
+
+	// the second read finds nothing left after the readiness
+	w.Read(fd, make([]byte, 100), done)
+	w.Read(fd, make([]byte, 100), done)
+	time.Sleep(10 * time.Millisecond)
+	conn.Write(make([]byte, 50))
+	if res := <-done; res.Size != 50 {
+		t.Fatal("short read:", res.Size)
+	}
+	time.Sleep(10 * time.Millisecond)
+	st := w.Stats()
+	if st.ReadsAgain == 0 || st.ReadSizes[1] != 1 {
+		t.Fatal("reads not counted:", st.ReadsAgain, st.ReadSizes)
+	}
+	if cs, _ := w.ConnStats(fd); cs.ReadsAgain != st.ReadsAgain {
+		t.Fatal("reads of fd not counted:", cs)
+	}
+
+	// a write larger than the socket buffer is written in parts
+	go io.Copy(ioutil.Discard, conn)
+	w.Write(fd, make([]byte, 1<<20), done)
+	if res := <-done; res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	st = w.Stats()
+	var writes uint64
+	for _, n := range st.WriteSizes {
+		writes += n
+	}
+	if st.ShortWrites == 0 || writes < 2 || st.WriteSizes[SizeBuckets-1] == 0 {
+		t.Fatal("writes not counted:", st.ShortWrites, st.WriteSizes)
+	}
+	if cs, _ := w.ConnStats(fd); cs.ShortWrites != st.ShortWrites {
+		t.Fatal("writes of fd not counted:", cs)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	logger := new(testLogger)
+	w, err := CreateWatcher(WithName("edge"), WithShards(2), WithWorkers(1), WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.Dispatch(make(chan OpResult), 1, func(OpResult) {})
+	time.Sleep(10 * time.Millisecond)
+
+	var profile bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&profile, 1)
+	for _, labels := range []string{
+		`"gaio.role":"poller", "gaio.shard":"0", "gaio.watcher":"edge"`,
+		`"gaio.role":"poller", "gaio.shard":"1", "gaio.watcher":"edge"`,
+		`"gaio.role":"worker", "gaio.watcher":"edge"`,
+		`"gaio.role":"dispatch", "gaio.watcher":"edge"`,
+	} {
+		if !strings.Contains(profile.String(), labels) {
+			t.Fatal("goroutine not labeled:", labels)
+		}
+	}
+
+	if st, _ := w.DumpState(); st.Name != "edge" || w.Name() != "edge" {
+		t.Fatal("incorrect name:", st.Name, w.Name())
+	}
+	w.logger.Log("test")
+	if entry := logger.find("test"); entry["watcher"] != "edge" {
+		t.Fatal("name not logged:", entry)
+	}
+	if other, _ := CreateWatcher(); other.Name() == "" || other.Name() == "edge" {
+		t.Fatal("incorrect default name:", other.Name())
+	} else {
+		other.Close()
+	}
+}
+
+func TestLeakCheck(t *testing.T) {
+	logger := new(testLogger)
+	w, err := CreateWatcher(WithLeakCheck(20*time.Millisecond), WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	live, client := tcpPair(t, w)
+	defer client.Close()
+	fd, client2 := tcpPair(t, w)
+	defer client2.Close()
+
+	// closed without StopWatch
+	w.fds.get(fd).conn.Close()
+	runtime.GC()
+
+	var entry map[string]interface{}
+	for start := time.Now(); entry == nil && time.Since(start) < time.Second; time.Sleep(10 * time.Millisecond) {
+		entry = logger.find("conn closed while watched")
+	}
+	if entry == nil || entry["fd"] != fd || !strings.Contains(entry["stack"].(string), "gaio.tcpPair") {
+		t.Fatal("leak not reported:", entry)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	reports := 0
+	for _, e := range logger.entries {
+		if e["msg"] == "conn closed while watched" {
+			if reports++; e["fd"] == live || reports > 1 {
+				t.Fatal("unexpected report:", e)
+			}
+		}
+	}
+}
+
+type closedRecorder struct {
+	mu      sync.Mutex
+	reasons map[int][]error
+	conns   map[int]net.Conn
+	ctxs    map[int]interface{}
+}
+
+func newClosedRecorder() *closedRecorder {
+	return &closedRecorder{reasons: make(map[int][]error), conns: make(map[int]net.Conn), ctxs: make(map[int]interface{})}
+}
+
+func (r *closedRecorder) onClosed(fd int, conn net.Conn, ctx interface{}, reason error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reasons[fd] = append(r.reasons[fd], reason)
+	r.conns[fd] = conn
+	r.ctxs[fd] = ctx
+}
+
+// wait waits for fds to be reported once each with reason
+func (r *closedRecorder) wait(t *testing.T, reason error, fds ...int) {
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		r.mu.Lock()
+		n := 0
+		for _, fd := range fds {
+			if len(r.reasons[fd]) > 1 || (len(r.reasons[fd]) == 1 && r.reasons[fd][0] != reason) {
+				r.mu.Unlock()
+				t.Fatal("incorrect reports of fd", fd, r.reasons[fd])
+			} else if len(r.reasons[fd]) == 1 {
+				n++
+			}
+		}
+		r.mu.Unlock()
+		if n == len(fds) {
+			return
+		} else if time.Since(start) > 5*time.Second {
+			t.Fatal("fds not reported:", n, len(fds))
+		}
+	}
+}
+
+func TestOnClosed(t *testing.T) {
+	rec := newClosedRecorder()
+	done := make(chan OpResult, 1)
+	var delivered bool
+	w, err := CreateWatcher(WithOnClosed(func(fd int, conn net.Conn, ctx interface{}, reason error) {
+		if reason == nil {
+			delivered = len(done) == 1
+		}
+		rec.onClosed(fd, conn, ctx, reason)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// StopWatch, after the result of the write before it
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	server := w.fds.get(fd).conn
+	w.Write(fd, make([]byte, 10), done)
+	w.StopWatch(fd)
+	rec.wait(t, nil, fd)
+	if !delivered || rec.conns[fd] != server {
+		t.Fatal("reported before the result or with another conn")
+	}
+	w.StopWatch(fd)
+
+	// Close, including a raw fd
+	fd2, conn2 := tcpPair(t, w)
+	defer conn2.Close()
+	w.Read(fd2, make([]byte, 1), done)
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	if _, err := w.WatchFd(fds[0]); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	rec.wait(t, ErrWatcherClosed, fd2, fds[0])
+	if rec.conns[fds[0]] != nil || w.Len() != 0 {
+		t.Fatal("incorrect conn or fds left:", rec.conns[fds[0]], w.Len())
+	}
+	rec.wait(t, nil, fd)
+}
+
+func TestOnClosedFailure(t *testing.T) {
+	rec := newClosedRecorder()
+	w, err := CreateWatcher(WithShards(1), WithOnClosed(rec.onClosed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	fd2, conn2 := tcpPair(t, w)
+	defer conn2.Close()
+
+	// a write with its progress past its buffer panics on slicing
+	w.shardOf(fd).submit(aiocb{kind: kindWrite, fd: fd, buffer: make([]byte, 1), size: 2})
+	<-w.Done()
+	rec.wait(t, w.Err(), fd, fd2)
+}
+
+func TestOnClosedRace(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithWorkers(2)}} {
+		rec := newClosedRecorder()
+		w, err := CreateWatcher(append(opts, WithOnClosed(rec.onClosed))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var fds []int
+		for i := 0; i < 50; i++ {
+			fd, conn := tcpPair(t, w)
+			defer conn.Close()
+			go io.Copy(ioutil.Discard, conn)
+			fds = append(fds, fd)
+		}
+
+		// StopWatch twice with writes in flight, racing with Close
+		var wg sync.WaitGroup
+		for _, fd := range fds {
+			wg.Add(1)
+			go func(fd int) {
+				defer wg.Done()
+				w.Write(fd, make([]byte, 1024), nil)
+				w.StopWatch(fd)
+				w.StopWatch(fd)
+			}(fd)
+		}
+		time.Sleep(time.Millisecond)
+		w.Close()
+		wg.Wait()
+
+		for start := time.Now(); ; time.Sleep(time.Millisecond) {
+			rec.mu.Lock()
+			n := len(rec.reasons)
+			rec.mu.Unlock()
+			if n == len(fds) {
+				break
+			} else if time.Since(start) > 5*time.Second {
+				t.Fatal("fds not reported:", n)
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		rec.mu.Lock()
+		for _, fd := range fds {
+			if r := rec.reasons[fd]; len(r) != 1 || (r[0] != nil && r[0] != ErrWatcherClosed) {
+				t.Fatal("incorrect reports of fd", fd, r)
+			}
+		}
+		rec.mu.Unlock()
+	}
+}
+
+func TestWatchDup(t *testing.T) {
+	w, err := CreateWatcher(WithWatchMode(WatchDup))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := w.Watch(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var original int
+	rawconn, _ := server.(*net.TCPConn).SyscallConn()
+	rawconn.Control(func(s uintptr) { original = int(s) })
+	if fd == original {
+		t.Fatal("fd not duplicated")
+	}
+
+	// the original is closed with a read pending on the duplicate
+	done := make(chan OpResult, 1)
+	w.Read(fd, make([]byte, 5), done)
+	time.Sleep(10 * time.Millisecond)
+	server.Close()
+	client.Write([]byte("hello"))
+	if res := <-done; res.Err != nil || string(res.Buffer[:res.Size]) != "hello" {
+		t.Fatal("read failed:", res.Err, res.Size)
+	}
+	w.Write(fd, []byte("world"), done)
+	if res := <-done; res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "world" {
+		t.Fatal("write failed:", err, string(buf))
+	}
+
+	// the duplicate is closed by StopWatch
+	w.StopWatch(fd)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := client.Read(buf); err != io.EOF {
+		t.Fatal("connection not closed:", n, err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithWorkers(2)}} {
+		testMigrate(t, opts)
+	}
+}
+
+func testMigrate(t *testing.T, opts []Option) {
+	w1, err := CreateWatcher(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w1.Close()
+	w2, err := CreateWatcher(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w2.Close()
+
+	// the client streams a pattern and checks the echo of the server
+	const total = 4 << 20
+	fd, conn := tcpPair(t, w1)
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 8192)
+		for sent := 0; sent < total; {
+			n := len(buf)
+			if total-sent < n {
+				n = total - sent
+			}
+			for i := 0; i < n; i++ {
+				buf[i] = byte((sent + i) % 251)
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return
+			}
+			sent += n
+		}
+	}()
+	echoed := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 8192)
+		for got := 0; got < total; {
+			n, err := conn.Read(buf)
+			if err != nil {
+				echoed <- err
+				return
+			}
+			for i := 0; i < n; i++ {
+				if buf[i] != byte((got+i)%251) {
+					echoed <- fmt.Errorf("corrupted echo at %v", got+i)
+					return
+				}
+			}
+			got += n
+		}
+		echoed <- nil
+	}()
+
+	// the server echoes with a read and a write pending while it moves to
+	// w2 and back to w1
+	done := make(chan OpResult, 16)
+	cur := w1
+	if err := cur.Read(fd, make([]byte, 4096), done); err != nil {
+		t.Fatal(err)
+	}
+	received, moves := 0, 0
+	for {
+		select {
+		case res := <-done:
+			if res.Err != nil {
+				t.Fatal(res.Err)
+			}
+			if res.Operation == OpWrite {
+				continue
+			}
+			received += res.Size
+			if err := cur.Write(fd, res.Buffer[:res.Size], done); err != nil {
+				t.Fatal(err)
+			}
+			if received < total {
+				if err := cur.Read(fd, make([]byte, 4096), done); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if moves < 2 && received > (moves+1)*total/3 {
+				to := w2
+				if cur == w2 {
+					to = w1
+				}
+				st, _ := cur.ConnStats(fd)
+				if err := cur.Migrate(fd, to); err != nil {
+					t.Fatal(err)
+				}
+				if cur.watched(fd) || !to.watched(fd) {
+					t.Fatal("fd not moved")
+				}
+				if moved, _ := to.ConnStats(fd); moved.BytesIn < st.BytesIn {
+					t.Fatal("stats not moved", moved, st)
+				}
+				cur = to
+				moves++
+			}
+		case err := <-echoed:
+			if err != nil {
+				t.Fatal(err)
+			}
+			if moves != 2 || received != total {
+				t.Fatal("moves", moves, "received", received)
+			}
+			if err := w1.Migrate(fd, w2); err != nil {
+				t.Fatal(err)
+			}
+			if err := w1.Migrate(fd, w2); err != ErrNotWatched {
+				t.Fatal(err)
+			}
+			return
+		case <-time.After(10 * time.Second):
+			t.Fatal("stalled after", received)
+		}
+	}
+}
+
+// TestImportHelper is the process importing the fds of TestExport
+func TestImportHelper(t *testing.T) {
+	if os.Getenv("GAIO_IMPORT_HELPER") != "1" {
+		return
+	}
+	conn, err := net.FileConn(os.NewFile(3, "handover"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan OpResult, 16)
+	w, fds, err := ImportWatcher(conn.(*net.UnixConn), done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if len(fds) != 1 {
+		t.Fatal("imported", fds)
+	}
+
+	// echo until the client closes
+	fd := fds[0].Fd
+	defer syscall.Close(fd)
+	if err := w.Read(fd, make([]byte, 1000), done); err != nil {
+		t.Fatal(err)
+	}
+	for res := range done {
+		if res.Operation == OpWrite {
+			if res.Err != nil {
+				t.Fatal(res.Err)
+			}
+			continue
+		} else if res.Err != nil {
+			t.Fatal(res.Err)
+		} else if res.Size == 0 {
+			w.StopWatch(fd)
+			return
+		}
+		w.Write(fd, res.Buffer[:res.Size], done)
+		w.Read(fd, make([]byte, 1000), done)
+	}
+}
+
+func TestExport(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handover := os.NewFile(uintptr(fds[0]), "handover")
+	defer handover.Close()
+	child := os.NewFile(uintptr(fds[1]), "child")
+	cmd := exec.Command(os.Args[0], "-test.run=^TestImportHelper$", "-test.v")
+	cmd.Env = append(os.Environ(), "GAIO_IMPORT_HELPER=1")
+	cmd.ExtraFiles = []*os.File{child}
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	child.Close()
+
+	// the client sends chunks and waits for each echo, the server hands
+	// over after a chunk with its echo possibly pending
+	const chunk, chunks = 1000, 100
+	fd, conn := tcpPair(t, w)
+	server := w.fds.get(fd).conn
+	echoed := make(chan error, 1)
+	go func() {
+		buf := make([]byte, chunk)
+		for i := 0; i < chunks; i++ {
+			for j := range buf {
+				buf[j] = byte(i + j)
+			}
+			if _, err := conn.Write(buf); err != nil {
+				echoed <- err
+				return
+			}
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				echoed <- err
+				return
+			}
+			for j := range buf {
+				if buf[j] != byte(i+j) {
+					echoed <- fmt.Errorf("corrupted echo of chunk %v", i)
+					return
+				}
+			}
+		}
+		echoed <- conn.Close()
+	}()
+
+	done := make(chan OpResult, 16)
+	if err := w.SetWriteWatermarks(fd, 100, 1<<20, nil); err != nil {
+		t.Fatal(err)
+	}
+	w.Read(fd, make([]byte, chunk), done)
+	for received := 0; ; {
+		res := <-done
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		} else if res.Operation == OpWrite {
+			continue
+		}
+		received += res.Size
+		w.Write(fd, res.Buffer[:res.Size], done)
+		if received == chunks/2*chunk {
+			break
+		}
+		w.Read(fd, make([]byte, chunk), done)
+	}
+	exported, err := w.Export(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exported) != 1 || exported[0].Fd != fd || exported[0].High != 1<<20 || w.Len() != 0 {
+		t.Fatal("exported", exported)
+	}
+	uc, err := net.FileConn(handover)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	if err := SendExported(uc.(*net.UnixConn), exported); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+
+	if err := <-echoed; err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err, out.String())
+	}
+}
+
+func TestDrain(t *testing.T) {
+	// fast conns drain their writes, their reads end
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan OpResult, 16)
+	const size = 1 << 20
+	received := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		fd, conn := tcpPair(t, w)
+		defer conn.Close()
+		w.Read(fd, nil, done)
+		w.Write(fd, make([]byte, size), done)
+		go func() {
+			n, _ := io.Copy(ioutil.Discard, conn)
+			received <- int(n)
+		}()
+	}
+	if err := w.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if w.Err() != ErrWatcherClosed {
+		t.Fatal(w.Err())
+	}
+	if conns, bytes := w.DrainProgress(); conns != 0 || bytes != 0 {
+		t.Fatal("left", conns, bytes)
+	}
+	for i := 0; i < 2; i++ {
+		if n := <-received; n != size {
+			t.Fatal("received", n)
+		}
+	}
+	var reads, writes int
+	for len(done) > 0 {
+		res := <-done
+		if res.Operation == OpRead && errors.Is(res.Err, ErrDraining) {
+			reads++
+		} else if res.Operation == OpWrite && res.Err == nil && res.Size == size {
+			writes++
+		} else {
+			t.Fatal(res)
+		}
+	}
+	if reads != 2 || writes != 2 {
+		t.Fatal("reads", reads, "writes", writes)
+	}
+
+	// a stalled conn is closed at the deadline
+	w, err = CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	w.Write(fd, make([]byte, 64<<20), done)
+	if conns, bytes := w.DrainProgress(); conns != 1 || bytes != 64<<20 {
+		t.Fatal("progress", conns, bytes)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := w.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	if w.Err() != ErrWatcherClosed || w.Len() != 0 {
+		t.Fatal("not closed")
+	}
+	if _, err := io.Copy(ioutil.Discard, conn); err != nil && !strings.Contains(err.Error(), "reset") {
+		t.Fatal(err)
+	}
+	// the pending write fails instead of being dropped
+	select {
+	case res := <-done:
+		if res.Operation != OpWrite || !(errors.Is(res.Err, ErrDraining) || errors.Is(res.Err, ErrWatcherClosed)) {
+			t.Fatal("incorrect write:", res.Err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write dropped")
+	}
+
+	// the conns of WatchDup are the caller's
+	w, err = CreateWatcher(WithWatchMode(WatchDup))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if _, err := w.Watch(server); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Write([]byte("ping")); err != nil {
+		t.Fatal("conn of WatchDup closed:", err)
+	}
+}
+
+func TestDrainRace(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	// reads racing the start of the drain are either rejected or ended by
+	// it, none is left behind
+	done := make(chan OpResult, 1<<16)
+	var wg sync.WaitGroup
+	var accepted int32
+	start := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for {
+				switch err := w.Read(fd, make([]byte, 1), done); err {
+				case nil:
+					atomic.AddInt32(&accepted, 1)
+				case ErrDraining, ErrWatcherClosed:
+					return
+				default:
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	close(start)
+	time.Sleep(time.Millisecond)
+	if err := w.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if len(done) != int(accepted) {
+		t.Fatal("accepted", accepted, "ended", len(done))
+	}
+	for len(done) > 0 {
+		if res := <-done; !errors.Is(res.Err, ErrDraining) {
+			t.Fatal(res)
+		}
+	}
+}
+
+func TestCloseWait(t *testing.T) {
+	// all complete before the timeout
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	done := make(chan OpResult, 16)
+	for i := 0; i < 4; i++ {
+		w.Write(fd, make([]byte, 4<<20), done)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		io.Copy(ioutil.Discard, conn)
+	}()
+	start := time.Now()
+	completed, aborted, err := w.CloseWait(10 * time.Second)
+	if err != nil || completed != 4 || aborted != 0 || time.Since(start) > 5*time.Second {
+		t.Fatal(completed, aborted, err)
+	}
+	if w.Err() != ErrWatcherClosed {
+		t.Fatal(w.Err())
+	}
+	for i := 0; i < 4; i++ {
+		if res := <-done; res.Err != nil {
+			t.Fatal(res.Err)
+		}
+	}
+
+	// a read never completes and fails at the timeout, new requests are
+	// rejected meanwhile
+	w, err = CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd2, conn2 := tcpPair(t, w)
+	defer conn2.Close()
+	w.Read(fd2, make([]byte, 1), done)
+	w.Write(fd2, []byte("hello"), done)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		if err := w.Read(fd2, make([]byte, 1), done); err != ErrWatcherClosed {
+			t.Error(err)
+		}
+	}()
+	// the write may complete before the call, the failed read doesn't
+	// extend the wait past the timeout
+	start = time.Now()
+	completed, aborted, err = w.CloseWait(100 * time.Millisecond)
+	if err != nil || completed > 1 || aborted != 1 {
+		t.Fatal(completed, aborted, err)
+	}
+	if elapsed := time.Since(start); elapsed >= 200*time.Millisecond {
+		t.Fatal("wait not bounded by the timeout", elapsed)
+	}
+	for i := 0; i < 2; i++ {
+		if res := <-done; res.Operation == OpRead && !errors.Is(res.Err, ErrWatcherClosed) || res.Operation == OpWrite && res.Err != nil {
+			t.Fatal(res)
+		}
+	}
+}
+
+func TestCloseWaitConcurrent(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan OpResult, 16)
+	for i := 0; i < 4; i++ {
+		fd, conn := tcpPair(t, w)
+		defer conn.Close()
+		w.Read(fd, make([]byte, 1), done)
+	}
+
+	// a Close during the wait ends it and fails the reads, once
+	var wg sync.WaitGroup
+	var total int64
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, aborted, _ := w.CloseWait(10 * time.Second)
+			atomic.AddInt64(&total, int64(aborted))
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	w.Close()
+	wg.Wait()
+	if total != 4*3 {
+		t.Fatal("aborted", total)
+	}
+	for i := 0; i < 4; i++ {
+		if res := <-done; !errors.Is(res.Err, ErrWatcherClosed) {
+			t.Fatal(res)
+		}
+	}
+	if len(done) != 0 {
+		t.Fatal("ended twice")
+	}
+}
+
+func TestErrorSink(t *testing.T) {
+	sink := make(chan OpResult, 16)
+	w, err := CreateWatcher(WithErrorSink(func(res OpResult) { sink <- res }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// writes without a done channel to a closed peer fail once it resets
+	fd, conn := tcpPair(t, w)
+	conn.Close()
+	for i := 0; ; i++ {
+		if err := w.Write(fd, []byte("hello"), nil); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case res := <-sink:
+			if res.Fd != fd || res.Operation != OpWrite || !errors.Is(res.Err, ErrConnClosed) {
+				t.Fatal(res)
+			}
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+		if i == 100 {
+			t.Fatal("no error reported")
+		}
+	}
+}
+
+func TestPending(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	done := make(chan OpResult, 16)
+	start := time.Now()
+	deadline := start.Add(time.Hour)
+	w.ReadTimeout(fd, make([]byte, 10), done, deadline)
+	w.Read(fd, nil, done)
+	// the peer doesn't read, so the first write stops partially written
+	const size = 64 << 20
+	w.Write(fd, make([]byte, size), done)
+	w.Write(fd, make([]byte, 100), done)
+
+	// the writes are tried after the batch of submissions
+	var ops []PendingOp
+	for i := 0; i < 100; i++ {
+		if ops, err = w.Pending(fd); err != nil {
+			t.Fatal(err)
+		} else if len(ops) != 4 || ops[2].Done > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(ops) != 4 {
+		t.Fatal(ops)
+	}
+	for i, want := range []PendingOp{
+		{Operation: OpRead, Len: 10, Deadline: deadline},
+		{Operation: OpRead},
+		{Operation: OpWrite, Len: size},
+		{Operation: OpWrite, Len: 100},
+	} {
+		op := ops[i]
+		if op.Operation != want.Operation || op.Len != want.Len || !op.Deadline.Equal(want.Deadline) || op.Queued.Before(start) || op.Queued.After(time.Now()) {
+			t.Fatal(i, op)
+		}
+	}
+	if ops[2].Done == 0 || ops[2].Done >= size || ops[3].Done != 0 {
+		t.Fatal("progress", ops[2].Done, ops[3].Done)
+	}
+
+	if _, err := w.Pending(fd + 1000); err != ErrNotWatched {
+		t.Fatal(err)
+	}
+	w.StopWatch(fd)
+	if _, err := w.Pending(fd); err != ErrNotWatched {
+		t.Fatal(err)
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	// the kinds
+	for err, kind := range map[error]error{
+		ErrKeepAliveTimeout:    ErrConnClosed,
+		ErrDraining:            ErrCanceled,
+		ErrExported:            ErrCanceled,
+		ErrUnsupportedAddr:     ErrUnsupported,
+		ErrKTLSUnsupported:     ErrUnsupported,
+		ErrUnsupportedCipher:   ErrUnsupported,
+		ErrBusyPollUnsupported: ErrUnsupported,
+	} {
+		if !errors.Is(err, kind) || !errors.Is(fmt.Errorf("wrapped: %w", err), kind) || !errors.Is(err, err) {
+			t.Fatal(err, kind)
+		}
+	}
+
+	w, err := CreateWatcher(WithMaxPending(2, 0), WithMaxConns(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	done := make(chan OpResult, 16)
+
+	// ErrNoRawConn
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	if _, err := w.Watch(p1); err != ErrNoRawConn {
+		t.Fatal(err)
+	}
+
+	// ErrAlreadyWatched and ErrMaxConns
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	if _, err := w.WatchFd(fd); err != ErrAlreadyWatched {
+		t.Fatal(err)
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+	if _, err := w.WatchFd(fds[0]); err != ErrMaxConns {
+		t.Fatal(err)
+	}
+
+	// ErrDeadline
+	w.ReadTimeout(fd, make([]byte, 1), done, time.Now().Add(10*time.Millisecond))
+	if res := <-done; !errors.Is(res.Err, ErrDeadline) {
+		t.Fatal(res.Err)
+	}
+
+	// ErrMaxPending
+	w.Read(fd, make([]byte, 1), done)
+	w.Read(fd, make([]byte, 1), done)
+	if err := w.Read(fd, make([]byte, 1), done); err != ErrMaxPending {
+		t.Fatal(err)
+	}
+
+	// ErrUnsupported
+	if err := w.WriteTo(fd, []byte("x"), &net.IPNet{}, done); !errors.Is(err, ErrUnsupported) {
+		t.Fatal(err)
+	}
+
+	// ErrCanceled, the reads end by Drain of a second watcher
+	w2, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd2, conn2 := tcpPair(t, w2)
+	defer conn2.Close()
+	w2.Read(fd2, make([]byte, 1), done)
+	if err := w2.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if res := <-done; !errors.Is(res.Err, ErrCanceled) || !errors.Is(res.Err, ErrDraining) {
+		t.Fatal(res.Err)
+	}
+
+	// ErrConnClosed, matching the errno too
+	conn.Close()
+	w.StopWatch(fd)
+	for atomic.LoadInt64(&w.pending) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// the reads may have completed with EOF
+	for len(done) > 0 {
+		<-done
+	}
+	fd, conn = tcpPair(t, w)
+	conn.Close()
+	for {
+		if err := w.Write(fd, []byte("hello"), done); err != nil {
+			t.Fatal(err)
+		}
+		if res := <-done; res.Err != nil {
+			if !errors.Is(res.Err, ErrConnClosed) || (!errors.Is(res.Err, syscall.EPIPE) && !errors.Is(res.Err, syscall.ECONNRESET)) {
+				t.Fatal(res.Err)
+			}
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// ErrNotWatched
+	w.StopWatch(fd)
+	if _, err := w.ConnStats(fd); err != ErrNotWatched {
+		t.Fatal(err)
+	}
+	if err := w.Write(fd, []byte("x"), done); err != nil {
+		t.Fatal(err)
+	}
+	if res := <-done; !errors.Is(res.Err, ErrNotWatched) {
+		t.Fatal(res.Err)
+	}
+
+	// ErrWatcherClosed
+	w.Close()
+	if err := w.Read(fd, nil, done); err != ErrWatcherClosed {
+		t.Fatal(err)
+	}
+}
+
+func TestOpError(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	done := make(chan OpResult, 1)
+
+	// a read reset by the peer
+	fd, conn := tcpPair(t, w)
+	w.Read(fd, make([]byte, 10), done)
+	conn.(*net.TCPConn).SetLinger(0)
+	peer := conn.LocalAddr().String()
+	conn.Close()
+	res := <-done
+	var oe *OpError
+	if !errors.As(res.Err, &oe) {
+		t.Fatal(res.Err)
+	}
+	if oe.Op != OpRead || oe.Fd != fd || oe.RemoteAddr == nil || oe.RemoteAddr.String() != peer || oe.BytesDone != 0 {
+		t.Fatal("incorrect context:", oe)
+	}
+	if !errors.Is(res.Err, syscall.ECONNRESET) || !errors.Is(res.Err, ErrConnClosed) || !strings.Contains(res.Err.Error(), peer) {
+		t.Fatal(res.Err)
+	}
+
+	// a write timed out after some bytes
+	fd, conn = tcpPair(t, w)
+	defer conn.Close()
+	w.WriteTimeout(fd, make([]byte, 64<<20), done, time.Now().Add(50*time.Millisecond))
+	res = <-done
+	if !errors.As(res.Err, &oe) {
+		t.Fatal(res.Err)
+	}
+	if oe.Op != OpWrite || oe.Fd != fd || oe.RemoteAddr.String() != conn.LocalAddr().String() || oe.BytesDone == 0 || oe.BytesDone != res.Size {
+		t.Fatal("incorrect context:", oe)
+	}
+	if !errors.Is(res.Err, ErrDeadline) || !strings.Contains(res.Err.Error(), fmt.Sprintf("after %v bytes", res.Size)) {
+		t.Fatal(res.Err)
+	}
+}
+
+func TestErrorConditions(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	done := make(chan OpResult, 1)
+
+	// a reset connection, the peer is gone
+	fd, conn := tcpPair(t, w)
+	w.Read(fd, make([]byte, 10), done)
+	conn.(*net.TCPConn).SetLinger(0)
+	conn.Close()
+	if res := <-done; !errors.Is(res.Err, ErrPeerGone) || !errors.Is(res.Err, ErrConnClosed) || errors.Is(res.Err, ErrTransient) {
+		t.Fatal(res.Err)
+	}
+
+	// a refused connection, the peer is gone but no connection closed
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	fd, err = w.Dial("tcp", addr, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := <-done; !errors.Is(res.Err, ErrPeerGone) || errors.Is(res.Err, ErrConnClosed) || !errors.Is(res.Err, syscall.ECONNREFUSED) {
+		t.Fatal(res.Err)
+	}
+	w.StopWatch(fd)
+	syscall.Close(fd)
+
+	// a datagram too large, an invalid request
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	fd, err = w.Watch(uc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteTo(fd, make([]byte, 70000), uc.LocalAddr(), done)
+	if res := <-done; !errors.Is(res.Err, ErrInvalid) || !errors.Is(res.Err, syscall.EMSGSIZE) {
+		t.Fatal(res.Err)
+	}
+
+	// injected errnos of each condition
+	for errno, want := range map[syscall.Errno]error{
+		syscall.ETIMEDOUT: ErrPeerGone,
+		syscall.ENOBUFS:   ErrTransient,
+		syscall.ENOMEM:    ErrTransient,
+		syscall.EBADF:     ErrInvalid,
+		syscall.EINVAL:    ErrInvalid,
+		syscall.ENOTSOCK:  ErrInvalid,
+	} {
+		err := w.opError(&OpResult{Operation: OpWrite, Fd: fd, Err: errno})
+		var oe *OpError
+		if !errors.Is(err, want) || !errors.Is(err, errno) || !errors.As(err, &oe) || err.Error() == "" {
+			t.Fatal(errno, err)
+		}
+		for _, other := range []error{ErrPeerGone, ErrTransient, ErrInvalid, ErrUnsupported} {
+			if other != want && errors.Is(err, other) {
+				t.Fatal(errno, "matches", other)
+			}
+		}
+	}
+	if err := w.opError(&OpResult{Err: syscall.EIO}); errors.Is(err, ErrPeerGone) || errors.Is(err, ErrTransient) || errors.Is(err, ErrInvalid) || !errors.Is(err, syscall.EIO) {
+		t.Fatal(err)
+	}
+	if !errors.Is(ErrKeepAliveTimeout, ErrPeerGone) {
+		t.Fatal("keepalive timeout")
+	}
+}
+
+func TestDeadlineExceeded(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	// the peer neither writes nor reads
+	done := make(chan OpResult, 1)
+	w.ReadTimeout(fd, make([]byte, 1), done, time.Now().Add(20*time.Millisecond))
+	read := <-done
+	w.WriteTimeout(fd, make([]byte, 64<<20), done, time.Now().Add(20*time.Millisecond))
+	write := <-done
+
+	for _, err := range []error{ErrDeadline, read.Err, write.Err} {
+		if !errors.Is(err, os.ErrDeadlineExceeded) || !errors.Is(err, ErrDeadline) {
+			t.Fatal("not a deadline:", err)
+		}
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() || ne.Temporary() {
+			t.Fatal("not a timeout:", err)
+		}
+	}
+
+	// other errors are no timeouts
+	if ne := error(&OpError{Err: ErrConnClosed}).(net.Error); ne.Timeout() {
+		t.Fatal("timeout:", ne)
+	}
+}
+
+func TestContext(t *testing.T) {
+	rec := newClosedRecorder()
+	w, err := CreateWatcher(WithOnClosed(rec.onClosed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	rec2 := newClosedRecorder()
+	w2, err := CreateWatcher(WithOnClosed(rec2.onClosed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w2.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	if _, ok := w.Context(fd); ok {
+		t.Fatal("context before SetContext")
+	}
+	if err := w.SetContext(fd, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := w.Context(fd); !ok || v != "a" {
+		t.Fatal("incorrect context:", v, ok)
+	}
+	if err := w.SetContext(-1, "a"); err != ErrNotWatched {
+		t.Fatal("context of an unwatched fd:", err)
+	}
+
+	// the context moves along with fd
+	if err := w.Migrate(fd, w2); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := w.Context(fd); ok {
+		t.Fatal("context left behind")
+	}
+	if v, ok := w2.Context(fd); !ok || v != "a" {
+		t.Fatal("incorrect migrated context:", v, ok)
+	}
+
+	// it's passed to OnClosed and cleared by StopWatch, while accessed
+	// concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if w2.SetContext(fd, i) != nil {
+					return
+				}
+				w2.Context(fd)
+			}
+		}(i)
+	}
+	w2.StopWatch(fd)
+	wg.Wait()
+	rec2.wait(t, nil, fd)
+	if _, ok := w2.Context(fd); ok {
+		t.Fatal("context not cleared")
+	}
+	if err := w2.SetContext(fd, "b"); err != ErrNotWatched {
+		t.Fatal("context of a stopped fd:", err)
+	}
+	rec2.mu.Lock()
+	ctx := rec2.ctxs[fd]
+	rec2.mu.Unlock()
+	if ctx != "a" && ctx != 0 && ctx != 1 && ctx != 2 && ctx != 3 {
+		t.Fatal("incorrect context closed:", ctx)
+	}
+
+	// and by Close
+	fd2, conn2 := tcpPair(t, w)
+	defer conn2.Close()
+	w.SetContext(fd2, "c")
+	w.Close()
+	rec.wait(t, ErrWatcherClosed, fd2)
+	if _, ok := w.Context(fd2); ok {
+		t.Fatal("context not cleared")
+	}
+	rec.mu.Lock()
+	ctx = rec.ctxs[fd2]
+	rec.mu.Unlock()
+	if ctx != "c" {
+		t.Fatal("incorrect context closed:", ctx)
+	}
+}
+
+func TestSetBuffer(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	if err := w.SetBuffer(-1, make([]byte, 8)); err != ErrNotWatched {
+		t.Fatal("buffer of an unwatched fd:", err)
+	}
+
+	// reads with a nil buffer read into it, it's replaced once they're
+	// done
+	buf1, buf2 := make([]byte, 8), make([]byte, 16)
+	if err := w.SetBuffer(fd, buf1); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan OpResult, 1)
+	w.Read(fd, nil, done)
+	if err := w.SetBuffer(fd, buf2); err != ErrBufferBusy {
+		t.Fatal("buffer replaced during a read:", err)
+	}
+	conn.Write([]byte("hello"))
+	res := <-done
+	if res.Err != nil || string(res.Buffer[:res.Size]) != "hello" || &res.Buffer[0] != &buf1[0] {
+		t.Fatal("incorrect read:", res.Err, string(res.Buffer[:res.Size]))
+	}
+	res.Release()
+	if err := w.SetBuffer(fd, buf2); err != nil {
+		t.Fatal(err)
+	}
+	w.Read(fd, nil, done)
+	conn.Write([]byte("world"))
+	if res := <-done; res.Err != nil || string(res.Buffer[:res.Size]) != "world" || &res.Buffer[0] != &buf2[0] {
+		t.Fatal("incorrect read:", res.Err, string(res.Buffer[:res.Size]))
+	}
+
+	// reads into buffers of their own don't hold it
+	w.Read(fd, make([]byte, 8), done)
+	if err := w.SetBuffer(fd, nil); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("x"))
+	<-done
+
+	// the pool is restored
+	w.Read(fd, nil, done)
+	conn.Write([]byte("y"))
+	if res := <-done; res.Err != nil || res.Size != 1 || &res.Buffer[0] == &buf2[0] {
+		t.Fatal("incorrect read:", res.Err, res.Size)
+	}
+
+	// StopWatch releases it
+	w.SetBuffer(fd, buf1)
+	w.Read(fd, nil, done)
+	w.StopWatch(fd)
+	if err := w.SetBuffer(fd, buf2); err != ErrNotWatched {
+		t.Fatal("buffer of a stopped fd:", err)
+	}
+}
+
+// fault is injected in a syscall by faultSyscalls
+type fault struct {
+	err   error         // returned instead of making the syscall
+	short int           // bytes transferred at most by a read or write
+	delay time.Duration // before the syscall
+}
+
+// faultSyscalls injects faults in the syscalls of a watcher, see
+// withSyscalls. The faults of a syscall apply to its next calls in order.
+type faultSyscalls struct {
+	sysCalls
+	mu     sync.Mutex
+	faults map[string][]fault
+	calls  map[string]int
+}
+
+func newFaultSyscalls() *faultSyscalls {
+	return &faultSyscalls{sysCalls: rawSyscalls{}, faults: make(map[string][]fault), calls: make(map[string]int)}
+}
+
+func (f *faultSyscalls) inject(call string, faults ...fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults[call] = append(f.faults[call], faults...)
+}
+
+// injected returns the number of faults of call consumed
+func (f *faultSyscalls) injected(call string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[call]
+}
+
+// next consumes the next fault of call, after its delay
+func (f *faultSyscalls) next(call string) fault {
+	f.mu.Lock()
+	var ft fault
+	if q := f.faults[call]; len(q) > 0 {
+		ft, f.faults[call] = q[0], q[1:]
+		f.calls[call]++
+	}
+	f.mu.Unlock()
+	time.Sleep(ft.delay)
+	return ft
+}
+
+func (ft fault) limit(p []byte) []byte {
+	if ft.short > 0 && len(p) > ft.short {
+		return p[:ft.short]
+	}
+	return p
+}
+
+func (f *faultSyscalls) Read(fd int, p []byte) (int, error) {
+	ft := f.next("read")
+	if ft.err != nil {
+		return -1, ft.err
+	}
+	return f.sysCalls.Read(fd, ft.limit(p))
+}
+
+func (f *faultSyscalls) Write(fd int, p []byte) (int, error) {
+	ft := f.next("write")
+	if ft.err != nil {
+		return -1, ft.err
+	}
+	return f.sysCalls.Write(fd, ft.limit(p))
+}
+
+func (f *faultSyscalls) Writev(fd int, iovs []unix.Iovec) (int, error) {
+	if ft := f.next("writev"); ft.err != nil {
+		return 0, ft.err
+	}
+	return f.sysCalls.Writev(fd, iovs)
+}
+
+func (f *faultSyscalls) Sendmsg(fd int, p, oob []byte, to unix.Sockaddr, flags int) (int, error) {
+	if ft := f.next("sendmsg"); ft.err != nil {
+		return 0, ft.err
+	}
+	return f.sysCalls.Sendmsg(fd, p, oob, to, flags)
+}
+
+func (f *faultSyscalls) Connect(fd int, sa unix.Sockaddr) error {
+	if ft := f.next("connect"); ft.err != nil {
+		return ft.err
+	}
+	return f.sysCalls.Connect(fd, sa)
+}
+
+func TestFaultRead(t *testing.T) {
+	fs := newFaultSyscalls()
+	w, err := CreateWatcher(withSyscalls(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	done := make(chan OpResult, 1)
+	read := func(want string) {
+		t.Helper()
+		w.Read(fd, make([]byte, 8), done)
+		if res := <-done; res.Err != nil || string(res.Buffer[:res.Size]) != want {
+			t.Fatal("incorrect read:", res.Err, string(res.Buffer[:res.Size]))
+		}
+	}
+
+	// short reads leave the rest for the next reads
+	fs.inject("read", fault{short: 2}, fault{short: 2})
+	conn.Write([]byte("hello"))
+	read("he")
+	read("ll")
+	read("o")
+
+	// a read without data waits for the next readiness
+	fs.inject("read", fault{err: syscall.EAGAIN})
+	w.Read(fd, make([]byte, 8), done)
+	select {
+	case res := <-done:
+		t.Fatal("read completed without data:", res.Err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	conn.Write([]byte("x"))
+	if res := <-done; res.Err != nil || string(res.Buffer[:res.Size]) != "x" {
+		t.Fatal("incorrect read:", res.Err)
+	}
+
+	// errors are classified, and the reads after them go on
+	fs.inject("read", fault{err: syscall.ECONNRESET}, fault{err: syscall.ENOMEM})
+	for _, kind := range []error{ErrConnClosed, ErrTransient} {
+		w.Read(fd, make([]byte, 8), done)
+		res := <-done
+		var oe *OpError
+		if !errors.Is(res.Err, kind) || !errors.As(res.Err, &oe) || oe.Op != OpRead || oe.Fd != fd {
+			t.Fatal("incorrect error:", res.Err)
+		}
+	}
+	conn.Write([]byte("y"))
+	read("y")
+}
+
+func TestFaultWrite(t *testing.T) {
+	fs := newFaultSyscalls()
+	w, err := CreateWatcher(WithShards(1), withSyscalls(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	done := make(chan OpResult, 3)
+
+	// a failed write leaves the fd usable
+	fs.inject("write", fault{err: syscall.ENOBUFS}, fault{delay: 20 * time.Millisecond})
+	w.Write(fd, []byte("a"), done)
+	if res := <-done; !errors.Is(res.Err, ErrTransient) || res.Size != 0 {
+		t.Fatal("incorrect error:", res.Err, res.Size)
+	}
+	start := time.Now()
+	w.Write(fd, []byte("b"), done)
+	if res := <-done; res.Err != nil || res.Size != 1 {
+		t.Fatal("incorrect write:", res.Err)
+	} else if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatal("write not delayed:", elapsed)
+	}
+
+	// a failed writev fails the first write only, the others are written
+	// by the next one
+	fs.inject("writev", fault{err: syscall.EPIPE})
+	release := holdLoop(t, w)
+	for _, s := range []string{"c", "d", "e"} {
+		w.Write(fd, []byte(s), done)
+	}
+	release()
+	if res := <-done; !errors.Is(res.Err, ErrConnClosed) || !errors.Is(res.Err, syscall.EPIPE) {
+		t.Fatal("incorrect error:", res.Err)
+	}
+	for i := 0; i < 2; i++ {
+		if res := <-done; res.Err != nil {
+			t.Fatal(res.Err)
+		}
+	}
+	if n := fs.injected("writev"); n != 1 {
+		t.Fatal("writev not injected:", n)
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "bde" {
+		t.Fatal("incorrect data:", err, string(buf))
+	}
+}
+
+func TestFaultConnect(t *testing.T) {
+	fs := newFaultSyscalls()
+	w, err := CreateWatcher(withSyscalls(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	fs.inject("connect", fault{err: syscall.ECONNREFUSED})
+	done := make(chan OpResult, 1)
+	fd, err := w.Dial("tcp", ln.Addr().String(), done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fd)
+	defer w.StopWatch(fd)
+	if res := <-done; !errors.Is(res.Err, ErrPeerGone) || !errors.Is(res.Err, syscall.ECONNREFUSED) {
+		t.Fatal("incorrect error:", res.Err)
+	}
+}
+
+func TestFaultSendmsg(t *testing.T) {
+	fs := newFaultSyscalls()
+	w, err := CreateWatcher(withSyscalls(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fd, err := w.Watch(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the datagrams of WriteTo are sent by sendmsg
+	fs.inject("sendmsg", fault{err: syscall.EMSGSIZE})
+	done := make(chan OpResult, 1)
+	w.WriteTo(fd, []byte("a"), conn.LocalAddr(), done)
+	if res := <-done; !errors.Is(res.Err, syscall.EMSGSIZE) {
+		t.Fatal("incorrect error:", res.Err)
+	}
+	w.WriteTo(fd, []byte("b"), conn.LocalAddr(), done)
+	if res := <-done; res.Err != nil || res.Size != 1 {
+		t.Fatal("incorrect write:", res.Err)
+	}
+	if n := fs.injected("sendmsg"); n != 1 {
+		t.Fatal("sendmsg not injected:", n)
+	}
+}
+
+// stepUntil runs the rounds of w, created with withManualStep, until cond
+// holds
+func stepUntil(t *testing.T, w *Watcher, cond func() bool) {
+	t.Helper()
+	for i := 0; !cond(); i++ {
+		if i == 1000 {
+			t.Fatal("condition not reached")
+		}
+		if err := w.step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStepReadTimeout(t *testing.T) {
+	w, err := CreateWatcher(withManualStep())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	// an expired request leaves the requests around it in order
+	done := make(chan OpResult, 4)
+	w.Read(fd, make([]byte, 1), done)
+	w.ReadTimeout(fd, make([]byte, 1), done, time.Now())
+	w.Read(fd, make([]byte, 1), done)
+	if err := w.step(); err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 1 {
+		t.Fatal("incorrect results:", len(done))
+	} else if res := <-done; !errors.Is(res.Err, ErrDeadline) {
+		t.Fatal("deadline not enforced:", res.Err)
+	}
+	conn.Write([]byte("ab"))
+	stepUntil(t, w, func() bool { return len(done) == 2 })
+	for _, want := range "ab" {
+		if res := <-done; res.Err != nil || string(res.Buffer[:res.Size]) != string(want) {
+			t.Fatal("incorrect read:", res.Err, string(res.Buffer[:res.Size]))
+		}
+	}
+}
+
+func TestStepStopWatch(t *testing.T) {
+	rec := newClosedRecorder()
+	w, err := CreateWatcher(WithOnClosed(rec.onClosed), withManualStep())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	// a read queued on the fd is dropped by StopWatch even with its data
+	// arrived before the loop handled the StopWatch
+	done := make(chan OpResult, 2)
+	w.Read(fd, make([]byte, 8), done)
+	w.step()
+	conn.Write([]byte("x"))
+	w.StopWatch(fd)
+	w.step()
+	if len(done) != 0 || atomic.LoadInt64(&w.pending) != 0 {
+		t.Fatal("read not dropped:", len(done), w.pending)
+	}
+	rec.wait(t, nil, fd)
+
+	// one submitted after StopWatch fails
+	w.Read(fd, make([]byte, 8), done)
+	w.step()
+	if res := <-done; !errors.Is(res.Err, ErrNotWatched) {
+		t.Fatal("read of a stopped fd:", res.Err)
+	}
+}
+
+func TestStepClose(t *testing.T) {
+	rec := newClosedRecorder()
+	w, err := CreateWatcher(WithOnClosed(rec.onClosed), withManualStep())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Close ends the fds and their requests without a loop
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	done := make(chan OpResult, 1)
+	w.Read(fd, make([]byte, 8), done)
+	w.step()
+	w.Close()
+	rec.wait(t, ErrWatcherClosed, fd)
+	if err := w.step(); err != ErrWatcherClosed {
+		t.Fatal("step of a closed watcher:", err)
+	}
+	if len(done) != 0 || atomic.LoadInt64(&w.pending) != 0 {
+		t.Fatal("read not dropped:", len(done), w.pending)
+	}
+}
+
+func TestAsyncConn(t *testing.T)            { testAsyncConn(t) }
+func TestAsyncConnCopyBuffers(t *testing.T) { testAsyncConn(t, WithCopyBuffers()) }
+
+func testAsyncConn(t *testing.T, opts ...Option) {
+	w, err := CreateWatcher(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, raw := tcpPair(t, w)
+	peer, err := w.Watch(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := w.NewAsyncConn(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc, err := w.NewAsyncConn(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.NewAsyncConn(-1); err != ErrNotWatched {
+		t.Fatal("async conn of an unwatched fd:", err)
+	}
+
+	server := tls.Server(sc, &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}})
+	client := tls.Client(cc, &tls.Config{InsecureSkipVerify: true})
+	defer client.Close()
+	defer server.Close()
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// data both ways
+	for i := 0; i < 10; i++ {
+		tx := make([]byte, 1024*i+1)
+		io.ReadFull(rand.Reader, tx)
+		errs := make(chan error, 1)
+		go func() {
+			_, err := client.Write(tx)
+			errs <- err
+		}()
+
+		rx := make([]byte, len(tx))
+		if _, err := io.ReadFull(server, rx); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			_, err := server.Write(rx)
+			errs <- err
+		}()
+
+		echo := make([]byte, len(tx))
+		if _, err := io.ReadFull(client, echo); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tx, echo) {
+			t.Fatal("incorrect echo")
+		}
+	}
+
+	// a read past its deadline times out
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = client.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatal("incorrect read past deadline:", err)
+	}
+
+	// closing a conn ends its pending read
+	errs := make(chan error, 1)
+	go func() {
+		_, err := sc.Read(make([]byte, 1))
+		errs <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	sc.Close()
+	if err := <-errs; err != ErrAsyncConnClosed {
+		t.Fatal("incorrect read of a closed conn:", err)
+	}
+	if err := sc.Close(); err != ErrAsyncConnClosed {
+		t.Fatal("conn closed twice:", err)
+	}
+}
+
+func TestListenerHTTP(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gln := NewListener(w, ln)
+	if gln.Addr() != ln.Addr() {
+		t.Fatal("incorrect address:", gln.Addr())
+	}
+
+	accepted := make(chan net.Conn, 2)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			fmt.Fprintf(rw, "%s %s", r.URL.Path, body)
+		}),
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				accepted <- conn
+			}
+		},
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(gln) }()
+
+	// requests on a kept alive connection
+	client := &http.Client{Timeout: 5 * time.Second}
+	for _, path := range []string{"/a", "/b"} {
+		resp, err := client.Post("http://"+ln.Addr().String()+path, "text/plain", strings.NewReader("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(body) != path+" hello" {
+			t.Fatal("incorrect response:", err, string(body))
+		}
+	}
+	if _, ok := (<-accepted).(*AsyncConn); !ok || len(accepted) != 0 {
+		t.Fatal("incorrect accepted connections:", len(accepted)+1)
+	}
+
+	srv.Close()
+	if err := <-served; err != http.ErrServerClosed {
+		t.Fatal(err)
+	}
+}
+
+// eventEchoServer is echoServer on an EventServer, configured by setup
+func eventEchoServer(t testing.TB, setup func(s *EventServer), opts ...Option) (*EventServer, net.Listener) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewEventServer(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.OnData = func(h Handle, data []byte) []byte { return data }
+	if setup != nil {
+		setup(s)
+	}
+	go s.Serve(ln)
+	return s, ln
+}
+
+func TestEventServerEcho(t *testing.T) { testEventServerEcho(t) }
+func TestEventServerEchoCopyBuffers(t *testing.T) {
+	testEventServerEcho(t, WithCopyBuffers())
+}
+
+func testEventServerEcho(t *testing.T, opts ...Option) {
+	s, ln := eventEchoServer(t, nil, append(opts, WithShards(2), WithReadBufferSize(512, 4096))...)
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+
+			tx := make([]byte, 64*1024)
+			io.ReadFull(rand.Reader, tx)
+			go conn.Write(tx)
+
+			rx := make([]byte, len(tx))
+			if _, err := io.ReadFull(conn, rx); err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(tx, rx) {
+				t.Error("incorrect receiving")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestEventServerPanic(t *testing.T) {
+	closed := make(chan error, 2)
+	s, ln := eventEchoServer(t, func(s *EventServer) {
+		s.OnClose = func(h Handle, err error) { closed <- err }
+		s.OnData = func(h Handle, data []byte) []byte {
+			if string(data) == "panic" {
+				panic("boom")
+			}
+			return data
+		}
+	})
+	defer s.Close()
+
+	bad, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	good, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer good.Close()
+
+	// the panic closes its connection only
+	bad.Write([]byte("panic"))
+	var pe *PanicError
+	if err := <-closed; !errors.As(err, &pe) || pe.Where != "OnData" || pe.Value != "boom" {
+		t.Fatal("incorrect close of a panic:", err)
+	}
+	bad.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := bad.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("connection of a panic not closed:", err)
+	}
+	good.Write([]byte("hello"))
+	rx := make([]byte, 5)
+	if _, err := io.ReadFull(good, rx); err != nil || string(rx) != "hello" {
+		t.Fatal("incorrect echo:", err, string(rx))
+	}
+
+	// a connection closed by the peer closes without an error
+	good.Close()
+	if err := <-closed; err != nil {
+		t.Fatal("incorrect close by the peer:", err)
+	}
+}
+
+func TestEventServerSlowHandler(t *testing.T) {
+	release := make(chan struct{})
+	s, ln := eventEchoServer(t, func(s *EventServer) {
+		s.Handlers = 1024
+		s.OnData = func(h Handle, data []byte) []byte {
+			if string(data) == "slow" {
+				<-release
+			}
+			return data
+		}
+	})
+	defer s.Close()
+
+	slow, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	fast, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+
+	// a blocked handler doesn't hold the other connections back
+	slow.Write([]byte("slow"))
+	time.Sleep(20 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		fast.Write([]byte("fast"))
+		rx := make([]byte, 4)
+		fast.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(fast, rx); err != nil || string(rx) != "fast" {
+			t.Fatal("incorrect echo behind a slow handler:", err, string(rx))
+		}
+	}
+	close(release)
+	rx := make([]byte, 4)
+	slow.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(slow, rx); err != nil || string(rx) != "slow" {
+		t.Fatal("incorrect echo of a slow handler:", err, string(rx))
+	}
+}
+
+// poolServer accepts the connections of a Pool, and returns them on accepted
+func poolServer(t *testing.T) (net.Listener, chan net.Conn) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	return ln, accepted
+}
+
+func TestPool(t *testing.T)            { testPool(t) }
+func TestPoolCopyBuffers(t *testing.T) { testPool(t, WithCopyBuffers()) }
+
+func testPool(t *testing.T, opts ...Option) {
+	w, err := CreateWatcher(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	ln, accepted := poolServer(t)
+	defer ln.Close()
+
+	p := NewPool(w, "tcp", ln.Addr().String(), 2, 0)
+	defer p.Close()
+	done := make(chan ConnResult, 4)
+
+	// the pool dials up to its size, the checkouts past it wait
+	for i := 0; i < 3; i++ {
+		if err := p.Get(done); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b := <-done, <-done
+	if a.Err != nil || b.Err != nil || a.Fd == b.Fd {
+		t.Fatal("incorrect checkouts:", a, b)
+	}
+	select {
+	case res := <-done:
+		t.Fatal("checkout of an exhausted pool:", res)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, total := p.Len(); total != 2 {
+		t.Fatal("incorrect pool size:", total)
+	}
+
+	// a connection put back goes to the checkout waiting
+	p.Put(a.Fd)
+	if res := <-done; res.Err != nil || res.Fd != a.Fd {
+		t.Fatal("incorrect checkout of a waiter:", res)
+	}
+
+	// an idle connection is checked out with its health read canceled
+	p.Put(a.Fd)
+	p.Get(done)
+	if res := <-done; res.Err != nil || res.Fd != a.Fd {
+		t.Fatal("incorrect checkout of an idle connection:", res)
+	}
+	w.Write(a.Fd, []byte("ping"), nil)
+	server := []net.Conn{<-accepted, <-accepted}
+	rx := make([]byte, 4)
+	for _, conn := range server {
+		conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+		if n, _ := io.ReadFull(conn, rx); n == 4 {
+			break
+		}
+	}
+	if string(rx) != "ping" {
+		t.Fatal("incorrect write of a checkout:", string(rx))
+	}
+	p.Put(a.Fd)
+	p.Put(b.Fd)
+	if idle, _ := p.Len(); idle != 2 {
+		t.Fatal("incorrect idle connections:", idle)
+	}
+
+	// a connection broken while idle is closed, and replaced on demand
+	server[0].Close()
+	server[1].Close()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if _, total := p.Len(); total == 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("broken connections kept:", total)
+		}
+	}
+	p.Get(done)
+	if res := <-done; res.Err != nil {
+		t.Fatal("incorrect checkout of a replacement:", res)
+	} else {
+		p.Discard(res.Fd)
+	}
+
+	// the fd of a discarded connection is closed by the watcher
+	replacement := <-accepted
+	defer replacement.Close()
+	replacement.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := replacement.Read(rx); err != io.EOF {
+		t.Fatal("discarded connection not closed:", err)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	ln, accepted := poolServer(t)
+	defer ln.Close()
+
+	p := NewPool(w, "tcp", ln.Addr().String(), 1, 20*time.Millisecond)
+	defer p.Close()
+	done := make(chan ConnResult, 1)
+	p.Get(done)
+	res := <-done
+	if res.Err != nil {
+		t.Fatal(res.Err)
+	}
+	p.Put(res.Fd)
+
+	conn := <-accepted
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("idle connection not closed:", err)
+	}
+	if _, total := p.Len(); total != 0 {
+		t.Fatal("idle connection kept:", total)
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	ln, accepted := poolServer(t)
+	defer ln.Close()
+
+	// an idle connection closes with the pool
+	done := make(chan ConnResult, 2)
+	p := NewPool(w, "tcp", ln.Addr().String(), 1, 0)
+	p.Get(done)
+	p.Put((<-done).Fd)
+	conn := <-accepted
+	p.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("idle connection not closed:", err)
+	}
+
+	// the checkouts waiting fail, and the connections checked out close
+	// when they're put back
+	p = NewPool(w, "tcp", ln.Addr().String(), 1, 0)
+	p.Get(done)
+	p.Get(done)
+	busy := <-done
+	conn = <-accepted
+	p.Close()
+	if res := <-done; res.Err != ErrPoolClosed {
+		t.Fatal("incorrect checkout of a closed pool:", res)
+	}
+	if err := p.Get(done); err != ErrPoolClosed {
+		t.Fatal("checkout of a closed pool:", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); err == io.EOF {
+		t.Fatal("connection checked out closed")
+	}
+	p.Put(busy.Fd)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("connection put back not closed:", err)
+	}
+	if _, total := p.Len(); total != 0 {
+		t.Fatal("connections left:", total)
+	}
+}
+
+func TestPoolUnbuffered(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	ln, _ := poolServer(t)
+	defer ln.Close()
+
+	// the results for a done without room are queued in order, and sent
+	// after the pool is closed
+	p := NewPool(w, "tcp", ln.Addr().String(), 1, 0)
+	base := runtime.NumGoroutine()
+	done := make(chan ConnResult)
+	for i := 0; i < 3; i++ {
+		if err := p.Get(done); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	p.Close()
+	if n := runtime.NumGoroutine(); n > base {
+		t.Fatal("goroutines delivering the results", n-base)
+	}
+	if res := <-done; res.Err != nil {
+		t.Fatal("incorrect checkout:", res)
+	}
+	for i := 0; i < 2; i++ {
+		if res := <-done; res.Err != ErrPoolClosed {
+			t.Fatal("incorrect checkout of a closed pool:", res)
+		}
+	}
+}
+
+// relayPair relays two tcp pairs, and returns the peers of the relayed fds
+func relayPair(t *testing.T, w *Watcher, done chan RelayResult) (net.Conn, net.Conn) {
+	a, peerA := tcpPair(t, w)
+	b, peerB := tcpPair(t, w)
+	if err := w.Relay(a, b, 4096, done); err != nil {
+		t.Fatal(err)
+	}
+	return peerA, peerB
+}
+
+func TestRelay(t *testing.T)            { testRelay(t) }
+func TestRelayCopyBuffers(t *testing.T) { testRelay(t, WithCopyBuffers()) }
+
+func testRelay(t *testing.T, opts ...Option) {
+	w, err := CreateWatcher(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	done := make(chan RelayResult, 1)
+	peerA, peerB := relayPair(t, w, done)
+	defer peerA.Close()
+	defer peerB.Close()
+
+	// large transfers both ways at once
+	txA := make([]byte, 8*1024*1024)
+	txB := make([]byte, 6*1024*1024)
+	io.ReadFull(rand.Reader, txA)
+	io.ReadFull(rand.Reader, txB)
+	errs := make(chan error, 4)
+	for _, c := range []struct {
+		conn net.Conn
+		tx   []byte
+	}{{peerA, txA}, {peerB, txB}} {
+		c := c
+		go func() {
+			_, err := c.conn.Write(c.tx)
+			errs <- err
+		}()
+	}
+	var rxA, rxB []byte
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		rxB = make([]byte, len(txA))
+		_, err := io.ReadFull(peerB, rxB)
+		errs <- err
+	}()
+	go func() {
+		defer wg.Done()
+		rxA = make([]byte, len(txB))
+		_, err := io.ReadFull(peerA, rxA)
+		errs <- err
+	}()
+	wg.Wait()
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(rxB, txA) || !bytes.Equal(rxA, txB) {
+		t.Fatal("incorrect relay")
+	}
+
+	// a half-close reaches the other side, which goes on writing
+	peerA.(*net.TCPConn).CloseWrite()
+	peerB.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := peerB.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("half-close not relayed:", err)
+	}
+	peerB.Write([]byte("late"))
+	rx := make([]byte, 4)
+	if _, err := io.ReadFull(peerA, rx); err != nil || string(rx) != "late" {
+		t.Fatal("incorrect write after a half-close:", err, string(rx))
+	}
+	peerB.(*net.TCPConn).CloseWrite()
+	res := <-done
+	if res.Err != nil || res.AToB != int64(len(txA)) || res.BToA != int64(len(txB)+4) {
+		t.Fatal("incorrect relay result:", res)
+	}
+	if w.watched(res.A) || w.watched(res.B) {
+		t.Fatal("relayed fds still watched")
+	}
+}
+
+func TestRelayCloseOrder(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// the side closing first doesn't matter
+	for _, first := range []int{0, 1} {
+		done := make(chan RelayResult, 1)
+		peerA, peerB := relayPair(t, w, done)
+		peers := []net.Conn{peerA, peerB}
+		closer, other := peers[first], peers[1-first]
+
+		closer.Write([]byte("bye"))
+		closer.(*net.TCPConn).CloseWrite()
+		rx, err := ioutil.ReadAll(other)
+		if err != nil || string(rx) != "bye" {
+			t.Fatal("incorrect data before a half-close:", err, string(rx))
+		}
+		other.Write([]byte("ok"))
+		other.(*net.TCPConn).CloseWrite()
+		rx, err = ioutil.ReadAll(closer)
+		if err != nil || string(rx) != "ok" {
+			t.Fatal("incorrect data after a half-close:", err, string(rx))
+		}
+		res := <-done
+		sent := []int64{res.AToB, res.BToA}
+		if res.Err != nil || sent[first] != 3 || sent[1-first] != 2 {
+			t.Fatal("incorrect relay result:", res)
+		}
+		peerA.Close()
+		peerB.Close()
+	}
+
+	// a reset ends the relay with its error
+	done := make(chan RelayResult, 1)
+	peerA, peerB := relayPair(t, w, done)
+	defer peerB.Close()
+	peerA.(*net.TCPConn).SetLinger(0)
+	peerA.Close()
+	if res := <-done; res.Err == nil {
+		t.Fatal("reset not reported:", res)
+	}
+}
+
+func TestRelayIdle(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// the goroutines of the watcher routing the results are started by the
+	// first relay
+	done := make(chan RelayResult, 32)
+	peerA, peerB := relayPair(t, w, done)
+	defer peerA.Close()
+	defer peerB.Close()
+	base := runtime.NumGoroutine()
+
+	var peers []net.Conn
+	for i := 0; i < 20; i++ {
+		peerA, peerB := relayPair(t, w, done)
+		peers = append(peers, peerA, peerB)
+	}
+	if n := runtime.NumGoroutine(); n > base {
+		t.Fatal("goroutines held by idle relays", n-base)
+	}
+	for _, c := range peers {
+		c.Close()
+	}
+	for i := 0; i < 20; i++ {
+		<-done
+	}
+
+	// a fd relayed already is busy
+	a, _ := tcpPair(t, w)
+	b, _ := tcpPair(t, w)
+	if err := w.Relay(a, b, 0, done); err != nil {
+		t.Fatal(err)
+	}
+	c, _ := tcpPair(t, w)
+	if err := w.Relay(a, c, 0, done); err != ErrFdBusy {
+		t.Fatal("incorrect error:", err)
+	}
+}
+
+// flateCodec compresses each write in a frame of its length and its
+// deflated data
+type flateCodec struct {
+	pending []byte // wire data of a partial frame
+}
+
+func (c *flateCodec) Encode(dst, src []byte) ([]byte, error) {
+	var out bytes.Buffer
+	fw, _ := flate.NewWriter(&out, flate.BestSpeed)
+	fw.Write(src)
+	fw.Close()
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(out.Len()))
+	dst = append(dst, hdr[:]...)
+	return append(dst, out.Bytes()...), nil
+}
+
+func (c *flateCodec) Decode(dst, src []byte) ([]byte, error) {
+	c.pending = append(c.pending, src...)
+	for len(c.pending) >= 4 {
+		n := int(binary.BigEndian.Uint32(c.pending))
+		if len(c.pending) < 4+n {
+			break
+		}
+		data, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(c.pending[4 : 4+n])))
+		if err != nil {
+			return dst, err
+		}
+		dst = append(dst, data...)
+		c.pending = c.pending[4+n:]
+	}
+	return dst, nil
+}
+
+func TestCodec(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	server, conn := tcpPair(t, w)
+	defer conn.Close()
+	client, err := w.Watch(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fd := range []int{server, client} {
+		if err := w.SetCodec(fd, &flateCodec{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.SetCodec(-1, &flateCodec{}); err != ErrNotWatched {
+		t.Fatal("codec of an unwatched fd:", err)
+	}
+
+	// the echo server of the tests on the decoded data
+	echo := make(chan OpResult, 4)
+	go func() {
+		for res := range echo {
+			if res.Err != nil || (res.Operation == OpRead && res.Size == 0) {
+				return
+			}
+			if res.Operation == OpRead {
+				w.Write(res.Fd, res.Buffer[:res.Size], echo)
+			} else {
+				res.Release()
+				w.Read(res.Fd, nil, echo)
+			}
+		}
+	}()
+	w.Read(server, nil, echo)
+
+	// compressible data of sizes around the buffers, read into a small
+	// buffer so decoded data is left for the next reads
+	done := make(chan OpResult, 1)
+	var sent, wire int
+	for _, size := range []int{1, 100, 4096, 100000} {
+		tx := bytes.Repeat([]byte(fmt.Sprintf("%08d", size)), size/8+1)[:size]
+		if err := w.Write(client, tx, done); err != nil {
+			t.Fatal(err)
+		}
+		res := <-done
+		if res.Err != nil || res.Size != len(tx) || res.WireSize == 0 || !bytes.Equal(res.Buffer, tx) {
+			t.Fatal("incorrect encoded write:", res.Err, res.Size, res.WireSize)
+		}
+		sent, wire = sent+res.Size, wire+res.WireSize
+
+		rx := make([]byte, 0, size)
+		buf := make([]byte, 1000)
+		for len(rx) < size {
+			w.Read(client, buf, done)
+			res := <-done
+			if res.Err != nil || res.Size == 0 {
+				t.Fatal("incorrect decoded read:", res.Err, res.Size)
+			}
+			rx = append(rx, res.Buffer[:res.Size]...)
+		}
+		if !bytes.Equal(rx, tx) {
+			t.Fatal("incorrect echo of", size, "bytes")
+		}
+	}
+	if wire >= sent {
+		t.Fatal("data not compressed:", wire, sent)
+	}
+	st, err := w.ConnStats(client)
+	if err != nil || st.BytesOut != uint64(sent) || st.WireOut != uint64(wire) || st.BytesIn != uint64(sent) || st.WireIn >= st.BytesIn {
+		t.Fatal("incorrect stats:", err, st)
+	}
+}
+
+func TestWatchFileChild(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("sh", "-c", "for i in 1 2 3; do echo line $i; sleep 0.01; done")
+	cmd.Stdout = pw
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	pw.Close()
+	fd, err := w.WatchFile(pr, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the output is streamed until the child exits and the pipe reads EOF
+	var out []byte
+	done := make(chan OpResult, 1)
+	for {
+		if err := w.Read(fd, nil, done); err != nil {
+			t.Fatal(err)
+		}
+		res := <-done
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if res.Size == 0 {
+			break
+		}
+		out = append(out, res.Buffer[:res.Size]...)
+		res.Release()
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "line 1\nline 2\nline 3\n" {
+		t.Fatalf("incorrect output %q", out)
+	}
+	w.StopWatch(fd)
+}
+
+func TestWatchFileShared(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.Close()
+	fd, err := w.WatchFile(pw, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan OpResult, 1)
+	w.Write(fd, []byte("hello"), done)
+	if res := <-done; res.Err != nil || res.Size != 5 {
+		t.Fatal("incorrect write:", res.Err, res.Size)
+	}
+	// the file of the caller is left open
+	w.StopWatch(fd)
+	time.Sleep(20 * time.Millisecond)
+	if _, err := pw.Write([]byte(" world")); err != nil {
+		t.Fatal("file closed by StopWatch:", err)
+	}
+	buf := make([]byte, 11)
+	if _, err := io.ReadFull(pr, buf); err != nil || string(buf) != "hello world" {
+		t.Fatalf("incorrect data %q %v", buf, err)
+	}
+
+	// the writes of a pipe whose readers are closed fail
+	fd, err = w.WatchFile(pw, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr.Close()
+	w.Write(fd, []byte("hello"), done)
+	if res := <-done; !errors.Is(res.Err, syscall.EPIPE) {
+		t.Fatal("write to a closed pipe:", res.Err)
+	}
+}
+
+// slowFileSyscalls delays the reads of a fd, like cold pages of a file
+type slowFileSyscalls struct {
+	sysCalls
+	fd    int32
+	delay time.Duration
+}
+
+func (s *slowFileSyscalls) Read(fd int, p []byte) (int, error) {
+	if int32(fd) == atomic.LoadInt32(&s.fd) {
+		time.Sleep(s.delay)
+	}
+	return s.sysCalls.Read(fd, p)
+}
+
+func TestRegularFile(t *testing.T) {
+	sys := &slowFileSyscalls{sysCalls: rawSyscalls{}, fd: -1, delay: 100 * time.Millisecond}
+	w, err := CreateWatcher(WithShards(1), WithFileWorkers(2), withSyscalls(sys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	f, err := ioutil.TempFile("", "gaio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// writes to a regular file
+	file, err := w.WatchFd(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan OpResult, 16)
+	data := make([]byte, 64*1024)
+	io.ReadFull(rand.Reader, data)
+	for i := 0; i < len(data); i += 4096 {
+		w.Write(file, data[i:i+4096], done)
+	}
+	for i := 0; i < len(data); i += 4096 {
+		if res := <-done; res.Err != nil || res.Size != 4096 {
+			t.Fatal("incorrect file write:", res.Err, res.Size)
+		}
+	}
+	w.StopWatch(file)
+
+	// slow reads of the file interleaved with an echo on a socket
+	r, err := os.Open(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err = w.WatchFile(r, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&sys.fd, int32(file))
+	reads := make(chan OpResult, 16)
+	for i := 0; i < 16; i++ {
+		w.Read(file, make([]byte, 4096), reads)
+	}
+
+	sock, conn := tcpPair(t, w)
+	defer conn.Close()
+	go io.Copy(conn, conn)
+	for i := 0; i < 10; i++ {
+		start := time.Now()
+		w.Write(sock, []byte("ping"), done)
+		w.Read(sock, make([]byte, 4), done)
+		for j := 0; j < 2; j++ {
+			if res := <-done; res.Err != nil || res.Size != 4 {
+				t.Fatal("incorrect echo:", res.Err, res.Size)
+			}
+		}
+		if elapsed := time.Since(start); elapsed > sys.delay/2 {
+			t.Fatal("echo delayed by file reads:", elapsed)
+		}
+	}
+
+	// the file is read in order
+	var rx []byte
+	for i := 0; i < 16; i++ {
+		res := <-reads
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		rx = append(rx, res.Buffer[:res.Size]...)
+	}
+	if !bytes.Equal(rx, data) {
+		t.Fatal("incorrect file data")
+	}
+	w.Read(file, nil, reads)
+	if res := <-reads; res.Err != nil || res.Size != 0 {
+		t.Fatal("no EOF at the end of the file:", res.Err, res.Size)
+	}
+}
+
+func TestWatchFdOptions(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a duplicate, the caller closes its fd at once
+	a, err := w.WatchFd(fds[0], DupFd())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == fds[0] {
+		t.Fatal("fd not duplicated")
+	}
+	syscall.Close(fds[0])
+	// the fd is given to the watcher
+	b, err := w.WatchFd(fds[1], OwnFd())
+	if err != nil || b != fds[1] {
+		t.Fatal("incorrect owned fd:", b, err)
+	}
+
+	// the requests and the conveniences of conns work without one
+	c, err := w.NewAsyncConn(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan OpResult, 1)
+	w.Write(b, []byte("hello"), done)
+	if res := <-done; res.Err != nil || res.Size != 5 {
+		t.Fatal("incorrect write:", res.Err, res.Size)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("incorrect read %q %v", buf, err)
+	}
+	if _, err := w.ConnStats(b); err != nil {
+		t.Fatal(err)
+	}
+
+	// both are closed by StopWatch
+	w.StopWatch(a)
+	w.StopWatch(b)
+	time.Sleep(20 * time.Millisecond)
+	for _, fd := range []int{a, b} {
+		if _, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0); err != syscall.EBADF {
+			t.Fatal("fd left open:", fd, err)
+		}
+	}
+
+	// not pollable
+	dir, err := os.Open(os.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.Close()
+	if _, err := w.WatchFd(int(dir.Fd()), DupFd()); !errors.Is(err, ErrNotPollable) || w.Len() != 0 {
+		t.Fatal("directory watched:", err, w.Len())
+	}
+}
+
+func TestWatchFdSocketOptions(t *testing.T) {
+	w, err := CreateWatcher(WithSockBuf(64*1024, 64*1024), WithBusyPoll(50), WithProbe(time.Millisecond, make(chan OpResult, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// the socket options apply to sockets only
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[1])
+	sock, err := w.WatchFd(fds[0], OwnFd())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := unix.GetsockoptInt(sock, unix.SOL_SOCKET, unix.SO_RCVBUF); err != nil || n < 64*1024 {
+		t.Fatal("receive buffer not applied:", n, err)
+	}
+
+	r, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer pw.Close()
+	pipe, err := w.WatchFd(int(r.Fd()))
+	if err != nil {
+		t.Fatal("pipe:", err)
+	}
+	f, err := ioutil.TempFile("", "gaio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	f.WriteString("hello")
+	f.Seek(0, io.SeekStart)
+	file, err := w.WatchFd(int(f.Fd()))
+	if err != nil {
+		t.Fatal("regular file:", err)
+	}
+
+	done := make(chan OpResult, 1)
+	pw.Write([]byte("hello"))
+	for _, fd := range []int{pipe, file} {
+		w.Read(fd, make([]byte, 5), done)
+		if res := <-done; res.Err != nil || string(res.Buffer[:res.Size]) != "hello" {
+			t.Fatal("incorrect read:", fd, res.Err, res.Size)
+		}
+	}
+	w.StopWatch(pipe)
+	w.StopWatch(file)
+}
+
+func TestWriteStall(t *testing.T) {
+	w, err := CreateWatcher(WithWriteStallTimeout(200 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// small buffers on both sides, so a peer not reading stalls the writes
+	pair := func() (int, net.Conn) {
+		fd, conn := tcpPair(t, w)
+		if err := setSockBuf(fd, 0, 64*1024); err != nil {
+			t.Fatal(err)
+		}
+		conn.(*net.TCPConn).SetReadBuffer(64 * 1024)
+		return fd, conn
+	}
+	data := make([]byte, 2*1024*1024)
+
+	// a slow peer which keeps reading
+	fd, conn := pair()
+	defer conn.Close()
+	go func(conn net.Conn) {
+		buf := make([]byte, 16*1024)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}(conn)
+	done := make(chan OpResult, 2)
+	w.Write(fd, data, done)
+	if res := <-done; res.Err != nil || res.Size != len(data) {
+		t.Fatal("slow peer stalled:", res.Err, res.Size)
+	}
+
+	// a peer which stops reading, the queued writes fail one after another
+	fd, conn = pair()
+	defer conn.Close()
+	start := time.Now()
+	w.Write(fd, data, done)
+	w.Write(fd, data, done)
+	res := <-done
+	if !errors.Is(res.Err, ErrWriteStalled) || !errors.Is(res.Err, ErrPeerGone) || res.Size >= len(data) {
+		t.Fatal("stall not detected:", res.Err, res.Size)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatal("incorrect stall detection time:", elapsed)
+	}
+	if res := <-done; !errors.Is(res.Err, ErrWriteStalled) || res.Size != 0 {
+		t.Fatal("next write not stalled:", res.Err, res.Size)
+	}
+}
+
+func TestWriteProgress(t *testing.T) {
+	w, err := CreateWatcher(WithWriteStallTimeout(100 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	go io.Copy(ioutil.Discard, conn)
+
+	// progress of a write every 256KB
+	data := make([]byte, 8*1024*1024)
+	p := &Progress{C: make(chan ProgressEvent, 1024), Every: 256 * 1024}
+	done := make(chan OpResult, 1)
+	if err := w.WriteProgress(fd, data, done, p); err != nil {
+		t.Fatal(err)
+	}
+	res := <-done
+	if res.Err != nil || res.Size != len(data) {
+		t.Fatal("incorrect write:", res.Err, res.Size)
+	}
+	var last ProgressEvent
+	for n := len(p.C); n > 0; n-- {
+		ev := <-p.C
+		if ev.Fd != fd || ev.Total != int64(len(data)) || ev.Done <= last.Done {
+			t.Fatal("incorrect progress:", ev, last)
+		}
+		if ev.Done < ev.Total && ev.Done-last.Done < p.Every {
+			t.Fatal("progress reported too often:", ev, last)
+		}
+		last = ev
+	}
+	if last.Done != int64(res.Size) {
+		t.Fatal("incorrect final progress:", last, res.Size)
+	}
+
+	// the progress of a file sent
+	f, err := ioutil.TempFile("", "gaio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	f.Write(data)
+	p.Every = 0
+	if err := w.SendFileProgress(fd, f, 0, int64(len(data)), done, p); err != nil {
+		t.Fatal(err)
+	}
+	if res := <-done; res.Err != nil || res.Size != len(data) {
+		t.Fatal("incorrect sendfile:", res.Err, res.Size)
+	}
+	last = ProgressEvent{}
+	for n := len(p.C); n > 0; n-- {
+		ev := <-p.C
+		if ev.Total != int64(len(data)) || ev.Done <= last.Done {
+			t.Fatal("incorrect sendfile progress:", ev, last)
+		}
+		last = ev
+	}
+	if last.Done != int64(len(data)) {
+		t.Fatal("incorrect final sendfile progress:", last)
+	}
+
+	// a transfer which fails midway reports no more progress
+	fd, conn = tcpPair(t, w)
+	defer conn.Close()
+	if err := w.WriteProgress(fd, data, done, p); err != nil {
+		t.Fatal(err)
+	}
+	res = <-done
+	if !errors.Is(res.Err, ErrWriteStalled) || res.Size == 0 || res.Size >= len(data) {
+		t.Fatal("transfer not stalled:", res.Err, res.Size)
+	}
+	time.Sleep(50 * time.Millisecond)
+	last = ProgressEvent{}
+	for n := len(p.C); n > 0; n-- {
+		last = <-p.C
+	}
+	if last.Done != int64(res.Size) {
+		t.Fatal("incorrect progress of a failed transfer:", last, res.Size)
+	}
+}
+
+func TestConnTags(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// conns accepted by two listeners, tagged with their names
+	accept := func(ln net.Listener, tags ...string) (int, net.Conn) {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fd, err := w.WatchWithTags(conn, tags...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fd, client
+	}
+	var fds [2][]int
+	var clients []net.Conn
+	for i, name := range []string{"public", "internal"} {
+		ln, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		for j := 0; j < 3; j++ {
+			fd, client := accept(ln, name, fmt.Sprint("tenant-", j))
+			defer client.Close()
+			fds[i] = append(fds[i], fd)
+			clients = append(clients, client)
+		}
+	}
+
+	// (i+1)*100 bytes written to each conn of listener i
+	done := make(chan OpResult, 6)
+	for i := range fds {
+		for _, fd := range fds[i] {
+			w.Write(fd, make([]byte, (i+1)*100), done)
+		}
+	}
+	for i := 0; i < 6; i++ {
+		if res := <-done; res.Err != nil {
+			t.Fatal(res.Err)
+		}
+	}
+	if st, n := w.TagStats("public"); n != 3 || st.BytesOut != 300 || st.Ops != 3 {
+		t.Fatal("incorrect stats of public:", n, st)
+	}
+	if st, n := w.TagStats("internal"); n != 3 || st.BytesOut != 600 || st.Ops != 3 {
+		t.Fatal("incorrect stats of internal:", n, st)
+	}
+	if st, n := w.TagStats("tenant-1"); n != 2 || st.BytesOut != 300 {
+		t.Fatal("incorrect stats of tenant-1:", n, st)
+	}
+	var ranged []int
+	w.RangeTag("internal", func(fd int) bool {
+		ranged = append(ranged, fd)
+		return true
+	})
+	sort.Ints(ranged)
+	if !reflect.DeepEqual(ranged, fds[1]) {
+		t.Fatal("incorrect fds of internal:", ranged, fds[1])
+	}
+
+	// the tags flow through the stats, the state and the errors
+	fd := fds[0][1]
+	if st, _ := w.ConnStats(fd); !reflect.DeepEqual(st.Tags, []string{"public", "tenant-1"}) {
+		t.Fatal("incorrect tags of stats:", st.Tags)
+	}
+	w.Read(fd, make([]byte, 1), done)
+	state, err := w.DumpState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, fs := range state.Fds {
+		found = found || (fs.Fd == fd && reflect.DeepEqual(fs.Tags, []string{"public", "tenant-1"}))
+	}
+	if !found {
+		t.Fatal("tags not in the state:", state.Fds)
+	}
+	clients[1].(*net.TCPConn).SetLinger(0)
+	clients[1].Close()
+	res := <-done
+	var oe *OpError
+	if !errors.As(res.Err, &oe) || !reflect.DeepEqual(oe.Tags, []string{"public", "tenant-1"}) || !strings.Contains(oe.Error(), "[public tenant-1]") {
+		t.Fatal("incorrect tags of the error:", res.Err)
+	}
+
+	// retagged, and cleaned up on StopWatch
+	if err := w.SetTags(fd, "quarantine"); err != nil {
+		t.Fatal(err)
+	}
+	if _, n := w.TagStats("tenant-1"); n != 1 {
+		t.Fatal("old tags left:", n)
+	}
+	for i := range fds {
+		for _, fd := range fds[i] {
+			w.StopWatch(fd)
+		}
+	}
+	if _, n := w.TagStats("public"); n != 0 || len(w.fds.byTag) != 0 || w.Tags(fd) != nil {
+		t.Fatal("tags left after StopWatch:", n, w.fds.byTag)
+	}
+	if err := w.SetTags(fd, "x"); err != ErrNotWatched {
+		t.Fatal("tags of an unwatched fd:", err)
+	}
+}
+
+func TestCloseTag(t *testing.T) {
+	rec := newClosedRecorder()
+	w, err := CreateWatcher(WithOnClosed(rec.onClosed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// tenant x, tenant y and an untagged conn, each with a read pending
+	var fds []int
+	var clients []net.Conn
+	done := make(chan OpResult, 8)
+	for _, tags := range [][]string{{"tenant-x"}, {"tenant-x", "public"}, {"tenant-y"}, nil} {
+		fd, client := tcpPair(t, w)
+		defer client.Close()
+		w.SetTags(fd, tags...)
+		w.Read(fd, make([]byte, 4), done)
+		fds = append(fds, fd)
+		clients = append(clients, client)
+	}
+
+	reason := errors.New("tenant x kicked")
+	if n := w.CloseTag("tenant-x", reason); n != 2 {
+		t.Fatal("incorrect conns closed:", n)
+	}
+	for i := 0; i < 2; i++ {
+		res := <-done
+		if (res.Fd != fds[0] && res.Fd != fds[1]) || !errors.Is(res.Err, reason) {
+			t.Fatal("incorrect completion of a closed conn:", res.Fd, res.Err)
+		}
+	}
+	rec.wait(t, reason, fds[0], fds[1])
+	for _, client := range clients[:2] {
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatal("conn not closed:", err)
+		}
+	}
+	if n := w.CloseTag("tenant-x", reason); n != 0 {
+		t.Fatal("conns closed twice:", n)
+	}
+
+	// the other conns are untouched
+	for i, fd := range fds[2:] {
+		clients[2+i].Write([]byte("ping"))
+		if res := <-done; res.Fd != fd || res.Err != nil || res.Size != 4 {
+			t.Fatal("incorrect read of an untouched conn:", res.Fd, res.Err, res.Size)
+		}
+	}
+	if _, n := w.TagStats("tenant-y"); n != 1 || w.Len() != 2 {
+		t.Fatal("incorrect conns left:", n, w.Len())
+	}
+}
+
+func TestCloseTagConcurrent(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// conns tagged and stopped while the tag is closed, a fd reused by an
+	// untagged conn is never closed
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	var untagged int32
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				fd, client := tcpPair(t, w)
+				if i%2 == 0 {
+					w.SetTags(fd, "churn")
+					w.StopWatch(fd)
+				} else {
+					atomic.AddInt32(&untagged, 1)
+				}
+				client.Close()
+			}
+		}(i)
+	}
+	for start := time.Now(); time.Since(start) < 100*time.Millisecond; {
+		w.CloseTag("churn", ErrConnClosed)
+	}
+	close(stop)
+	wg.Wait()
+	w.CloseTag("churn", ErrConnClosed)
+	if _, n := w.TagStats("churn"); n != 0 {
+		t.Fatal("tagged conns left:", n)
+	}
+	if w.Len() != int(atomic.LoadInt32(&untagged)) {
+		t.Fatal("untagged conns closed:", w.Len(), untagged)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	if err := w.SetHeartbeat(fd, 50*time.Millisecond, []byte("P")); err != nil {
+		t.Fatal(err)
+	}
+
+	// reads the bytes of the peer for d
+	received := func(d time.Duration) string {
+		var b []byte
+		buf := make([]byte, 1024)
+		conn.SetReadDeadline(time.Now().Add(d))
+		for {
+			n, err := conn.Read(buf)
+			b = append(b, buf[:n]...)
+			if err != nil {
+				return string(b)
+			}
+		}
+	}
+
+	// beats during silence, and no read completes
+	done := make(chan OpResult, 1)
+	if err := w.ReadTimeout(fd, nil, done, time.Now().Add(200*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if b := received(400 * time.Millisecond); len(b) < 4 || len(b) > 9 || strings.Trim(b, "P") != "" {
+		t.Fatal("incorrect heartbeats during silence:", b)
+	}
+	if res := <-done; !errors.Is(res.Err, ErrDeadline) {
+		t.Fatal("read not expired with heartbeats:", res.Err)
+	}
+
+	// no beat while writes go out, but one may precede them
+	stop := make(chan struct{})
+	go func() {
+		results := make(chan OpResult, 1)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+			w.Write(fd, []byte("d"), results)
+			<-results
+		}
+	}()
+	b := received(300 * time.Millisecond)
+	close(stop)
+	if len(b) == 0 || strings.Contains(strings.TrimLeft(b, "P"), "P") {
+		t.Fatal("heartbeats between writes:", b)
+	}
+
+	// beats again, until StopWatch
+	if b := received(200 * time.Millisecond); !strings.Contains(b, "P") {
+		t.Fatal("heartbeats not resumed:", b)
+	}
+	w.StopWatch(fd)
+	received(100 * time.Millisecond)
+	if b := received(200 * time.Millisecond); b != "" {
+		t.Fatal("heartbeats after StopWatch:", b)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	probes := make(chan OpResult, 4)
+	w, err := CreateWatcher(WithProbe(50*time.Millisecond, probes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// a healthy idle conn isn't reported
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	select {
+	case res := <-probes:
+		t.Fatal("healthy conn reported:", res.Err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// a reset is reported without any request
+	start := time.Now()
+	conn.(*net.TCPConn).SetLinger(0)
+	conn.Close()
+	select {
+	case res := <-probes:
+		if res.Operation != OpProbe || res.Fd != fd || !errors.Is(res.Err, ErrPeerGone) {
+			t.Fatal("incorrect probe result:", res.Operation, res.Fd, res.Err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatal("reset detected late:", elapsed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("reset not detected")
+	}
+
+	// once
+	select {
+	case res := <-probes:
+		t.Fatal("reported again:", res.Err)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestTagProbe(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	probes := make(chan OpResult, 4)
+	w.SetTagProbe("probed", 50*time.Millisecond, probes)
+	tagged, conn := tcpPair(t, w)
+	if err := w.SetTags(tagged, "probed"); err != nil {
+		t.Fatal(err)
+	}
+	untagged, conn2 := tcpPair(t, w)
+	for _, c := range []net.Conn{conn, conn2} {
+		c.(*net.TCPConn).SetLinger(0)
+		c.Close()
+	}
+
+	select {
+	case res := <-probes:
+		if res.Fd != tagged || !errors.Is(res.Err, ErrPeerGone) {
+			t.Fatal("incorrect probe result:", res.Fd, res.Err)
+		}
+		if res.Err.(*OpError).Tags[0] != "probed" {
+			t.Fatal("tags not reported:", res.Err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("reset not detected")
+	}
+	select {
+	case res := <-probes:
+		t.Fatal("untagged conn probed:", res.Fd, untagged, res.Err)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// hookSyscalls calls hook before the next write to fd
+type hookSyscalls struct {
+	sysCalls
+	fd   int32
+	hook func()
+}
+
+func (h *hookSyscalls) Write(fd int, p []byte) (int, error) {
+	if atomic.CompareAndSwapInt32(&h.fd, int32(fd), -1) {
+		h.hook()
+	}
+	return h.sysCalls.Write(fd, p)
+}
+
+func TestSwitch(t *testing.T) {
+	sys := &hookSyscalls{sysCalls: rawSyscalls{}, fd: -1}
+	w, err := CreateWatcher(withSyscalls(sys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// the read ends with its buffer, and the write goes out
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	done := make(chan OpResult, 2)
+	buf := make([]byte, 16)
+	w.Read(fd, buf, done)
+	if err := w.SwitchToWrite(fd, []byte("response"), done); err != nil {
+		t.Fatal(err)
+	}
+	res := <-done
+	if res.Operation != OpRead || !errors.Is(res.Err, ErrSwitched) || !errors.Is(res.Err, ErrCanceled) || &res.Buffer[0] != &buf[0] {
+		t.Fatal("read not ended by the switch:", res.Operation, res.Err)
+	}
+	if res := <-done; res.Operation != OpWrite || res.Err != nil || res.Size != 8 {
+		t.Fatal("write not done:", res.Err, res.Size)
+	}
+	got := make([]byte, 8)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "response" {
+		t.Fatal("incorrect response:", string(got), err)
+	}
+
+	// the mirror ends a write the peer doesn't read
+	if err := setSockBuf(fd, 0, 64*1024); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 8*1024*1024)
+	w.Write(fd, data, done)
+	time.Sleep(50 * time.Millisecond)
+	if err := w.SwitchToRead(fd, nil, done); err != nil {
+		t.Fatal(err)
+	}
+	res = <-done
+	if res.Operation != OpWrite || !errors.Is(res.Err, ErrSwitched) || res.Size == 0 || res.Size == len(data) {
+		t.Fatal("write not ended by the switch:", res.Operation, res.Err, res.Size)
+	}
+	go io.Copy(ioutil.Discard, conn)
+	conn.Write([]byte("request"))
+	if res := <-done; res.Operation != OpRead || res.Err != nil || res.Size == 0 {
+		t.Fatal("read not done:", res.Err, res.Size)
+	}
+
+	// a reset of the peer between the end of the read and the write fails
+	// the write
+	fd, conn = tcpPair(t, w)
+	w.Read(fd, buf, done)
+	conn.(*net.TCPConn).SetLinger(0)
+	sys.hook = func() { conn.Close() }
+	atomic.StoreInt32(&sys.fd, int32(fd))
+	start := time.Now()
+	w.SwitchToWrite(fd, []byte("response"), done)
+	if res := <-done; !errors.Is(res.Err, ErrSwitched) {
+		t.Fatal("read not ended by the switch:", res.Err)
+	}
+	select {
+	case res := <-done:
+		if !errors.Is(res.Err, ErrPeerGone) {
+			t.Fatal("reset not detected:", res.Err, res.Size)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reset not detected")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatal("reset detected late:", elapsed)
+	}
+}
+
+func TestPollerGroup(t *testing.T) {
+	g, err := NewPollerGroup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	w1, err := CreateWatcherInGroup(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w2, err := CreateWatcherInGroup(g, WithName("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w1.shards[0].pfd != w2.shards[0].pfd {
+		t.Fatal("poller not shared")
+	}
+
+	// interleaved echoes, each watcher delivers to its own channel
+	fd1, conn1 := tcpPair(t, w1)
+	defer conn1.Close()
+	fd2, conn2 := tcpPair(t, w2)
+	defer conn2.Close()
+	done1, done2 := make(chan OpResult, 1), make(chan OpResult, 1)
+	for i := 0; i < 100; i++ {
+		w1.Read(fd1, nil, done1)
+		w2.Read(fd2, nil, done2)
+		conn2.Write([]byte("two"))
+		conn1.Write([]byte("one"))
+		for _, c := range []struct {
+			done chan OpResult
+			fd   int
+			data string
+		}{{done1, fd1, "one"}, {done2, fd2, "two"}} {
+			res := <-c.done
+			if res.Err != nil || res.Fd != c.fd || string(res.Buffer[:res.Size]) != c.data {
+				t.Fatal("incorrect result:", res.Err, res.Fd, string(res.Buffer[:res.Size]))
+			}
+			res.Release()
+		}
+	}
+
+	// the deadlines of both watchers are kept by the timer of the group
+	start := time.Now()
+	w2.ReadTimeout(fd2, nil, done2, start.Add(300*time.Millisecond))
+	w1.ReadTimeout(fd1, nil, done1, start.Add(50*time.Millisecond))
+	if res := <-done1; !errors.Is(res.Err, ErrDeadline) || time.Since(start) > 250*time.Millisecond {
+		t.Fatal("incorrect deadline:", res.Err, time.Since(start))
+	}
+	if res := <-done2; !errors.Is(res.Err, ErrDeadline) || time.Since(start) < 300*time.Millisecond {
+		t.Fatal("incorrect deadline:", res.Err, time.Since(start))
+	}
+
+	// closing a watcher leaves the other running
+	w1.Close()
+	<-w1.Done()
+	if err := w1.Read(fd1, nil, done1); err != ErrWatcherClosed {
+		t.Fatal("read on a closed watcher:", err)
+	}
+	w2.Read(fd2, nil, done2)
+	conn2.Write([]byte("two"))
+	if res := <-done2; res.Err != nil || string(res.Buffer[:res.Size]) != "two" {
+		t.Fatal("watcher stopped by the close of another:", res.Err)
+	}
+
+	// the fd of the closed watcher can join the other one
+	if _, err := w2.WatchFd(fd1); err != nil {
+		t.Fatal("fd of the closed watcher still registered:", err)
+	}
+	w2.Read(fd1, nil, done1)
+	conn1.Write([]byte("one"))
+	if res := <-done1; res.Err != nil || string(res.Buffer[:res.Size]) != "one" {
+		t.Fatal("incorrect read of the moved fd:", res.Err)
+	}
+	w2.StopWatch(fd1)
+
+	// closing the group closes the watchers left
+	g.Close()
+	select {
+	case <-w2.Done():
+	case <-time.After(time.Second):
+		t.Fatal("watcher not closed with its group")
+	}
+	if _, err := CreateWatcherInGroup(g); err != ErrGroupClosed {
+		t.Fatal("watcher created in a closed group:", err)
 	}
-	conn.Close()
 }
@@ -0,0 +1,283 @@
+package gaio
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrAsyncConnClosed is returned by the I/O of a closed AsyncConn.
+var ErrAsyncConnClosed = newKindError("use of closed AsyncConn", ErrCanceled)
+
+// AsyncConn is a net.Conn over a watched fd, for the code which needs a
+// net.Conn like crypto/tls while the watcher owns the polling. Read and
+// Write submit a request to the watcher and block the calling goroutine
+// until it completes, one Read and one Write at a time.
+//
+// The deadlines are those of ReadTimeout and WriteTimeout. A read deadline
+// applies to a pending Read too, like net.Conn, while a write deadline
+// applies to the Writes started after it's set.
+type AsyncConn struct {
+	w      *Watcher
+	fd     int
+	local  net.Addr
+	remote net.Addr
+
+	rmu   sync.Mutex
+	rdone chan OpResult
+	rwake chan struct{} // a read deadline was set
+
+	// the pending read, which outlives a Read ended by its deadline, and
+	// the data read not returned yet
+	rinflight  bool
+	rsubmitted time.Time // the deadline of the pending read
+	rres       OpResult
+	rdata      []byte
+
+	wmu   sync.Mutex
+	wdone chan OpResult
+
+	mu        sync.Mutex
+	rdeadline time.Time
+	wdeadline time.Time
+
+	owned     net.Conn // closed by Close, see Listener
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewAsyncConn returns an AsyncConn over the watched fd, Close closes it
+// with CloseConn.
+func (w *Watcher) NewAsyncConn(fd int) (*AsyncConn, error) {
+	if !w.watched(fd) {
+		return nil, ErrNotWatched
+	}
+	c := &AsyncConn{
+		w:      w,
+		fd:     fd,
+		rdone:  make(chan OpResult, 1),
+		rwake:  make(chan struct{}, 1),
+		wdone:  make(chan OpResult, 1),
+		closed: make(chan struct{}),
+	}
+	if conn := w.fds.conn(fd); conn != nil {
+		c.local, c.remote = conn.LocalAddr(), conn.RemoteAddr()
+	} else {
+		if sa, err := unix.Getsockname(fd); err == nil {
+			c.local = sockaddrToAddr(sa, true)
+		}
+		c.remote = remoteAddr(fd, nil)
+	}
+	return c, nil
+}
+
+// Fd returns the fd of c.
+func (c *AsyncConn) Fd() int { return c.fd }
+
+// Read reads into p like net.Conn, a read of the closed peer returns
+// io.EOF. The data is read into a buffer of the watcher and copied to p, so
+// a Read ended by its deadline leaves its request pending, and the data it
+// reads is returned by the next Read.
+func (c *AsyncConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	for len(c.rdata) == 0 {
+		// the request of a Read ended by its deadline may still be pending
+		if !c.rinflight {
+			if err := c.submitRead(); err != nil {
+				return 0, err
+			}
+		}
+
+		res, err := c.waitRead()
+		if err != nil {
+			return 0, err
+		}
+		c.rinflight, c.rsubmitted = false, time.Time{}
+		if errors.Is(res.Err, ErrDeadline) && !c.readExpired() {
+			// expired before its deadline was moved
+			continue
+		} else if res.Err != nil {
+			res.Release()
+			return 0, res.Err
+		} else if res.Size == 0 {
+			res.Release()
+			return 0, io.EOF
+		}
+		c.rres = res
+		c.rdata = res.Buffer[:res.Size]
+	}
+
+	n := copy(p, c.rdata)
+	c.rdata = c.rdata[n:]
+	if len(c.rdata) == 0 {
+		c.rres.Release()
+		c.rres = OpResult{}
+	}
+	return n, nil
+}
+
+// submitRead submits a read with the read deadline of c
+func (c *AsyncConn) submitRead() error {
+	c.mu.Lock()
+	deadline := c.rdeadline
+	c.mu.Unlock()
+	if err := c.w.ReadTimeout(c.fd, nil, c.rdone, deadline); err != nil {
+		return err
+	}
+	c.rinflight, c.rsubmitted = true, deadline
+	return nil
+}
+
+// readExpired reports whether the read deadline of c has passed
+func (c *AsyncConn) readExpired() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.rdeadline.IsZero() && !time.Now().Before(c.rdeadline)
+}
+
+// waitRead returns the result of the pending read, or the error ending the
+// wait. A deadline set while waiting which is earlier than the one of the
+// request ends the wait with ErrDeadline, leaving the request pending.
+func (c *AsyncConn) waitRead() (OpResult, error) {
+	for {
+		c.mu.Lock()
+		deadline := c.rdeadline
+		c.mu.Unlock()
+		if !deadline.IsZero() && (c.rsubmitted.IsZero() || deadline.Before(c.rsubmitted)) {
+			if !time.Now().Before(deadline) {
+				return OpResult{}, &OpError{Op: OpRead, Fd: c.fd, RemoteAddr: c.remote, Err: ErrDeadline}
+			}
+		} else {
+			deadline = time.Time{}
+		}
+		if res, ok, err := c.waitReadUntil(deadline); ok {
+			return res, err
+		}
+	}
+}
+
+// waitReadUntil waits for the result of the pending read until deadline if
+// not zero, or the read deadline is moved, ok is false if the wait ended
+// without a result or an error
+func (c *AsyncConn) waitReadUntil(deadline time.Time) (res OpResult, ok bool, err error) {
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		expired = t.C
+	}
+
+	select {
+	case res = <-c.rdone:
+		return res, true, nil
+	case <-c.closed:
+		return res, true, ErrAsyncConnClosed
+	case <-c.w.die:
+		return res, true, ErrWatcherClosed
+	case <-c.rwake:
+	case <-expired:
+	}
+	return res, false, nil
+}
+
+// Write writes p like net.Conn, it returns after p is fully written or
+// fails.
+func (c *AsyncConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if len(p) == 0 {
+		return 0, nil
+	}
+	c.mu.Lock()
+	deadline := c.wdeadline
+	c.mu.Unlock()
+
+	res, err := c.wait(c.w.WriteTimeout(c.fd, p, c.wdone, deadline), c.wdone)
+	if err != nil {
+		return 0, err
+	}
+	return res.Size, res.Err
+}
+
+// wait returns the result of the request submitted with err, or the error
+// ending the wait
+func (c *AsyncConn) wait(err error, done chan OpResult) (OpResult, error) {
+	if err != nil {
+		return OpResult{}, err
+	}
+	select {
+	case res := <-done:
+		return res, nil
+	case <-c.closed:
+		return OpResult{}, ErrAsyncConnClosed
+	case <-c.w.die:
+		return OpResult{}, ErrWatcherClosed
+	}
+}
+
+// Close stops watching the fd of c and closes its conn, see CloseConn, the
+// pending Read and Write return ErrAsyncConnClosed.
+func (c *AsyncConn) Close() error {
+	err := ErrAsyncConnClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.w.CloseConn(c.fd)
+		if c.owned != nil {
+			c.owned.Close()
+		}
+		err = nil
+	})
+	return err
+}
+
+// LocalAddr returns the local address of c.
+func (c *AsyncConn) LocalAddr() net.Addr { return c.local }
+
+// RemoteAddr returns the address of the peer of c.
+func (c *AsyncConn) RemoteAddr() net.Addr { return c.remote }
+
+// SetDeadline sets the read and write deadlines of c.
+func (c *AsyncConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rdeadline, c.wdeadline = t, t
+	c.wakeRead()
+	return nil
+}
+
+// SetReadDeadline sets the deadline of the reads, zero means none. It
+// applies to a pending Read as well.
+func (c *AsyncConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rdeadline = t
+	c.wakeRead()
+	return nil
+}
+
+// wakeRead wakes a Read waiting for its result to apply a new deadline
+func (c *AsyncConn) wakeRead() {
+	select {
+	case c.rwake <- struct{}{}:
+	default:
+	}
+}
+
+// SetWriteDeadline sets the deadline of the next writes, zero means none.
+func (c *AsyncConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wdeadline = t
+	return nil
+}
+
+var _ net.Conn = (*AsyncConn)(nil)
@@ -0,0 +1,51 @@
+package gaio
+
+import "time"
+
+// result is a completion held back for delivery in a batch
+type result struct {
+	done chan OpResult
+	res  OpResult
+}
+
+// deliver sends res to done, or holds it back in the batch of s with
+// WithCompletionBatching. The batch is delivered when it's full, when the
+// window of its first result ends, on Flush and on Close.
+func (s *shard) deliver(done chan OpResult, res OpResult) {
+	s.ops.count(&res)
+	if d := s.w.fds.get(res.Fd); d != nil {
+		d.stats.count(&res)
+	}
+	if s.w.batchMax <= 0 {
+		s.send(done, res)
+		return
+	}
+
+	if len(s.batch) == 0 && s.pfd != nil && s.w.batchWindow > 0 {
+		s.batchDeadline = time.Now().Add(s.w.batchWindow)
+	}
+	s.batch = append(s.batch, result{done, res})
+	if len(s.batch) >= s.w.batchMax {
+		s.flushBatch()
+	}
+}
+
+// flushBatch delivers the results held back in order
+func (s *shard) flushBatch() {
+	for i := range s.batch {
+		s.send(s.batch[i].done, s.batch[i].res)
+		s.batch[i] = result{}
+	}
+	s.batch = s.batch[:0]
+}
+
+// Flush delivers the completions held back by WithCompletionBatching without
+// waiting for their window to end.
+func (w *Watcher) Flush() error {
+	for _, s := range w.shards {
+		if err := s.submit(aiocb{kind: kindFlush, fd: -1}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
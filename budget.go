@@ -0,0 +1,53 @@
+package gaio
+
+const (
+	// a fd is drained for at most readBudgetBytes or readBudgetOps reads per
+	// round, then it's continued on the next round after the other fds
+	readBudgetBytes = 256 * 1024
+	readBudgetOps   = 64
+)
+
+// resetBudget starts the budget of a fd
+func (s *shard) resetBudget() {
+	s.budgetBytes = readBudgetBytes
+	s.budgetOps = readBudgetOps
+}
+
+// consume charges a read of n bytes to the budget
+func (s *shard) consume(n int) {
+	s.budgetBytes -= n
+	s.budgetOps--
+}
+
+func (s *shard) exhausted() bool {
+	return s.budgetBytes <= 0 || s.budgetOps <= 0
+}
+
+// remember queues d for the next round if its budget was exhausted with
+// requests left, the fd stays ready in edge-triggered mode without a new
+// edge, so it must not wait for one.
+func (s *shard) remember(d *fdDesc) {
+	s.scheduleResume(d)
+	if !d.moreRead && !d.moreWrite {
+		return
+	}
+	if !d.backlogRead && !d.backlogWrite {
+		s.backlog = append(s.backlog, d)
+	}
+	d.backlogRead = d.backlogRead || d.moreRead
+	d.backlogWrite = d.backlogWrite || d.moreWrite
+	d.moreRead, d.moreWrite = false, false
+}
+
+// continueBacklog processes the fds remembered in the last round
+func (s *shard) continueBacklog() {
+	backlog := s.backlog
+	s.backlog = s.spareBacklog
+	for i, d := range backlog {
+		read, write := d.backlogRead, d.backlogWrite
+		d.backlogRead, d.backlogWrite = false, false
+		s.dispatch(d, read, write)
+		backlog[i] = nil
+	}
+	s.spareBacklog = backlog[:0]
+}
@@ -0,0 +1,116 @@
+package gaio
+
+// Codec transforms the data of a fd between the application and the wire,
+// like a cipher or a compression, see SetCodec. Its calls are made in the
+// order of the data of the fd, Encode in the order of the writes and
+// Decode in the order of the reads, never concurrently for one direction.
+type Codec interface {
+	// Encode appends the wire data of src to dst and returns it.
+	Encode(dst, src []byte) ([]byte, error)
+	// Decode appends the data decoded from the wire data src to dst and
+	// returns it. The data of src which can't be decoded yet, like a
+	// partial frame, is kept by the codec for the next call.
+	Decode(dst, src []byte) ([]byte, error)
+}
+
+// SetCodec sets the codec of the watched fd, nil removes it. The writes
+// submitted by Write, WriteTimeout and WriteTo without an address are
+// encoded when they're first tried, into a pooled buffer, and the data
+// read by Read and ReadTimeout is decoded before it's delivered. A read
+// completes once data is decoded, the decoded data which doesn't fit in
+// its buffer is delivered by the next reads, a read with a nil buffer gets
+// all of it. OpResult.Size is the size of the data of the application and
+// OpResult.WireSize the size on the wire, a write which failed reports the
+// bytes written to the wire only. The codec applies to the requests tried
+// after the call.
+func (w *Watcher) SetCodec(fd int, c Codec) error {
+	return w.fds.setCodec(fd, c)
+}
+
+// encode replaces the buffer of the write pcb with its encoding, the
+// buffer of the application is kept in plain. It returns false if pcb
+// failed.
+func (s *shard) encode(pcb *aiocb) bool {
+	c := s.w.fds.codec(pcb.fd)
+	if c == nil {
+		return true
+	}
+	out, err := c.Encode(s.w.pool.get(len(pcb.buffer))[:0], pcb.buffer)
+	if err != nil {
+		s.complete(pcb, OpResult{Operation: OpWrite, Fd: pcb.fd, Buffer: pcb.buffer, Err: err})
+		return false
+	}
+	pcb.plain, pcb.buffer = pcb.buffer, out
+	return true
+}
+
+// plainResult reports the result of an encoded write with the buffer of
+// the application
+func (pcb *aiocb) plainResult(res *OpResult) {
+	if pcb.plain == nil {
+		return
+	}
+	res.Buffer, res.WireSize, res.coded = pcb.plain, res.Size, true
+	if res.Size == len(pcb.buffer) && res.Err == nil {
+		res.Size = len(pcb.plain)
+	} else {
+		res.Size = 0
+	}
+}
+
+// releaseEncoded returns the encoding of a write which ended to the pool
+func (s *shard) releaseEncoded(cb *aiocb) {
+	if cb.plain != nil {
+		s.w.pool.put(cb.buffer)
+		cb.buffer, cb.plain = cb.plain, nil
+	}
+}
+
+// decodeRead decodes the nr bytes read into buf by pcb with the codec of
+// d, it returns false if no data could be decoded yet
+func (s *shard) decodeRead(pcb *aiocb, d *fdDesc, buf []byte, nr int) bool {
+	c := s.w.fds.codec(pcb.fd)
+	if c == nil {
+		d.decoded = append(d.decoded, buf[:nr]...)
+		return true
+	}
+	out, err := c.Decode(d.decoded, buf[:nr])
+	if err != nil {
+		s.complete(pcb, OpResult{Operation: OpRead, Fd: pcb.fd, Buffer: pcb.buffer, WireSize: nr, Err: err, coded: true})
+		return true
+	}
+	d.decoded = out
+	if len(out) == 0 {
+		return false
+	}
+	s.completeDecoded(pcb, d, nr)
+	return true
+}
+
+// completeDecoded completes the read pcb with the decoded data of d, wire is
+// the size of the data read by pcb
+func (s *shard) completeDecoded(pcb *aiocb, d *fdDesc, wire int) {
+	res := OpResult{Operation: OpRead, Fd: pcb.fd, WireSize: wire, coded: true}
+	if pcb.auto || s.w.copyBuffers {
+		size := len(d.decoded)
+		if !pcb.auto && len(pcb.buffer) < size {
+			size = len(pcb.buffer)
+		}
+		res.Buffer = s.w.pool.get(size)
+		res.pool = s.w.pool
+	} else {
+		res.Buffer = pcb.buffer
+	}
+	res.Size = copy(res.Buffer, d.decoded)
+	d.decoded = d.decoded[:copy(d.decoded, d.decoded[res.Size:])]
+
+	res.Err = s.w.opError(&res)
+	pcb.moveTag(&res)
+	s.traceEnd(pcb, res)
+	s.retire(pcb)
+	if pcb.done != nil {
+		s.deliver(pcb.done, res)
+	} else {
+		res.Release()
+	}
+}
@@ -0,0 +1,35 @@
+package gaio
+
+// Completions returns a sequence of the results received from done, which
+// blocks for the next result and ends when the watcher is closed, after the
+// results already queued in done:
+//
+//	for res := range w.Completions(done) {
+//		...
+//	}
+//
+// Breaking out of the loop stops receiving at once, the results delivered
+// later stay in done. A sequence is ranged over by one goroutine at a time.
+func (w *Watcher) Completions(done chan OpResult) func(yield func(OpResult) bool) {
+	return func(yield func(OpResult) bool) {
+		for {
+			select {
+			case res := <-done:
+				if !yield(res) {
+					return
+				}
+			case <-w.die:
+				for {
+					select {
+					case res := <-done:
+						if !yield(res) {
+							return
+						}
+					default:
+						return
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+//go:build go1.23
+// +build go1.23
+
+package gaio
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestCompletions(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	// the echo server of examples/echo-server as a loop over the results
+	done := make(chan OpResult)
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		for res := range w.Completions(done) {
+			if res.Err != nil || (res.Operation == OpRead && res.Size == 0) {
+				w.StopWatch(res.Fd)
+				continue
+			}
+			switch res.Operation {
+			case OpRead:
+				w.Write(res.Fd, res.Buffer[:res.Size:cap(res.Buffer)], done)
+			case OpWrite:
+				w.Read(res.Fd, res.Buffer[:cap(res.Buffer)], done)
+			}
+		}
+	}()
+	if err := w.Read(fd, make([]byte, 1024), done); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range []string{"hello", "world"} {
+		conn.Write([]byte(msg))
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, []byte(msg)) {
+			t.Fatal("incorrect echo:", err, string(buf))
+		}
+	}
+
+	// the sequence ends with the watcher
+	w.Close()
+	<-served
+
+	// and breaking out of the loop stops it
+	queued := make(chan OpResult, 2)
+	queued <- OpResult{Fd: 1}
+	queued <- OpResult{Fd: 2}
+	for res := range w.Completions(queued) {
+		if res.Fd != 1 {
+			t.Fatal("incorrect result:", res.Fd)
+		}
+		break
+	}
+	if len(queued) != 1 {
+		t.Fatal("results received after break:", 2-len(queued))
+	}
+}
+
+func TestCompletionsNoAllocs(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	done := make(chan OpResult, 1)
+	seq := w.Completions(done)
+	allocs := testing.AllocsPerRun(100, func() {
+		done <- OpResult{Fd: 1}
+		for res := range seq {
+			if res.Fd != 1 {
+				t.Fatal("incorrect result:", res.Fd)
+			}
+			break
+		}
+	})
+	if allocs != 0 {
+		t.Fatal("allocations per result:", allocs)
+	}
+}
@@ -0,0 +1,370 @@
+package gaio
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrPoolClosed is the error of the checkouts of a closed Pool.
+var ErrPoolClosed = newKindError("pool closed", ErrCanceled)
+
+// errReadCanceled ends the health read of a pooled connection checked out,
+// see cancelReads
+var errReadCanceled = newKindError("read canceled", ErrCanceled)
+
+// ConnResult is the result of a checkout of a Pool, the fd of a connection
+// or the error of its dial.
+type ConnResult struct {
+	Fd  int
+	Err error
+}
+
+// the states of a pooled connection
+const (
+	connDialing  = iota
+	connIdle     // in the pool with a health read pending
+	connChecking // checked out, waiting for its health read to end
+	connBusy     // checked out
+)
+
+// pooledConn is a connection of a Pool
+type pooledConn struct {
+	state int
+	done  chan ConnResult // of the checkout of a connChecking
+	probe [1]byte         // of the health read
+}
+
+// Pool is a pool of persistent connections to an address, dialed with
+// Watcher.Dial on demand up to a bounded size. A connection back in the
+// pool has a read pending until it's checked out, which closes it if the
+// peer closes it, sends unsolicited data, or it stays idle past the idle
+// timeout. Checkouts wait in order while the pool is exhausted, a broken
+// connection is replaced with a new dial for them.
+type Pool struct {
+	w       *Watcher
+	network string
+	address string
+	max     int
+	idle    time.Duration
+
+	results chan OpResult // of the dials and the health reads
+	queued  chan struct{} // signals loop of the results undelivered
+
+	mu          sync.Mutex
+	conns       map[int]*pooledConn
+	free        []int // idle fds, the most recent last
+	waiters     []chan ConnResult
+	undelivered []delivery // for the done channels which were full
+	closed      bool
+	die         chan struct{}
+}
+
+// delivery is a result of a checkout waiting for room in its done channel
+type delivery struct {
+	done chan ConnResult
+	res  ConnResult
+}
+
+// NewPool returns a pool of up to max connections to address on network,
+// dialed by w, see Dial. An idle connection is closed after idleTimeout, 0
+// keeps it until it breaks.
+func NewPool(w *Watcher, network, address string, max int, idleTimeout time.Duration) *Pool {
+	if max < 1 {
+		max = 1
+	}
+	p := &Pool{
+		w:       w,
+		network: network,
+		address: address,
+		max:     max,
+		idle:    idleTimeout,
+		results: make(chan OpResult, max),
+		queued:  make(chan struct{}, 1),
+		conns:   make(map[int]*pooledConn),
+		die:     make(chan struct{}),
+	}
+	go p.loop()
+	return p
+}
+
+// cancelReads ends the pending reads of fd with errReadCanceled, the
+// requests submitted after are not affected
+func (w *Watcher) cancelReads(fd int) error {
+	return w.shardOf(fd).submit(aiocb{kind: kindCancel, fd: fd})
+}
+
+// Get checks out a connection, its fd is delivered to done once one is idle
+// or dialed. The connection is given back with Put, or Discard if it
+// broke. done receives the error of the dial of a checkout which failed,
+// and ErrPoolClosed for the checkouts waiting when the pool is closed. The
+// results for a done without room wait in the pool, in order.
+func (p *Pool) Get(done chan ConnResult) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrPoolClosed
+	}
+	return p.checkout(done)
+}
+
+// checkout takes an idle connection for done, or dials one, or queues done
+func (p *Pool) checkout(done chan ConnResult) error {
+	for len(p.free) > 0 {
+		fd := p.free[len(p.free)-1]
+		p.free = p.free[:len(p.free)-1]
+		c := p.conns[fd]
+		if err := p.w.cancelReads(fd); err != nil {
+			p.discard(fd)
+			continue
+		}
+		c.state, c.done = connChecking, done
+		return nil
+	}
+
+	p.waiters = append(p.waiters, done)
+	if len(p.conns) < p.max {
+		fd, err := p.dial()
+		if err != nil {
+			p.waiters = p.waiters[:len(p.waiters)-1]
+			return err
+		}
+		p.conns[fd] = &pooledConn{state: connDialing}
+	}
+	return nil
+}
+
+// Put gives the connection of fd back to the pool, to the oldest checkout
+// waiting or idle. The connections of a closed pool are closed.
+func (p *Pool) Put(fd int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c := p.conns[fd]; c != nil && c.state == connBusy {
+		p.release(fd, c)
+	}
+}
+
+// Discard closes the connection of fd checked out, which broke, it's
+// replaced for the checkouts waiting.
+func (p *Pool) Discard(fd int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c := p.conns[fd]; c != nil && c.state == connBusy {
+		p.discard(fd)
+		p.replace()
+	}
+}
+
+// Len returns the idle connections and all those of the pool, dialing and
+// checked out included.
+func (p *Pool) Len() (idle, total int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.free), len(p.conns)
+}
+
+// Close closes the idle connections, fails the checkouts waiting with
+// ErrPoolClosed, and closes the connections checked out once they're put
+// back.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrPoolClosed
+	}
+	p.closed = true
+	close(p.die)
+	for fd, c := range p.conns {
+		if c.state == connChecking {
+			p.deliver(c.done, ConnResult{Err: ErrPoolClosed})
+		}
+		if c.state != connBusy {
+			p.discard(fd)
+		}
+	}
+	for _, done := range p.waiters {
+		p.deliver(done, ConnResult{Err: ErrPoolClosed})
+	}
+	p.waiters = nil
+	return nil
+}
+
+// release hands c to the oldest checkout waiting, or keeps it idle with a
+// health read pending
+func (p *Pool) release(fd int, c *pooledConn) {
+	if p.closed {
+		p.discard(fd)
+		return
+	}
+	if len(p.waiters) > 0 {
+		done := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		c.state = connBusy
+		p.deliver(done, ConnResult{Fd: fd})
+		return
+	}
+
+	var deadline time.Time
+	if p.idle > 0 {
+		deadline = time.Now().Add(p.idle)
+	}
+	if err := p.w.ReadTimeout(fd, c.probe[:], p.results, deadline); err != nil {
+		p.discard(fd)
+		return
+	}
+	c.state = connIdle
+	p.free = append(p.free, fd)
+}
+
+// discard stops watching fd, which the watcher closes once its requests
+// are dropped, see dial
+func (p *Pool) discard(fd int) {
+	delete(p.conns, fd)
+	for i, free := range p.free {
+		if free == fd {
+			p.free = append(p.free[:i], p.free[i+1:]...)
+			break
+		}
+	}
+	p.w.StopWatch(fd)
+}
+
+// dial dials a connection whose fd is owned by the watcher like with
+// OwnFd, so it's closed once its StopWatch is processed: the fd number
+// isn't reused by the dial of a replacement while the stale health read is
+// still queued for it
+func (p *Pool) dial() (int, error) {
+	fd, err := p.w.Dial(p.network, p.address, p.results)
+	if err != nil {
+		return 0, err
+	}
+	if d := p.w.fds.watched(fd); d != nil {
+		d.set(fdOwned, true)
+	}
+	return fd, nil
+}
+
+// replace dials a connection for the oldest checkout waiting if the pool
+// has room, a failed dial fails the checkout
+func (p *Pool) replace() {
+	if len(p.waiters) <= p.dialing() || len(p.conns) >= p.max {
+		return
+	}
+	fd, err := p.dial()
+	if err != nil {
+		done := p.waiters[0]
+		p.waiters = p.waiters[1:]
+		p.deliver(done, ConnResult{Err: err})
+		return
+	}
+	p.conns[fd] = &pooledConn{state: connDialing}
+}
+
+// dialing returns the connections being dialed
+func (p *Pool) dialing() (n int) {
+	for _, c := range p.conns {
+		if c.state == connDialing {
+			n++
+		}
+	}
+	return n
+}
+
+// deliver sends res to done without blocking the pool, the result for a
+// full done, or one with results queued already, is queued in order and
+// sent by loop once done has room
+func (p *Pool) deliver(done chan ConnResult, res ConnResult) {
+	for _, u := range p.undelivered {
+		if u.done == done {
+			p.queue(done, res)
+			return
+		}
+	}
+	select {
+	case done <- res:
+	default:
+		p.queue(done, res)
+	}
+}
+
+func (p *Pool) queue(done chan ConnResult, res ConnResult) {
+	p.undelivered = append(p.undelivered, delivery{done, res})
+	select {
+	case p.queued <- struct{}{}:
+	default:
+	}
+}
+
+// loop processes the results of the dials and the health reads, and sends
+// the results undelivered, those left once the pool is closed included
+func (p *Pool) loop() {
+	die := p.die
+	for {
+		var out chan ConnResult
+		var next ConnResult
+		p.mu.Lock()
+		if len(p.undelivered) > 0 {
+			out, next = p.undelivered[0].done, p.undelivered[0].res
+		} else if die == nil {
+			p.mu.Unlock()
+			return
+		}
+		p.mu.Unlock()
+
+		select {
+		case res := <-p.results:
+			p.handle(res)
+		case out <- next:
+			p.mu.Lock()
+			p.undelivered[0] = delivery{}
+			p.undelivered = p.undelivered[1:]
+			p.mu.Unlock()
+		case <-p.queued:
+		case <-die:
+			die = nil
+		case <-p.w.die:
+			return
+		}
+	}
+}
+
+func (p *Pool) handle(res OpResult) {
+	// the byte of a health read isn't used
+	res.Release()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c := p.conns[res.Fd]
+	if c == nil {
+		return
+	}
+
+	switch c.state {
+	case connDialing:
+		if res.Err == nil {
+			p.release(res.Fd, c)
+			return
+		}
+		p.discard(res.Fd)
+		if len(p.waiters) > 0 {
+			done := p.waiters[0]
+			p.waiters = p.waiters[1:]
+			p.deliver(done, ConnResult{Err: res.Err})
+		}
+	case connChecking:
+		if errors.Is(res.Err, errReadCanceled) {
+			c.state = connBusy
+			p.deliver(c.done, ConnResult{Fd: res.Fd})
+			return
+		}
+		// broke before its checkout, which takes another one
+		done := c.done
+		p.discard(res.Fd)
+		if err := p.checkout(done); err != nil {
+			p.deliver(done, ConnResult{Err: err})
+		}
+	case connIdle:
+		// closed by the peer, unsolicited data, or idle too long
+		p.discard(res.Fd)
+		p.replace()
+	}
+}
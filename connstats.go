@@ -0,0 +1,127 @@
+package gaio
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ConnStats are the totals of the results delivered for a watched fd since
+// it was watched.
+type ConnStats struct {
+	BytesIn    uint64    // bytes of the results of reads
+	BytesOut   uint64    // bytes of the results of writes
+	WireIn     uint64    // bytes of the reads on the wire, see SetCodec
+	WireOut    uint64    // bytes of the writes on the wire, see SetCodec
+	Ops        uint64    // results of reads and writes
+	LastActive time.Time // time of the last result, zero if none
+
+	// syscalls, see Stats.ReadsAgain, Stats.WritesAgain and
+	// Stats.ShortWrites
+	ReadsAgain  uint64
+	WritesAgain uint64
+	ShortWrites uint64
+
+	// the tags of the fd, see SetTags, shared and not to be modified
+	Tags []string
+}
+
+// connStats are the counters of ConnStats in a descriptor, accessed
+// atomically
+type connStats struct {
+	bytesIn    uint64
+	bytesOut   uint64
+	wireIn     uint64
+	wireOut    uint64
+	ops        uint64
+	lastActive int64 // unix nanoseconds
+
+	readsAgain  uint64
+	writesAgain uint64
+	shortWrites uint64
+}
+
+// count accounts a result delivered for the fd
+func (cs *connStats) count(res *OpResult) {
+	wire := res.Size
+	if res.coded {
+		wire = res.WireSize
+	}
+	switch res.Operation {
+	case OpRead, OpUrgent:
+		atomic.AddUint64(&cs.bytesIn, uint64(res.Size))
+		atomic.AddUint64(&cs.wireIn, uint64(wire))
+	case OpWrite:
+		atomic.AddUint64(&cs.bytesOut, uint64(res.Size))
+		atomic.AddUint64(&cs.wireOut, uint64(wire))
+	default:
+		return
+	}
+	atomic.AddUint64(&cs.ops, 1)
+	atomic.StoreInt64(&cs.lastActive, time.Now().UnixNano())
+}
+
+func (cs *connStats) reset() {
+	atomic.StoreUint64(&cs.bytesIn, 0)
+	atomic.StoreUint64(&cs.bytesOut, 0)
+	atomic.StoreUint64(&cs.wireIn, 0)
+	atomic.StoreUint64(&cs.wireOut, 0)
+	atomic.StoreUint64(&cs.ops, 0)
+	atomic.StoreInt64(&cs.lastActive, 0)
+	atomic.StoreUint64(&cs.readsAgain, 0)
+	atomic.StoreUint64(&cs.writesAgain, 0)
+	atomic.StoreUint64(&cs.shortWrites, 0)
+}
+
+// restore sets the counters to st, see Migrate
+func (cs *connStats) restore(st ConnStats) {
+	atomic.StoreUint64(&cs.bytesIn, st.BytesIn)
+	atomic.StoreUint64(&cs.bytesOut, st.BytesOut)
+	atomic.StoreUint64(&cs.wireIn, st.WireIn)
+	atomic.StoreUint64(&cs.wireOut, st.WireOut)
+	atomic.StoreUint64(&cs.ops, st.Ops)
+	atomic.StoreUint64(&cs.readsAgain, st.ReadsAgain)
+	atomic.StoreUint64(&cs.writesAgain, st.WritesAgain)
+	atomic.StoreUint64(&cs.shortWrites, st.ShortWrites)
+	if !st.LastActive.IsZero() {
+		atomic.StoreInt64(&cs.lastActive, st.LastActive.UnixNano())
+	}
+}
+
+func (cs *connStats) snapshot() (st ConnStats) {
+	st.BytesIn = atomic.LoadUint64(&cs.bytesIn)
+	st.BytesOut = atomic.LoadUint64(&cs.bytesOut)
+	st.WireIn = atomic.LoadUint64(&cs.wireIn)
+	st.WireOut = atomic.LoadUint64(&cs.wireOut)
+	st.Ops = atomic.LoadUint64(&cs.ops)
+	st.ReadsAgain = atomic.LoadUint64(&cs.readsAgain)
+	st.WritesAgain = atomic.LoadUint64(&cs.writesAgain)
+	st.ShortWrites = atomic.LoadUint64(&cs.shortWrites)
+	if ns := atomic.LoadInt64(&cs.lastActive); ns != 0 {
+		st.LastActive = time.Unix(0, ns)
+	}
+	return st
+}
+
+// ConnStats returns the totals of a watched fd, they're reset by StopWatch.
+func (w *Watcher) ConnStats(fd int) (ConnStats, error) {
+	d := w.fds.watched(fd)
+	if d == nil {
+		return ConnStats{}, ErrNotWatched
+	}
+	st := d.stats.snapshot()
+	st.Tags = w.fds.tags(fd)
+	return st, nil
+}
+
+// RangeStats calls f with the totals of each watched fd until f returns
+// false, fds watched or stopped during the iteration may be missed.
+func (w *Watcher) RangeStats(f func(fd int, st ConnStats) bool) {
+	w.fds.each(func(fd int, d *fdDesc) bool {
+		if !d.has(fdWatched) {
+			return true
+		}
+		st := d.stats.snapshot()
+		st.Tags = w.fds.tags(fd)
+		return f(fd, st)
+	})
+}
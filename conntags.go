@@ -0,0 +1,160 @@
+package gaio
+
+import "net"
+
+// WatchWithTags watches conn like Watch and labels its fd with tags, see
+// SetTags.
+func (w *Watcher) WatchWithTags(conn net.Conn, tags ...string) (int, error) {
+	fd, err := w.Watch(conn)
+	if err != nil {
+		return 0, err
+	}
+	w.fds.setTags(fd, tags)
+	w.applyProbe(fd, false)
+	return fd, nil
+}
+
+// SetTags labels the watched fd with tags, like a tenant or the name of its
+// listener, replacing its previous ones. The tags of a fd are reported in
+// its ConnStats, DumpState and the OpErrors of its requests, and select the
+// fds of TagStats and RangeTag, and the probe of SetTagProbe. They're
+// cleared when fd is deregistered.
+// ErrNotWatched is returned if fd isn't watched.
+func (w *Watcher) SetTags(fd int, tags ...string) error {
+	if !w.fds.setTags(fd, tags) {
+		return ErrNotWatched
+	}
+	return w.applyProbe(fd, false)
+}
+
+// Tags returns the tags of fd, nil if fd isn't watched or has none. The
+// slice is shared and must not be modified.
+func (w *Watcher) Tags(fd int) []string {
+	return w.fds.tags(fd)
+}
+
+// TagStats returns the sums of the ConnStats of the fds tagged with tag,
+// and their number. LastActive is the latest of the fds, and Tags is nil.
+func (w *Watcher) TagStats(tag string) (st ConnStats, n int) {
+	for _, fd := range w.fds.tagged(tag) {
+		d := w.fds.watched(fd)
+		if d == nil {
+			continue
+		}
+		fs := d.stats.snapshot()
+		st.BytesIn += fs.BytesIn
+		st.BytesOut += fs.BytesOut
+		st.WireIn += fs.WireIn
+		st.WireOut += fs.WireOut
+		st.Ops += fs.Ops
+		st.ReadsAgain += fs.ReadsAgain
+		st.WritesAgain += fs.WritesAgain
+		st.ShortWrites += fs.ShortWrites
+		if fs.LastActive.After(st.LastActive) {
+			st.LastActive = fs.LastActive
+		}
+		n++
+	}
+	return st, n
+}
+
+// RangeTag calls f with the fds tagged with tag until f returns false, f is
+// called without locks held, so it may call StopWatch. The fds are looked up
+// in an index of the tags, without visiting the other fds.
+func (w *Watcher) RangeTag(tag string, f func(fd int) bool) {
+	for _, fd := range w.fds.tagged(tag) {
+		if !f(fd) {
+			return
+		}
+	}
+}
+
+// setTags sets the tags of fd and indexes them, it returns false if fd
+// isn't watched
+func (t *fdTable) setTags(fd int, tags []string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d := t.watched(fd)
+	if d == nil {
+		return false
+	}
+	t.untag(d)
+	if len(tags) == 0 {
+		return true
+	}
+	d.tags = append([]string(nil), tags...)
+	if t.byTag == nil {
+		t.byTag = make(map[string]map[int]struct{})
+	}
+	for _, tag := range d.tags {
+		fds := t.byTag[tag]
+		if fds == nil {
+			fds = make(map[int]struct{})
+			t.byTag[tag] = fds
+		}
+		fds[fd] = struct{}{}
+	}
+	return true
+}
+
+// untag removes the tags of d from the index, with the lock held
+func (t *fdTable) untag(d *fdDesc) {
+	for _, tag := range d.tags {
+		if fds := t.byTag[tag]; fds != nil {
+			delete(fds, d.fd)
+			if len(fds) == 0 {
+				delete(t.byTag, tag)
+			}
+		}
+	}
+	d.tags = nil
+}
+
+// tags returns the tags of fd
+func (t *fdTable) tags(fd int) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if d := t.watched(fd); d != nil {
+		return d.tags
+	}
+	return nil
+}
+
+// tagged returns the fds tagged with tag
+func (t *fdTable) tagged(tag string) []int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fds := make([]int, 0, len(t.byTag[tag]))
+	for fd := range t.byTag[tag] {
+		fds = append(fds, fd)
+	}
+	return fds
+}
+
+// CloseTag closes the fds tagged with tag like CloseConn, except their
+// queued requests fail with reason, which is also the reason passed to the
+// callback of WithOnClosed, and returns their number. A nil reason drops
+// the requests like CloseConn. The fds are looked up once, so the fds tagged
+// meanwhile may be missed, and a fd is only closed if it still has the tag
+// when it's closed.
+func (w *Watcher) CloseTag(tag string, reason error) (n int) {
+	for _, fd := range w.fds.tagged(tag) {
+		conn, ctx, flags := w.fds.unregisterTagged(fd, tag)
+		if flags&fdWatched == 0 {
+			continue
+		}
+		w.shardOf(fd).pfd.Unwatch(fd)
+		w.submitStop(aiocb{kind: kindStop, fd: fd, conn: conn, ctx: ctx, closeConn: true, reason: reason}, flags)
+		n++
+	}
+	return n
+}
+
+// abort ends a request queued on a fd closed by CloseTag with reason
+func (s *shard) abort(cb *aiocb, reason error) {
+	if sp := cb.splice; sp != nil && sp.finished {
+		s.retire(cb)
+		return
+	}
+	s.fail(cb, reason)
+}
@@ -0,0 +1,82 @@
+package gaio
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SetDropOldest sets whether results delivered to a full done drop the
+// oldest result it holds instead of waiting for the receiver, the buffer of
+// a dropped result is released and the drop is counted in Stats.Dropped.
+// Channels without a buffer always wait.
+func (w *Watcher) SetDropOldest(done chan OpResult, enabled bool) {
+	w.dropMu.Lock()
+	defer w.dropMu.Unlock()
+	if w.dropOldest == nil {
+		w.dropOldest = make(map[chan OpResult]struct{})
+	}
+	if enabled && cap(done) > 0 {
+		w.dropOldest[done] = struct{}{}
+	} else {
+		delete(w.dropOldest, done)
+	}
+	atomic.StoreInt32(&w.dropping, int32(len(w.dropOldest)))
+}
+
+// dropsOldest reports whether done drops its oldest result when full
+func (w *Watcher) dropsOldest(done chan OpResult) bool {
+	if atomic.LoadInt32(&w.dropping) == 0 {
+		return false
+	}
+	w.dropMu.RLock()
+	defer w.dropMu.RUnlock()
+	_, ok := w.dropOldest[done]
+	return ok
+}
+
+// send delivers res to done, a send which can't complete immediately is
+// timed for WithSlowConsumer, or makes room with SetDropOldest. The
+// results of an embedded watcher are held for Poll instead.
+func (s *shard) send(done chan OpResult, res OpResult) {
+	if s.w.embedded {
+		s.polled = append(s.polled, res)
+		return
+	}
+	if s.w.slowHook == nil && atomic.LoadInt32(&s.w.dropping) == 0 {
+		done <- res
+		return
+	}
+
+	select {
+	case done <- res:
+		return
+	default:
+	}
+
+	if s.w.dropsOldest(done) {
+		for {
+			select {
+			case done <- res:
+				return
+			default:
+			}
+			select {
+			case old := <-done:
+				old.Release()
+				atomic.AddUint64(&s.ops.dropped, 1)
+			default:
+			}
+		}
+	}
+
+	start := time.Now()
+	done <- res
+	if wait := time.Since(start); s.w.slowHook != nil && wait >= s.w.slowAfter {
+		s.w.reportSlow(res.Fd, wait)
+	}
+}
+
+func (w *Watcher) reportSlow(fd int, wait time.Duration) {
+	defer w.recoverCallback("slow consumer hook")
+	w.slowHook(fd, wait)
+}
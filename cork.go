@@ -0,0 +1,25 @@
+package gaio
+
+const (
+	corkOn  = 1
+	corkOff = -1
+)
+
+// Cork submits a request to cork fd(TCP_CORK on linux, TCP_NOPUSH on bsd),
+// partial segments of the following writes are held by the kernel, so the
+// pieces of a multi-part response coalesce into full segments. The cork is
+// cleared once the writes after it are flushed and the write queue of fd is
+// empty, so the pieces of a response are submitted together and its last
+// bytes don't wait for the cork timeout.
+//
+// Cork and Uncork are queued in order with writes on fd.
+func (w *Watcher) Cork(fd int) error {
+	return w.shardOf(fd).submit(aiocb{kind: kindWrite, fd: fd, cork: corkOn})
+}
+
+// Uncork submits a request to clear the cork of fd, it's applied after all
+// the previously submitted writes have been flushed to the kernel, so the
+// last bytes are sent immediately instead of waiting for the cork timeout.
+func (w *Watcher) Uncork(fd int) error {
+	return w.shardOf(fd).submit(aiocb{kind: kindWrite, fd: fd, cork: corkOff})
+}
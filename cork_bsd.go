@@ -0,0 +1,9 @@
+// +build darwin netbsd freebsd openbsd dragonfly
+
+package gaio
+
+import "golang.org/x/sys/unix"
+
+func setCork(fd int, on bool) error {
+	return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_NOPUSH, boolint(on))
+}
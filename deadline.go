@@ -0,0 +1,212 @@
+package gaio
+
+import (
+	"container/heap"
+	"time"
+)
+
+// ErrDeadline is returned by requests which didn't complete before their
+// deadline, see ReadTimeout and WriteTimeout. Like the deadlines of net.Conn
+// it wraps os.ErrDeadlineExceeded and is a net.Error whose Timeout is true,
+// so do the OpErrors wrapping it.
+var ErrDeadline error = &deadlineError{}
+
+// deadlineError is the error of ErrDeadline
+type deadlineError struct{}
+
+func (e *deadlineError) Error() string   { return "operation exceeded deadline" }
+func (e *deadlineError) Timeout() bool   { return true }
+func (e *deadlineError) Temporary() bool { return false }
+func (e *deadlineError) Unwrap() error   { return errDeadlineExceeded }
+
+// timer is the deadline of a pending request, it's kept in the heap of the
+// loop of the shard until the request completes or expires.
+type timer struct {
+	deadline time.Time
+	d        *fdDesc
+	index    int  // in the heap, -1 if not
+	canceled bool // completed on a worker, see releaseTimers
+	resume   bool // resumes the writes of d, see SetWriteRateLimit
+	stall    bool // checks the progress of the writes of d, see checkStall
+	beat     bool // writes the heartbeat of d, see SetHeartbeat
+	probe    bool // probes d when idle, see WithProbe
+}
+
+// timerHeap is a min-heap of timers by deadline
+type timerHeap []*timer
+
+func (h timerHeap) Len() int           { return len(h) }
+func (h timerHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*timer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = nil
+	t.index = -1
+	*h = old[:n-1]
+	return t
+}
+
+// ReadTimeout submits a read request like Read, which fails with ErrDeadline
+// if no data is read before deadline.
+func (w *Watcher) ReadTimeout(fd int, buf []byte, done chan OpResult, deadline time.Time) error {
+	return w.shardOf(fd).submit(aiocb{kind: kindRead, fd: fd, buffer: buf, auto: buf == nil, done: done, deadline: deadline})
+}
+
+// WriteTimeout submits a write request like Write, which fails with
+// ErrDeadline if it's not fully written before deadline, OpResult.Size is
+// the number of bytes written then.
+func (w *Watcher) WriteTimeout(fd int, buf []byte, done chan OpResult, deadline time.Time) error {
+	return w.shardOf(fd).submit(aiocb{kind: kindWrite, fd: fd, buffer: buf, done: done, deadline: deadline})
+}
+
+// startTimer adds the deadline of a request queued to d to the heap
+func (s *shard) startTimer(cb *aiocb, d *fdDesc) {
+	if cb.deadline.IsZero() || cb.timer != nil {
+		return
+	}
+	cb.timer = &timer{deadline: cb.deadline, d: d}
+	heap.Push(&s.timers, cb.timer)
+}
+
+// stopTimer removes the deadline of a request which completed or was
+// dropped. The heap is owned by the loop, a worker hands the timer back to
+// the loop with the descriptor instead.
+func (s *shard) stopTimer(cb *aiocb) {
+	t := cb.timer
+	if t == nil {
+		return
+	}
+	cb.timer = nil
+	if s.pfd == nil {
+		t.canceled = true
+		t.d.canceled = append(t.d.canceled, t)
+	} else if t.index >= 0 {
+		heap.Remove(&s.timers, t.index)
+	}
+}
+
+// releaseTimers processes the timers of d handed back by a worker, the
+// canceled ones are removed and the expired ones are put back to expire on
+// the loop.
+func (s *shard) releaseTimers(d *fdDesc) {
+	for i, t := range d.canceled {
+		if t.index >= 0 {
+			heap.Remove(&s.timers, t.index)
+		}
+		d.canceled[i] = nil
+	}
+	d.canceled = d.canceled[:0]
+	for i, t := range d.expired {
+		if !t.canceled {
+			heap.Push(&s.timers, t)
+		}
+		d.expired[i] = nil
+	}
+	d.expired = d.expired[:0]
+}
+
+// expire fails the requests whose deadline passed and delivers the batch
+// of results whose window ended, then arms the timer of the poller for the
+// earliest deadline left. The timer is only rearmed for an earlier deadline,
+// a later one is armed when it fires.
+func (s *shard) expire() {
+	if len(s.batch) > 0 && s.w.batchWindow <= 0 {
+		s.flushBatch()
+	}
+	if len(s.timers) == 0 && len(s.batch) == 0 {
+		return
+	}
+
+	now := time.Now()
+	if !s.armed.IsZero() && !now.Before(s.armed) {
+		s.armed = time.Time{}
+	}
+	for len(s.timers) > 0 && !now.Before(s.timers[0].deadline) {
+		t := heap.Pop(&s.timers).(*timer)
+		if t.resume {
+			t.d.resume = nil
+			s.dispatch(t.d, false, true)
+			continue
+		}
+		if t.d.busy {
+			// the queues of d are on a worker, expired on release after
+			// the results of the worker, so they stay in order
+			t.d.expired = append(t.d.expired, t)
+			continue
+		}
+		if t.stall {
+			s.checkStall(t, now)
+			continue
+		}
+		if t.beat {
+			s.sendHeartbeat(t, now)
+			continue
+		}
+		if t.probe {
+			s.sendProbe(t, now)
+			continue
+		}
+		for _, q := range []*[]aiocb{&t.d.readers, &t.d.writers, &t.d.urgents} {
+			if s.expireIn(q, t) {
+				break
+			}
+		}
+	}
+	if len(s.batch) > 0 && !now.Before(s.batchDeadline) {
+		s.flushBatch()
+	}
+
+	var deadline time.Time
+	if len(s.timers) > 0 {
+		deadline = s.timers[0].deadline
+	}
+	if len(s.batch) > 0 && (deadline.IsZero() || s.batchDeadline.Before(deadline)) {
+		deadline = s.batchDeadline
+	}
+	if !deadline.IsZero() && (s.armed.IsZero() || deadline.Before(s.armed)) {
+		delay := deadline.Sub(now)
+		if delay <= 0 {
+			delay = 1
+		}
+		if s.setTimer(deadline, delay) == nil {
+			s.armed = deadline
+		}
+	}
+}
+
+// expireIn fails the request of t in q if found, the requests after it keep
+// their order
+func (s *shard) expireIn(q *[]aiocb, t *timer) bool {
+	for i := range *q {
+		cb := (*q)[i]
+		if cb.timer != t {
+			continue
+		}
+		if cb.zcPending {
+			// the kernel still references the buffer
+			(*q)[i].timer = nil
+			return true
+		}
+
+		copy((*q)[i:], (*q)[i+1:])
+		(*q)[len(*q)-1] = aiocb{}
+		*q = (*q)[:len(*q)-1]
+
+		s.complete(&cb, OpResult{Operation: cb.op(), Fd: cb.fd, Buffer: cb.buffer, Size: cb.size, Err: ErrDeadline})
+		return true
+	}
+	return false
+}
@@ -0,0 +1,8 @@
+// +build go1.15
+
+package gaio
+
+import "os"
+
+// errDeadlineExceeded is wrapped by ErrDeadline
+var errDeadlineExceeded error = os.ErrDeadlineExceeded
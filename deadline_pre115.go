@@ -0,0 +1,7 @@
+// +build !go1.15
+
+package gaio
+
+// errDeadlineExceeded is wrapped by ErrDeadline, os.ErrDeadlineExceeded
+// was added in go1.15
+var errDeadlineExceeded error
@@ -0,0 +1,60 @@
+package gaio
+
+import "runtime"
+
+// deriveDefaults returns the number of shards, the cap of the events buffer
+// and the parallelism of the workers for procs = GOMAXPROCS and the
+// expected number of connections, 0 if unknown. Without expected
+// connections a single shard is kept, as Splice and Relay between fds of
+// different shards copy through user space. Given them, a shard per P
+// spreads the syscalls over all cores, but there's no point in more than a
+// shard per 256 connections, and the events buffer is sized to drain the
+// connections of a shard in a few waits. The workers, of WithWorkers and of
+// the handlers of Dispatch, are a goroutine per P, at most one per 64
+// connections.
+func deriveDefaults(procs, conns int) (shards, maxEvents, workers int) {
+	shards = 1
+	if conns > 0 {
+		shards = procs
+		if conns/256 < shards {
+			shards = conns / 256
+		}
+		if shards < 1 {
+			shards = 1
+		}
+	}
+
+	maxEvents = defaultMaxEvents
+	if conns > 0 {
+		maxEvents = conns / shards
+		if maxEvents < 256 {
+			maxEvents = 256
+		} else if maxEvents > defaultMaxEvents {
+			maxEvents = defaultMaxEvents
+		}
+	}
+
+	workers = procs
+	if conns > 0 && conns/64 < workers {
+		workers = conns / 64
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return shards, maxEvents, workers
+}
+
+// applyDerivedDefaults fills the settings not given by options
+func (w *Watcher) applyDerivedDefaults() {
+	shards, maxEvents, workers := deriveDefaults(runtime.GOMAXPROCS(0), w.expectedConns)
+	if w.numShards == 0 {
+		w.numShards = shards
+	}
+	if w.maxEvents == 0 {
+		w.maxEvents = maxEvents
+	}
+	if w.numWorkers < 0 {
+		w.numWorkers = workers
+	}
+	w.parallelism = workers
+}
@@ -0,0 +1,97 @@
+package gaio
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Dial connects to the address on the named network("tcp", "tcp4" or "tcp6")
+// asynchronously, the returned fd is watched, and the completion is delivered
+// to done when the connection has been established or failed. The address is
+// resolved synchronously. The fd belongs to the caller, who should close it
+// after StopWatch.
+func (w *Watcher) Dial(network, address string, done chan OpResult) (int, error) {
+	return w.dial(network, address, nil, false, done)
+}
+
+// DialFastOpen connects like Dial, with data sent in the SYN using TCP Fast
+// Open when a cookie is available, the completion is delivered when all the
+// data has been written. It falls back to a normal connect followed by a
+// write if TCP Fast Open is unsupported or disabled.
+func (w *Watcher) DialFastOpen(network, address string, data []byte, done chan OpResult) (int, error) {
+	return w.dial(network, address, data, true, done)
+}
+
+func (w *Watcher) dial(network, address string, data []byte, fastopen bool, done chan OpResult) (int, error) {
+	raddr, err := net.ResolveTCPAddr(network, address)
+	if err != nil {
+		return 0, err
+	}
+
+	sa, err := ipToSockaddr(raddr.IP, raddr.Port, raddr.Zone)
+	if err != nil {
+		return 0, err
+	}
+
+	family := unix.AF_INET
+	if _, ok := sa.(*unix.SockaddrInet6); ok {
+		family = unix.AF_INET6
+	}
+
+	fd, err := socket(family, unix.SOCK_STREAM)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := w.WatchFd(fd); err != nil {
+		unix.Close(fd)
+		return 0, err
+	}
+
+	cb := aiocb{kind: kindWrite, fd: fd, addr: sa, done: done}
+	if fastopen && len(data) > 0 {
+		cb.buffer = data
+		cb.fastopen = true
+	} else {
+		cb.connect = true
+	}
+
+	if err := w.shardOf(fd).submit(cb); err != nil {
+		w.StopWatch(fd)
+		unix.Close(fd)
+		return 0, err
+	}
+	return fd, nil
+}
+
+// tryConnect starts a non-blocking connect, and checks the result when fd
+// becomes writable
+func (s *shard) tryConnect(pcb *aiocb) (complete bool) {
+	var err error
+	if pcb.addr != nil {
+		err = s.w.sys.Connect(pcb.fd, pcb.addr)
+		pcb.addr = nil
+		if err == syscall.EINPROGRESS {
+			return false
+		}
+	} else {
+		var errno int
+		errno, err = unix.GetsockoptInt(pcb.fd, unix.SOL_SOCKET, unix.SO_ERROR)
+		if err == nil && errno != 0 {
+			err = syscall.Errno(errno)
+		}
+		if err == syscall.EINPROGRESS || err == syscall.EALREADY {
+			return false
+		} else if err == nil {
+			// spurious wakeup before the connection has been established
+			if _, perr := unix.Getpeername(pcb.fd); perr == syscall.ENOTCONN {
+				return false
+			}
+		}
+	}
+
+	s.complete(pcb, OpResult{Operation: OpWrite, Fd: pcb.fd, Err: err})
+	return true
+}
@@ -0,0 +1,163 @@
+package gaio
+
+import (
+	"errors"
+	"sync"
+)
+
+// dispatchQueue is the capacity of the queue of each dispatch goroutine
+const dispatchQueue = 64
+
+// Dispatch receives the results from done and calls handler on n
+// goroutines until the watcher is closed. Results are assigned to the
+// goroutines by fd, so the results of a fd are handled one at a time and in
+// the order they were delivered, while different fds are handled in
+// parallel. A panic of handler is logged and the goroutine goes on. n < 1
+// starts GOMAXPROCS goroutines, at most one per 64 connections given by
+// WithExpectedConns.
+func (w *Watcher) Dispatch(done chan OpResult, n int, handler func(OpResult)) {
+	if n < 1 {
+		n = w.parallelism
+	}
+
+	queues := make([]chan OpResult, n)
+	for i := range queues {
+		queues[i] = make(chan OpResult, dispatchQueue)
+		queue := queues[i]
+		w.goLabeled("dispatch", -1, func() {
+			for {
+				select {
+				case res := <-queue:
+					w.handle(handler, res)
+				case <-w.die:
+					return
+				}
+			}
+		})
+	}
+
+	w.goLabeled("dispatch", -1, func() {
+		for {
+			select {
+			case res := <-done:
+				select {
+				case queues[uint(res.Fd)%uint(n)] <- res:
+				case <-w.die:
+					return
+				}
+			case <-w.die:
+				return
+			}
+		}
+	})
+}
+
+func (w *Watcher) handle(handler func(OpResult), res OpResult) {
+	defer w.recoverCallback("dispatch handler")
+	handler(res)
+}
+
+// ErrFdBusy is returned by the helpers, like StartTLS and Relay, for a fd
+// driven by another helper already.
+var ErrFdBusy = errors.New("fd is driven by a helper already")
+
+// opWake is the operation of the results waking a helper up, see wake
+const opWake OpType = -1
+
+// helper is the state machine of a helper, driven by the results of the
+// requests it submits, like TLSConn and Relay
+type helper interface {
+	// onResult handles a result of a request of the helper, or a wakeup,
+	// the results of a fd are handled one at a time and in order
+	onResult(res OpResult)
+	// onClose ends the helper once the watcher has terminated
+	onClose()
+}
+
+// helperTable routes the results of the requests of the helpers to them by
+// fd, on the goroutines of Dispatch, so the helpers hold no goroutines of
+// their own
+type helperTable struct {
+	once   sync.Once
+	done   chan OpResult
+	mu     sync.Mutex
+	byFd   map[int]helper // protected by mu
+	closed bool           // protected by mu
+}
+
+// attach routes the results of fds to h, and returns the done channel of
+// the requests of h
+func (w *Watcher) attach(h helper, fds ...int) (chan OpResult, error) {
+	t := &w.helpers
+	t.once.Do(func() {
+		t.done = make(chan OpResult, dispatchQueue)
+		w.Dispatch(t.done, 0, t.route)
+		w.goLabeled("helpers", -1, func() {
+			<-w.die
+			t.close()
+		})
+	})
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil, ErrWatcherClosed
+	}
+	for _, fd := range fds {
+		if _, ok := t.byFd[fd]; ok {
+			return nil, ErrFdBusy
+		}
+	}
+	if t.byFd == nil {
+		t.byFd = make(map[int]helper)
+	}
+	for _, fd := range fds {
+		t.byFd[fd] = h
+	}
+	return t.done, nil
+}
+
+// detach stops routing the results of fds, the results left are released
+func (w *Watcher) detach(fds ...int) {
+	t := &w.helpers
+	t.mu.Lock()
+	for _, fd := range fds {
+		delete(t.byFd, fd)
+	}
+	t.mu.Unlock()
+}
+
+// wake has the helper of fd handle a result of opWake, in order with the
+// results of fd
+func (w *Watcher) wake(fd int) {
+	select {
+	case w.helpers.done <- OpResult{Operation: opWake, Fd: fd}:
+	case <-w.die:
+	}
+}
+
+func (t *helperTable) route(res OpResult) {
+	t.mu.Lock()
+	h := t.byFd[res.Fd]
+	t.mu.Unlock()
+	if h == nil {
+		res.Release()
+		return
+	}
+	h.onResult(res)
+}
+
+// close ends the helpers once the watcher has terminated
+func (t *helperTable) close() {
+	t.mu.Lock()
+	t.closed = true
+	ended := make(map[helper]bool)
+	for _, h := range t.byFd {
+		ended[h] = true
+	}
+	t.byFd = nil
+	t.mu.Unlock()
+	for h := range ended {
+		h.onClose()
+	}
+}
@@ -0,0 +1,155 @@
+package gaio
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ErrDraining is the error of the reads submitted or pending once Drain
+// started.
+var ErrDraining = newKindError("watcher draining", ErrCanceled)
+
+// Drain shuts the watcher down gracefully: reads are rejected with
+// ErrDraining from now on and the pending ones end with it, splices and
+// offloaded reads excepted, while writes go on. Each fd is closed by
+// CloseConn once it has no pending requests, so the conns of WatchDup and
+// WatchFd are left to the caller. When all fds are stopped the watcher is
+// closed and Drain returns nil. If ctx is done first, the fds left are
+// closed the same way with their pending requests failing with
+// ErrDraining, the watcher is closed and ctx.Err() is returned. See
+// DrainProgress.
+func (w *Watcher) Drain(ctx context.Context) error {
+	atomic.StoreInt32(&w.draining, 1)
+	for _, s := range w.shards {
+		if err := s.submit(aiocb{kind: kindDrain, fd: -1}); err != nil {
+			return err
+		}
+	}
+
+	for w.stopDrained(false) > 0 {
+		select {
+		case <-w.settled:
+		case <-ctx.Done():
+			w.stopDrained(true)
+			w.closeDrained()
+			return ctx.Err()
+		case <-w.die:
+			return ErrWatcherClosed
+		}
+	}
+	return w.closeDrained()
+}
+
+// closeDrained closes the watcher once its fds are stopped, the loops end
+// the stops left like CloseWait, so their conns are closed and the requests
+// not failed by them yet fail with ErrWatcherClosed
+func (w *Watcher) closeDrained() error {
+	atomic.StoreInt32(&w.closing, 1)
+	return w.Close()
+}
+
+// DrainProgress returns the fds left to drain, which are the watched fds,
+// and the bytes of the buffers of their pending requests.
+func (w *Watcher) DrainProgress() (conns int, bytes int64) {
+	return w.fds.len(), atomic.LoadInt64(&w.pinned)
+}
+
+// stopDrained closes the fds without pending requests, or all with force,
+// whose requests fail with ErrDraining, it returns the fds left
+func (w *Watcher) stopDrained(force bool) (left int) {
+	var drained []int
+	w.Range(func(fd int, conn net.Conn) bool {
+		if d := w.fds.get(fd); force || d == nil || atomic.LoadInt32(&d.pending) == 0 {
+			drained = append(drained, fd)
+		} else {
+			left++
+		}
+		return true
+	})
+
+	for _, fd := range drained {
+		w.stopWatch(fd, true, ErrDraining)
+	}
+	return left
+}
+
+// drainShard ends the reads of the fds of s, those of a fd on a worker once
+// it returns
+func (s *shard) drainShard() {
+	s.w.fds.each(func(fd int, d *fdDesc) bool {
+		if s.w.shardOf(fd) != s {
+			return true
+		}
+		if d.busy {
+			d.deferred = append(d.deferred, aiocb{kind: kindDrain, fd: fd})
+		} else {
+			s.drainReads(d)
+		}
+		return true
+	})
+}
+
+// drainReads ends the reads of d with ErrDraining, splices and offloaded
+// reads go on
+func (s *shard) drainReads(d *fdDesc) {
+	s.endReads(d, ErrDraining)
+}
+
+// endReads ends the reads of d with err, splices and offloaded reads go on
+func (s *shard) endReads(d *fdDesc, err error) {
+	readers := d.readers[:0]
+	for i := range d.readers {
+		if cb := &d.readers[i]; cb.splice != nil || cb.offload != nil {
+			readers = append(readers, *cb)
+		} else {
+			s.fail(cb, err)
+		}
+	}
+	for i := len(readers); i < len(d.readers); i++ {
+		d.readers[i] = aiocb{}
+	}
+	d.readers = readers
+
+	for i := range d.urgents {
+		s.fail(&d.urgents[i], err)
+	}
+	d.urgents = nil
+}
+
+// CloseWait closes the watcher once its pending requests complete, within
+// timeout. New requests are rejected with ErrWatcherClosed from now on,
+// and the requests left at the timeout fail with ErrWatcherClosed, their
+// results delivered unlike with Close. It returns the requests pending at
+// the call which completed and which were failed, and the error of Close.
+// A Close during the wait ends it, the requests left fail the same way.
+func (w *Watcher) CloseWait(timeout time.Duration) (completed, aborted int, err error) {
+	atomic.StoreInt32(&w.closing, 1)
+	start := int(atomic.LoadInt64(&w.pending))
+	aborted0 := atomic.LoadInt64(&w.aborted)
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	w.waitPending(deadline.C)
+	err = w.Close()
+	// the loops fail the requests left as they terminate
+	w.loops.Wait()
+	aborted = int(atomic.LoadInt64(&w.aborted) - aborted0)
+	return start - aborted, aborted, err
+}
+
+// waitPending waits until no request is pending, expired fires or the
+// watcher terminates, the loops signal the last request retired as
+// w.closing is set
+func (w *Watcher) waitPending(expired <-chan time.Time) {
+	for atomic.LoadInt64(&w.pending) > 0 {
+		select {
+		case <-w.settled:
+		case <-expired:
+			return
+		case <-w.die:
+			return
+		}
+	}
+}
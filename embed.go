@@ -0,0 +1,84 @@
+package gaio
+
+import "errors"
+
+// ErrNotEmbedded is returned by PollFd and Poll for a watcher created
+// without WithEmbedded.
+var ErrNotEmbedded = errors.New("watcher is not embedded")
+
+// embeddedDone stands for the nil done channel of the requests of an
+// embedded watcher, nothing is sent to it
+var embeddedDone = make(chan OpResult)
+
+// WithEmbedded makes the watcher a participant of an external event loop
+// instead of running its own: it has a single shard and no goroutines, the
+// loop waits on PollFd and calls Poll when it's readable. The results of
+// the requests, and the watermark crossings and probe failures, are
+// returned by Poll instead of being sent to their done channels, which may
+// be nil. The helpers consuming results from channels, like Relay,
+// Dispatcher and Pool, don't work with it, and the requests answered by
+// the loop, like DumpState or Migrate, block until Poll is called by
+// another goroutine.
+func WithEmbedded() Option {
+	return func(w *Watcher) {
+		w.embedded = true
+	}
+}
+
+// PollFd returns the descriptor of the poller of an embedded watcher, it's
+// readable whenever Poll has work: results to return, submissions, events
+// of the watched fds or expired deadlines. It's owned by the watcher and
+// closed by Close.
+func (w *Watcher) PollFd() (int, error) {
+	if !w.embedded {
+		return -1, ErrNotEmbedded
+	}
+	return w.shards[0].pfd.pollFd(), nil
+}
+
+// Poll runs a round of the loop of an embedded watcher without blocking,
+// and returns up to maxResults results, all of them if maxResults isn't
+// positive. A round only runs once the results of the previous ones are
+// returned, and PollFd stays readable while results are left. The slice
+// returned is reused by the next call, so Poll doesn't allocate once its
+// buffers are sized. Poll must not be called concurrently, it returns
+// ErrWatcherClosed once the watcher has terminated.
+func (w *Watcher) Poll(maxResults int) ([]OpResult, error) {
+	if !w.embedded {
+		return nil, ErrNotEmbedded
+	}
+	s := w.shards[0]
+	if maxResults <= 0 || len(s.polled) < maxResults {
+		if err := w.step(); err != nil {
+			return nil, err
+		}
+	}
+
+	// the submissions from now on wake the poller up again, like when the
+	// loop parks
+	s.queueMu.Lock()
+	queued := len(s.queue) > 0
+	s.notified = queued
+	s.queueMu.Unlock()
+
+	n := len(s.polled)
+	if maxResults > 0 && n > maxResults {
+		n = maxResults
+	}
+	// the results of the last call are overwritten or cleared
+	results := append(s.returned[:0], s.polled[:n]...)
+	for i := n; i < len(s.returned); i++ {
+		s.returned[i] = OpResult{}
+	}
+	s.returned = results
+	left := copy(s.polled, s.polled[n:])
+	for i := left; i < len(s.polled); i++ {
+		s.polled[i] = OpResult{}
+	}
+	s.polled = s.polled[:left]
+	if left > 0 || queued {
+		// readable until the results and the submissions left are taken
+		s.pfd.Wakeup()
+	}
+	return results, nil
+}
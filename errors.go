@@ -0,0 +1,192 @@
+package gaio
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The errors of the package are the sentinels below and the errors of the
+// system, returned by its functions and wrapped in an OpError in
+// OpResult.Err, so they're matched with errors.Is. A sentinel may stand for
+// a condition, which its errors match as well as their own sentinel or
+// errno: ErrConnClosed, ErrPeerGone, ErrTransient, ErrInvalid, ErrCanceled
+// and ErrUnsupported. The errnos matching a condition depend on the
+// platform, so conditions are tested instead of errnos.
+var (
+	// ErrNoRawConn is returned by Watch for a conn without a raw fd.
+	ErrNoRawConn = errors.New("net.Conn does implement net.RawConn")
+	// ErrWatcherClosed is returned by the submissions to a closed watcher,
+	// and is the error of the requests ended by CloseWait.
+	ErrWatcherClosed = errors.New("watcher closed")
+	// ErrNotWatched is returned for fds which are not watched.
+	ErrNotWatched = errors.New("fd is not watched")
+	// ErrAlreadyWatched is returned by Watch and WatchFd for a fd watched
+	// already.
+	ErrAlreadyWatched = errors.New("fd is watched already")
+	// ErrMaxConns is returned by Watch past the limit of WithMaxConns.
+	ErrMaxConns = errors.New("too many watched connections")
+	// ErrBufferBusy is returned by SetBuffer while reads into the buffer
+	// are pending.
+	ErrBufferBusy = errors.New("buffer is used by pending reads")
+
+	// ErrConnClosed matches the errors of requests on a connection closed
+	// or reset by the peer, such as EPIPE and ECONNRESET, and
+	// ErrKeepAliveTimeout.
+	ErrConnClosed = errors.New("connection closed")
+	// ErrPeerGone matches the errors of a peer which went away: those of
+	// ErrConnClosed, timeouts and unreachable or refusing peers.
+	ErrPeerGone = errors.New("peer is gone")
+	// ErrTransient matches the errors of a shortage of resources which may
+	// succeed when retried, such as ENOBUFS and ENOMEM.
+	ErrTransient = errors.New("transient failure")
+	// ErrInvalid matches the errors of invalid requests, programming
+	// errors such as EBADF and EINVAL.
+	ErrInvalid = errors.New("invalid request")
+	// ErrCanceled matches the errors of requests ended before they
+	// completed, ErrDraining and ErrExported.
+	ErrCanceled = errors.New("request canceled")
+	// ErrUnsupported matches the errors of features the system or the
+	// platform doesn't support.
+	ErrUnsupported = errors.New("not supported")
+)
+
+// errnoConditions are the conditions matched by the errnos of results,
+// completed by the platform
+var errnoConditions = map[syscall.Errno][]error{
+	syscall.EPIPE:        {ErrConnClosed, ErrPeerGone},
+	syscall.ECONNRESET:   {ErrConnClosed, ErrPeerGone},
+	syscall.ECONNABORTED: {ErrConnClosed, ErrPeerGone},
+	syscall.ETIMEDOUT:    {ErrPeerGone},
+	syscall.ECONNREFUSED: {ErrPeerGone},
+	syscall.EHOSTUNREACH: {ErrPeerGone},
+	syscall.EHOSTDOWN:    {ErrPeerGone},
+	syscall.ENETUNREACH:  {ErrPeerGone},
+	syscall.ENETDOWN:     {ErrPeerGone},
+	syscall.ENETRESET:    {ErrPeerGone},
+	syscall.ENOTCONN:     {ErrPeerGone},
+
+	syscall.ENOBUFS: {ErrTransient},
+	syscall.ENOMEM:  {ErrTransient},
+	syscall.EAGAIN:  {ErrTransient},
+	syscall.EINTR:   {ErrTransient},
+	syscall.EMFILE:  {ErrTransient},
+	syscall.ENFILE:  {ErrTransient},
+
+	syscall.EBADF:        {ErrInvalid},
+	syscall.EINVAL:       {ErrInvalid},
+	syscall.EFAULT:       {ErrInvalid},
+	syscall.ENOTSOCK:     {ErrInvalid},
+	syscall.EDESTADDRREQ: {ErrInvalid},
+	syscall.EISCONN:      {ErrInvalid},
+	syscall.EMSGSIZE:     {ErrInvalid},
+
+	syscall.EOPNOTSUPP:   {ErrUnsupported},
+	syscall.EAFNOSUPPORT: {ErrUnsupported},
+	syscall.ENOPROTOOPT:  {ErrUnsupported},
+}
+
+// kindError is a sentinel standing for conditions, see errors.Is
+type kindError struct {
+	msg   string
+	kinds []error
+}
+
+func newKindError(msg string, kinds ...error) error {
+	return &kindError{msg: msg, kinds: kinds}
+}
+
+func (e *kindError) Error() string        { return e.msg }
+func (e *kindError) Is(target error) bool { return isKind(e.kinds, target) }
+
+// errnoError is an errno matching conditions, it matches both with
+// errors.Is
+type errnoError struct {
+	errno syscall.Errno
+	kinds []error
+}
+
+func (e *errnoError) Error() string        { return e.errno.Error() }
+func (e *errnoError) Unwrap() error        { return e.errno }
+func (e *errnoError) Is(target error) bool { return isKind(e.kinds, target) }
+
+func isKind(kinds []error, target error) bool {
+	for _, kind := range kinds {
+		if target == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// OpError is the error of a request in OpResult.Err, with the context of
+// the request. errors.Is and errors.As see through it to Err, a sentinel of
+// the package or an errno.
+type OpError struct {
+	Op         OpType
+	Fd         int
+	RemoteAddr net.Addr // of the peer, nil if unknown
+	BytesDone  int      // bytes transferred before the error
+	Tags       []string // of the fd, see SetTags
+	Err        error
+}
+
+func (e *OpError) Error() string {
+	s := e.Op.String() + " fd " + strconv.Itoa(e.Fd)
+	if e.RemoteAddr != nil {
+		s += " " + e.RemoteAddr.String()
+	}
+	if len(e.Tags) > 0 {
+		s += " [" + strings.Join(e.Tags, " ") + "]"
+	}
+	if e.BytesDone > 0 {
+		s += " after " + strconv.Itoa(e.BytesDone) + " bytes"
+	}
+	return s + ": " + e.Err.Error()
+}
+
+func (e *OpError) Unwrap() error { return e.Err }
+
+// Timeout reports whether Err is a timeout, like net.OpError, so OpError
+// is a net.Error.
+func (e *OpError) Timeout() bool {
+	var t interface{ Timeout() bool }
+	return errors.As(e.Err, &t) && t.Timeout()
+}
+
+// Temporary reports whether Err is temporary, like net.OpError.
+func (e *OpError) Temporary() bool {
+	var t interface{ Temporary() bool }
+	return errors.As(e.Err, &t) && t.Temporary()
+}
+
+// opError wraps the error of res in an OpError, with its errno matching
+// its conditions
+func (w *Watcher) opError(res *OpResult) error {
+	err := res.Err
+	if err == nil {
+		return nil
+	} else if _, ok := err.(*OpError); ok {
+		return err
+	}
+	if errno, ok := err.(syscall.Errno); ok && errnoConditions[errno] != nil {
+		err = &errnoError{errno: errno, kinds: errnoConditions[errno]}
+	}
+	oe := &OpError{Op: res.Operation, Fd: res.Fd, RemoteAddr: w.peerAddr(res.Fd), Tags: w.fds.tags(res.Fd), Err: err}
+	if res.Size > 0 {
+		// a failed syscall returns -1
+		oe.BytesDone = res.Size
+	}
+	return oe
+}
+
+// peerAddr is the remote address of fd for an error, from its conn if any
+// as a reset socket has no peer
+func (w *Watcher) peerAddr(fd int) net.Addr {
+	if conn := w.fds.conn(fd); conn != nil {
+		return conn.RemoteAddr()
+	}
+	return remoteAddr(fd, nil)
+}
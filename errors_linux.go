@@ -0,0 +1,9 @@
+package gaio
+
+import "syscall"
+
+func init() {
+	errnoConditions[syscall.ENONET] = []error{ErrPeerGone}
+	errnoConditions[syscall.EREMOTEIO] = []error{ErrPeerGone}
+	errnoConditions[syscall.ENOSR] = []error{ErrTransient}
+}
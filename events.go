@@ -0,0 +1,71 @@
+package gaio
+
+import "sync/atomic"
+
+const (
+	// minEvents is the initial size of the events buffer of a poller
+	minEvents = 64
+	// defaultMaxEvents caps the growth of the events buffer
+	defaultMaxEvents = 4096
+	// defaultEventBudget is the number of events processed before the
+	// submissions are drained
+	defaultEventBudget = 256
+
+	// the buffer is doubled after growAfter consecutive full waits, and
+	// halved after shrinkAfter consecutive waits using less than a quarter
+	growAfter   = 2
+	shrinkAfter = 1024
+)
+
+// eventsPolicy sizes the events buffer of a poller, so a burst of ready fds
+// is drained with a few waits without holding a large buffer forever.
+type eventsPolicy struct {
+	size  int
+	max   int
+	full  int // consecutive full waits
+	light int // consecutive waits using less than a quarter
+	stats *pollStats
+}
+
+func newEventsPolicy(max int, stats *pollStats) eventsPolicy {
+	if max < minEvents {
+		max = minEvents
+	}
+	atomic.StoreInt64(&stats.bufSize, minEvents)
+	return eventsPolicy{size: minEvents, max: max, stats: stats}
+}
+
+// next records a wait returning n events, and returns the size of the
+// buffer for the next wait.
+func (e *eventsPolicy) next(n int) int {
+	atomic.AddUint64(&e.stats.waits, 1)
+	atomic.AddUint64(&e.stats.events, uint64(n))
+
+	switch {
+	case n >= e.size:
+		e.light = 0
+		if e.full++; e.full >= growAfter && e.size < e.max {
+			e.full = 0
+			e.size *= 2
+			if e.size > e.max {
+				e.size = e.max
+			}
+			atomic.AddUint64(&e.stats.grown, 1)
+			atomic.StoreInt64(&e.stats.bufSize, int64(e.size))
+		}
+	case n < e.size/4:
+		e.full = 0
+		if e.light++; e.light >= shrinkAfter && e.size > minEvents {
+			e.light = 0
+			if e.size /= 2; e.size < minEvents {
+				e.size = minEvents
+			}
+			atomic.AddUint64(&e.stats.shrunk, 1)
+			atomic.StoreInt64(&e.stats.bufSize, int64(e.size))
+		}
+	default:
+		e.full = 0
+		e.light = 0
+	}
+	return e.size
+}
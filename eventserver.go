@@ -0,0 +1,259 @@
+package gaio
+
+import (
+	"net"
+	"runtime/debug"
+	"sync"
+)
+
+// EventServer serves connections with callbacks, on a Watcher which reads
+// from every connection, passes the data to OnData and writes its reply
+// before reading again, so a connection handles one read at a time. The
+// callbacks of a connection are called in order, those of different
+// connections in parallel. The poller count and buffer sizes are the
+// options of its watcher, see WithShards and WithReadBufferSize, which
+// Watcher returns for the tuning of connections.
+type EventServer struct {
+	// OnOpen is called for each connection before its first read.
+	OnOpen func(h Handle)
+	// OnData is called with the data read from a connection, valid during
+	// the call only, and returns the data to write back, if any. The reply
+	// may be data itself, and must not be modified until the connection
+	// reads again.
+	OnData func(h Handle, data []byte) (reply []byte)
+	// OnClose is called once a connection is closed, err is nil if it was
+	// closed by the peer or Handle.Close. It's called from the event loops
+	// of the watcher and must not block.
+	OnClose func(h Handle, err error)
+	// Handlers is the number of goroutines calling OnData, derived like
+	// those of Dispatch if zero.
+	Handlers int
+
+	w       *Watcher
+	results chan OpResult
+	start   sync.Once
+
+	mu        sync.Mutex
+	conns     map[int]*eventConn
+	listeners map[net.Listener]struct{}
+}
+
+// eventConn is a connection of an EventServer
+type eventConn struct {
+	conn    net.Conn
+	read    OpResult // held until its reply is written
+	closing bool     // no more requests are submitted
+	err     error    // why it's closed
+}
+
+// Handle is a connection of an EventServer, its methods are called from the
+// callbacks of the connection.
+type Handle struct {
+	s  *EventServer
+	fd int
+}
+
+// NewEventServer returns an EventServer on a new watcher with opts, its
+// OnClose replaces the callback of WithOnClosed.
+func NewEventServer(opts ...Option) (*EventServer, error) {
+	s := &EventServer{
+		results:   make(chan OpResult, 1024),
+		conns:     make(map[int]*eventConn),
+		listeners: make(map[net.Listener]struct{}),
+	}
+	w, err := CreateWatcher(append(opts, WithOnClosed(s.closed))...)
+	if err != nil {
+		return nil, err
+	}
+	s.w = w
+	return s, nil
+}
+
+// Watcher returns the watcher of s.
+func (s *EventServer) Watcher() *Watcher { return s.w }
+
+// Serve accepts the connections of ln until it fails or s is closed.
+func (s *EventServer) Serve(ln net.Listener) error {
+	s.start.Do(func() {
+		s.w.Dispatch(s.results, s.Handlers, s.handle)
+	})
+
+	s.mu.Lock()
+	s.listeners[ln] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, ln)
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-s.w.die:
+				return ErrWatcherClosed
+			default:
+				return err
+			}
+		}
+		if err := s.open(conn); err != nil {
+			s.w.logger.Log("event server watch failed", "addr", conn.RemoteAddr(), "err", err)
+			conn.Close()
+		}
+	}
+}
+
+// open watches conn and starts reading
+func (s *EventServer) open(conn net.Conn) error {
+	fd, err := s.w.Watch(conn)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.conns[fd] = &eventConn{conn: conn}
+	s.mu.Unlock()
+
+	h := Handle{s: s, fd: fd}
+	if s.OnOpen != nil && !s.call("OnOpen", h, func() { s.OnOpen(h) }) {
+		return nil
+	}
+	s.read(fd)
+	return nil
+}
+
+// handle processes a result of a connection on a dispatch goroutine
+func (s *EventServer) handle(res OpResult) {
+	h := Handle{s: s, fd: res.Fd}
+	switch {
+	case res.Err != nil:
+		res.Release()
+		s.release(res.Fd)
+		s.close(res.Fd, res.Err)
+	case res.Operation == OpRead && res.Size == 0:
+		res.Release()
+		s.close(res.Fd, nil)
+	case res.Operation == OpRead:
+		var reply []byte
+		if s.OnData != nil && !s.call("OnData", h, func() { reply = s.OnData(h, res.Buffer[:res.Size]) }) {
+			res.Release()
+			return
+		}
+		if len(reply) == 0 {
+			res.Release()
+			s.read(res.Fd)
+			return
+		}
+		s.mu.Lock()
+		c := s.conns[res.Fd]
+		if c == nil || c.closing {
+			s.mu.Unlock()
+			res.Release()
+			return
+		}
+		c.read = res
+		s.mu.Unlock()
+		if err := s.w.Write(res.Fd, reply, s.results); err != nil {
+			s.release(res.Fd)
+			s.close(res.Fd, err)
+		}
+	default:
+		// the reply is written
+		s.release(res.Fd)
+		s.read(res.Fd)
+	}
+}
+
+// read submits the next read of fd unless it's closing
+func (s *EventServer) read(fd int) {
+	s.mu.Lock()
+	c := s.conns[fd]
+	s.mu.Unlock()
+	if c == nil || c.closing {
+		return
+	}
+	if err := s.w.Read(fd, nil, s.results); err != nil {
+		s.close(fd, err)
+	}
+}
+
+// release releases the read held for the reply of fd
+func (s *EventServer) release(fd int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c := s.conns[fd]; c != nil {
+		c.read.Release()
+		c.read = OpResult{}
+	}
+}
+
+// call runs a callback of h, a panic closes the connection with a
+// PanicError and is logged
+func (s *EventServer) call(name string, h Handle, f func()) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			err := &PanicError{Where: name, Value: r, Stack: debug.Stack()}
+			s.w.logger.Log("callback panicked", "callback", name, "err", err)
+			s.close(h.fd, err)
+		}
+	}()
+	f()
+	return true
+}
+
+// close closes fd for err once, the error is reported to OnClose
+func (s *EventServer) close(fd int, err error) {
+	s.mu.Lock()
+	c := s.conns[fd]
+	if c == nil || c.closing {
+		s.mu.Unlock()
+		return
+	}
+	c.closing, c.err = true, err
+	s.mu.Unlock()
+	s.w.StopWatch(fd)
+}
+
+// closed is the callback of WithOnClosed of the watcher
+func (s *EventServer) closed(fd int, conn net.Conn, ctx interface{}, reason error) {
+	s.mu.Lock()
+	c := s.conns[fd]
+	delete(s.conns, fd)
+	s.mu.Unlock()
+	if c == nil {
+		return
+	}
+	c.read.Release()
+	c.conn.Close()
+	if c.err == nil {
+		c.err = reason
+	}
+	if s.OnClose != nil {
+		defer s.w.recoverCallback("OnClose")
+		s.OnClose(Handle{s: s, fd: fd}, c.err)
+	}
+}
+
+// Close closes the listeners being served and the watcher, with the
+// connections.
+func (s *EventServer) Close() error {
+	s.mu.Lock()
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	s.mu.Unlock()
+	return s.w.Close()
+}
+
+// Fd returns the fd of the connection.
+func (h Handle) Fd() int { return h.fd }
+
+// Write writes data to the connection apart from the replies of OnData,
+// data must not be modified until it's written. A failed write fails the
+// reads of the connection, which close it.
+func (h Handle) Write(data []byte) error {
+	return h.s.w.Write(h.fd, data, nil)
+}
+
+// Close closes the connection.
+func (h Handle) Close() { h.s.close(h.fd, nil) }
@@ -0,0 +1,448 @@
+// Package fakes provides an in-memory gaio.Interface for the unit tests of
+// code using a watcher, its completions are scripted by the test instead
+// of driven by sockets and time.
+package fakes
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/xtaci/gaio"
+)
+
+// readSize is the size of the buffers of reads submitted with a nil buffer
+const readSize = 4096
+
+// firstFd is the fd of the first conn watched by Watch
+const firstFd = 3
+
+// request is a pending read or write
+type request struct {
+	op       gaio.OpType
+	buf      []byte
+	size     int // bytes written so far
+	done     chan gaio.OpResult
+	deadline time.Time
+}
+
+// fdState is the script and the pending requests of a watched fd
+type fdState struct {
+	conn    net.Conn
+	ctx     interface{}
+	input   []byte // fed and not read yet
+	eof     bool
+	budget  int // bytes the writes may take, negative if unlimited
+	fail    map[gaio.OpType]error
+	readers []*request
+	writers []*request
+}
+
+// delivery is a result waiting to be delivered
+type delivery struct {
+	done chan gaio.OpResult
+	res  gaio.OpResult
+}
+
+// Watcher is an in-memory gaio.Interface. Reads complete with the bytes fed
+// by Feed, writes are captured and returned by Written, and deadlines
+// expire as the clock is advanced by Advance. It keeps the contracts of
+// gaio.Watcher: the requests of a fd complete in order, requests on a fd
+// which isn't watched fail with gaio.ErrNotWatched, StopWatch, CloseConn
+// and Close drop the pending requests without results, the submissions to a closed
+// watcher return gaio.ErrWatcherClosed, and the errors of results are
+// wrapped in a gaio.OpError.
+//
+// The results are delivered in order by a goroutine of the watcher, so the
+// test receives them like from a gaio.Watcher.
+type Watcher struct {
+	mu      sync.Mutex
+	now     time.Time
+	nextFd  int
+	fds     map[int]*fdState
+	written map[int][]byte
+	queue   []delivery
+
+	notify  chan struct{}
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+var _ gaio.Interface = (*Watcher)(nil)
+
+// NewWatcher creates a fake watcher whose clock starts at the current time.
+func NewWatcher() *Watcher {
+	w := &Watcher{
+		now:     time.Now(),
+		nextFd:  firstFd,
+		fds:     make(map[int]*fdState),
+		written: make(map[int][]byte),
+		notify:  make(chan struct{}, 1),
+		die:     make(chan struct{}),
+	}
+	go w.deliverLoop()
+	return w
+}
+
+// Watch watches conn under a new fd, any net.Conn can be watched.
+func (w *Watcher) Watch(conn net.Conn) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed() {
+		return 0, gaio.ErrWatcherClosed
+	}
+	for _, st := range w.fds {
+		if st.conn == conn {
+			return 0, gaio.ErrAlreadyWatched
+		}
+	}
+	for w.fds[w.nextFd] != nil {
+		w.nextFd++
+	}
+	fd := w.nextFd
+	w.nextFd++
+	w.watch(fd, conn)
+	return fd, nil
+}
+
+// WatchFd watches fd, without a conn, the options are ignored.
+func (w *Watcher) WatchFd(fd int, opts ...gaio.WatchOption) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed() {
+		return 0, gaio.ErrWatcherClosed
+	} else if fd < 0 {
+		return 0, syscall.EBADF
+	} else if w.fds[fd] != nil {
+		return 0, gaio.ErrAlreadyWatched
+	}
+	w.watch(fd, nil)
+	return fd, nil
+}
+
+func (w *Watcher) watch(fd int, conn net.Conn) {
+	w.fds[fd] = &fdState{conn: conn, budget: -1, fail: make(map[gaio.OpType]error)}
+	delete(w.written, fd)
+}
+
+// StopWatch stops watching fd, its pending requests are dropped.
+func (w *Watcher) StopWatch(fd int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.fds, fd)
+}
+
+// CloseConn stops watching fd like StopWatch, and closes its conn, a fd
+// watched by WatchFd has none.
+func (w *Watcher) CloseConn(fd int) {
+	w.mu.Lock()
+	st := w.fds[fd]
+	delete(w.fds, fd)
+	w.mu.Unlock()
+	if st != nil && st.conn != nil {
+		st.conn.Close()
+	}
+}
+
+// SetContext associates v with the watched fd.
+func (w *Watcher) SetContext(fd int, v interface{}) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	st := w.fds[fd]
+	if st == nil {
+		return gaio.ErrNotWatched
+	}
+	st.ctx = v
+	return nil
+}
+
+// Context returns the value associated with fd by SetContext.
+func (w *Watcher) Context(fd int) (interface{}, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if st := w.fds[fd]; st != nil && st.ctx != nil {
+		return st.ctx, true
+	}
+	return nil, false
+}
+
+// Read submits a read, which completes with the bytes fed to fd. A nil buf
+// is allocated at completion.
+func (w *Watcher) Read(fd int, buf []byte, done chan gaio.OpResult) error {
+	return w.submit(fd, &request{op: gaio.OpRead, buf: buf, done: done})
+}
+
+// ReadTimeout submits a read like Read, which fails with gaio.ErrDeadline
+// once the clock reaches deadline.
+func (w *Watcher) ReadTimeout(fd int, buf []byte, done chan gaio.OpResult, deadline time.Time) error {
+	return w.submit(fd, &request{op: gaio.OpRead, buf: buf, done: done, deadline: deadline})
+}
+
+// Write submits a write, which completes once buf is taken by the budget
+// of fd, see SetWriteBudget.
+func (w *Watcher) Write(fd int, buf []byte, done chan gaio.OpResult) error {
+	return w.submit(fd, &request{op: gaio.OpWrite, buf: buf, done: done})
+}
+
+// WriteTimeout submits a write like Write, which fails with
+// gaio.ErrDeadline once the clock reaches deadline.
+func (w *Watcher) WriteTimeout(fd int, buf []byte, done chan gaio.OpResult, deadline time.Time) error {
+	return w.submit(fd, &request{op: gaio.OpWrite, buf: buf, done: done, deadline: deadline})
+}
+
+// Close closes the watcher, the pending requests are dropped.
+func (w *Watcher) Close() error {
+	w.dieOnce.Do(func() {
+		w.mu.Lock()
+		close(w.die)
+		w.fds = make(map[int]*fdState)
+		w.mu.Unlock()
+	})
+	return nil
+}
+
+// Done returns a channel closed by Close.
+func (w *Watcher) Done() <-chan struct{} {
+	return w.die
+}
+
+// Err returns nil until Close, then gaio.ErrWatcherClosed.
+func (w *Watcher) Err() error {
+	if w.closed() {
+		return gaio.ErrWatcherClosed
+	}
+	return nil
+}
+
+// Feed queues data to be read from the watched fd.
+func (w *Watcher) Feed(fd int, data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	st := w.fds[fd]
+	if st == nil {
+		return gaio.ErrNotWatched
+	}
+	st.input = append(st.input, data...)
+	w.process(fd, st)
+	return nil
+}
+
+// FeedEOF ends the data of the watched fd, the reads after the data fed
+// complete with zero bytes like at the end of a stream.
+func (w *Watcher) FeedEOF(fd int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	st := w.fds[fd]
+	if st == nil {
+		return gaio.ErrNotWatched
+	}
+	st.eof = true
+	w.process(fd, st)
+	return nil
+}
+
+// Written returns the bytes written to fd since the last call, including
+// the writes of fd before StopWatch.
+func (w *Watcher) Written(fd int) []byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	b := w.written[fd]
+	delete(w.written, fd)
+	return b
+}
+
+// SetWriteBudget lets the writes of the watched fd take n more bytes, a
+// write left partially written waits for the next budget. A negative n,
+// the default, takes writes whole.
+func (w *Watcher) SetWriteBudget(fd int, n int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	st := w.fds[fd]
+	if st == nil {
+		return gaio.ErrNotWatched
+	}
+	st.budget = n
+	w.process(fd, st)
+	return nil
+}
+
+// Fail makes the next read or write of the watched fd, pending or
+// submitted later, fail with err.
+func (w *Watcher) Fail(fd int, op gaio.OpType, err error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	st := w.fds[fd]
+	if st == nil {
+		return gaio.ErrNotWatched
+	}
+	st.fail[op] = err
+	w.process(fd, st)
+	return nil
+}
+
+// Now returns the time of the clock of the watcher.
+func (w *Watcher) Now() time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.now
+}
+
+// Advance advances the clock of the watcher by d, the requests whose
+// deadline it reaches fail with gaio.ErrDeadline, by fd.
+func (w *Watcher) Advance(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.now = w.now.Add(d)
+	fds := make([]int, 0, len(w.fds))
+	for fd := range w.fds {
+		fds = append(fds, fd)
+	}
+	sort.Ints(fds)
+	for _, fd := range fds {
+		w.expire(fd, w.fds[fd])
+	}
+}
+
+func (w *Watcher) closed() bool {
+	select {
+	case <-w.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// submit queues req on fd and completes what it can, a request on a fd
+// which isn't watched fails with gaio.ErrNotWatched
+func (w *Watcher) submit(fd int, req *request) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed() {
+		return gaio.ErrWatcherClosed
+	}
+	st := w.fds[fd]
+	if st == nil {
+		w.complete(fd, nil, req, 0, gaio.ErrNotWatched)
+		return nil
+	}
+	if req.op == gaio.OpRead {
+		st.readers = append(st.readers, req)
+	} else {
+		st.writers = append(st.writers, req)
+	}
+	w.process(fd, st)
+	w.expire(fd, st)
+	return nil
+}
+
+// process completes the requests of fd in order, as far as its input and
+// write budget allow
+func (w *Watcher) process(fd int, st *fdState) {
+	for len(st.readers) > 0 {
+		req := st.readers[0]
+		if err := st.fail[gaio.OpRead]; err != nil {
+			delete(st.fail, gaio.OpRead)
+			st.readers = st.readers[1:]
+			w.complete(fd, st, req, 0, err)
+			continue
+		} else if len(st.input) == 0 && !st.eof {
+			break
+		}
+		if req.buf == nil {
+			size := len(st.input)
+			if size > readSize {
+				size = readSize
+			}
+			req.buf = make([]byte, size)
+		}
+		n := copy(req.buf, st.input)
+		st.input = st.input[n:]
+		st.readers = st.readers[1:]
+		w.complete(fd, st, req, n, nil)
+	}
+
+	for len(st.writers) > 0 {
+		req := st.writers[0]
+		if err := st.fail[gaio.OpWrite]; err != nil {
+			delete(st.fail, gaio.OpWrite)
+			st.writers = st.writers[1:]
+			w.complete(fd, st, req, req.size, err)
+			continue
+		}
+		n := len(req.buf) - req.size
+		if st.budget >= 0 && n > st.budget {
+			n = st.budget
+		}
+		w.written[fd] = append(w.written[fd], req.buf[req.size:req.size+n]...)
+		req.size += n
+		if st.budget >= 0 {
+			st.budget -= n
+		}
+		if req.size < len(req.buf) {
+			break
+		}
+		st.writers = st.writers[1:]
+		w.complete(fd, st, req, req.size, nil)
+	}
+}
+
+// expire fails the requests of fd whose deadline the clock reached
+func (w *Watcher) expire(fd int, st *fdState) {
+	for _, q := range []*[]*request{&st.readers, &st.writers} {
+		kept := (*q)[:0]
+		for _, req := range *q {
+			if !req.deadline.IsZero() && !w.now.Before(req.deadline) {
+				w.complete(fd, st, req, req.size, gaio.ErrDeadline)
+			} else {
+				kept = append(kept, req)
+			}
+		}
+		*q = kept
+	}
+}
+
+// complete queues the result of req for delivery
+func (w *Watcher) complete(fd int, st *fdState, req *request, size int, err error) {
+	if req.done == nil {
+		return
+	}
+	res := gaio.OpResult{Operation: req.op, Fd: fd, Buffer: req.buf, Size: size}
+	if err != nil {
+		oe := &gaio.OpError{Op: req.op, Fd: fd, BytesDone: size, Err: err}
+		if st != nil && st.conn != nil {
+			oe.RemoteAddr = st.conn.RemoteAddr()
+		}
+		res.Err = oe
+	}
+	w.queue = append(w.queue, delivery{req.done, res})
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// deliverLoop delivers the results in order until Close
+func (w *Watcher) deliverLoop() {
+	for {
+		w.mu.Lock()
+		queue := w.queue
+		w.queue = nil
+		w.mu.Unlock()
+
+		for _, d := range queue {
+			select {
+			case d.done <- d.res:
+			case <-w.die:
+				return
+			}
+		}
+
+		select {
+		case <-w.notify:
+		case <-w.die:
+			return
+		}
+	}
+}
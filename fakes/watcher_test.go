@@ -0,0 +1,310 @@
+package fakes
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xtaci/gaio"
+)
+
+// peer is the other end of a watched fd
+type peer interface {
+	send(t *testing.T, data []byte)
+	sendEOF(t *testing.T)
+	recv(t *testing.T, n int) []byte
+	waitClosed(t *testing.T)
+	close()
+}
+
+// waitClosed waits for the end of conn, closed by its other end
+func waitClosed(t *testing.T, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("conn not closed:", err)
+	}
+}
+
+// connPeer is the peer of a fd watched by a gaio.Watcher
+type connPeer struct{ conn net.Conn }
+
+func (p connPeer) send(t *testing.T, data []byte) {
+	if _, err := p.conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (p connPeer) sendEOF(t *testing.T) {
+	if err := p.conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (p connPeer) recv(t *testing.T, n int) []byte {
+	buf := make([]byte, n)
+	p.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(p.conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func (p connPeer) waitClosed(t *testing.T) { waitClosed(t, p.conn) }
+
+func (p connPeer) close() { p.conn.Close() }
+
+// fakePeer is the peer of a fd watched by a Watcher
+type fakePeer struct {
+	w    *Watcher
+	fd   int
+	conn net.Conn
+}
+
+func (p fakePeer) send(t *testing.T, data []byte) {
+	if err := p.w.Feed(p.fd, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (p fakePeer) sendEOF(t *testing.T) {
+	if err := p.w.FeedEOF(p.fd); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (p fakePeer) recv(t *testing.T, n int) []byte {
+	b := p.w.Written(p.fd)
+	if len(b) != n {
+		t.Fatalf("%v bytes written, want %v", len(b), n)
+	}
+	return b
+}
+
+func (p fakePeer) waitClosed(t *testing.T) { waitClosed(t, p.conn) }
+
+func (p fakePeer) close() { p.conn.Close() }
+
+func watchReal(t *testing.T) (gaio.Interface, int, peer) {
+	w, err := gaio.CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := w.Watch(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, fd, connPeer{client}
+}
+
+func watchFake(t *testing.T) (gaio.Interface, int, peer) {
+	w := NewWatcher()
+	client, conn := net.Pipe()
+	fd, err := w.Watch(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, fd, fakePeer{w, fd, client}
+}
+
+func TestParity(t *testing.T) {
+	for name, watch := range map[string]func(*testing.T) (gaio.Interface, int, peer){"real": watchReal, "fake": watchFake} {
+		t.Run(name, func(t *testing.T) { testSemantics(t, watch) })
+	}
+}
+
+func TestParityCloseConn(t *testing.T) {
+	for name, watch := range map[string]func(*testing.T) (gaio.Interface, int, peer){"real": watchReal, "fake": watchFake} {
+		t.Run(name, func(t *testing.T) { testCloseConn(t, watch) })
+	}
+}
+
+// testCloseConn checks CloseConn stops watching fd and closes its conn
+func testCloseConn(t *testing.T, watch func(*testing.T) (gaio.Interface, int, peer)) {
+	w, fd, p := watch(t)
+	defer w.Close()
+	defer p.close()
+	done := make(chan gaio.OpResult, 1)
+
+	w.CloseConn(fd)
+	p.waitClosed(t)
+	if err := w.Read(fd, make([]byte, 8), done); err != nil {
+		t.Fatal(err)
+	}
+	if res := <-done; !errors.Is(res.Err, gaio.ErrNotWatched) {
+		t.Fatal("read of a closed conn:", res.Err)
+	}
+}
+
+// testSemantics checks the documented semantics of a watcher
+func testSemantics(t *testing.T, watch func(*testing.T) (gaio.Interface, int, peer)) {
+	w, fd, p := watch(t)
+	defer w.Close()
+	defer p.close()
+	done := make(chan gaio.OpResult, 4)
+
+	if err := w.SetContext(fd, "session"); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := w.Context(fd); !ok || v != "session" {
+		t.Fatal("incorrect context:", v, ok)
+	}
+
+	// writes complete in order
+	for _, s := range []string{"a", "b", "c"} {
+		if err := w.Write(fd, []byte(s), done); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, s := range []string{"a", "b", "c"} {
+		if res := <-done; res.Err != nil || res.Operation != gaio.OpWrite || string(res.Buffer[:res.Size]) != s {
+			t.Fatal("incorrect write:", res.Err, string(res.Buffer[:res.Size]))
+		}
+	}
+	if b := p.recv(t, 3); string(b) != "abc" {
+		t.Fatal("incorrect bytes written:", string(b))
+	}
+
+	// so do reads, into their buffer or an allocated one
+	w.Read(fd, make([]byte, 8), done)
+	w.Read(fd, nil, done)
+	p.send(t, []byte("hello"))
+	if res := <-done; res.Err != nil || res.Operation != gaio.OpRead || string(res.Buffer[:res.Size]) != "hello" {
+		t.Fatal("incorrect read:", res.Err, string(res.Buffer[:res.Size]))
+	}
+	p.send(t, []byte("world"))
+	if res := <-done; res.Err != nil || string(res.Buffer[:res.Size]) != "world" {
+		t.Fatal("incorrect read:", res.Err, string(res.Buffer[:res.Size]))
+	}
+
+	// an expired read fails with ErrDeadline, a timeout
+	w.ReadTimeout(fd, make([]byte, 8), done, time.Now().Add(-time.Second))
+	res := <-done
+	var oe *gaio.OpError
+	if !errors.Is(res.Err, gaio.ErrDeadline) || !errors.As(res.Err, &oe) || oe.Fd != fd || !oe.Timeout() {
+		t.Fatal("deadline not enforced:", res.Err)
+	}
+
+	// the end of the stream is a read of zero bytes
+	p.sendEOF(t)
+	w.Read(fd, make([]byte, 8), done)
+	if res := <-done; res.Err != nil || res.Size != 0 {
+		t.Fatal("incorrect end of stream:", res.Err, res.Size)
+	}
+
+	// requests on a fd which isn't watched fail in their result
+	w.StopWatch(fd)
+	if _, ok := w.Context(fd); ok {
+		t.Fatal("context not cleared")
+	}
+	if err := w.Read(fd, make([]byte, 8), done); err != nil {
+		t.Fatal(err)
+	}
+	if res := <-done; !errors.Is(res.Err, gaio.ErrNotWatched) || !errors.As(res.Err, &oe) || oe.Op != gaio.OpRead {
+		t.Fatal("read of a stopped fd:", res.Err)
+	}
+
+	// and the submissions to a closed watcher
+	if w.Err() != nil {
+		t.Fatal(w.Err())
+	}
+	w.Close()
+	<-w.Done()
+	if err := w.Write(fd, []byte("x"), done); err != gaio.ErrWatcherClosed || w.Err() != gaio.ErrWatcherClosed {
+		t.Fatal("write to a closed watcher:", err, w.Err())
+	}
+}
+
+func TestWriteBudget(t *testing.T) {
+	w := NewWatcher()
+	defer w.Close()
+	fd, _ := w.WatchFd(7)
+	done := make(chan gaio.OpResult, 2)
+
+	// writes wait for the budget and the ones after them for their turn
+	w.SetWriteBudget(fd, 3)
+	w.Write(fd, []byte("hello"), done)
+	w.Write(fd, []byte("!"), done)
+	if b := w.Written(fd); string(b) != "hel" {
+		t.Fatal("incorrect bytes written:", string(b))
+	}
+	w.SetWriteBudget(fd, -1)
+	if res := <-done; res.Err != nil || res.Size != 5 {
+		t.Fatal("incorrect write:", res.Err, res.Size)
+	}
+	if res := <-done; res.Err != nil || res.Size != 1 {
+		t.Fatal("incorrect write:", res.Err, res.Size)
+	}
+	if b := w.Written(fd); string(b) != "lo!" {
+		t.Fatal("incorrect bytes written:", string(b))
+	}
+
+	// a stalled write expires with its progress as the clock advances
+	w.SetWriteBudget(fd, 2)
+	w.WriteTimeout(fd, []byte("hello"), done, w.Now().Add(time.Second))
+	w.Advance(time.Second - 1)
+	select {
+	case res := <-done:
+		t.Fatal("expired early:", res.Err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	w.Advance(1)
+	res := <-done
+	var oe *gaio.OpError
+	if !errors.Is(res.Err, gaio.ErrDeadline) || res.Size != 2 || !errors.As(res.Err, &oe) || oe.BytesDone != 2 {
+		t.Fatal("deadline not enforced:", res.Err, res.Size)
+	}
+}
+
+func TestFail(t *testing.T) {
+	w := NewWatcher()
+	defer w.Close()
+	fd, _ := w.WatchFd(7)
+	if _, err := w.WatchFd(7); err != gaio.ErrAlreadyWatched {
+		t.Fatal("watched twice:", err)
+	}
+	done := make(chan gaio.OpResult, 1)
+
+	// the next read fails, the ones after it are unaffected
+	w.Read(fd, nil, done)
+	w.Fail(fd, gaio.OpRead, errors.New("reset"))
+	if res := <-done; res.Err == nil || res.Err.Error() != "read fd 7: reset" {
+		t.Fatal("incorrect error:", res.Err)
+	}
+	w.Feed(fd, []byte("x"))
+	w.Read(fd, nil, done)
+	if res := <-done; res.Err != nil || string(res.Buffer[:res.Size]) != "x" {
+		t.Fatal("incorrect read:", res.Err)
+	}
+
+	// pending requests are dropped by StopWatch, the bytes written stay
+	w.Write(fd, []byte("ab"), done)
+	<-done
+	w.Read(fd, nil, done)
+	w.StopWatch(fd)
+	if err := w.Feed(fd, []byte("x")); err != gaio.ErrNotWatched {
+		t.Fatal("fed a stopped fd:", err)
+	}
+	select {
+	case res := <-done:
+		t.Fatal("result of a dropped read:", res.Err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if b := w.Written(fd); string(b) != "ab" {
+		t.Fatal("incorrect bytes written:", string(b))
+	}
+}
@@ -0,0 +1,155 @@
+package gaio
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// PanicError is a panic recovered by the watcher with the stack of the
+// goroutine which panicked. A panic of a loop or a worker terminates the
+// watcher with it, see Err, and a panic of a callback of the application is
+// logged with it, see WithLogger.
+type PanicError struct {
+	Where string // "poller", "worker", or the callback
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("%v panic: %v\n%s", e.Where, e.Value, e.Stack)
+}
+
+// wait runs the poller of s until the watcher terminates, a panic of the
+// loop is returned as an error so it terminates the watcher
+func (s *shard) wait(event func(fd int, readable, writable bool), wakeup func(), idle func() bool) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Where: "poller", Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return s.pfd.Wait(event, wakeup, idle, s.w.die)
+}
+
+// doJob executes a job on the worker ws, a panic is returned as an error so
+// it terminates the watcher
+func (ws *shard) doJob(j job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Where: "worker", Value: r, Stack: debug.Stack()}
+		}
+	}()
+	ws.ops, ws.ready = j.s.ops, j.ready
+	ws.doIO(j.d, j.readable, j.writable)
+	return nil
+}
+
+// recoverCallback is deferred around the callbacks of the application run
+// by the watcher, their panics are logged instead of terminating the loop
+// calling them
+func (w *Watcher) recoverCallback(name string) {
+	if r := recover(); r != nil {
+		w.logger.Log("callback panicked", "callback", name, "err", &PanicError{Where: name, Value: r, Stack: debug.Stack()})
+	}
+}
+
+// endPending ends the requests left on s when the watcher terminates, they
+// fail with err after a fatal error or CloseWait and are dropped on Close.
+// The fds on workers are ended by the workers, see finish.
+func (s *shard) endPending(err error) {
+	s.queueMu.Lock()
+	queue, finished := s.queue, s.finished
+	s.queue, s.finished = nil, nil
+	s.closed = true
+	s.queueMu.Unlock()
+	for _, d := range finished {
+		d.busy = false
+	}
+	// the submissions left by a panic of the loop come first
+	for _, queue := range [][]aiocb{s.unhandled, queue} {
+		for i := range queue {
+			s.end(&queue[i], err)
+		}
+	}
+	s.unhandled = nil
+
+	// jobs no worker took, the fds of other shards are handed back to them
+	// or ended apart from their loops
+	if s.w.jobs != nil {
+	drain:
+		for {
+			select {
+			case j := <-s.w.jobs:
+				s.abandon(j, err)
+			default:
+				break drain
+			}
+		}
+	}
+	for _, j := range s.w.files.take() {
+		s.abandon(j, err)
+	}
+
+	s.w.fds.each(func(fd int, d *fdDesc) bool {
+		if !d.busy && s.w.shardOf(fd) == s {
+			s.endQueues(d, err)
+		}
+		return true
+	})
+}
+
+// abandon takes back the fd of a job no worker took, the fds of other
+// shards are handed back to them or ended apart from their loops
+func (s *shard) abandon(j job, err error) {
+	if j.s == s {
+		j.d.busy = false
+	} else if !j.s.finish(j.d) {
+		(&shard{w: s.w, ops: j.s.ops}).endQueues(j.d, err)
+	}
+}
+
+// endQueues ends the requests queued on d, and deregisters d
+func (s *shard) endQueues(d *fdDesc, err error) {
+	for _, q := range [][]aiocb{d.readers, d.writers, d.urgents} {
+		for i := range q {
+			if sp := q[i].splice; sp != nil && sp.finished {
+				s.retire(&q[i])
+			} else {
+				s.end(&q[i], err)
+			}
+		}
+	}
+	for i := range d.deferred {
+		s.end(&d.deferred[i], err)
+	}
+	d.readers, d.writers, d.urgents, d.zc, d.deferred = nil, nil, nil, nil, nil
+	d.splices = 0
+
+	if conn, ctx, flags := s.w.fds.unregister(d.fd); flags&fdWatched != 0 {
+		s.w.notifyClosed(d.fd, conn, ctx, err)
+		if flags&fdOwned != 0 {
+			unix.Close(d.fd)
+		}
+	}
+}
+
+// end fails a request with err, or drops it on Close. A StopWatch not
+// handled yet is reported to WithOnClosed.
+func (s *shard) end(cb *aiocb, err error) {
+	if cb.kind >= kindStop {
+		if cb.closing {
+			s.w.notifyClosed(cb.fd, cb.conn, cb.ctx, cb.reason)
+		}
+		cb.closeStopped()
+		return
+	} else if err == ErrWatcherClosed && atomic.LoadInt32(&s.w.closing) == 0 {
+		s.drop(cb, err)
+	} else {
+		if cb.counted && err == ErrWatcherClosed {
+			atomic.AddInt64(&s.w.aborted, 1)
+		}
+		s.fail(cb, err)
+	}
+}
@@ -0,0 +1,377 @@
+package gaio
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// flags of fdDesc
+const (
+	fdWatched   uint32 = 1 << iota
+	fdQuickAck         // TCP_QUICKACK re-asserted after reads
+	fdRcvLowat         // SO_RCVLOWAT honoured by reads
+	fdKeepAlive        // ETIMEDOUT maps to ErrKeepAliveTimeout
+	fdLeaked           // reported closed while watched, see WithLeakCheck
+	fdOwned            // duplicated by Watch and closed by the watcher, see WatchDup
+	fdBuffer           // has a buffer for reads, see SetBuffer
+	fdCodec            // has a codec, see SetCodec
+	fdFile             // regular file, executed by the file workers
+	fdReadOnly         // notification fd failing writes, see WatchNotify
+	fdHeartbeat        // writes a heartbeat when silent, see SetHeartbeat
+	fdProbe            // probed when idle, see WithProbe
+	fdSocket           // socket, which the socket options apply to
+	fdCorked           // corked by Cork, see doWrites
+	fdOffloaded        // paired in the sockmap, see Offload
+	fdKTLS             // kernel TLS socket, EIO is a control record, see EnableKTLS
+)
+
+// fdDesc holds the states of a watched fd, it's kept for reuse after
+// StopWatch as fd numbers are recycled by the kernel.
+type fdDesc struct {
+	pinned  int64       // bytes held by pending requests, accessed atomically, first for alignment
+	wrote   int64       // time of the last bytes written, see progressed, accessed atomically
+	stats   connStats   // totals of the results, 64-bit aligned after pinned
+	conn    net.Conn    // hold net.Conn to prevent from GC, nil for raw fds
+	ctx     interface{} // of SetContext, protected by the lock of the table like conn
+	buffer  []byte      // of SetBuffer, protected by the lock of the table like conn
+	codec   Codec       // of SetCodec, protected by the lock of the table like conn
+	bound   int32       // pending reads into buffer, accessed atomically
+	flags   uint32      // accessed atomically
+	pending int32       // pending requests, accessed atomically
+
+	fd int
+
+	// the stack of Watch with WithLeakCheck, protected by the lock of the
+	// table like conn
+	watchStack []uintptr
+
+	// of SetTags, indexed by the table, protected by its lock like conn
+	tags []string
+
+	// size of the buffers allocated for reads, accessed atomically, the
+	// counters are owned by the loop of the shard
+	readSize  int32
+	readFull  uint8
+	readSmall uint8
+
+	// owned by the loop of the shard
+	readers []aiocb
+	writers []aiocb
+	urgents []aiocb
+	zc      *zcState
+	splices int // splice requests queued, processed on the loop
+
+	// decoded data not delivered yet, see SetCodec
+	decoded []byte
+
+	// bytes of the writes queued, see SetWriteWatermarks
+	queued int
+	water  *watermarks
+
+	// write rate limit, the time its writes resume once suspended, and the
+	// timer resuming them
+	rate     *tokenBucket
+	resumeAt time.Time
+	resume   *timer
+
+	// the timer checking the progress of the writes, see checkStall
+	stall *timer
+
+	// the heartbeat of SetHeartbeat and its timer
+	beat *heartbeat
+
+	// the probe of WithProbe or SetTagProbe and its timer
+	prober *probeConfig
+	probe  *timer
+
+	// the budget was exhausted with requests left, set by the executor of
+	// the requests, then moved to the backlog of the loop
+	moreRead     bool
+	moreWrite    bool
+	backlogRead  bool
+	backlogWrite bool
+
+	// new requests to process after the batch of submissions
+	dirtyRead  bool
+	dirtyWrite bool
+
+	// executing on a worker, requests and readiness are deferred
+	busy         bool
+	deferred     []aiocb
+	pendingRead  bool
+	pendingWrite bool
+
+	// timers of requests completed on a worker, and expired while d was
+	// on a worker, see releaseTimers
+	canceled []*timer
+	expired  []*timer
+}
+
+func (d *fdDesc) has(flag uint32) bool {
+	return atomic.LoadUint32(&d.flags)&flag != 0
+}
+
+func (d *fdDesc) set(flag uint32, on bool) {
+	for {
+		old := atomic.LoadUint32(&d.flags)
+		flags := old &^ flag
+		if on {
+			flags |= flag
+		}
+		if atomic.CompareAndSwapUint32(&d.flags, old, flags) {
+			return
+		}
+	}
+}
+
+// fdTable is a dense table of descriptors indexed by fd, lookups are lock
+// free, the lock is only taken to create descriptors and grow the table.
+type fdTable struct {
+	slots unsafe.Pointer // *[]unsafe.Pointer to fdDesc
+	mu    sync.Mutex
+	count int                         // watched fds, protected by mu
+	byTag map[string]map[int]struct{} // fds by tag, see SetTags, protected by mu
+
+	// probes by tag, see SetTagProbe, protected by mu
+	probes map[string]*probeConfig
+}
+
+func (t *fdTable) get(fd int) *fdDesc {
+	slots := (*[]unsafe.Pointer)(atomic.LoadPointer(&t.slots))
+	if slots == nil || fd < 0 || fd >= len(*slots) {
+		return nil
+	}
+	return (*fdDesc)(atomic.LoadPointer(&(*slots)[fd]))
+}
+
+// register marks fd as watched with conn and flags, the descriptor is
+// created if needed. ErrAlreadyWatched is returned if fd is watched, and
+// ErrMaxConns if max fds are watched already, 0 means unlimited.
+func (t *fdTable) register(fd int, conn net.Conn, max int, flags uint32) (*fdDesc, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.watched(fd) != nil {
+		return nil, ErrAlreadyWatched
+	} else if max > 0 && t.count >= max {
+		return nil, ErrMaxConns
+	}
+
+	var slots []unsafe.Pointer
+	if p := (*[]unsafe.Pointer)(atomic.LoadPointer(&t.slots)); p != nil {
+		slots = *p
+	}
+	if fd >= len(slots) {
+		n := 2 * len(slots)
+		if n <= fd {
+			n = fd + 1
+		}
+		grown := make([]unsafe.Pointer, n)
+		for i := range slots {
+			grown[i] = atomic.LoadPointer(&slots[i])
+		}
+		slots = grown
+		atomic.StorePointer(&t.slots, unsafe.Pointer(&slots))
+	}
+
+	d := (*fdDesc)(atomic.LoadPointer(&slots[fd]))
+	if d == nil {
+		d = &fdDesc{fd: fd}
+		atomic.StorePointer(&slots[fd], unsafe.Pointer(d))
+	}
+	if !d.has(fdWatched) {
+		t.count++
+		d.stats.reset()
+	}
+	d.conn = conn
+	atomic.StoreUint32(&d.flags, fdWatched|flags)
+	atomic.StoreInt32(&d.readSize, 0)
+	return d, nil
+}
+
+// unregister clears the watched states of fd, it returns the conn, the
+// context and the flags of fd, so only one of racing calls sees fdWatched
+func (t *fdTable) unregister(fd int) (conn net.Conn, ctx interface{}, flags uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.unregisterLocked(fd)
+}
+
+// unregisterTagged unregisters fd if it's tagged with tag, so a fd number
+// reused by another conn isn't unregistered
+func (t *fdTable) unregisterTagged(fd int, tag string) (conn net.Conn, ctx interface{}, flags uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if d := t.watched(fd); d != nil {
+		for _, dtag := range d.tags {
+			if dtag == tag {
+				return t.unregisterLocked(fd)
+			}
+		}
+	}
+	return nil, nil, 0
+}
+
+func (t *fdTable) unregisterLocked(fd int) (conn net.Conn, ctx interface{}, flags uint32) {
+	if d := t.get(fd); d != nil {
+		if flags = atomic.LoadUint32(&d.flags); flags&fdWatched != 0 {
+			t.count--
+		}
+		conn, ctx = d.conn, d.ctx
+		d.conn, d.ctx, d.buffer, d.codec, d.watchStack = nil, nil, nil, nil, nil
+		t.untag(d)
+		atomic.StoreUint32(&d.flags, 0)
+		d.stats.reset()
+	}
+	return conn, ctx, flags
+}
+
+// setContext sets the context of fd, it returns false if fd isn't watched
+func (t *fdTable) setContext(fd int, ctx interface{}) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if d := t.watched(fd); d != nil {
+		d.ctx = ctx
+		return true
+	}
+	return false
+}
+
+// setBuffer replaces the buffer for the reads of fd unless reads into the
+// previous one are pending
+func (t *fdTable) setBuffer(fd int, buf []byte) error {
+	if len(buf) == 0 {
+		buf = nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d := t.watched(fd)
+	if d == nil {
+		return ErrNotWatched
+	} else if d.buffer != nil && atomic.LoadInt32(&d.bound) > 0 {
+		return ErrBufferBusy
+	}
+	d.buffer = buf
+	d.set(fdBuffer, buf != nil)
+	return nil
+}
+
+// setCodec sets the codec of fd
+func (t *fdTable) setCodec(fd int, c Codec) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d := t.watched(fd)
+	if d == nil {
+		return ErrNotWatched
+	}
+	d.codec = c
+	d.set(fdCodec, c != nil)
+	return nil
+}
+
+// codec returns the codec of fd, nil if none
+func (t *fdTable) codec(fd int) Codec {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if d := t.get(fd); d != nil {
+		return d.codec
+	}
+	return nil
+}
+
+// bindBuffer makes the read cb use the buffer of its fd, if any
+func (t *fdTable) bindBuffer(cb *aiocb) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if d := t.watched(cb.fd); d != nil && d.buffer != nil {
+		cb.buffer, cb.auto, cb.boundDesc = d.buffer, false, d
+		atomic.AddInt32(&d.bound, 1)
+	}
+}
+
+// context returns the context of fd, nil if fd isn't watched
+func (t *fdTable) context(fd int) interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if d := t.watched(fd); d != nil {
+		return d.ctx
+	}
+	return nil
+}
+
+// conn returns the conn of fd, nil if fd isn't watched or is a raw fd
+func (t *fdTable) conn(fd int) net.Conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if d := t.get(fd); d != nil {
+		return d.conn
+	}
+	return nil
+}
+
+// watched returns the descriptor of fd if it's being watched
+func (t *fdTable) watched(fd int) *fdDesc {
+	if d := t.get(fd); d != nil && d.has(fdWatched) {
+		return d
+	}
+	return nil
+}
+
+// len returns the number of watched fds
+func (t *fdTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.count
+}
+
+// each calls f with the descriptors of the table until f returns false
+func (t *fdTable) each(f func(fd int, d *fdDesc) bool) {
+	slots := (*[]unsafe.Pointer)(atomic.LoadPointer(&t.slots))
+	if slots == nil {
+		return
+	}
+	for fd := range *slots {
+		if d := (*fdDesc)(atomic.LoadPointer(&(*slots)[fd])); d != nil && !f(fd, d) {
+			return
+		}
+	}
+}
+
+// rangeChunk is the number of slots rangeConns copies per lock
+const rangeChunk = 256
+
+// rangeConns calls f with the watched fds and their conns until f returns
+// false. They're copied a chunk at a time, f is called without the lock.
+func (t *fdTable) rangeConns(f func(fd int, conn net.Conn) bool) {
+	fds := make([]int, 0, rangeChunk)
+	conns := make([]net.Conn, 0, rangeChunk)
+	for start := 0; ; start += rangeChunk {
+		fds, conns = fds[:0], conns[:0]
+		t.mu.Lock()
+		slots := (*[]unsafe.Pointer)(atomic.LoadPointer(&t.slots))
+		if slots == nil || start >= len(*slots) {
+			t.mu.Unlock()
+			return
+		}
+		end := start + rangeChunk
+		if end > len(*slots) {
+			end = len(*slots)
+		}
+		for fd := start; fd < end; fd++ {
+			if d := (*fdDesc)(atomic.LoadPointer(&(*slots)[fd])); d != nil && d.has(fdWatched) {
+				fds = append(fds, fd)
+				conns = append(conns, d.conn)
+			}
+		}
+		t.mu.Unlock()
+
+		for i := range fds {
+			if !f(fds[i], conns[i]) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package gaio
+
+import (
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileConn holds the file of WatchFile as the conn of its fd, for Range and
+// WithOnClosed
+type fileConn struct{ *os.File }
+
+func (c fileConn) LocalAddr() net.Addr  { return fileAddr(c.Name()) }
+func (c fileConn) RemoteAddr() net.Addr { return fileAddr(c.Name()) }
+
+// fileAddr is the address of a watched file, its name
+type fileAddr string
+
+func (a fileAddr) Network() string { return "file" }
+func (a fileAddr) String() string  { return string(a) }
+
+// WatchFile starts watching events on the file f, like a pipe, a FIFO or a
+// terminal, whose descriptor is set to non-blocking mode. A read completes
+// with zero bytes once all the writers of a pipe are closed, and a write
+// fails with EPIPE once all its readers are. The options of sockets, like
+// WithKeepAlive, don't apply.
+//
+// The fd of f is shared with the caller, who closes f after StopWatch, and
+// in WatchDup mode it's a duplicate owned by the watcher. If own is true
+// the ownership of f is transferred: f is closed once it's watched, and the
+// watcher closes its duplicate on StopWatch and Close.
+func (w *Watcher) WatchFile(f *os.File, own bool) (fd int, err error) {
+	rawconn, err := f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	dup := own || w.watchMode == WatchDup
+	var operr error
+	if err := rawconn.Control(func(s uintptr) {
+		fd = int(s)
+		if dup {
+			fd, operr = unix.FcntlInt(s, unix.F_DUPFD_CLOEXEC, 0)
+		}
+	}); err != nil {
+		return 0, err
+	}
+	if operr != nil {
+		return 0, operr
+	}
+
+	var conn net.Conn = fileConn{f}
+	var flags uint32
+	if dup {
+		conn, flags = nil, fdOwned
+		dupfd := fd
+		defer func() {
+			if err != nil {
+				unix.Close(dupfd)
+			}
+		}()
+	}
+
+	typ, err := typeFlags(fd)
+	if err != nil {
+		return 0, err
+	}
+	flags |= typ
+
+	// files like os.Stdin are blocking
+	if err := unix.SetNonblock(fd, true); err != nil {
+		return 0, err
+	}
+	d, err := w.fds.register(fd, conn, w.maxConns, flags)
+	if err != nil {
+		return 0, err
+	}
+	if w.leakInterval > 0 {
+		w.fds.setStack(d, watchStack())
+	}
+	if err := w.poll(d); err != nil {
+		w.fds.unregister(fd)
+		return 0, err
+	}
+	if w.terminatedWatching(fd) {
+		return 0, ErrWatcherClosed
+	}
+	if own {
+		f.Close()
+	}
+	return fd, nil
+}
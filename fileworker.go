@@ -0,0 +1,111 @@
+package gaio
+
+import (
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// defaultFileWorkers is the number of workers of regular files
+const defaultFileWorkers = 4
+
+// fileQueue is the queue of the jobs of regular files, which the pollers
+// can't wait on as they're always ready, executed by a bounded pool of
+// workers started with the first regular file. The loops never block on it.
+type fileQueue struct {
+	mu    sync.Mutex
+	jobs  []job
+	wake  chan struct{} // a token per job, up to the number of workers
+	start sync.Once
+}
+
+// push queues j for a file worker
+func (q *fileQueue) push(j job) {
+	q.mu.Lock()
+	q.jobs = append(q.jobs, j)
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+		// all the workers are woken up already
+	}
+}
+
+// pop takes the oldest job, ok is false if there's none
+func (q *fileQueue) pop() (j job, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.jobs) == 0 {
+		return j, false
+	}
+	j, q.jobs[0] = q.jobs[0], job{}
+	q.jobs = q.jobs[1:]
+	return j, true
+}
+
+// take takes the jobs no worker took
+func (q *fileQueue) take() []job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := q.jobs
+	q.jobs = nil
+	return jobs
+}
+
+// ErrNotPollable is returned by Watch, WatchFd and WatchFile for a
+// descriptor which can't be polled nor read, like a directory.
+var ErrNotPollable = newKindError("descriptor can't be polled", ErrInvalid)
+
+// typeFlags returns the flags of the type of fd: sockets, which the socket
+// options apply to, and regular files, executed by the file workers as
+// they're always ready. The other types, like pipes, terminals, devices or
+// notification fds, are polled like sockets.
+func typeFlags(fd int) (uint32, error) {
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return 0, err
+	}
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFSOCK:
+		return fdSocket, nil
+	case unix.S_IFREG:
+		return fdFile, nil
+	case unix.S_IFDIR:
+		return 0, ErrNotPollable
+	}
+	return 0, nil
+}
+
+// poll makes the poller of its shard wait on the events of d, regular files
+// are left to the file workers
+func (w *Watcher) poll(d *fdDesc) error {
+	if !d.has(fdFile) {
+		return w.shardOf(d.fd).pfd.Watch(d.fd)
+	}
+	if !w.manual {
+		w.files.start.Do(func() {
+			for i := 0; i < w.numFileWorkers; i++ {
+				w.goLabeled("fileworker", -1, w.fileWorker)
+			}
+		})
+	}
+	return nil
+}
+
+// fileWorker executes the blocking syscalls of regular files like a worker
+// executes those of sockets
+func (w *Watcher) fileWorker() {
+	ws := &shard{w: w, buffer: make([]byte, 4096)}
+	defer ws.closePipes()
+	for {
+		if j, ok := w.files.pop(); ok {
+			w.runJob(ws, j)
+			continue
+		}
+		select {
+		case <-w.files.wake:
+		case <-w.die:
+			return
+		}
+	}
+}
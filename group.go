@@ -0,0 +1,249 @@
+package gaio
+
+import (
+	"errors"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// ErrGroupClosed is returned by CreateWatcherInGroup for a closed group.
+var ErrGroupClosed = errors.New("poller group closed")
+
+// PollerGroup runs the loops of several watchers on one poller and one
+// goroutine, for the libraries of a process which each create a watcher
+// doing little. The fds of all the watchers are registered in the same
+// epoll set or kqueue, while each watcher keeps its own fds, options,
+// requests and done channels.
+type PollerGroup struct {
+	pfd *poller
+	die chan struct{}
+
+	mu      sync.Mutex
+	members []*shard // protected by mu
+	closed  bool     // protected by mu
+
+	// owned by the loop of the group: the members of the round, the
+	// earliest deadline of their timers and the one the timer is armed for
+	round []*shard
+	next  time.Time
+	armed time.Time
+}
+
+// NewPollerGroup creates a group and starts its loop, which runs until
+// Close.
+func NewPollerGroup() (*PollerGroup, error) {
+	pfd, err := openPoll()
+	if err != nil {
+		return nil, err
+	}
+	pfd.sys = rawSyscalls{}
+	g := &PollerGroup{pfd: pfd, die: make(chan struct{})}
+	go g.loop()
+	return g, nil
+}
+
+// CreateWatcherInGroup creates a watcher like CreateWatcher whose loop is
+// run by g. It has a single shard, and the options of the poller and the
+// loop, like WithEventBudget, WithSpin, WithLockOSThread and WithEmbedded,
+// don't apply, the poller counters of Stats are those of g. Closing the
+// watcher leaves the other watchers of g running, its fds are removed from
+// the poller of g.
+func CreateWatcherInGroup(g *PollerGroup, opts ...Option) (*Watcher, error) {
+	return CreateWatcher(append(opts[:len(opts):len(opts)], func(w *Watcher) { w.group = g })...)
+}
+
+// Close closes the watchers of g and terminates its loop, which closes the
+// poller.
+func (g *PollerGroup) Close() error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return nil
+	}
+	g.closed = true
+	members := g.members
+	g.mu.Unlock()
+
+	for _, s := range members {
+		s.w.Close()
+	}
+	close(g.die)
+	return g.pfd.Wakeup()
+}
+
+// join adds s to the members of g
+func (g *PollerGroup) join(s *shard) error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return ErrGroupClosed
+	}
+	g.members = append(g.members, s)
+	g.mu.Unlock()
+	return g.pfd.Wakeup()
+}
+
+// leave removes the member s whose watcher terminated and ends it
+func (g *PollerGroup) leave(s *shard) {
+	g.mu.Lock()
+	for i := range g.members {
+		if g.members[i] == s {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			break
+		}
+	}
+	g.mu.Unlock()
+
+	// the fds left open would stay registered in the poller of g
+	s.w.fds.each(func(fd int, d *fdDesc) bool {
+		if d.has(fdWatched) {
+			g.pfd.Unwatch(fd)
+		}
+		return true
+	})
+	s.exit()
+}
+
+// refresh takes the members of the next round
+func (g *PollerGroup) refresh() {
+	g.mu.Lock()
+	g.round = append(g.round[:0], g.members...)
+	g.mu.Unlock()
+}
+
+func (g *PollerGroup) loop() {
+	defer func() {
+		// a panic of the poller itself terminates all the members
+		var err error = ErrGroupClosed
+		if r := recover(); r != nil {
+			err = &PanicError{Where: "poller", Value: r, Stack: debug.Stack()}
+		}
+		g.mu.Lock()
+		g.closed = true
+		members := g.members
+		g.members = nil
+		g.mu.Unlock()
+		for _, s := range members {
+			s.w.shutdown(err)
+			s.exit()
+		}
+	}()
+
+	if err := g.pfd.Wait(g.onEvent, g.drain, g.idle, g.die); err != nil {
+		g.mu.Lock()
+		for _, s := range g.members {
+			s.w.logger.Log("poller failed", "err", err)
+			s.w.shutdown(err)
+		}
+		g.mu.Unlock()
+	}
+}
+
+// onEvent dispatches the readiness of fd to the member watching it
+func (g *PollerGroup) onEvent(fd int, readable, writable bool) {
+	for retry := false; ; retry = true {
+		for _, s := range g.round {
+			if s.w.fds.watched(fd) != nil {
+				g.event(s, fd, readable, writable)
+				return
+			}
+		}
+		if retry {
+			return
+		}
+		// watched by a member which joined during the round
+		g.refresh()
+	}
+}
+
+// event dispatches the readiness of fd to the member s
+func (g *PollerGroup) event(s *shard, fd int, readable, writable bool) {
+	defer g.recoverMember(s)
+	select {
+	case <-s.w.die:
+		return
+	default:
+	}
+	s.onEvent(fd, readable, writable)
+}
+
+// drain drains the members after each round of events, and arms the timer
+// of the poller for the earliest of their deadlines
+func (g *PollerGroup) drain() {
+	g.refresh()
+	g.next = time.Time{}
+	for _, s := range g.round {
+		select {
+		case <-s.w.die:
+			g.leave(s)
+			continue
+		default:
+		}
+		// each member reports its earliest deadline, see setTimer
+		s.armed = time.Time{}
+		g.drainMember(s)
+	}
+
+	now := time.Now()
+	if !g.armed.IsZero() && !now.Before(g.armed) {
+		g.armed = time.Time{}
+	}
+	if g.next.IsZero() || g.next.Equal(g.armed) {
+		return
+	}
+	delay := g.next.Sub(now)
+	if delay <= 0 {
+		delay = 1
+	}
+	if g.pfd.SetTimer(delay) == nil {
+		g.armed = g.next
+	}
+}
+
+// drainMember drains the member s
+func (g *PollerGroup) drainMember(s *shard) {
+	defer g.recoverMember(s)
+	s.drain()
+}
+
+// idle reports whether all the members may park
+func (g *PollerGroup) idle() bool {
+	idle := true
+	for _, s := range g.round {
+		if !s.idle() {
+			idle = false
+		}
+	}
+	return idle
+}
+
+// recoverMember terminates the watcher of s with a panic of its loop, the
+// other members go on
+func (g *PollerGroup) recoverMember(s *shard) {
+	if r := recover(); r != nil {
+		err := &PanicError{Where: "poller", Value: r, Stack: debug.Stack()}
+		s.w.logger.Log("poller failed", "err", err)
+		s.w.shutdown(err)
+	}
+}
+
+// setTimer arms the timer of the poller of s for deadline, after delay,
+// the members of a group report their deadline to it instead
+func (s *shard) setTimer(deadline time.Time, delay time.Duration) error {
+	if g := s.w.group; g != nil {
+		if g.next.IsZero() || deadline.Before(g.next) {
+			g.next = deadline
+		}
+		return nil
+	}
+	return s.pfd.SetTimer(delay)
+}
+
+// poller returns the poller of g, nil for a watcher without a group
+func (g *PollerGroup) poller() *poller {
+	if g == nil {
+		return nil
+	}
+	return g.pfd
+}
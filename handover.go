@@ -0,0 +1,238 @@
+package gaio
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrExported is the error of the requests of a fd ended by Export.
+var ErrExported = newKindError("fd exported", ErrCanceled)
+
+// maxRights is the number of fds sent in one message, the limit of
+// SCM_RIGHTS on linux
+const maxRights = 253
+
+// ExportedFd describes a fd handed over to another process by Export and
+// SendExported, it's encoded as JSON.
+type ExportedFd struct {
+	Fd        int           // in the process of the watcher, the new fd once imported
+	Low       int           `json:",omitempty"` // see SetWriteWatermarks
+	High      int           `json:",omitempty"`
+	RateLimit int           `json:",omitempty"` // bytes per second, see SetWriteRateLimit
+	Burst     int           `json:",omitempty"`
+	Heartbeat time.Duration `json:",omitempty"` // see SetHeartbeat
+	Payload   []byte        `json:",omitempty"` // of the heartbeat
+	Writes    [][]byte      `json:",omitempty"` // bytes left of the pending writes
+}
+
+// Export takes all the watched fds out of w for handing them over to
+// another process with SendExported, like Migrate each fd is taken out by
+// its loop between two rounds. Its pending requests end with ErrExported,
+// and if writes is set the bytes left of its plain writes are included to
+// be written by the importer. The fds are no longer watched but still open,
+// the caller closes them once sent, including the duplicates of WatchDup.
+//
+// On error the fds exported so far are returned with it.
+func (w *Watcher) Export(writes bool) ([]ExportedFd, error) {
+	var fds []int
+	w.Range(func(fd int, conn net.Conn) bool {
+		fds = append(fds, fd)
+		return true
+	})
+
+	var exported []ExportedFd
+	for _, fd := range fds {
+		m, err := w.takeOut(fd)
+		if err == ErrNotWatched {
+			// stopped meanwhile
+			continue
+		} else if err != nil {
+			return exported, err
+		}
+
+		e := ExportedFd{Fd: fd}
+		if m.water != nil {
+			e.Low, e.High = m.water.low, m.water.high
+		}
+		if m.rate != nil {
+			e.RateLimit, e.Burst = int(m.rate.rate), int(m.rate.burst)
+		}
+		if m.beat != nil {
+			e.Heartbeat, e.Payload = m.beat.interval, m.beat.payload
+		}
+		for i := range m.reqs {
+			cb := &m.reqs[i]
+			if writes && cb.kind == kindWrite && cb.file == nil && cb.addr == nil && !cb.connect && cb.size < len(cb.buffer) {
+				e.Writes = append(e.Writes, append([]byte(nil), cb.buffer[cb.size:]...))
+			}
+			m.fail(i, ErrExported)
+		}
+		exported = append(exported, e)
+	}
+	return exported, nil
+}
+
+// SendExported sends the fds of Export with their descriptions over conn,
+// to be received by ImportWatcher. The fds are passed with SCM_RIGHTS, in
+// messages of a length prefixed JSON array, and a zero length ends them.
+func SendExported(conn *net.UnixConn, fds []ExportedFd) error {
+	for len(fds) > 0 {
+		n := len(fds)
+		if n > maxRights {
+			n = maxRights
+		}
+		if err := sendExported(conn, fds[:n]); err != nil {
+			return err
+		}
+		fds = fds[n:]
+	}
+	return sendExported(conn, nil)
+}
+
+func sendExported(conn *net.UnixConn, fds []ExportedFd) error {
+	var msg []byte
+	var oob []byte
+	if len(fds) > 0 {
+		var err error
+		if msg, err = json.Marshal(fds); err != nil {
+			return err
+		}
+		rights := make([]int, len(fds))
+		for i := range fds {
+			rights[i] = fds[i].Fd
+		}
+		oob = unix.UnixRights(rights...)
+	}
+
+	// the rights go along with the prefix, the rest of a stream may be
+	// written in parts
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], uint32(len(msg)))
+	if _, _, err := conn.WriteMsgUnix(prefix[:], oob, nil); err != nil {
+		return err
+	}
+	_, err := conn.Write(msg)
+	return err
+}
+
+// ImportWatcher creates a watcher with opts and watches the fds received
+// from SendExported over conn, like WatchFd. The watermarks and rate limit
+// of each fd are set again, with the watermarks reported to done, and its
+// writes are submitted with done. The descriptions are returned with the
+// new fds, which are closed by the caller once stopped like those of
+// WatchFd.
+func ImportWatcher(conn *net.UnixConn, done chan OpResult, opts ...Option) (*Watcher, []ExportedFd, error) {
+	w, err := CreateWatcher(opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var imported []ExportedFd
+	abort := func(err error) (*Watcher, []ExportedFd, error) {
+		w.Close()
+		for i := range imported {
+			unix.Close(imported[i].Fd)
+		}
+		return nil, nil, err
+	}
+	for {
+		fds, err := receiveExported(conn)
+		if err != nil {
+			return abort(err)
+		} else if len(fds) == 0 {
+			return w, imported, nil
+		}
+		for i := range fds {
+			if err := w.importFd(&fds[i], done); err != nil {
+				imported = append(imported, fds...)
+				return abort(err)
+			}
+		}
+		imported = append(imported, fds...)
+	}
+}
+
+// receiveExported receives a message of sendExported, its fds replace the
+// ones of the sender
+func receiveExported(conn *net.UnixConn) ([]ExportedFd, error) {
+	var prefix [4]byte
+	oob := make([]byte, unix.CmsgSpace(maxRights*4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(prefix[:], oob)
+	if err != nil {
+		return nil, err
+	}
+	var rights []int
+	if oobn > 0 {
+		msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return nil, err
+		}
+		for i := range msgs {
+			fds, err := unix.ParseUnixRights(&msgs[i])
+			if err != nil {
+				closeAll(rights)
+				return nil, err
+			}
+			rights = append(rights, fds...)
+		}
+	}
+
+	var fds []ExportedFd
+	if _, err = io.ReadFull(conn, prefix[n:]); err == nil {
+		msg := make([]byte, binary.BigEndian.Uint32(prefix[:]))
+		if _, err = io.ReadFull(conn, msg); err == nil && len(msg) > 0 {
+			err = json.Unmarshal(msg, &fds)
+		}
+	}
+	if err == nil && len(fds) != len(rights) {
+		err = errors.New("gaio: exported fds and descriptions differ")
+	}
+	if err != nil {
+		closeAll(rights)
+		return nil, err
+	}
+	for i := range fds {
+		fds[i].Fd = rights[i]
+	}
+	return fds, nil
+}
+
+// importFd watches an imported fd and restores its settings and writes
+func (w *Watcher) importFd(e *ExportedFd, done chan OpResult) error {
+	if _, err := w.WatchFd(e.Fd); err != nil {
+		return err
+	}
+	if e.High > 0 {
+		if err := w.SetWriteWatermarks(e.Fd, e.Low, e.High, done); err != nil {
+			return err
+		}
+	}
+	if e.RateLimit > 0 {
+		if err := w.SetWriteRateLimit(e.Fd, e.RateLimit, e.Burst); err != nil {
+			return err
+		}
+	}
+	if e.Heartbeat > 0 {
+		if err := w.SetHeartbeat(e.Fd, e.Heartbeat, e.Payload); err != nil {
+			return err
+		}
+	}
+	for _, b := range e.Writes {
+		if err := w.Write(e.Fd, b, done); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func closeAll(fds []int) {
+	for _, fd := range fds {
+		unix.Close(fd)
+	}
+}
@@ -0,0 +1,78 @@
+package gaio
+
+import (
+	"container/heap"
+	"sync/atomic"
+	"time"
+)
+
+// SetHeartbeat submits a request to write payload to fd whenever nothing
+// was written to it for interval, like the ping frames of a protocol, with
+// the timers of the loop instead of a goroutine or a timer per conn. The
+// heartbeats are queued in order with the writes of fd, none is queued while
+// a write is pending, and their results are not delivered.
+//
+// Heartbeats are outbound only, they never complete or extend the reads of
+// fd, so a dead peer is detected by a read submitted with ReadTimeout which
+// expires as its replies stop. A zero interval removes the heartbeat, and
+// it's removed by StopWatch.
+func (w *Watcher) SetHeartbeat(fd int, interval time.Duration, payload []byte) error {
+	var hb *heartbeat
+	if interval > 0 {
+		hb = &heartbeat{interval: interval, payload: append([]byte(nil), payload...)}
+	}
+	return w.shardOf(fd).submit(aiocb{kind: kindHeartbeat, fd: fd, beat: hb})
+}
+
+// heartbeat is the heartbeat of a fd, owned by the loop
+type heartbeat struct {
+	interval time.Duration
+	payload  []byte
+	timer    *timer
+}
+
+// setHeartbeat replaces the heartbeat of d with hb, its interval starts now
+func (s *shard) setHeartbeat(d *fdDesc, hb *heartbeat) {
+	if old := d.beat; old != nil {
+		// it may be held by d.expired until d is released
+		old.timer.canceled = true
+		if old.timer.index >= 0 {
+			heap.Remove(&s.timers, old.timer.index)
+		}
+	}
+	d.beat = hb
+	d.set(fdHeartbeat, hb != nil)
+	if hb == nil {
+		return
+	}
+	atomic.StoreInt64(&d.wrote, s.now.UnixNano())
+	hb.timer = &timer{deadline: s.now.Add(hb.interval), d: d, beat: true}
+	heap.Push(&s.timers, hb.timer)
+}
+
+// sendHeartbeat writes the heartbeat of the fd of t if nothing was written for its
+// interval, and rearms t
+func (s *shard) sendHeartbeat(t *timer, now time.Time) {
+	d := t.d
+	hb := d.beat
+	if hb == nil || hb.timer != t {
+		return
+	}
+	last := time.Unix(0, atomic.LoadInt64(&d.wrote))
+	if deadline := last.Add(hb.interval); now.Before(deadline) {
+		t.deadline = deadline
+		heap.Push(&s.timers, t)
+		return
+	}
+
+	// a pending write isn't silence
+	if len(d.writers) == 0 {
+		atomic.AddUint64(&s.ops.submitted, 1)
+		cb := aiocb{kind: kindWrite, fd: d.fd, buffer: hb.payload, since: now}
+		s.handle(&cb)
+		s.flushOne(d)
+	}
+	atomic.StoreInt64(&d.wrote, now.UnixNano())
+	t.deadline = now.Add(hb.interval)
+	heap.Push(&s.timers, t)
+}
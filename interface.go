@@ -0,0 +1,29 @@
+package gaio
+
+import (
+	"net"
+	"time"
+)
+
+// Interface is the core of the requests of a Watcher, for the code using a
+// watcher to be tested without sockets, see the in-memory implementation
+// in package fakes.
+type Interface interface {
+	Watch(conn net.Conn) (fd int, err error)
+	WatchFd(fd int, opts ...WatchOption) (int, error)
+	StopWatch(fd int)
+	CloseConn(fd int)
+	SetContext(fd int, v interface{}) error
+	Context(fd int) (v interface{}, ok bool)
+
+	Read(fd int, buf []byte, done chan OpResult) error
+	ReadTimeout(fd int, buf []byte, done chan OpResult, deadline time.Time) error
+	Write(fd int, buf []byte, done chan OpResult) error
+	WriteTimeout(fd int, buf []byte, done chan OpResult, deadline time.Time) error
+
+	Close() error
+	Done() <-chan struct{}
+	Err() error
+}
+
+var _ Interface = (*Watcher)(nil)
@@ -0,0 +1,75 @@
+package gaio
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrKeepAliveTimeout is returned in OpResult when the kernel gave up on a
+// connection with keepalive enabled as the peer stopped answering probes, it
+// replaces the bare ETIMEDOUT so dead peers can be told apart.
+var ErrKeepAliveTimeout = newKindError("keepalive timeout, peer is unreachable", ErrConnClosed, ErrPeerGone)
+
+type keepAliveConfig struct {
+	idle, interval time.Duration
+	count          int
+}
+
+// SetKeepAlive configures TCP keepalive of a watched fd, the first probe is
+// sent after idle, then every interval until count probes are unanswered.
+// Pending and subsequent requests on fd fail with ErrKeepAliveTimeout once
+// the kernel declares the peer dead. Durations are rounded up to seconds, 0
+// keeps the system default.
+func (w *Watcher) SetKeepAlive(fd int, enable bool, idle, interval time.Duration, count int) error {
+	d := w.fds.watched(fd)
+	if d == nil {
+		return ErrNotWatched
+	}
+
+	if !enable {
+		d.set(fdKeepAlive, false)
+		return os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 0))
+	}
+	return w.setKeepAlive(fd, &keepAliveConfig{idle, interval, count})
+}
+
+func (w *Watcher) setKeepAlive(fd int, cfg *keepAliveConfig) error {
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1); err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+	if cfg.idle > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, tcpKeepIdle, seconds(cfg.idle)); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if cfg.interval > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, seconds(cfg.interval)); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if cfg.count > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPCNT, cfg.count); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if d := w.fds.get(fd); d != nil {
+		d.set(fdKeepAlive, true)
+	}
+	return nil
+}
+
+func (w *Watcher) keepAliveErr(fd int, err error) error {
+	if err == syscall.ETIMEDOUT {
+		if d := w.fds.get(fd); d != nil && d.has(fdKeepAlive) {
+			return ErrKeepAliveTimeout
+		}
+	}
+	return err
+}
+
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,7 @@
+// +build darwin
+
+package gaio
+
+import "golang.org/x/sys/unix"
+
+const tcpKeepIdle = unix.TCP_KEEPALIVE
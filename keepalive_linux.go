@@ -0,0 +1,7 @@
+// +build linux
+
+package gaio
+
+import "golang.org/x/sys/unix"
+
+const tcpKeepIdle = unix.TCP_KEEPIDLE
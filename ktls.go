@@ -0,0 +1,80 @@
+package gaio
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"fmt"
+	"hash"
+)
+
+var (
+	ErrKTLSUnsupported   = newKindError("kernel TLS is not supported", ErrUnsupported)
+	ErrUnsupportedCipher = newKindError("cipher suite is not supported by kernel TLS", ErrUnsupported)
+)
+
+// KTLSKeys contains the traffic keys of one direction of a TLS connection
+type KTLSKeys struct {
+	Version     uint16 // tls.VersionTLS12 or tls.VersionTLS13
+	CipherSuite uint16
+	Key         []byte
+	IV          []byte // 12 bytes, implicit salt followed by nonce
+	Seq         uint64 // sequence number of the next record
+}
+
+// TLSRecordError is returned for a read on a kernel TLS socket which has
+// received a non application data record, the record payload is placed in
+// OpResult.Buffer, e.g. for alert(21) it contains the level and description.
+type TLSRecordError struct {
+	Type uint8
+}
+
+func (e *TLSRecordError) Error() string {
+	return fmt.Sprintf("tls control record received, type %d", e.Type)
+}
+
+// KTLSKeysFromSecret derives the traffic keys from a TLS 1.3 traffic secret,
+// such as the ones logged by tls.Config.KeyLogWriter as
+// CLIENT_TRAFFIC_SECRET_0 and SERVER_TRAFFIC_SECRET_0.
+func KTLSKeysFromSecret(suite uint16, secret []byte) (*KTLSKeys, error) {
+	var keyLen int
+	var h func() hash.Hash
+	switch suite {
+	case tls.TLS_AES_128_GCM_SHA256:
+		keyLen, h = 16, sha256.New
+	case tls.TLS_AES_256_GCM_SHA384:
+		keyLen, h = 32, sha512.New384
+	case tls.TLS_CHACHA20_POLY1305_SHA256:
+		keyLen, h = 32, sha256.New
+	default:
+		return nil, ErrUnsupportedCipher
+	}
+
+	return &KTLSKeys{
+		Version:     tls.VersionTLS13,
+		CipherSuite: suite,
+		Key:         hkdfExpandLabel(h, secret, "key", keyLen),
+		IV:          hkdfExpandLabel(h, secret, "iv", 12),
+	}, nil
+}
+
+// hkdfExpandLabel implements HKDF-Expand-Label of RFC 8446 with empty context
+func hkdfExpandLabel(h func() hash.Hash, secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := []byte{byte(length >> 8), byte(length), byte(len(label))}
+	info = append(info, label...)
+	info = append(info, 0)
+
+	var out, t []byte
+	mac := hmac.New(h, secret)
+	for i := byte(1); len(out) < length; i++ {
+		mac.Reset()
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		t = mac.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:length]
+}
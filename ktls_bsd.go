@@ -0,0 +1,10 @@
+// +build darwin netbsd freebsd openbsd dragonfly
+
+package gaio
+
+import "syscall"
+
+// EnableKTLS offloads record encryption to the kernel, linux only.
+func (w *Watcher) EnableKTLS(fd int, tx, rx *KTLSKeys) error { return ErrKTLSUnsupported }
+
+func readTLSRecord(sys sysCalls, fd int, p []byte) (int, error) { return 0, syscall.EIO }
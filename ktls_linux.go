@@ -0,0 +1,124 @@
+// +build linux
+
+package gaio
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	tcpULP = 31  // TCP_ULP
+	solTLS = 282 // SOL_TLS
+	tlsTX  = 1   // TLS_TX
+	tlsRX  = 2   // TLS_RX
+
+	tlsGetRecordType = 2 // TLS_GET_RECORD_TYPE
+
+	tlsCipherAESGCM128        = 51
+	tlsCipherAESGCM256        = 52
+	tlsCipherChaCha20Poly1305 = 54
+)
+
+// EnableKTLS offloads record encryption of the watched socket to the kernel,
+// tx and rx are keys negotiated by a completed handshake, either may be nil.
+// After that Write and SendFile produce TLS records transparently, and reads
+// of control records fail with *TLSRecordError. No data should be buffered
+// by the user space TLS implementation which performed the handshake.
+// ErrNotWatched is returned for a fd not watched.
+func (w *Watcher) EnableKTLS(fd int, tx, rx *KTLSKeys) error {
+	d := w.fds.watched(fd)
+	if d == nil {
+		return ErrNotWatched
+	}
+
+	var txInfo, rxInfo []byte
+	var err error
+	if tx != nil {
+		if txInfo, err = cryptoInfo(tx); err != nil {
+			return err
+		}
+	}
+	if rx != nil {
+		if rxInfo, err = cryptoInfo(rx); err != nil {
+			return err
+		}
+	}
+
+	if err := unix.SetsockoptString(fd, unix.SOL_TCP, tcpULP, "tls"); err != nil {
+		if err == syscall.ENOENT || err == syscall.ENOPROTOOPT {
+			return ErrKTLSUnsupported
+		}
+		return err
+	}
+
+	if txInfo != nil {
+		if err := unix.SetsockoptString(fd, solTLS, tlsTX, string(txInfo)); err != nil {
+			return err
+		}
+	}
+	if rxInfo != nil {
+		if err := unix.SetsockoptString(fd, solTLS, tlsRX, string(rxInfo)); err != nil {
+			return err
+		}
+		d.set(fdKTLS, true)
+	}
+	return nil
+}
+
+// cryptoInfo marshals the keys as struct tls12_crypto_info_*
+func cryptoInfo(k *KTLSKeys) ([]byte, error) {
+	var cipher uint16
+	var keyLen, saltLen int
+	switch k.CipherSuite {
+	case tls.TLS_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256:
+		cipher, keyLen, saltLen = tlsCipherAESGCM128, 16, 4
+	case tls.TLS_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384:
+		cipher, keyLen, saltLen = tlsCipherAESGCM256, 32, 4
+	case tls.TLS_CHACHA20_POLY1305_SHA256, tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305:
+		cipher, keyLen, saltLen = tlsCipherChaCha20Poly1305, 32, 0
+	default:
+		return nil, ErrUnsupportedCipher
+	}
+
+	if (k.Version != tls.VersionTLS12 && k.Version != tls.VersionTLS13) || len(k.Key) != keyLen || len(k.IV) != 12 {
+		return nil, ErrUnsupportedCipher
+	}
+
+	// struct tls_crypto_info, iv, key, salt, rec_seq
+	info := make([]byte, 4, 4+12-saltLen+keyLen+saltLen+8)
+	binary.LittleEndian.PutUint16(info[0:], k.Version)
+	binary.LittleEndian.PutUint16(info[2:], cipher)
+	info = append(info, k.IV[saltLen:]...)
+	info = append(info, k.Key...)
+	info = append(info, k.IV[:saltLen]...)
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], k.Seq)
+	return append(info, seq[:]...), nil
+}
+
+// readTLSRecord reads a record with its type, called when read(2) on a kernel
+// TLS socket returns EIO for a control record
+func readTLSRecord(sys sysCalls, fd int, p []byte) (int, error) {
+	oob := make([]byte, unix.CmsgSpace(1))
+	n, oobn, _, _, err := sys.Recvmsg(fd, p, oob, 0)
+	if err != nil {
+		return n, err
+	}
+
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return n, err
+	}
+	for _, m := range msgs {
+		if m.Header.Level == solTLS && m.Header.Type == tlsGetRecordType && len(m.Data) > 0 {
+			if m.Data[0] != 23 { // not application data
+				return n, &TLSRecordError{Type: m.Data[0]}
+			}
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,214 @@
+package gaio
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// tlsPair performs a TLS 1.3 handshake over a tcp connection, returns the raw
+// server side connection, the client and the traffic keys of the server
+func tlsPair(t *testing.T) (net.Conn, *tls.Conn, *KTLSKeys, *KTLSKeys) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	chClient := make(chan *tls.Conn, 1)
+	go func() {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS13})
+		if err != nil {
+			t.Error(err)
+		}
+		chClient <- conn
+	}()
+
+	raw, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keylog bytes.Buffer
+	server := tls.Server(raw, &tls.Config{
+		Certificates:           []tls.Certificate{testCertificate(t)},
+		SessionTicketsDisabled: true,
+		KeyLogWriter:           &keylog,
+	})
+	if err := server.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	client := <-chClient
+	if client == nil {
+		t.FailNow()
+	}
+
+	secrets := make(map[string][]byte)
+	scanner := bufio.NewScanner(&keylog)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 3 {
+			secrets[fields[0]], _ = hex.DecodeString(fields[2])
+		}
+	}
+
+	suite := server.ConnectionState().CipherSuite
+	tx, err := KTLSKeysFromSecret(suite, secrets["SERVER_TRAFFIC_SECRET_0"])
+	if err != nil {
+		t.Skip(err)
+	}
+	rx, err := KTLSKeysFromSecret(suite, secrets["CLIENT_TRAFFIC_SECRET_0"])
+	if err != nil {
+		t.Skip(err)
+	}
+	return raw, client, tx, rx
+}
+
+func TestKTLSKeysFromSecret(t *testing.T) {
+	raw, client, tx, _ := tlsPair(t)
+	defer raw.Close()
+	defer client.Close()
+
+	if tx.CipherSuite != tls.TLS_AES_128_GCM_SHA256 && tx.CipherSuite != tls.TLS_AES_256_GCM_SHA384 {
+		t.Skip("cipher suite", tx.CipherSuite)
+	}
+
+	// seal a record with the derived keys in user space
+	block, err := aes.NewCipher(tx.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inner := append([]byte("hello"), 23)
+	hdr := []byte{23, 3, 3, 0, 0}
+	binary.BigEndian.PutUint16(hdr[3:], uint16(len(inner)+aead.Overhead()))
+	nonce := append([]byte(nil), tx.IV...) // seq 0
+	record := aead.Seal(hdr, nonce, inner, hdr)
+	if _, err := raw.Write(record); err != nil {
+		t.Fatal(err)
+	}
+
+	rx := make([]byte, 5)
+	if _, err := io.ReadFull(client, rx); err != nil {
+		t.Fatal(err)
+	}
+	if string(rx) != "hello" {
+		t.Fatal("incorrect decryption")
+	}
+}
+
+func TestKTLS(t *testing.T) {
+	raw, client, tx, rx := tlsPair(t)
+	defer raw.Close()
+	defer client.Close()
+
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, err := w.Watch(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.EnableKTLS(fd, tx, rx); err == ErrKTLSUnsupported {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan OpResult, 1)
+	if err := w.Write(fd, []byte("hello"), done); err != nil {
+		t.Fatal(err)
+	}
+	if res := <-done; res.Err != nil {
+		t.Fatal(res.Err)
+	}
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("incorrect receiving", err)
+	}
+
+	if err := w.Read(fd, make([]byte, 64), done); err != nil {
+		t.Fatal(err)
+	}
+	client.Write([]byte("world"))
+	res := <-done
+	if res.Err != nil || string(res.Buffer[:res.Size]) != "world" {
+		t.Fatal("incorrect reading", res.Err)
+	}
+
+	// close_notify alert
+	if err := w.Read(fd, make([]byte, 64), done); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	res = <-done
+	if e, ok := res.Err.(*TLSRecordError); !ok || e.Type != 21 {
+		t.Fatal("alert not surfaced", res.Err)
+	}
+}
+
+func TestReadEIO(t *testing.T) {
+	// a pty master reads EIO once the slave is closed
+	master, err := unix.Open("/dev/ptmx", unix.O_RDWR|unix.O_NOCTTY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Skip("pty unavailable:", err)
+	}
+	defer unix.Close(master)
+	if err := unix.IoctlSetPointerInt(master, unix.TIOCSPTLCK, 0); err != nil {
+		t.Fatal(err)
+	}
+	n, err := unix.IoctlGetInt(master, unix.TIOCGPTN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slave, err := unix.Open("/dev/pts/"+strconv.Itoa(n), unix.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unix.Close(slave)
+
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if err := w.EnableKTLS(master, nil, nil); err != ErrNotWatched {
+		t.Fatal("unexpected error", err)
+	}
+	if _, err := w.WatchFd(master); err != nil {
+		t.Fatal(err)
+	}
+
+	// not mistaken for a control record of kernel TLS
+	done := make(chan OpResult, 1)
+	if err := w.Read(master, make([]byte, 64), done); err != nil {
+		t.Fatal(err)
+	}
+	if res := <-done; !errors.Is(res.Err, syscall.EIO) {
+		t.Fatal("unexpected error", res.Err)
+	}
+	w.StopWatch(master)
+}
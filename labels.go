@@ -0,0 +1,32 @@
+package gaio
+
+import (
+	"context"
+	"runtime/pprof"
+	"strconv"
+	"sync/atomic"
+)
+
+// watchers numbers the watchers of the process for their default names
+var watchers uint64
+
+// Name returns the name of the watcher, see WithName.
+func (w *Watcher) Name() string {
+	return w.name
+}
+
+// goLabeled runs f on a new goroutine with the pprof labels of the watcher,
+// the role of the goroutine, and its shard unless shard is negative, so the
+// profiles of the goroutines can be told apart.
+func (w *Watcher) goLabeled(role string, shard int, f func()) {
+	labels := pprof.Labels("gaio.watcher", w.name, "gaio.role", role)
+	if shard >= 0 {
+		labels = pprof.Labels("gaio.watcher", w.name, "gaio.role", role, "gaio.shard", strconv.Itoa(shard))
+	}
+	go pprof.Do(context.Background(), labels, func(context.Context) { f() })
+}
+
+// defaultName numbers the watchers without a name from 1
+func defaultName() string {
+	return strconv.FormatUint(atomic.AddUint64(&watchers, 1), 10)
+}
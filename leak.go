@@ -0,0 +1,97 @@
+package gaio
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// watchedConn is a conn of the table checked by the leak check
+type watchedConn struct {
+	fd    int
+	d     *fdDesc
+	conn  net.Conn
+	stack []uintptr
+}
+
+// watchedConns returns the watched fds with a conn
+func (t *fdTable) watchedConns() (conns []watchedConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.each(func(fd int, d *fdDesc) bool {
+		if d.has(fdWatched) && d.conn != nil {
+			conns = append(conns, watchedConn{fd, d, d.conn, d.watchStack})
+		}
+		return true
+	})
+	return conns
+}
+
+// setStack records the stack of the Watch of d
+func (t *fdTable) setStack(d *fdDesc, stack []uintptr) {
+	t.mu.Lock()
+	d.watchStack = stack
+	t.mu.Unlock()
+}
+
+// watchStack returns the stack of the caller of Watch
+func watchStack() []uintptr {
+	pcs := make([]uintptr, 32)
+	return pcs[:runtime.Callers(3, pcs)]
+}
+
+// leakCheck logs the conns closed while watched every interval of
+// WithLeakCheck, once per Watch, until the watcher terminates
+func (w *Watcher) leakCheck() {
+	ticker := time.NewTicker(w.leakInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.die:
+			return
+		}
+
+		for _, c := range w.fds.watchedConns() {
+			if c.d.has(fdLeaked) || !connClosed(c.conn, c.fd) {
+				continue
+			}
+			c.d.set(fdLeaked, true)
+			w.logger.Log("conn closed while watched", "fd", c.fd, "stack", formatStack(c.stack))
+		}
+	}
+}
+
+// connClosed reports whether conn was closed, or its fd isn't fd anymore
+func connClosed(conn net.Conn, fd int) bool {
+	c, ok := conn.(interface {
+		SyscallConn() (syscall.RawConn, error)
+	})
+	if !ok {
+		return false
+	}
+	rawconn, err := c.SyscallConn()
+	if err != nil {
+		return true
+	}
+	current := -1
+	if err := rawconn.Control(func(s uintptr) { current = int(s) }); err != nil {
+		return true
+	}
+	return current != fd
+}
+
+func formatStack(stack []uintptr) string {
+	var sb strings.Builder
+	frames := runtime.CallersFrames(stack)
+	for {
+		frame, more := frames.Next()
+		fmt.Fprintf(&sb, "%v\n\t%v:%v\n", frame.Function, frame.File, frame.Line)
+		if !more {
+			return sb.String()
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package gaio
+
+import (
+	"net"
+)
+
+// Listener is a net.Listener whose connections are watched by a Watcher,
+// Accept returns them as AsyncConns, for the frameworks serving a
+// net.Listener like net/http.
+type Listener struct {
+	w  *Watcher
+	ln net.Listener
+}
+
+// NewListener returns a Listener accepting the connections of ln, which
+// are watched by w.
+func NewListener(w *Watcher, ln net.Listener) *Listener {
+	return &Listener{w: w, ln: ln}
+}
+
+// Accept waits for the next connection of the listener and returns it as a
+// *AsyncConn. A connection which can't be watched, like past the limit of
+// WithMaxConns, is closed and the next one is waited for, until the
+// watcher is closed.
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			return nil, err
+		}
+		c, err := l.watch(conn)
+		if err == nil {
+			return c, nil
+		}
+		conn.Close()
+		select {
+		case <-l.w.die:
+			return nil, ErrWatcherClosed
+		default:
+		}
+	}
+}
+
+// watch watches conn and returns its AsyncConn
+func (l *Listener) watch(conn net.Conn) (*AsyncConn, error) {
+	fd, err := l.w.Watch(conn)
+	if err != nil {
+		return nil, err
+	}
+	c, err := l.w.NewAsyncConn(fd)
+	if err != nil {
+		l.w.StopWatch(fd)
+		return nil, err
+	}
+	if l.w.watchMode == WatchDup {
+		// the watcher closes its duplicate only
+		c.owned = conn
+	}
+	return c, nil
+}
+
+// Close closes the underlying listener, the accepted connections stay
+// open.
+func (l *Listener) Close() error { return l.ln.Close() }
+
+// Addr returns the address of the underlying listener.
+func (l *Listener) Addr() net.Addr { return l.ln.Addr() }
+
+var _ net.Listener = (*Listener)(nil)
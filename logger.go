@@ -0,0 +1,34 @@
+package gaio
+
+// Logger receives the warnings of a watcher, with context as alternating
+// keys and values such as "fd", 5. It's called from the event loops, so it
+// must not block, its panics are ignored.
+type Logger interface {
+	Log(msg string, keyvals ...interface{})
+}
+
+// nopLogger discards everything, it's the default Logger
+type nopLogger struct{}
+
+func (nopLogger) Log(string, ...interface{}) {}
+
+// safeLogger ignores the panics of a Logger, it's the last resort of the
+// panics of the other callbacks
+type safeLogger struct {
+	Logger
+}
+
+func (l safeLogger) Log(msg string, keyvals ...interface{}) {
+	defer func() { recover() }()
+	l.Logger.Log(msg, keyvals...)
+}
+
+// namedLogger adds the name of the watcher to the context of its warnings
+type namedLogger struct {
+	Logger
+	name string
+}
+
+func (l namedLogger) Log(msg string, keyvals ...interface{}) {
+	l.Logger.Log(msg, append(keyvals, "watcher", l.name)...)
+}
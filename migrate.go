@@ -0,0 +1,190 @@
+package gaio
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrNotMigratable is returned by Migrate for a fd with requests bound to
+// its watcher: splices, offloaded reads and zero copy writes waiting for
+// their notifications.
+var ErrNotMigratable = errors.New("fd has requests which can't migrate")
+
+// migration is the state of a fd moved out of the loop of its shard
+type migration struct {
+	conn  net.Conn
+	ctx   interface{}
+	tags  []string
+	flags uint32
+	stats ConnStats
+	water *watermarks
+	rate  *tokenBucket
+	beat  *heartbeat
+	reqs  []aiocb // urgent reads, reads and writes, each in order
+	err   error
+}
+
+// Migrate moves the watched fd and its pending requests to the watcher to,
+// for rebalancing busy watchers or moving idle fds to another one. The loop
+// of fd takes it out between two rounds, after the requests executing on a
+// worker return, so each request either completes on w before the move or
+// is queued on to in its order, with the progress of a partial write, its
+// deadline and its done channel. The watermarks, rate limit, heartbeat and
+// ConnStats of fd move along with its context, the settings of to apply to
+// it like to Watch.
+//
+// Requests must not be submitted for fd during the move, they fail with
+// ErrNotWatched, and must be submitted to to once Migrate returns. Moved
+// requests are traced on w as dropped with ErrNotWatched and on to as new,
+// one rejected by a limit of to completes with the error of its submission.
+// If fd can't be watched by to it stays on w and the error is returned.
+func (w *Watcher) Migrate(fd int, to *Watcher) error {
+	if to == w {
+		return nil
+	}
+
+	m, err := w.takeOut(fd)
+	if err != nil {
+		return err
+	}
+
+	err = to.adopt(fd, m)
+	if err != nil && w.adopt(fd, m) != nil {
+		m.abort(fd, err)
+	}
+	return err
+}
+
+// takeOut takes fd and its requests out of its loop
+func (w *Watcher) takeOut(fd int) (*migration, error) {
+	reply := make(chan *migration, 1)
+	if err := w.shardOf(fd).submit(aiocb{kind: kindMigrate, fd: fd, migrate: reply}); err != nil {
+		return nil, err
+	}
+	var m *migration
+	select {
+	case m = <-reply:
+	case <-w.die:
+		// fd may have left the loop before it terminated
+		select {
+		case m = <-reply:
+		default:
+			return nil, ErrWatcherClosed
+		}
+	}
+	return m, m.err
+}
+
+// migrateOut takes fd out of the loop of s, its requests are released from
+// the accounting of the watcher and returned to be submitted to the other
+func (s *shard) migrateOut(fd int) *migration {
+	d := s.w.fds.watched(fd)
+	if d == nil {
+		return &migration{err: ErrNotWatched}
+	}
+	for _, q := range [][]aiocb{d.urgents, d.readers, d.writers} {
+		for i := range q {
+			if q[i].splice != nil || q[i].offload != nil || q[i].zcPending {
+				return &migration{err: ErrNotMigratable}
+			}
+		}
+	}
+
+	// the results delivered before the move come first
+	s.flushBatch()
+	m := &migration{stats: d.stats.snapshot(), water: d.water, rate: d.rate, beat: d.beat}
+	d.water, d.rate = nil, nil
+	s.setHeartbeat(d, nil)
+	s.setProbe(d, nil)
+	for _, q := range [][]aiocb{d.urgents, d.readers, d.writers} {
+		for i := range q {
+			// the tag moves with the request
+			tag := q[i].tag
+			q[i].tag = tagRef{}
+			s.retire(&q[i])
+			q[i].tag = tag
+			m.reqs = append(m.reqs, q[i])
+		}
+	}
+	d.readers, d.writers, d.urgents, d.zc = nil, nil, nil, nil
+	d.resumeAt = time.Time{}
+
+	s.pfd.Unwatch(fd)
+	m.tags = s.w.fds.tags(fd)
+	m.conn, m.ctx, m.flags = s.w.fds.unregister(fd)
+	m.flags &^= fdWatched | fdLeaked | fdBuffer
+	return m
+}
+
+// adopt watches a fd migrated from another watcher and submits its
+// requests
+func (w *Watcher) adopt(fd int, m *migration) error {
+	d, err := w.fds.register(fd, m.conn, w.maxConns, m.flags)
+	if err != nil {
+		return err
+	}
+	d.stats.restore(m.stats)
+	w.fds.setContext(fd, m.ctx)
+	w.fds.setTags(fd, m.tags)
+	if w.leakInterval > 0 {
+		w.fds.setStack(d, watchStack())
+	}
+	if err := w.applyDefaults(fd); err != nil {
+		w.fds.unregister(fd)
+		return err
+	}
+	s := w.shardOf(fd)
+	if err := w.poll(d); err != nil {
+		w.fds.unregister(fd)
+		return err
+	}
+	if w.terminatedWatching(fd) {
+		return ErrWatcherClosed
+	}
+
+	if m.water != nil {
+		s.submit(aiocb{kind: kindWatermark, fd: fd, water: m.water})
+	}
+	if m.rate != nil {
+		s.submit(aiocb{kind: kindRateLimit, fd: fd, rate: m.rate})
+	}
+	if m.beat != nil {
+		s.submit(aiocb{kind: kindHeartbeat, fd: fd, beat: &heartbeat{interval: m.beat.interval, payload: m.beat.payload}})
+	}
+	for i := range m.reqs {
+		if err := s.submit(m.reqs[i]); err != nil {
+			m.fail(i, err)
+		}
+	}
+	m.reqs = nil
+	return nil
+}
+
+// fail completes a moved request which was rejected with err
+func (m *migration) fail(i int, err error) {
+	cb := &m.reqs[i]
+	if cb.done != nil {
+		res := cb.dropped(err)
+		oe := &OpError{Op: res.Operation, Fd: cb.fd, BytesDone: res.Size, Err: err}
+		if m.conn != nil {
+			oe.RemoteAddr = m.conn.RemoteAddr()
+		}
+		res.Err = oe
+		cb.moveTag(&res)
+		cb.done <- res
+	}
+	cb.releaseTag()
+}
+
+// abort ends a fd which could be watched by neither watcher
+func (m *migration) abort(fd int, err error) {
+	for i := range m.reqs {
+		m.fail(i, err)
+	}
+	if m.flags&fdOwned != 0 {
+		unix.Close(fd)
+	}
+}
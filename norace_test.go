@@ -0,0 +1,5 @@
+// +build !race
+
+package gaio
+
+const raceEnabled = false
@@ -0,0 +1,58 @@
+package gaio
+
+import (
+	"io"
+	"syscall"
+	"unsafe"
+)
+
+// ErrReadOnly is the error of the writes to a notification fd which can't
+// be written, like a timerfd, see WatchNotify.
+var ErrReadOnly = newKindError("write to a read-only notification fd", ErrInvalid)
+
+// WatchNotify watches the notification fd, like an eventfd or a timerfd,
+// with WatchFd and arms a read of its 8-byte counter, made on each of its
+// events. Each value read is delivered to done in OpResult.Count, with a
+// nil Buffer, and the read is armed again until StopWatch, or an error
+// which is its last result. The writes to an eventfd signal it, the writes
+// to a timerfd fail with ErrReadOnly. Fds reading records of another size,
+// like a signalfd, are read with WatchFd and Read.
+func (w *Watcher) WatchNotify(fd int, done chan OpResult) (int, error) {
+	fd, err := w.WatchFd(fd)
+	if err != nil {
+		return 0, err
+	}
+	if isTimerfd(fd) {
+		w.fds.get(fd).set(fdReadOnly, true)
+	}
+	if err := w.shardOf(fd).submit(aiocb{kind: kindRead, fd: fd, notify: true, done: done}); err != nil {
+		w.StopWatch(fd)
+		return 0, err
+	}
+	return fd, nil
+}
+
+// tryNotify reads the counter of a notification fd until EAGAIN, the read
+// pcb stays armed unless it fails
+func (s *shard) tryNotify(pcb *aiocb) (complete bool) {
+	var counter [8]byte
+	for !s.exhausted() {
+		n, err := s.w.sys.Read(pcb.fd, counter[:])
+		if err == syscall.EAGAIN {
+			s.countAgain(pcb.fd, false)
+			return false
+		} else if err == nil && n < len(counter) {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			s.complete(pcb, OpResult{Operation: OpRead, Fd: pcb.fd, Err: err})
+			return true
+		}
+		s.countRead(n)
+		s.consume(n)
+		if pcb.done != nil {
+			s.deliver(pcb.done, OpResult{Operation: OpRead, Fd: pcb.fd, Size: n, Count: *(*uint64)(unsafe.Pointer(&counter[0]))})
+		}
+	}
+	return false
+}
@@ -0,0 +1,6 @@
+// +build darwin netbsd freebsd openbsd dragonfly
+
+package gaio
+
+// isTimerfd reports whether fd is a timerfd, there's none
+func isTimerfd(fd int) bool { return false }
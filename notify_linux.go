@@ -0,0 +1,14 @@
+// +build linux
+
+package gaio
+
+import (
+	"os"
+	"strconv"
+)
+
+// isTimerfd reports whether fd is a timerfd
+func isTimerfd(fd int) bool {
+	link, err := os.Readlink("/proc/self/fd/" + strconv.Itoa(fd))
+	return err == nil && link == "anon_inode:[timerfd]"
+}
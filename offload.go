@@ -0,0 +1,115 @@
+package gaio
+
+import (
+	"errors"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+var ErrNotOffloaded = errors.New("fds are not offloaded as a pair")
+
+// offloadState is shared by the pending offload requests of a pair
+type offloadState struct {
+	active int32
+}
+
+// Offload pairs two connected TCP sockets for forwarding data in both
+// directions entirely in the kernel, via a sockmap and a BPF stream verdict
+// program. Sockets not supported by sockmap, or systems without the
+// capability to load BPF programs fallback to Splice in both directions.
+//
+// A completion is delivered for each fd on peer close or error, with
+// OpResult.Fd set to the fd, so the application can clean up the pair.
+// Data received before Offload should be consumed before pairing.
+// StopWatch of either fd unpairs them like Unoffload.
+func (w *Watcher) Offload(fdA, fdB int, done chan OpResult) error {
+	state := &offloadState{active: 1}
+	m, err := w.getSockmap()
+	if err == nil {
+		err = m.add(fdA, fdB, state)
+	}
+
+	if err != nil {
+		if err := w.Splice(fdA, fdB, 0, done); err != nil {
+			return err
+		}
+		return w.Splice(fdB, fdA, 0, done)
+	}
+
+	for _, fd := range []int{fdA, fdB} {
+		if d := w.fds.watched(fd); d != nil {
+			d.set(fdOffloaded, true)
+		}
+		if err := w.shardOf(fd).submit(aiocb{kind: kindRead, fd: fd, offload: state, done: done}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unoffload stops forwarding between the pair in kernel and returns the
+// sockets to normal reads and writes, no completion will be delivered for
+// the pair after that. ErrNotOffloaded is returned for pairs forwarded by
+// the Splice fallback.
+func (w *Watcher) Unoffload(fdA, fdB int) error {
+	m, err := w.getSockmap()
+	if err != nil {
+		return ErrNotOffloaded
+	}
+
+	state := m.remove(fdA, fdB)
+	if state == nil {
+		return ErrNotOffloaded
+	}
+	atomic.StoreInt32(&state.active, 0)
+	for _, fd := range []int{fdA, fdB} {
+		if d := w.fds.get(fd); d != nil {
+			d.set(fdOffloaded, false)
+		}
+	}
+	return nil
+}
+
+// unoffloadFd unpairs the offloaded fd stopped by StopWatch, its slots in
+// the sockmap would leak otherwise, and the pending offload read of its
+// peer ends like with Unoffload
+func (w *Watcher) unoffloadFd(fd int) {
+	m, err := w.getSockmap()
+	if err != nil {
+		return
+	}
+	peer, state := m.removeFd(fd)
+	if state == nil {
+		return
+	}
+	atomic.StoreInt32(&state.active, 0)
+	if d := w.fds.get(peer); d != nil {
+		d.set(fdOffloaded, false)
+	}
+}
+
+func (w *Watcher) getSockmap() (*sockmap, error) {
+	w.sockmapOnce.Do(func() {
+		w.sockmap, w.sockmapErr = openSockmap()
+	})
+	return w.sockmap, w.sockmapErr
+}
+
+// tryOffload checks the state of an offloaded socket on readiness, as data
+// is redirected in kernel, readable means peer close or error.
+func (s *shard) tryOffload(pcb *aiocb) (complete bool) {
+	if atomic.LoadInt32(&pcb.offload.active) == 0 {
+		return true
+	}
+
+	n, _, err := s.w.sys.Recvfrom(pcb.fd, s.buffer[:1], unix.MSG_PEEK)
+	if err == syscall.EAGAIN || (err == nil && n > 0) {
+		// data left in the receive queue will be read after Unoffload
+		return false
+	}
+
+	s.complete(pcb, OpResult{Fd: pcb.fd, Err: err})
+	return true
+}
@@ -0,0 +1,17 @@
+// +build darwin netbsd freebsd openbsd dragonfly
+
+package gaio
+
+import "syscall"
+
+type sockmap struct{}
+
+func openSockmap() (*sockmap, error) { return nil, syscall.ENOSYS }
+
+func (m *sockmap) add(a, b int, state *offloadState) error { return syscall.ENOSYS }
+
+func (m *sockmap) remove(a, b int) *offloadState { return nil }
+
+func (m *sockmap) removeFd(fd int) (peer int, state *offloadState) { return -1, nil }
+
+func (m *sockmap) close() {}
@@ -0,0 +1,330 @@
+// +build linux
+
+package gaio
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	cmdMapCreate     = 0
+	cmdMapUpdateElem = 2
+	cmdMapDeleteElem = 3
+	cmdProgLoad      = 5
+	cmdProgAttach    = 8
+
+	// maxOffloadSockets is the capacity of the sockmap
+	maxOffloadSockets = 65536
+)
+
+var errNotInet4 = errors.New("offload: only established ipv4 tcp sockets are supported")
+
+// pairKey identifies a socket in the bpf program by the fields of __sk_buff
+type pairKey struct {
+	remoteIP4  [4]byte // network byte order
+	remotePort [4]byte // network byte order in the upper 16 bits
+	localPort  uint32  // host byte order
+}
+
+// sockmap forwards data between paired sockets in the kernel, a stream
+// verdict program looks up the peer slot of the receiving socket and
+// redirects the skb to the egress of that socket.
+type sockmap struct {
+	mapFd     int // BPF_MAP_TYPE_SOCKMAP, slot -> socket
+	pairsFd   int // BPF_MAP_TYPE_HASH, pairKey -> peer slot
+	parserFd  int
+	verdictFd int
+
+	free  []uint32 // free slots
+	slots map[int]offloadSlot
+	sync.Mutex
+}
+
+type offloadSlot struct {
+	slot  uint32
+	key   pairKey
+	peer  int
+	state *offloadState
+}
+
+type bpfMapCreateAttr struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	mapFlags   uint32
+}
+
+type bpfMapElemAttr struct {
+	mapFd uint32
+	_     uint32
+	key   uint64
+	value uint64
+	flags uint64
+}
+
+type bpfProgLoadAttr struct {
+	progType    uint32
+	insnCnt     uint32
+	insns       uint64
+	license     uint64
+	logLevel    uint32
+	logSize     uint32
+	logBuf      uint64
+	kernVersion uint32
+	progFlags   uint32
+}
+
+type bpfProgAttachAttr struct {
+	targetFd    uint32
+	attachBpfFd uint32
+	attachType  uint32
+	attachFlags uint32
+}
+
+type bpfInsn struct {
+	code uint8
+	regs uint8 // dst:4 src:4
+	off  int16
+	imm  int32
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	r, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
+
+func bpfMapCreate(mapType, keySize, valueSize, maxEntries uint32) (int, error) {
+	attr := bpfMapCreateAttr{mapType: mapType, keySize: keySize, valueSize: valueSize, maxEntries: maxEntries}
+	return bpf(cmdMapCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+func bpfMapUpdate(fd int, key, value unsafe.Pointer) error {
+	attr := bpfMapElemAttr{mapFd: uint32(fd), key: uint64(uintptr(key)), value: uint64(uintptr(value))}
+	_, err := bpf(cmdMapUpdateElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+func bpfMapDelete(fd int, key unsafe.Pointer) error {
+	attr := bpfMapElemAttr{mapFd: uint32(fd), key: uint64(uintptr(key))}
+	_, err := bpf(cmdMapDeleteElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+func bpfProgLoadSKB(insns []bpfInsn) (int, error) {
+	license := []byte("GPL\x00")
+	attr := bpfProgLoadAttr{
+		progType: unix.BPF_PROG_TYPE_SK_SKB,
+		insnCnt:  uint32(len(insns)),
+		insns:    uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:  uint64(uintptr(unsafe.Pointer(&license[0]))),
+	}
+	return bpf(cmdProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+func bpfProgAttach(target, prog int, attachType uint32) error {
+	attr := bpfProgAttachAttr{targetFd: uint32(target), attachBpfFd: uint32(prog), attachType: attachType}
+	_, err := bpf(cmdProgAttach, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// the stream parser treats every skb as a complete message
+func parserProg() []bpfInsn {
+	return []bpfInsn{
+		{code: 0x61, regs: 0x10, off: 0}, // r0 = skb->len
+		{code: 0x95},                     // exit
+	}
+}
+
+// the stream verdict program redirects skb to the peer socket
+func verdictProg(pairsFd, mapFd int) []bpfInsn {
+	return []bpfInsn{
+		{code: 0xbf, regs: 0x16},                          // r6 = r1
+		{code: 0x61, regs: 0x62, off: 92},                 // r2 = skb->remote_ip4
+		{code: 0x63, regs: 0x2a, off: -12},                // *(u32 *)(r10 - 12) = r2
+		{code: 0x61, regs: 0x62, off: 132},                // r2 = skb->remote_port
+		{code: 0x63, regs: 0x2a, off: -8},                 // *(u32 *)(r10 - 8) = r2
+		{code: 0x61, regs: 0x62, off: 136},                // r2 = skb->local_port
+		{code: 0x63, regs: 0x2a, off: -4},                 // *(u32 *)(r10 - 4) = r2
+		{code: 0x18, regs: 0x11, imm: int32(pairsFd)}, {}, // r1 = pairs map
+		{code: 0xbf, regs: 0xa2},                        // r2 = r10
+		{code: 0x07, regs: 0x02, imm: -12},              // r2 += -12
+		{code: 0x85, imm: 1},                            // call bpf_map_lookup_elem
+		{code: 0x15, regs: 0x00, off: 7},                // if r0 == 0 goto pass
+		{code: 0x61, regs: 0x03},                        // r3 = *(u32 *)r0
+		{code: 0x18, regs: 0x12, imm: int32(mapFd)}, {}, // r2 = sockmap
+		{code: 0xbf, regs: 0x61},         // r1 = r6
+		{code: 0xb7, regs: 0x04},         // r4 = 0
+		{code: 0x85, imm: 52},            // call bpf_sk_redirect_map
+		{code: 0x95},                     // exit
+		{code: 0xb7, regs: 0x00, imm: 1}, // pass: r0 = SK_PASS
+		{code: 0x95},                     // exit
+	}
+}
+
+func openSockmap() (m *sockmap, err error) {
+	m = &sockmap{mapFd: -1, pairsFd: -1, parserFd: -1, verdictFd: -1}
+	defer func() {
+		if err != nil {
+			m.close()
+		}
+	}()
+
+	if m.mapFd, err = bpfMapCreate(unix.BPF_MAP_TYPE_SOCKMAP, 4, 4, maxOffloadSockets); err != nil {
+		return nil, err
+	}
+	if m.pairsFd, err = bpfMapCreate(unix.BPF_MAP_TYPE_HASH, uint32(unsafe.Sizeof(pairKey{})), 4, maxOffloadSockets); err != nil {
+		return nil, err
+	}
+	if m.parserFd, err = bpfProgLoadSKB(parserProg()); err != nil {
+		return nil, err
+	}
+	if m.verdictFd, err = bpfProgLoadSKB(verdictProg(m.pairsFd, m.mapFd)); err != nil {
+		return nil, err
+	}
+	if err = bpfProgAttach(m.mapFd, m.parserFd, unix.BPF_SK_SKB_STREAM_PARSER); err != nil {
+		return nil, err
+	}
+	if err = bpfProgAttach(m.mapFd, m.verdictFd, unix.BPF_SK_SKB_STREAM_VERDICT); err != nil {
+		return nil, err
+	}
+
+	m.free = make([]uint32, maxOffloadSockets)
+	for i := range m.free {
+		m.free[i] = uint32(maxOffloadSockets - 1 - i)
+	}
+	m.slots = make(map[int]offloadSlot)
+	return m, nil
+}
+
+// keyOf builds the key of a socket as seen by the verdict program
+func keyOf(fd int) (key pairKey, err error) {
+	local, err := unix.Getsockname(fd)
+	if err != nil {
+		return key, err
+	}
+	remote, err := unix.Getpeername(fd)
+	if err != nil {
+		return key, err
+	}
+
+	l, ok1 := local.(*unix.SockaddrInet4)
+	r, ok2 := remote.(*unix.SockaddrInet4)
+	if !ok1 || !ok2 {
+		return key, errNotInet4
+	}
+
+	key.remoteIP4 = r.Addr
+	key.remotePort = [4]byte{0, 0, byte(r.Port >> 8), byte(r.Port)}
+	key.localPort = uint32(l.Port)
+	return key, nil
+}
+
+// add pairs the two sockets for forwarding
+func (m *sockmap) add(a, b int, state *offloadState) error {
+	ka, err := keyOf(a)
+	if err != nil {
+		return err
+	}
+	kb, err := keyOf(b)
+	if err != nil {
+		return err
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if len(m.free) < 2 {
+		return syscall.ENOSPC
+	}
+	if _, ok := m.slots[a]; ok {
+		return syscall.EEXIST
+	}
+	if _, ok := m.slots[b]; ok {
+		return syscall.EEXIST
+	}
+
+	sa, sb := m.free[len(m.free)-1], m.free[len(m.free)-2]
+	m.free = m.free[:len(m.free)-2]
+	slotA := offloadSlot{slot: sa, key: ka, peer: b, state: state}
+	slotB := offloadSlot{slot: sb, key: kb, peer: a, state: state}
+
+	// publish the peer slots before the sockets enter the map
+	if err := bpfMapUpdate(m.pairsFd, unsafe.Pointer(&ka), unsafe.Pointer(&sb)); err != nil {
+		m.release(slotA, slotB)
+		return err
+	}
+	if err := bpfMapUpdate(m.pairsFd, unsafe.Pointer(&kb), unsafe.Pointer(&sa)); err != nil {
+		m.release(slotA, slotB)
+		return err
+	}
+
+	va, vb := uint32(a), uint32(b)
+	if err := bpfMapUpdate(m.mapFd, unsafe.Pointer(&sa), unsafe.Pointer(&va)); err != nil {
+		m.release(slotA, slotB)
+		return err
+	}
+	if err := bpfMapUpdate(m.mapFd, unsafe.Pointer(&sb), unsafe.Pointer(&vb)); err != nil {
+		m.release(slotA, slotB)
+		return err
+	}
+
+	m.slots[a] = slotA
+	m.slots[b] = slotB
+	return nil
+}
+
+// remove unpairs the two sockets, returns nil if they're not paired
+func (m *sockmap) remove(a, b int) *offloadState {
+	m.Lock()
+	defer m.Unlock()
+	slotA, ok := m.slots[a]
+	if !ok || slotA.peer != b {
+		return nil
+	}
+	slotB := m.slots[b]
+	delete(m.slots, a)
+	delete(m.slots, b)
+	m.release(slotA, slotB)
+	return slotA.state
+}
+
+// removeFd unpairs the socket fd from its peer, returns nil if it's not
+// paired
+func (m *sockmap) removeFd(fd int) (peer int, state *offloadState) {
+	m.Lock()
+	defer m.Unlock()
+	slot, ok := m.slots[fd]
+	if !ok {
+		return -1, nil
+	}
+	slotPeer := m.slots[slot.peer]
+	delete(m.slots, fd)
+	delete(m.slots, slot.peer)
+	m.release(slot, slotPeer)
+	return slot.peer, slot.state
+}
+
+// release removes the slots from the maps, and recycles them
+func (m *sockmap) release(slots ...offloadSlot) {
+	for _, s := range slots {
+		bpfMapDelete(m.mapFd, unsafe.Pointer(&s.slot))
+		bpfMapDelete(m.pairsFd, unsafe.Pointer(&s.key))
+		m.free = append(m.free, s.slot)
+	}
+}
+
+func (m *sockmap) close() {
+	for _, fd := range []int{m.verdictFd, m.parserFd, m.pairsFd, m.mapFd} {
+		if fd >= 0 {
+			unix.Close(fd)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package gaio
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestOffload(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if _, err := w.getSockmap(); err != nil {
+		t.Skip("sockmap unavailable, requires CAP_BPF:", err)
+	}
+
+	a, clientA := tcpPair(t, w)
+	defer clientA.Close()
+	b, clientB := tcpPair(t, w)
+	defer clientB.Close()
+
+	done := make(chan OpResult, 2)
+	if err := w.Offload(a, b, done); err != nil {
+		t.Fatal(err)
+	}
+
+	// both directions
+	tx := bytes.Repeat([]byte("0123456789"), 100000)
+	for _, pair := range [][2]io.ReadWriter{{clientA, clientB}, {clientB, clientA}} {
+		go pair[0].Write(tx)
+		rx := make([]byte, len(tx))
+		if _, err := io.ReadFull(pair[1], rx); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tx, rx) {
+			t.Fatal("incorrect forwarding")
+		}
+	}
+
+	// back to normal reads
+	if err := w.Unoffload(a, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Unoffload(a, b); err != ErrNotOffloaded {
+		t.Fatal("unexpected error", err)
+	}
+	if err := w.Read(a, make([]byte, 64), done); err != nil {
+		t.Fatal(err)
+	}
+	clientA.Write([]byte("hello"))
+	res := <-done
+	if res.Fd != a || string(res.Buffer[:res.Size]) != "hello" {
+		t.Fatal("incorrect reading after unoffload", res.Fd, res.Size, res.Err)
+	}
+
+	// peer close notification
+	if err := w.Offload(a, b, done); err != nil {
+		t.Fatal(err)
+	}
+	clientA.Close()
+	select {
+	case res := <-done:
+		if res.Fd != a || res.Err != nil {
+			t.Fatal("unexpected completion", res.Fd, res.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer close not notified")
+	}
+	w.Unoffload(a, b)
+}
+
+func TestOffloadStopWatch(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	m, err := w.getSockmap()
+	if err != nil {
+		t.Skip("sockmap unavailable, requires CAP_BPF:", err)
+	}
+
+	a, clientA := tcpPair(t, w)
+	defer clientA.Close()
+	b, clientB := tcpPair(t, w)
+	defer clientB.Close()
+
+	done := make(chan OpResult, 2)
+	if err := w.Offload(a, b, done); err != nil {
+		t.Fatal(err)
+	}
+
+	// the slots of the pair are freed without Unoffload
+	w.StopWatch(a)
+	m.Lock()
+	n := len(m.slots)
+	m.Unlock()
+	if n != 0 {
+		t.Fatal("slots left in the sockmap", n)
+	}
+	if err := w.Unoffload(a, b); err != ErrNotOffloaded {
+		t.Fatal("unexpected error", err)
+	}
+}
@@ -0,0 +1,23 @@
+package gaio
+
+import "net"
+
+// notifyClosed reports a fd deregistered to the callback of WithOnClosed,
+// the teardown which deregistered it calls it once its requests are done
+func (w *Watcher) notifyClosed(fd int, conn net.Conn, ctx interface{}, reason error) {
+	if w.onClosed == nil {
+		return
+	}
+	defer w.recoverCallback("OnClosed")
+	w.onClosed(fd, conn, ctx, reason)
+}
+
+// sinkError reports the failure of a request without a done channel to the
+// callback of WithErrorSink
+func (w *Watcher) sinkError(res OpResult) {
+	if w.errorSink == nil || res.Err == nil {
+		return
+	}
+	defer w.recoverCallback("error sink")
+	w.errorSink(res)
+}
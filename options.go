@@ -0,0 +1,367 @@
+package gaio
+
+import (
+	"net"
+	"time"
+)
+
+// Option configures a Watcher in CreateWatcher.
+type Option func(w *Watcher)
+
+// WithShards runs n pollers each with its own event loop, fds are assigned
+// to them by fd % n, so requests on different fds are processed on up to n
+// cores. The default is 1, or GOMAXPROCS, at most one per 256 connections,
+// if the connections are given by WithExpectedConns. Splice and Relay
+// between fds of different shards copy through user space.
+//
+// GOMAXPROCS follows the CPU limit of the cgroup since Go 1.25, older
+// versions need it set by hand or with a package such as automaxprocs in
+// containers, otherwise a shard is started for every core of the host.
+func WithShards(n int) Option {
+	return func(w *Watcher) {
+		if n > 0 {
+			w.numShards = n
+		}
+	}
+}
+
+// WithMaxEvents caps the events buffer of each poller, which starts at 64
+// events and doubles while waits keep returning a full buffer, so a burst of
+// ready fds is drained with fewer waits. It's halved back after a sustained
+// period of low readiness, see Stats. The default is 4096, or the expected
+// connections per shard within [256, 4096] if given by WithExpectedConns.
+func WithMaxEvents(n int) Option {
+	return func(w *Watcher) {
+		if n > 0 {
+			w.maxEvents = n
+		}
+	}
+}
+
+// WithEventBudget limits the events processed by a poller per round to n,
+// the submissions are drained between rounds and the remaining events are
+// processed in order before waiting again, so a large burst neither delays
+// new requests nor starves the fds at the end of it. 0 processes all events
+// of a wait in one round, the default is 256.
+func WithEventBudget(n int) Option {
+	return func(w *Watcher) {
+		if n >= 0 {
+			w.eventBudget = n
+		}
+	}
+}
+
+// WithWorkers executes the read and write syscalls on a pool of n workers
+// shared by all shards, the pollers only detect readiness. The requests of a
+// fd are still executed in order by one worker at a time, and splice
+// requests are executed by the pollers. It helps when the syscalls of large
+// buffers saturate the pollers, at the cost of a handoff per readiness.
+// Disabled by default, n <= 0 starts GOMAXPROCS workers, at most one per 64
+// connections given by WithExpectedConns.
+func WithWorkers(n int) Option {
+	return func(w *Watcher) {
+		if n > 0 {
+			w.numWorkers = n
+		} else {
+			w.numWorkers = -1
+		}
+	}
+}
+
+// WithFileWorkers sets the number of workers executing the reads and writes
+// of regular files, which the pollers can't wait on as they're always
+// ready, and which may block on the disk. The workers are shared by all
+// the regular files of the watcher, watched by Watch, WatchFd or WatchFile,
+// and started with the first one, their completions are delivered like
+// those of sockets. The default is 4.
+func WithFileWorkers(n int) Option {
+	return func(w *Watcher) {
+		if n > 0 {
+			w.numFileWorkers = n
+		}
+	}
+}
+
+// WithWriteStallTimeout fails the write at the head of the queue of a fd
+// with ErrWriteStalled once the kernel accepted none of the bytes of its
+// writes for d, like when the peer stops reading but keeps the connection
+// open, whatever the deadlines of the writes. Every byte written restarts
+// the clock, so slow peers which keep reading are not affected, and the
+// writes queued after a failed one are given d again. Disabled by default.
+func WithWriteStallTimeout(d time.Duration) Option {
+	return func(w *Watcher) {
+		w.stallTimeout = d
+	}
+}
+
+// WithSpin makes an idle poller keep polling without blocking for d after
+// the last event or request, before parking until the next wakeup. It cuts
+// the wakeup latency of requests and events arriving within d, at the cost
+// of a core busy for d after every activity, see Stats for the time spent
+// spinning. Disabled by default.
+func WithSpin(d time.Duration) Option {
+	return func(w *Watcher) {
+		w.spin = d
+	}
+}
+
+// WithLockOSThread locks each poller to its own OS thread.
+func WithLockOSThread() Option {
+	return func(w *Watcher) {
+		w.lockOSThread = true
+	}
+}
+
+// WithCPUAffinity locks each poller to its own OS thread like
+// WithLockOSThread, and binds the thread of shard i to cpus[i % len(cpus)]
+// with sched_setaffinity. Failures are not fatal, see AffinityErr.
+func WithCPUAffinity(cpus []int) Option {
+	return func(w *Watcher) {
+		w.lockOSThread = true
+		w.cpus = cpus
+	}
+}
+
+// WithReadBufferSize bounds the buffers allocated for reads submitted with a
+// nil buffer. The size of a fd starts at min, it's doubled after reads keep
+// filling the buffer and halved after a run of reads using less than a
+// quarter of it. The defaults are 2048 and 65536.
+func WithReadBufferSize(min, max int) Option {
+	return func(w *Watcher) {
+		if min > 0 && max >= min {
+			w.minReadBuf = min
+			w.maxReadBuf = max
+		}
+	}
+}
+
+// WithReadBufferPool sets the watermarks of the pool of buffers for reads
+// submitted with a nil buffer, per size class. A class running out of free
+// buffers is refilled with low buffers at once, at most high free buffers
+// are kept, and the free buffers above low are released to the heap after
+// the pool has been idle for a second. The defaults are 0 and 256.
+func WithReadBufferPool(low, high int) Option {
+	return func(w *Watcher) {
+		if low >= 0 && high >= low {
+			w.poolLow = low
+			w.poolHigh = high
+		}
+	}
+}
+
+// WithExpectedConns gives the expected number of connections, which the
+// defaults of WithShards, WithMaxEvents, WithWorkers and Dispatch are
+// derived from together with GOMAXPROCS.
+func WithExpectedConns(n int) Option {
+	return func(w *Watcher) {
+		if n > 0 {
+			w.expectedConns = n
+		}
+	}
+}
+
+// WithBufferQuota caps the bytes of the buffers held by pending requests,
+// total for the watcher and perFd for each fd, 0 means unlimited. A
+// submission past a quota fails with ErrBufferQuotaExceeded, so a peer which
+// never reads can't make its queued writes grow without bound. The bytes are
+// released when the requests complete or are dropped by StopWatch.
+func WithBufferQuota(total, perFd int64) Option {
+	return func(w *Watcher) {
+		w.quota = total
+		w.fdQuota = perFd
+	}
+}
+
+// WithMaxPending limits the requests submitted and not yet completed, total
+// for the watcher and perFd for each fd, 0 means unlimited. A submission
+// past a limit fails with ErrMaxPending, or waits for capacity with
+// WithPendingWait. StopWatch and Splice are not counted.
+func WithMaxPending(total, perFd int) Option {
+	return func(w *Watcher) {
+		w.maxPending = total
+		w.maxPendingFd = perFd
+	}
+}
+
+// WithPendingWait makes submissions past a limit of WithMaxPending wait until
+// a pending request completes instead of failing, requests must not be
+// submitted from the goroutine receiving the completions then.
+func WithPendingWait() Option {
+	return func(w *Watcher) {
+		w.pendingWait = true
+	}
+}
+
+// WithName names the watcher in its warnings, the errors of Healthy,
+// DumpState and the pprof labels of its goroutines, the watchers are
+// numbered from 1 by default.
+func WithName(name string) Option {
+	return func(w *Watcher) {
+		w.name = name
+	}
+}
+
+// WithLogger routes the warnings of the watcher to l, such as a poller
+// failing, events on fds not watched and write queues reaching their high
+// watermark. They're discarded by default.
+func WithLogger(l Logger) Option {
+	return func(w *Watcher) {
+		if l != nil {
+			w.logger = safeLogger{l}
+		}
+	}
+}
+
+// WithWatchdog logs a loop which has work but hasn't finished a round within
+// interval as "poller stuck", with the state of its shard, and sets the
+// interval of Healthy.
+func WithWatchdog(interval time.Duration) Option {
+	return func(w *Watcher) {
+		w.stuckAfter = interval
+	}
+}
+
+// WithLeakCheck checks the watched conns every interval and logs those
+// closed without StopWatch as "conn closed while watched", with the stack
+// of their Watch, which is recorded from then on. The watcher references
+// the conns it watches, so a conn dropped without StopWatch or Close is
+// never collected and can't be detected.
+func WithLeakCheck(interval time.Duration) Option {
+	return func(w *Watcher) {
+		w.leakInterval = interval
+	}
+}
+
+// WithWatchMode sets how Watch takes the fds of conns, WatchShared by
+// default.
+func WithWatchMode(mode WatchMode) Option {
+	return func(w *Watcher) {
+		w.watchMode = mode
+	}
+}
+
+// WithOnClosed calls f once for each watched fd when the watcher is done
+// with it: its requests completed or dropped, the results before delivered,
+// and the fd deregistered. reason is nil for StopWatch, ErrWatcherClosed for
+// Close, or the error of a watcher terminated by a failure, see Err. conn is
+// nil for fds watched by WatchFd, ctx is the context of fd, see SetContext.
+// f is called from the event loops, workers and StopWatch, it must not
+// block.
+func WithOnClosed(f func(fd int, conn net.Conn, ctx interface{}, reason error)) Option {
+	return func(w *Watcher) {
+		w.onClosed = f
+	}
+}
+
+// WithErrorSink calls f with the failed results of the requests submitted
+// without a done channel, which are dropped otherwise, so writes whose
+// results are ignored don't fail unnoticed. res.Fd and res.Operation
+// identify the request, res.Buffer is only valid during the call. f is
+// called from the event loops and workers, it must not block.
+func WithErrorSink(f func(res OpResult)) Option {
+	return func(w *Watcher) {
+		w.errorSink = f
+	}
+}
+
+// WithTracer installs t to observe every read and write request from its
+// submission to its end, see Tracer.
+func WithTracer(t Tracer) Option {
+	return func(w *Watcher) {
+		w.tracer = t
+	}
+}
+
+// WithSlowConsumer calls hook with the fd of a result and the time its
+// delivery waited for the receiver of done, when it's threshold or more. The
+// hook is called from the event loops and workers, it must not block.
+func WithSlowConsumer(threshold time.Duration, hook func(fd int, wait time.Duration)) Option {
+	return func(w *Watcher) {
+		w.slowAfter = threshold
+		w.slowHook = hook
+	}
+}
+
+// WithCopyBuffers decouples the buffers of requests from the watcher, the
+// buffer of a write is copied on submission and can be reused by the caller
+// immediately, and the data of a read is delivered in a copy instead of the
+// buffer passed to Read, which is never written. The copies are borrowed
+// from the pool of read buffers and returned in OpResult.Buffer, to be
+// released with OpResult.Release. It costs a copy of every byte transferred
+// and a pool lookup per request. Zero copy writes are not copied. The
+// helpers reading through the watcher, like StartTLS, Splice, Relay,
+// AsyncConn, EventServer and Pool, consume the copies.
+func WithCopyBuffers() Option {
+	return func(w *Watcher) {
+		w.copyBuffers = true
+	}
+}
+
+// WithCompletionBatching holds completions back and delivers them in
+// batches of up to max results, at most window after the first one, so a
+// consumer receives a burst of results per wakeup instead of one. A zero
+// window delivers the batch at the end of each round of events. Results
+// are delivered in order, immediately on Flush and Close. Completions on
+// workers are delivered at the end of each job.
+func WithCompletionBatching(max int, window time.Duration) Option {
+	return func(w *Watcher) {
+		w.batchMax = max
+		w.batchWindow = window
+	}
+}
+
+// WithMaxConns limits the fds watched at once, Watch and WatchFd fail with
+// ErrMaxConns past the limit until a fd is released by StopWatch, 0 means
+// unlimited.
+func WithMaxConns(n int) Option {
+	return func(w *Watcher) {
+		w.maxConns = n
+	}
+}
+
+// WithSockBuf applies SO_RCVBUF and SO_SNDBUF to every fd passed to Watch or
+// WatchFd, 0 leaves the system default.
+func WithSockBuf(rcv, snd int) Option {
+	return func(w *Watcher) {
+		w.defaultRcvBuf = rcv
+		w.defaultSndBuf = snd
+	}
+}
+
+// WithKeepAlive enables TCP keepalive on every fd passed to Watch or WatchFd,
+// see SetKeepAlive.
+func WithKeepAlive(idle, interval time.Duration, count int) Option {
+	return func(w *Watcher) {
+		w.defaultKeepAlive = &keepAliveConfig{idle, interval, count}
+	}
+}
+
+// WithBusyPoll sets SO_BUSY_POLL on every fd passed to Watch or WatchFd, see
+// SetBusyPoll. It's silently skipped if the kernel has no busy polling.
+func WithBusyPoll(usec int) Option {
+	return func(w *Watcher) {
+		w.defaultBusyPoll = usec
+	}
+}
+
+// applyDefaults applies the socket options and the probe of w to a new fd,
+// the fds which aren't sockets, like notification fds, are left as is
+func (w *Watcher) applyDefaults(fd int) error {
+	if d := w.fds.get(fd); d == nil || !d.has(fdSocket) {
+		return nil
+	}
+	if err := setSockBuf(fd, w.defaultRcvBuf, w.defaultSndBuf); err != nil {
+		return err
+	}
+	if w.defaultBusyPoll > 0 {
+		if err := setBusyPoll(fd, w.defaultBusyPoll); err != nil && err != ErrBusyPollUnsupported {
+			return err
+		}
+	}
+	if w.defaultKeepAlive != nil {
+		if err := w.setKeepAlive(fd, w.defaultKeepAlive); err != nil {
+			return err
+		}
+	}
+	return w.applyProbe(fd, false)
+}
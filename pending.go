@@ -0,0 +1,153 @@
+package gaio
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrMaxPending is returned by submissions past a limit of WithMaxPending.
+var ErrMaxPending = errors.New("too many pending requests")
+
+// admit accounts a request before it's queued, the pending requests and
+// their buffers are limited by WithMaxPending and WithBufferQuota
+func (w *Watcher) admit(cb *aiocb) error {
+	if err := w.acquire(cb); err != nil {
+		return err
+	}
+	if err := w.pin(cb); err != nil {
+		w.retire(cb)
+		return err
+	}
+	return nil
+}
+
+// retire releases the accounting of a request which completed or was
+// dropped
+func (w *Watcher) retire(cb *aiocb) {
+	w.unpin(cb)
+	cb.releaseTag()
+	if cb.boundDesc != nil {
+		atomic.AddInt32(&cb.boundDesc.bound, -1)
+		cb.boundDesc = nil
+	}
+	if !cb.counted {
+		return
+	}
+	cb.counted = false
+	settled := atomic.AddInt64(&w.pending, -1) == 0 && atomic.LoadInt32(&w.closing) != 0
+	if cb.countedDesc != nil {
+		// the fd may be closed by Drain
+		settled = settled || atomic.AddInt32(&cb.countedDesc.pending, -1) == 0 && atomic.LoadInt32(&w.draining) != 0
+		cb.countedDesc = nil
+	}
+	if settled {
+		select {
+		case w.settled <- struct{}{}:
+		default:
+		}
+	}
+	if atomic.LoadInt32(&w.pendingWaiters) > 0 {
+		w.pendingMu.Lock()
+		w.pendingCond.Broadcast()
+		w.pendingMu.Unlock()
+	}
+}
+
+// retire releases the accounting and the deadline of a request, a traced
+// request retired without a result was dropped by StopWatch
+func (s *shard) retire(cb *aiocb) {
+	if cb.traced {
+		s.traceEnd(cb, cb.dropped(ErrNotWatched))
+	}
+	if cb.splice != nil {
+		s.unwatchForeign(cb.splice)
+	}
+	s.stopTimer(cb)
+	s.releaseEncoded(cb)
+	s.dequeued(cb)
+	s.w.retire(cb)
+}
+
+// complete delivers the result of a request, its accounting is released
+// first, so the capacity is available to the receiver of the result
+func (s *shard) complete(pcb *aiocb, res OpResult) {
+	pcb.plainResult(&res)
+	if pcb.file != nil {
+		res.Sent, res.Size = pcb.sent, clampInt(pcb.sent)
+	}
+	res.Err = s.w.opError(&res)
+	pcb.moveTag(&res)
+	s.traceEnd(pcb, res)
+	s.retire(pcb)
+	if pcb.done != nil {
+		if pcb.copied {
+			res.pool = s.w.pool
+		}
+		s.deliver(pcb.done, res)
+		return
+	}
+	s.w.sinkError(res)
+	if pcb.copied {
+		s.w.pool.put(pcb.buffer)
+	}
+}
+
+// acquire counts a request as pending, waiting for capacity with
+// WithPendingWait. StopWatch, Flush, the settings of a fd and splice
+// requests are not counted, a splice is queued on both of its fds, nor the
+// read of WatchNotify, which is armed until StopWatch.
+func (w *Watcher) acquire(cb *aiocb) error {
+	if cb.kind >= kindStop || cb.splice != nil || cb.notify {
+		return nil
+	}
+
+	for {
+		if w.tryAcquire(cb) {
+			return nil
+		} else if !w.pendingWait {
+			return ErrMaxPending
+		}
+
+		w.pendingMu.Lock()
+		atomic.AddInt32(&w.pendingWaiters, 1)
+		// checked again after announcing the wait, so a completion in
+		// between is never missed
+		ok := w.tryAcquire(cb)
+		closed := false
+		if !ok {
+			select {
+			case <-w.die:
+				closed = true
+			default:
+				w.pendingCond.Wait()
+			}
+		}
+		atomic.AddInt32(&w.pendingWaiters, -1)
+		w.pendingMu.Unlock()
+
+		if ok {
+			return nil
+		} else if closed {
+			return ErrWatcherClosed
+		}
+	}
+}
+
+func (w *Watcher) tryAcquire(cb *aiocb) bool {
+	d := w.fds.get(cb.fd)
+	if d != nil {
+		if n := atomic.AddInt32(&d.pending, 1); w.maxPendingFd > 0 && int(n) > w.maxPendingFd {
+			atomic.AddInt32(&d.pending, -1)
+			return false
+		}
+	}
+	if n := atomic.AddInt64(&w.pending, 1); w.maxPending > 0 && int(n) > w.maxPending {
+		atomic.AddInt64(&w.pending, -1)
+		if d != nil {
+			atomic.AddInt32(&d.pending, -1)
+		}
+		return false
+	}
+	cb.counted, cb.countedDesc = true, d
+	return true
+}
@@ -0,0 +1,140 @@
+package gaio
+
+import (
+	"sync"
+	"time"
+)
+
+// poolIdle is how long the pool must be unused before the free buffers
+// above the low watermark are released to the heap
+const poolIdle = time.Second
+
+// bufferPool holds the buffers of reads submitted with a nil buffer, in
+// size classes of min doubled up to max. The free buffers of a class are
+// refilled to low when it runs out, and capped at high.
+type bufferPool struct {
+	min, max  int
+	low, high int
+
+	mu        sync.Mutex
+	classes   [][][]byte
+	allocated uint64
+	lastGet   time.Time
+}
+
+func newBufferPool(min, max, low, high int) *bufferPool {
+	p := &bufferPool{min: min, max: max, low: low, high: high}
+	for size := min; ; size *= 2 {
+		p.classes = append(p.classes, nil)
+		if size >= max {
+			break
+		}
+	}
+	return p
+}
+
+// class returns the index and buffer size of the class holding size
+func (p *bufferPool) class(size int) (int, int) {
+	i, c := 0, p.min
+	for c < size && i < len(p.classes)-1 {
+		i++
+		c *= 2
+	}
+	return i, c
+}
+
+// get borrows a buffer of size bytes, a buffer larger than the largest
+// class is allocated and left to the GC
+func (p *bufferPool) get(size int) []byte {
+	i, c := p.class(size)
+	if c < size {
+		return make([]byte, size)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastGet = time.Now()
+
+	free := p.classes[i]
+	if len(free) == 0 {
+		// under load, refill the class to the low watermark
+		for n := 0; n < p.low; n++ {
+			free = append(free, make([]byte, c))
+		}
+		p.allocated += uint64(p.low)
+		if len(free) == 0 {
+			p.allocated++
+			p.classes[i] = free
+			return make([]byte, c)[:size]
+		}
+	}
+	buf := free[len(free)-1]
+	free[len(free)-1] = nil
+	p.classes[i] = free[:len(free)-1]
+	return buf[:size]
+}
+
+// put returns a buffer, buffers not from the pool or above the high
+// watermark are left to the GC
+func (p *bufferPool) put(buf []byte) {
+	i, c := p.class(cap(buf))
+	if c != cap(buf) {
+		return
+	}
+	p.mu.Lock()
+	if len(p.classes[i]) < p.high {
+		p.classes[i] = append(p.classes[i], buf[:c])
+	}
+	p.mu.Unlock()
+}
+
+// trim releases the free buffers above the low watermark once the pool has
+// been idle, it's called by the loops before parking
+func (p *bufferPool) trim() {
+	p.mu.Lock()
+	if time.Since(p.lastGet) > poolIdle {
+		for i, free := range p.classes {
+			if len(free) > p.low {
+				for j := p.low; j < len(free); j++ {
+					free[j] = nil
+				}
+				p.classes[i] = free[:p.low]
+			}
+		}
+	}
+	p.mu.Unlock()
+}
+
+// stats returns the free buffers and the bytes they hold
+func (p *bufferPool) stats() (free int, bytes int64, allocated uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	size := p.min
+	for _, class := range p.classes {
+		free += len(class)
+		bytes += int64(len(class) * size)
+		size *= 2
+	}
+	return free, bytes, p.allocated
+}
+
+// Release returns the buffer of a read submitted with a nil buffer, or a
+// copy made with WithCopyBuffers, to the pool of the watcher, the buffer
+// must not be used after. Without Release the buffer is left to the GC.
+func (r *OpResult) Release() {
+	if r.pool != nil {
+		r.pool.put(r.Buffer)
+		r.pool = nil
+		r.Buffer = nil
+	}
+}
+
+// copyBuffer replaces the buffer of a write with a pooled copy, so the
+// caller can reuse it once submitted, see WithCopyBuffers
+func (w *Watcher) copyBuffer(cb *aiocb) {
+	if cb.kind != kindWrite || len(cb.buffer) == 0 || cb.zerocopy || cb.copied {
+		return
+	}
+	buf := w.pool.get(len(cb.buffer))
+	copy(buf, cb.buffer)
+	cb.buffer, cb.copied = buf, true
+}
@@ -0,0 +1,143 @@
+package gaio
+
+import (
+	"container/heap"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// probeConfig is a probe of WithProbe or SetTagProbe, shared by the fds it
+// applies to
+type probeConfig struct {
+	interval time.Duration
+	done     chan OpResult
+}
+
+// WithProbe probes the idle watched fds every interval, those with no
+// pending write and nothing written for interval, with a write of zero
+// bytes. It sends nothing to the peer but fails with the error the kernel
+// holds for the socket, like ECONNRESET once a reset arrived, ETIMEDOUT
+// once the TCP keepalive or user timeout gave up, or EPIPE, which are
+// otherwise only reported to the next request. A failed probe is delivered
+// to done as an OpResult with Operation OpProbe, and the fd isn't probed
+// anymore, so the application can reap it. It complements WithKeepAlive,
+// whose failures it surfaces without waiting for a request. Disabled by
+// default, SetTagProbe overrides it for tagged fds.
+func WithProbe(interval time.Duration, done chan OpResult) Option {
+	return func(w *Watcher) {
+		if interval > 0 {
+			w.probe = &probeConfig{interval, done}
+		}
+	}
+}
+
+// SetTagProbe probes the fds tagged with tag like WithProbe, the fds tagged
+// with it later included, instead of the probe of WithProbe. The probe of
+// the first tag of a fd with one applies. A zero interval removes the probe
+// of tag.
+func (w *Watcher) SetTagProbe(tag string, interval time.Duration, done chan OpResult) {
+	var p *probeConfig
+	if interval > 0 {
+		p = &probeConfig{interval, done}
+	}
+	w.fds.setTagProbe(tag, p)
+	for _, fd := range w.fds.tagged(tag) {
+		w.applyProbe(fd, true)
+	}
+}
+
+// applyProbe submits the probe of fd for its tags, which is only submitted
+// if there's one to set or force is true, and only to sockets
+func (w *Watcher) applyProbe(fd int, force bool) error {
+	if d := w.fds.watched(fd); d == nil || !d.has(fdSocket) {
+		return nil
+	}
+	p, tagged := w.fds.probeOf(fd)
+	if p == nil {
+		p = w.probe
+	}
+	if p == nil && !tagged && !force {
+		return nil
+	}
+	return w.shardOf(fd).submit(aiocb{kind: kindProbe, fd: fd, probe: p})
+}
+
+// setTagProbe sets the probe of tag
+func (t *fdTable) setTagProbe(tag string, p *probeConfig) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p == nil {
+		delete(t.probes, tag)
+		return
+	}
+	if t.probes == nil {
+		t.probes = make(map[string]*probeConfig)
+	}
+	t.probes[tag] = p
+}
+
+// probeOf returns the probe of the first tag of fd with one, tagged is
+// true if probes are set for tags
+func (t *fdTable) probeOf(fd int) (p *probeConfig, tagged bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if d := t.watched(fd); d != nil {
+		for _, tag := range d.tags {
+			if p = t.probes[tag]; p != nil {
+				break
+			}
+		}
+	}
+	return p, len(t.probes) > 0
+}
+
+// setProbe replaces the probe of d with p, its interval starts now
+func (s *shard) setProbe(d *fdDesc, p *probeConfig) {
+	if t := d.probe; t != nil {
+		// it may be held by d.expired until d is released
+		t.canceled = true
+		if t.index >= 0 {
+			heap.Remove(&s.timers, t.index)
+		}
+		d.probe = nil
+	}
+	d.prober = p
+	d.set(fdProbe, p != nil)
+	if p == nil {
+		return
+	}
+	d.probe = &timer{deadline: s.now.Add(p.interval), d: d, probe: true}
+	heap.Push(&s.timers, d.probe)
+}
+
+// sendProbe probes the fd of t if it's idle, and rearms t unless it failed
+func (s *shard) sendProbe(t *timer, now time.Time) {
+	d := t.d
+	p := d.prober
+	if d.probe != t {
+		return
+	}
+	last := time.Unix(0, atomic.LoadInt64(&d.wrote))
+	if deadline := last.Add(p.interval); now.Before(deadline) {
+		t.deadline = deadline
+		heap.Push(&s.timers, t)
+		return
+	}
+
+	// a pending write fails by itself
+	if len(d.writers) == 0 {
+		_, err := s.w.sys.Write(d.fd, nil)
+		if err != nil && err != syscall.EAGAIN && err != syscall.EINTR {
+			s.setProbe(d, nil)
+			res := OpResult{Operation: OpProbe, Fd: d.fd, Err: err}
+			res.Err = s.w.opError(&res)
+			if p.done != nil {
+				s.deliver(p.done, res)
+			}
+			return
+		}
+	}
+	t.deadline = now.Add(p.interval)
+	heap.Push(&s.timers, t)
+}
@@ -0,0 +1,85 @@
+package gaio
+
+import (
+	"os"
+	"time"
+)
+
+// Progress reports the progress of a large write, see WriteProgress and
+// SendFileProgress. An event is sent to C once Every bytes or Interval
+// passed since the previous one, on every write if both are zero, and when
+// all the bytes are written. Events are sent without blocking, those which
+// find C full are skipped, so a later event or the completion supersedes
+// them. The events of a request are sent in order, before its completion,
+// and none is sent after a request fails or is dropped.
+type Progress struct {
+	C        chan ProgressEvent
+	Every    int64
+	Interval time.Duration
+}
+
+// ProgressEvent is the progress of a write, the bytes written so far out of
+// its total, on the wire with a codec.
+type ProgressEvent struct {
+	Fd    int
+	Done  int64
+	Total int64
+}
+
+// progressState is the progress reported of a request
+type progressState struct {
+	p     *Progress
+	total int64 // of a sendfile
+	last  int64
+	at    time.Time
+}
+
+// WriteProgress submits a write request like Write, whose progress is
+// reported to p.
+func (w *Watcher) WriteProgress(fd int, buf []byte, done chan OpResult, p *Progress) error {
+	return w.shardOf(fd).submit(aiocb{kind: kindWrite, fd: fd, buffer: buf, done: done, progress: newProgress(p, int64(len(buf)))})
+}
+
+// SendFileProgress submits a request like SendFile, whose progress is
+// reported to p.
+func (w *Watcher) SendFileProgress(fd int, f *os.File, offset, count int64, done chan OpResult, p *Progress) error {
+	ffd, err := fileFd(f)
+	if err != nil {
+		return err
+	}
+	return w.shardOf(fd).submit(aiocb{kind: kindWrite, fd: fd, file: f, fileFd: ffd, offset: offset, count: count, done: done, progress: newProgress(p, count)})
+}
+
+func newProgress(p *Progress, total int64) *progressState {
+	if p == nil || p.C == nil {
+		return nil
+	}
+	return &progressState{p: p, total: total, at: time.Now()}
+}
+
+// reportProgress sends the progress of pcb after a write if it's due
+func (s *shard) reportProgress(pcb *aiocb) {
+	ps := pcb.progress
+	if ps == nil {
+		return
+	}
+	done, total := pcb.sent, ps.total
+	if pcb.file == nil {
+		done, total = int64(pcb.size), int64(len(pcb.buffer))
+	}
+	due := done >= total || (ps.p.Every <= 0 && ps.p.Interval <= 0) ||
+		(ps.p.Every > 0 && done-ps.last >= ps.p.Every)
+	now := ps.at
+	if !due && ps.p.Interval > 0 {
+		now = time.Now()
+		due = now.Sub(ps.at) >= ps.p.Interval
+	}
+	if !due || done == ps.last {
+		return
+	}
+	ps.last, ps.at = done, now
+	select {
+	case ps.p.C <- ProgressEvent{Fd: pcb.fd, Done: done, Total: total}:
+	default:
+	}
+}
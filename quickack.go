@@ -0,0 +1,18 @@
+package gaio
+
+// SetQuickAck enables or disables TCP_QUICKACK on fd, ACKs are sent
+// immediately instead of being delayed when enabled. As the kernel clears the
+// option on its own, it's re-asserted after every read completion on fd until
+// disabled or StopWatch.
+func (w *Watcher) SetQuickAck(fd int, enable bool) error {
+	d := w.fds.watched(fd)
+	if d == nil {
+		return ErrNotWatched
+	}
+	if err := setQuickAck(fd, enable); err != nil {
+		return err
+	}
+
+	d.set(fdQuickAck, enable)
+	return nil
+}
@@ -0,0 +1,7 @@
+// +build darwin netbsd freebsd openbsd dragonfly
+
+package gaio
+
+import "syscall"
+
+func setQuickAck(fd int, enable bool) error { return syscall.ENOPROTOOPT }
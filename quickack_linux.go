@@ -0,0 +1,9 @@
+// +build linux
+
+package gaio
+
+import "golang.org/x/sys/unix"
+
+func setQuickAck(fd int, enable bool) error {
+	return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_QUICKACK, boolint(enable))
+}
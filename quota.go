@@ -0,0 +1,57 @@
+package gaio
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrBufferQuotaExceeded is returned by submissions whose buffer would take
+// the bytes held by pending requests past a quota of WithBufferQuota.
+var ErrBufferQuotaExceeded = errors.New("buffer quota exceeded")
+
+// pin accounts the buffer of a request to the watcher and its fd, the
+// request is rejected if it exceeds a quota
+func (w *Watcher) pin(cb *aiocb) error {
+	n := int64(len(cb.buffer))
+	if n == 0 {
+		return nil
+	}
+
+	d := w.fds.get(cb.fd)
+	if d != nil {
+		if p := atomic.AddInt64(&d.pinned, n); w.fdQuota > 0 && p > w.fdQuota {
+			atomic.AddInt64(&d.pinned, -n)
+			return ErrBufferQuotaExceeded
+		}
+	}
+	if p := atomic.AddInt64(&w.pinned, n); w.quota > 0 && p > w.quota {
+		atomic.AddInt64(&w.pinned, -n)
+		if d != nil {
+			atomic.AddInt64(&d.pinned, -n)
+		}
+		return ErrBufferQuotaExceeded
+	}
+	cb.pinned, cb.pinnedDesc = n, d
+	return nil
+}
+
+// unpin releases the buffer of a request which completed or was dropped
+func (w *Watcher) unpin(cb *aiocb) {
+	if cb.pinned == 0 {
+		return
+	}
+	atomic.AddInt64(&w.pinned, -cb.pinned)
+	if cb.pinnedDesc != nil {
+		atomic.AddInt64(&cb.pinnedDesc.pinned, -cb.pinned)
+	}
+	cb.pinned, cb.pinnedDesc = 0, nil
+}
+
+// PinnedBytes returns the bytes held by the pending requests of fd.
+func (w *Watcher) PinnedBytes(fd int) (int64, error) {
+	d := w.fds.watched(fd)
+	if d == nil {
+		return 0, ErrNotWatched
+	}
+	return atomic.LoadInt64(&d.pinned), nil
+}
@@ -0,0 +1,114 @@
+package gaio
+
+import (
+	"container/heap"
+	"time"
+)
+
+// SetWriteRateLimit submits a request to limit the plain writes of fd to
+// bytesPerSec, with bursts up to burst bytes. When the tokens run out the
+// writes of fd are suspended and resumed by the timer of the loop as
+// tokens accrue, other fds are unaffected. A zero bytesPerSec removes the
+// limit. Zero copy writes, SendFile and Splice are not limited.
+func (w *Watcher) SetWriteRateLimit(fd int, bytesPerSec, burst int) error {
+	var tb *tokenBucket
+	if bytesPerSec > 0 {
+		if burst < 1 {
+			burst = 1
+		}
+		tb = &tokenBucket{rate: float64(bytesPerSec), burst: float64(burst), tokens: float64(burst)}
+	}
+	return w.shardOf(fd).submit(aiocb{kind: kindRateLimit, fd: fd, rate: tb})
+}
+
+// tokenBucket is the write rate limit of a fd, owned by the owner of the
+// descriptor like its queues
+type tokenBucket struct {
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// resumeAfter is the period of tokens a suspended fd waits for, so it's
+// not resumed for every byte
+const resumeAfter = 10 * time.Millisecond
+
+// refill adds the tokens accrued since the last refill
+func (tb *tokenBucket) refill(now time.Time) {
+	if !tb.last.IsZero() {
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+		if tb.tokens > tb.burst {
+			tb.tokens = tb.burst
+		}
+	}
+	tb.last = now
+}
+
+// limitWrites sets the bytes the writes of d may take, it returns false if
+// d has no tokens left and is suspended
+func (s *shard) limitWrites(d *fdDesc) bool {
+	tb := d.rate
+	if tb == nil {
+		return true
+	}
+
+	now := time.Now()
+	tb.refill(now)
+	if tb.tokens < 1 {
+		s.suspendWrites(d, now)
+		return false
+	}
+	s.limited, s.writeLimit = true, int(tb.tokens)
+	return true
+}
+
+// endWrites takes the bytes written from the tokens of d, and suspends the
+// writes of d if they ran out with writes left
+func (s *shard) endWrites(d *fdDesc) {
+	if !s.limited {
+		return
+	}
+	tb := d.rate
+	tb.tokens -= float64(int(tb.tokens) - s.writeLimit)
+	if s.writeLimit == 0 && len(d.writers) > 0 {
+		s.suspendWrites(d, tb.last)
+	}
+	s.limited, s.writeLimit = false, 0
+}
+
+// suspendWrites sets the time the writes of d resume, when the tokens for
+// resumeAfter have accrued, at most a burst
+func (s *shard) suspendWrites(d *fdDesc, now time.Time) {
+	tb := d.rate
+	want := tb.rate * resumeAfter.Seconds()
+	if want > tb.burst {
+		want = tb.burst
+	}
+	if want < 1 {
+		want = 1
+	}
+	wait := time.Duration((want - tb.tokens) / tb.rate * float64(time.Second))
+	d.resumeAt = now.Add(wait)
+}
+
+// scheduleResume adds the resumption of the writes of d to the timers of
+// the loop, once per suspension
+func (s *shard) scheduleResume(d *fdDesc) {
+	if d.resumeAt.IsZero() {
+		return
+	}
+	if d.resume == nil {
+		d.resume = &timer{deadline: d.resumeAt, d: d, resume: true}
+		heap.Push(&s.timers, d.resume)
+	}
+	d.resumeAt = time.Time{}
+}
+
+// limit truncates b to the bytes the current writes may take
+func (s *shard) limit(b []byte) []byte {
+	if s.limited && len(b) > s.writeLimit {
+		return b[:s.writeLimit]
+	}
+	return b
+}
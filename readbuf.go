@@ -0,0 +1,77 @@
+package gaio
+
+import "sync/atomic"
+
+const (
+	defaultMinReadBuf = 2048
+	defaultMaxReadBuf = 64 * 1024
+	// defaultPoolHigh caps the free buffers kept per size class
+	defaultPoolHigh = 256
+
+	// the buffer of a fd is doubled after readGrowAfter consecutive full
+	// reads, and halved after readShrinkAfter consecutive reads using less
+	// than a quarter
+	readGrowAfter   = 2
+	readShrinkAfter = 8
+)
+
+// SetBuffer sets the buffer the reads of the watched fd submitted with a nil
+// buffer read into instead of a pooled one, nil restores the pool. The
+// buffer belongs to the watcher until it's replaced or fd is deregistered,
+// by StopWatch, Close or Migrate, and the data of a result must be consumed before the next read into it.
+// The buffer can't be replaced while reads into it are pending,
+// ErrBufferBusy is returned then.
+func (w *Watcher) SetBuffer(fd int, buf []byte) error {
+	return w.fds.setBuffer(fd, buf)
+}
+
+// ReadBufferSize returns the size of the next buffer allocated for a read
+// on fd submitted with a nil buffer.
+func (w *Watcher) ReadBufferSize(fd int) (int, error) {
+	if !w.watched(fd) {
+		return 0, ErrNotWatched
+	}
+	return w.readBufferSize(fd), nil
+}
+
+func (w *Watcher) readBufferSize(fd int) int {
+	if d := w.fds.get(fd); d != nil {
+		if size := int(atomic.LoadInt32(&d.readSize)); size > 0 {
+			return size
+		}
+	}
+	return w.minReadBuf
+}
+
+// adaptReadBuffer records a read of n bytes into an allocated buffer of size
+func (w *Watcher) adaptReadBuffer(fd int, n, size int) {
+	d := w.fds.get(fd)
+	if d == nil {
+		return
+	}
+
+	cur := w.readBufferSize(fd)
+	switch {
+	case n >= size:
+		d.readSmall = 0
+		if d.readFull++; d.readFull >= readGrowAfter && cur < w.maxReadBuf {
+			d.readFull = 0
+			if cur *= 2; cur > w.maxReadBuf {
+				cur = w.maxReadBuf
+			}
+			atomic.StoreInt32(&d.readSize, int32(cur))
+		}
+	case n < size/4:
+		d.readFull = 0
+		if d.readSmall++; d.readSmall >= readShrinkAfter && cur > w.minReadBuf {
+			d.readSmall = 0
+			if cur /= 2; cur < w.minReadBuf {
+				cur = w.minReadBuf
+			}
+			atomic.StoreInt32(&d.readSize, int32(cur))
+		}
+	default:
+		d.readFull = 0
+		d.readSmall = 0
+	}
+}
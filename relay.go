@@ -0,0 +1,182 @@
+package gaio
+
+import (
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// RelayResult is the result of Relay, the bytes relayed in each direction
+// and the error which ended it, if any.
+type RelayResult struct {
+	A, B int
+	AToB int64
+	BToA int64
+	Err  error
+}
+
+// relayDir is a direction of a relay
+type relayDir struct {
+	src, dst int
+	buf      []byte
+	n        int64
+}
+
+// relay is the state machine of a Relay, driven by the results of its
+// requests routed by attach
+type relay struct {
+	w    *Watcher
+	ch   chan OpResult // the results of the requests, see attach
+	done chan RelayResult
+
+	mu      sync.Mutex
+	dirs    [2]relayDir
+	pending int   // the requests submitted and not completed
+	err     error // why the relay ended
+	ended   bool
+}
+
+// Relay copies the data of a to b and of b to a through user space, in
+// buffers of bufSize bytes borrowed from the pool of the watcher, 0 means
+// the size of a splice pipe. EOF read from one fd shuts down the writes of
+// the other, so its peer sees the half-close. The relay completes once both
+// directions read EOF, or a request of either fails, then both fds are
+// stopped, and the result is delivered to done, which should be buffered
+// as it's sent from the goroutines routing the results of the helpers. The
+// fds belong to the caller, who closes them after the result. No other
+// reads or writes should be submitted to a and b during the relay, see
+// Splice for a relay in the kernel. ErrFdBusy is returned for a fd driven
+// by another helper.
+//
+// a and b are fds like for the other requests of the watcher, rather than
+// the Handles of an EventServer, whose conns are read by the server itself.
+func (w *Watcher) Relay(a, b int, bufSize int, done chan RelayResult) error {
+	if !w.watched(a) || !w.watched(b) {
+		return ErrNotWatched
+	}
+	select {
+	case <-w.die:
+		return ErrWatcherClosed
+	default:
+	}
+	if bufSize <= 0 {
+		bufSize = pipeSize
+	}
+
+	r := &relay{w: w, done: done, dirs: [2]relayDir{{src: a, dst: b}, {src: b, dst: a}}}
+	ch, err := w.attach(r, a, b)
+	if err != nil {
+		return err
+	}
+	r.ch = ch
+
+	r.mu.Lock()
+	for i := range r.dirs {
+		r.dirs[i].buf = w.pool.get(bufSize)
+		if r.err == nil {
+			r.submit(w.Read(r.dirs[i].src, r.dirs[i].buf, r.ch))
+		}
+	}
+	res, ok := r.end()
+	r.mu.Unlock()
+	if ok {
+		r.deliver(res)
+	}
+	return nil
+}
+
+// submit counts a request submitted, or ends the relay with its error
+func (r *relay) submit(err error) {
+	if err != nil {
+		r.err = err
+		return
+	}
+	r.pending++
+}
+
+func (r *relay) onResult(res OpResult) {
+	if res.Operation == opWake {
+		return
+	}
+	r.mu.Lock()
+	if r.ended {
+		r.mu.Unlock()
+		res.Release()
+		return
+	}
+	r.pending--
+
+	d := &r.dirs[0]
+	if (res.Operation == OpRead) != (res.Fd == d.src) {
+		d = &r.dirs[1]
+	}
+	switch {
+	case res.Err != nil:
+		res.Release()
+		r.err = res.Err
+	case res.Operation == OpRead && res.Size == 0:
+		// the writes of dst are done, shutdown fails if its peer is gone
+		unix.Shutdown(d.dst, unix.SHUT_WR)
+	case res.Operation == OpRead:
+		// the data is in a pooled copy with WithCopyBuffers
+		r.submit(r.w.Write(d.dst, res.Buffer[:res.Size], r.ch))
+		res.Release()
+	default:
+		res.Release()
+		d.n += int64(res.Size)
+		r.submit(r.w.Read(d.src, d.buf, r.ch))
+	}
+	result, ok := r.end()
+	r.mu.Unlock()
+	if ok {
+		r.deliver(result)
+	}
+}
+
+func (r *relay) onClose() {
+	r.mu.Lock()
+	if r.err == nil {
+		r.err = ErrWatcherClosed
+	}
+	result, ok := r.end()
+	r.mu.Unlock()
+	if ok {
+		r.deliver(result)
+	}
+}
+
+// end stops both fds once both directions are done or one failed, and
+// returns the result to deliver
+func (r *relay) end() (RelayResult, bool) {
+	if r.ended || (r.err == nil && r.pending > 0) {
+		return RelayResult{}, false
+	}
+	r.ended = true
+	a, b := r.dirs[0].src, r.dirs[1].src
+	r.w.detach(a, b)
+	r.w.StopWatch(a)
+	r.w.StopWatch(b)
+	if r.pending == 0 {
+		// the buffers of requests dropped by StopWatch are left to the GC
+		for i := range r.dirs {
+			r.w.pool.put(r.dirs[i].buf)
+		}
+	}
+	return RelayResult{A: a, B: b, AToB: r.dirs[0].n, BToA: r.dirs[1].n, Err: r.err}, true
+}
+
+// deliver sends res to done, once the watcher has terminated only if done
+// has room, as it may not be received anymore
+func (r *relay) deliver(res RelayResult) {
+	if r.done == nil {
+		return
+	}
+	select {
+	case r.done <- res:
+	case <-r.w.die:
+		select {
+		case r.done <- res:
+		default:
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package gaio
+
+// WatchSCTP starts watching events on a connected one-to-one style SCTP
+// socket(SOCK_STREAM, IPPROTO_SCTP), and subscribes to the stream info
+// of incoming messages.
+func (w *Watcher) WatchSCTP(fd int) (int, error) {
+	if err := subscribeSCTP(fd); err != nil {
+		return 0, err
+	}
+	return w.WatchFd(fd)
+}
+
+// ReadSCTP submits a read request on a SCTP socket, a completion contains at
+// most one message, with the stream id in OpResult.Stream. MSG_EOR is set in
+// OpResult.Flags when the end of the message has been read.
+func (w *Watcher) ReadSCTP(fd int, buf []byte, done chan OpResult) error {
+	return w.shardOf(fd).submit(aiocb{kind: kindRead, fd: fd, buffer: buf, sctp: true, done: done})
+}
+
+// WriteSCTP submits a message to be sent on the SCTP stream `stream`
+func (w *Watcher) WriteSCTP(fd int, buf []byte, stream uint16, done chan OpResult) error {
+	return w.shardOf(fd).submit(aiocb{kind: kindWrite, fd: fd, buffer: buf, sctp: true, stream: stream, done: done})
+}
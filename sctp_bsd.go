@@ -0,0 +1,13 @@
+// +build darwin netbsd freebsd openbsd dragonfly
+
+package gaio
+
+import "syscall"
+
+func subscribeSCTP(fd int) error { return syscall.ENOPROTOOPT }
+
+func recvSCTP(sys sysCalls, fd int, p []byte) (n int, stream uint16, flags int, err error) {
+	return 0, 0, 0, syscall.ENOPROTOOPT
+}
+
+func sendSCTP(sys sysCalls, fd int, p []byte, stream uint16) (int, error) { return 0, syscall.ENOPROTOOPT }
@@ -0,0 +1,54 @@
+// +build linux
+
+package gaio
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	solSCTP    = 132 // SOL_SCTP
+	sctpSndrcv = 1   // SCTP_SNDRCV
+	sctpEvents = 11  // SCTP_EVENTS
+
+	sizeofSndrcvinfo = 32 // sizeof(struct sctp_sndrcvinfo)
+)
+
+// subscribeSCTP enables sctp_data_io_event, the first field of
+// struct sctp_event_subscribe, to receive SCTP_SNDRCV ancillary data.
+func subscribeSCTP(fd int) error {
+	return unix.SetsockoptString(fd, solSCTP, sctpEvents, "\x01")
+}
+
+func recvSCTP(sys sysCalls, fd int, p []byte) (n int, stream uint16, flags int, err error) {
+	oob := make([]byte, unix.CmsgSpace(sizeofSndrcvinfo))
+	n, oobn, flags, _, err := sys.Recvmsg(fd, p, oob, 0)
+	if err != nil {
+		return n, 0, 0, err
+	}
+
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return n, 0, flags, err
+	}
+
+	for _, m := range msgs {
+		if m.Header.Level == solSCTP && m.Header.Type == sctpSndrcv && len(m.Data) >= 2 {
+			// sinfo_stream is the first field of struct sctp_sndrcvinfo
+			stream = *(*uint16)(unsafe.Pointer(&m.Data[0]))
+		}
+	}
+	return n, stream, flags, nil
+}
+
+func sendSCTP(sys sysCalls, fd int, p []byte, stream uint16) (int, error) {
+	oob := make([]byte, unix.CmsgSpace(sizeofSndrcvinfo))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = solSCTP
+	h.Type = sctpSndrcv
+	h.SetLen(unix.CmsgLen(sizeofSndrcvinfo))
+	*(*uint16)(unsafe.Pointer(&oob[unix.CmsgLen(0)])) = stream
+	return sys.Sendmsg(fd, p, oob, nil, 0)
+}
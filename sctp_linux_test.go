@@ -0,0 +1,91 @@
+package gaio
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func sctpPair(t *testing.T) (int, int) {
+	ln, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, unix.IPPROTO_SCTP)
+	if err != nil {
+		t.Skip("sctp unsupported:", err)
+	}
+	defer unix.Close(ln)
+
+	if err := unix.Bind(ln, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Listen(ln, 1); err != nil {
+		t.Fatal(err)
+	}
+	sa, err := unix.Getsockname(ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, unix.IPPROTO_SCTP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Connect(client, sa); err != nil {
+		t.Fatal(err)
+	}
+
+	server, _, err := unix.Accept(ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestSCTPStream(t *testing.T) {
+	client, server := sctpPair(t)
+	defer unix.Close(client)
+	defer unix.Close(server)
+
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	cfd, err := w.WatchSCTP(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sfd, err := w.WatchSCTP(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan OpResult, 2)
+	msgs := []string{"a", "bb"}
+	for i, m := range msgs {
+		if err := w.WriteSCTP(cfd, []byte(m), uint16(i+1), done); err != nil {
+			t.Fatal(err)
+		}
+		if res := <-done; res.Err != nil {
+			t.Fatal(res.Err)
+		}
+	}
+
+	for i, m := range msgs {
+		if err := w.ReadSCTP(sfd, make([]byte, 64), done); err != nil {
+			t.Fatal(err)
+		}
+		res := <-done
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if string(res.Buffer[:res.Size]) != m {
+			t.Fatal("message boundary not preserved:", string(res.Buffer[:res.Size]))
+		}
+		if res.Stream != uint16(i+1) {
+			t.Fatal("incorrect stream id", res.Stream)
+		}
+		if res.Flags&unix.MSG_EOR == 0 {
+			t.Fatal("MSG_EOR not set")
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package gaio
+
+import (
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxSendfileSize limits the bytes transferred by a single sendfile(2) call,
+// so a huge file won't starve other connections.
+const maxSendfileSize = 4 << 20
+
+// maxInt is the largest int, 2GiB-1 on 32-bit platforms
+const maxInt = int64(^uint(0) >> 1)
+
+// SendFile submits a request to send `count` bytes of file `f` starting from
+// `offset` to fd, the data is copied by the kernel with sendfile(2) without
+// passing through user space. OpResult.Sent is the total bytes transferred,
+// OpResult.Size is the same clamped to the range of int, which a file past
+// 2GiB exceeds on 32-bit platforms.
+func (w *Watcher) SendFile(fd int, f *os.File, offset, count int64, done chan OpResult) error {
+	ffd, err := fileFd(f)
+	if err != nil {
+		return err
+	}
+	return w.shardOf(fd).submit(aiocb{kind: kindWrite, fd: fd, file: f, fileFd: ffd, offset: offset, count: count, done: done})
+}
+
+// fileFd returns the fd of f, fetched once on submission with Control, as
+// File.Fd puts f in blocking mode on each call
+func fileFd(f *os.File) (fd int, err error) {
+	rawconn, err := f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	if err := rawconn.Control(func(s uintptr) { fd = int(s) }); err != nil {
+		return 0, err
+	}
+	return fd, nil
+}
+
+// trySendfile sends the file until the socket buffer is full or all
+// bytes have been transferred, returns true if the request has completed
+func (s *shard) trySendfile(pcb *aiocb) (complete bool) {
+	var err error
+	for pcb.count > 0 {
+		chunk := pcb.count
+		if chunk > maxSendfileSize {
+			chunk = maxSendfileSize
+		}
+
+		var n int
+		n, err = unix.Sendfile(pcb.fd, pcb.fileFd, &pcb.offset, int(chunk))
+		if n > 0 {
+			pcb.sent += int64(n)
+			pcb.count -= int64(n)
+			s.progressed(pcb.fd, n)
+			s.reportProgress(pcb)
+		}
+
+		if err == syscall.EAGAIN {
+			return false
+		} else if err != nil {
+			break
+		} else if n == 0 {
+			err = io.ErrUnexpectedEOF
+			break
+		}
+	}
+
+	s.complete(pcb, OpResult{Operation: OpWrite, Fd: pcb.fd, Err: err})
+	return true
+}
+
+// clampInt converts n to int, clamped to maxInt
+func clampInt(n int64) int {
+	if n > maxInt {
+		return int(maxInt)
+	}
+	return int(n)
+}
@@ -0,0 +1,11 @@
+// +build linux freebsd netbsd openbsd dragonfly
+
+package gaio
+
+import "golang.org/x/sys/unix"
+
+// socket creates a non-blocking socket closed on exec, set atomically so a
+// concurrent fork doesn't inherit it
+func socket(family, sotype int) (int, error) {
+	return unix.Socket(family, sotype|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, 0)
+}
@@ -0,0 +1,28 @@
+// +build darwin
+
+package gaio
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// socket creates a non-blocking socket closed on exec, under ForkLock as
+// SOCK_CLOEXEC isn't supported, so a concurrent fork doesn't inherit it
+func socket(family, sotype int) (int, error) {
+	syscall.ForkLock.RLock()
+	fd, err := unix.Socket(family, sotype, 0)
+	if err == nil {
+		unix.CloseOnExec(fd)
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return 0, err
+	}
+	return fd, nil
+}
@@ -0,0 +1,114 @@
+package gaio
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// SetNotSentLowat sets TCP_NOTSENT_LOWAT on fd, the kernel reports fd as
+// writable only when the bytes not yet sent drop below the threshold, which
+// limits the data buffered in kernel for streaming servers generating data on
+// demand. A zero-length Write completes when fd becomes writable, and can be
+// used as a paced notification, queued writes still flush as usual.
+func (w *Watcher) SetNotSentLowat(fd int, bytes int) error {
+	if !w.watched(fd) {
+		return ErrNotWatched
+	}
+	return setNotSentLowat(fd, bytes)
+}
+
+// SetReadLowWatermark sets SO_RCVLOWAT on fd, readability is reported only
+// once n bytes are queued or the peer has shut down, so reads on fd complete
+// with at least n bytes instead of waking up for every tiny sliver. The
+// buffer passed to Read should be no smaller than n, n <= 1 restores the
+// default.
+func (w *Watcher) SetReadLowWatermark(fd int, n int) error {
+	d := w.fds.watched(fd)
+	if d == nil {
+		return ErrNotWatched
+	}
+	if n < 1 {
+		n = 1
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVLOWAT, n); err != nil {
+		return err
+	}
+
+	d.set(fdRcvLowat, n > 1)
+	return nil
+}
+
+// SetSockBuf sets SO_RCVBUF and SO_SNDBUF of a watched fd, 0 leaves the
+// corresponding buffer unchanged. Linux doubles the requested sizes to leave
+// room for bookkeeping and clamps them to rmem_max/wmem_max, use SockBuf to
+// read back the effective values.
+func (w *Watcher) SetSockBuf(fd int, rcv, snd int) error {
+	if !w.watched(fd) {
+		return ErrNotWatched
+	}
+	return setSockBuf(fd, rcv, snd)
+}
+
+// SockBuf returns the effective SO_RCVBUF and SO_SNDBUF of a watched fd.
+func (w *Watcher) SockBuf(fd int) (rcv, snd int, err error) {
+	if !w.watched(fd) {
+		return 0, 0, ErrNotWatched
+	}
+	if rcv, err = unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF); err != nil {
+		return 0, 0, os.NewSyscallError("getsockopt", err)
+	}
+	if snd, err = unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF); err != nil {
+		return 0, 0, os.NewSyscallError("getsockopt", err)
+	}
+	return rcv, snd, nil
+}
+
+func setSockBuf(fd int, rcv, snd int) error {
+	if rcv > 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, rcv); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	if snd > 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF, snd); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+	}
+	return nil
+}
+
+// ErrBusyPollUnsupported is returned by SetBusyPoll if the kernel is built
+// without busy polling.
+var ErrBusyPollUnsupported = newKindError("busy polling is not supported", ErrUnsupported)
+
+// SetBusyPoll sets SO_BUSY_POLL on a watched fd, reads on it busy-poll the
+// device queue for up to usec microseconds before sleeping, SO_PREFER_BUSY_POLL
+// is also set where available. It trades CPU for latency, a core spins for
+// the whole budget whenever the socket is idle. Raising usec above sysctl
+// net.core.busy_read requires CAP_NET_ADMIN, 0 disables.
+func (w *Watcher) SetBusyPoll(fd int, usec int) error {
+	if !w.watched(fd) {
+		return ErrNotWatched
+	}
+	return setBusyPoll(fd, usec)
+}
+
+// readable polls fd for POLLIN without blocking, which honours SO_RCVLOWAT.
+func readable(fd int) bool {
+	return poll(fd, unix.POLLIN)
+}
+
+// writable polls fd for POLLOUT without blocking.
+func writable(fd int) bool {
+	return poll(fd, unix.POLLOUT)
+}
+
+func poll(fd int, events int16) bool {
+	fds := []unix.PollFd{{Fd: int32(fd), Events: events}}
+	n, err := unix.Poll(fds, 0)
+	if err != nil {
+		return true // complete rather than stall
+	}
+	return n > 0 && fds[0].Revents != 0
+}
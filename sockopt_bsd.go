@@ -0,0 +1,18 @@
+// +build darwin netbsd freebsd openbsd dragonfly
+
+package gaio
+
+import "syscall"
+
+func boolint(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func setBusyPoll(fd int, usec int) error { return ErrBusyPollUnsupported }
+
+func setNotSentLowat(fd int, bytes int) error { return syscall.ENOPROTOOPT }
+
+func getTCPInfo(fd int) (*TCPInfo, error) { return nil, syscall.ENOPROTOOPT }
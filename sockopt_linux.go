@@ -0,0 +1,83 @@
+// +build linux
+
+package gaio
+
+import (
+	"os"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func boolint(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+const soPreferBusyPoll = 0x45
+
+func setBusyPoll(fd int, usec int) error {
+	err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_BUSY_POLL, usec)
+	if err == unix.ENOPROTOOPT {
+		return ErrBusyPollUnsupported
+	} else if err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+
+	// since linux 5.11
+	unix.SetsockoptInt(fd, unix.SOL_SOCKET, soPreferBusyPoll, boolint(usec > 0))
+	return nil
+}
+
+func setNotSentLowat(fd int, bytes int) error {
+	return unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_NOTSENT_LOWAT, bytes)
+}
+
+// tcpInfo mirrors struct tcp_info of linux up to tcpi_delivery_rate, older
+// kernels fill in a prefix and leave the rest zero.
+type tcpInfo struct {
+	state, caState, retransmits, probes, backoff, options, wscale, flags uint8
+
+	rto, ato, sndMss, rcvMss, unacked, sacked, lost, retrans, fackets uint32
+	lastDataSent, lastAckSent, lastDataRecv, lastAckRecv              uint32
+	pmtu, rcvSsthresh, rtt, rttvar, sndSsthresh, sndCwnd, advmss      uint32
+	reordering, rcvRtt, rcvSpace, totalRetrans                        uint32
+
+	pacingRate, maxPacingRate, bytesAcked, bytesReceived uint64
+
+	segsOut, segsIn, notsentBytes, minRtt, dataSegsIn, dataSegsOut uint32
+
+	deliveryRate uint64
+}
+
+func getTCPInfo(fd int) (*TCPInfo, error) {
+	var ti tcpInfo
+	size := uint32(unsafe.Sizeof(ti))
+	_, _, e := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), unix.IPPROTO_TCP, unix.TCP_INFO,
+		uintptr(unsafe.Pointer(&ti)), uintptr(unsafe.Pointer(&size)), 0)
+	if e != 0 {
+		return nil, e
+	}
+
+	return &TCPInfo{
+		State:        ti.state,
+		Retransmits:  ti.retransmits,
+		RTT:          time.Duration(ti.rtt) * time.Microsecond,
+		RTTVar:       time.Duration(ti.rttvar) * time.Microsecond,
+		MinRTT:       time.Duration(ti.minRtt) * time.Microsecond,
+		RTO:          time.Duration(ti.rto) * time.Microsecond,
+		SndMSS:       ti.sndMss,
+		SndCwnd:      ti.sndCwnd,
+		SndSsthresh:  ti.sndSsthresh,
+		Unacked:      ti.unacked,
+		Lost:         ti.lost,
+		TotalRetrans: ti.totalRetrans,
+		NotSent:      ti.notsentBytes,
+		BytesAcked:   ti.bytesAcked,
+		BytesRecv:    ti.bytesReceived,
+		DeliveryRate: ti.deliveryRate,
+	}, nil
+}
@@ -0,0 +1,328 @@
+package gaio
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestEnableFastOpen(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	if err := EnableFastOpen(ln, 16); err != nil {
+		t.Fatal(err)
+	}
+
+	rawconn, err := ln.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var qlen int
+	rawconn.Control(func(fd uintptr) {
+		qlen, err = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN)
+	})
+	if err != nil || qlen != 16 {
+		t.Fatal("option not applied", qlen, err)
+	}
+}
+
+func TestQuickAck(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	if err := w.SetQuickAck(fd, true); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan OpResult, 1)
+	buf := make([]byte, 64)
+	for i := 0; i < 100; i++ {
+		conn.Write([]byte("ping"))
+		w.Read(fd, buf, done)
+		if res := <-done; res.Err != nil {
+			t.Fatal(res.Err)
+		}
+
+		if v, err := unix.GetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_QUICKACK); err != nil || v != 1 {
+			t.Fatal("quickack not re-asserted", v, err)
+		}
+
+		w.Write(fd, []byte("pong"), done)
+		<-done
+		io.ReadFull(conn, buf[:4])
+	}
+}
+
+func TestNotSentLowat(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	if err := w.SetNotSentLowat(fd, 16384); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := unix.GetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_NOTSENT_LOWAT); err != nil || v != 16384 {
+		t.Fatal("option not applied", v, err)
+	}
+
+	// fill the socket until the kernel refuses more
+	buf := make([]byte, 65536)
+	for {
+		if _, err := unix.Write(fd, buf); err == syscall.EAGAIN {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan OpResult, 1)
+	w.Write(fd, nil, done)
+	select {
+	case <-done:
+		t.Fatal("notified while above low watermark")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	go io.Copy(ioutil.Discard, conn)
+	select {
+	case res := <-done:
+		if res.Err != nil || res.Size != 0 {
+			t.Fatal(res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no writability notification")
+	}
+
+	if err := w.SetNotSentLowat(-1, 16384); err != ErrNotWatched {
+		t.Fatal("expected ErrNotWatched", err)
+	}
+}
+
+func TestReadLowWatermark(t *testing.T) {
+	reads := func(lowat int) int {
+		w, err := CreateWatcher()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+
+		fd, conn := tcpPair(t, w)
+		defer conn.Close()
+		if lowat > 0 {
+			if err := w.SetReadLowWatermark(fd, lowat); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		go func() {
+			for i := 0; i < 128; i++ {
+				conn.Write(make([]byte, 8))
+				time.Sleep(100 * time.Microsecond)
+			}
+		}()
+
+		done := make(chan OpResult, 1)
+		buf := make([]byte, 4096)
+		count, total := 0, 0
+		for total < 1024 {
+			w.Read(fd, buf, done)
+			res := <-done
+			if res.Err != nil {
+				t.Fatal(res.Err)
+			}
+			count++
+			total += res.Size
+		}
+		return count
+	}
+
+	without, with := reads(0), reads(512)
+	t.Log("reads without lowat:", without, "with:", with)
+	if with > 2 || with >= without {
+		t.Fatal("low watermark not honoured")
+	}
+}
+
+func TestTCPInfo(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if unsafe.Sizeof(tcpInfo{}) != 168 {
+		t.Fatal("tcp_info layout mismatch", unsafe.Sizeof(tcpInfo{}))
+	}
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	go io.Copy(ioutil.Discard, conn)
+
+	done := make(chan OpResult, 1)
+	for i := 0; i < 16; i++ {
+		w.Write(fd, make([]byte, 65536), done)
+		if res := <-done; res.Err != nil {
+			t.Fatal(res.Err)
+		}
+	}
+
+	info, err := w.TCPInfo(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("%+v", info)
+	if info.RTT == 0 || info.SndCwnd == 0 || info.BytesAcked == 0 {
+		t.Fatal("insane tcp info", info)
+	}
+
+	w.StopWatch(fd)
+	if _, err := w.TCPInfo(fd); err != ErrNotWatched {
+		t.Fatal("expected ErrNotWatched", err)
+	}
+}
+
+func TestSockBuf(t *testing.T) {
+	w, err := CreateWatcher(WithSockBuf(8192, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	if rcv, _, err := w.SockBuf(fd); err != nil || rcv != 16384 {
+		t.Fatal("default not applied", rcv, err)
+	}
+
+	if err := w.SetSockBuf(fd, 4096, 4096); err != nil {
+		t.Fatal(err)
+	}
+	rcv, snd, err := w.SockBuf(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF); v != snd || snd < 4096 || rcv < 4096 {
+		t.Fatal("effective values mismatch", rcv, snd, v)
+	}
+
+	// tiny buffers force many partial writes
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	received := make(chan []byte)
+	go func() {
+		buf, _ := ioutil.ReadAll(io.LimitReader(conn, int64(len(data))))
+		received <- buf
+	}()
+
+	done := make(chan OpResult, 1)
+	w.Write(fd, data, done)
+	if res := <-done; res.Err != nil || res.Size != len(data) {
+		t.Fatal(res.Err, res.Size)
+	}
+	if !bytes.Equal(<-received, data) {
+		t.Fatal("data mismatch")
+	}
+
+	if err := w.SetSockBuf(-1, 4096, 4096); err != ErrNotWatched {
+		t.Fatal("expected ErrNotWatched", err)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	w, err := CreateWatcher(WithKeepAlive(time.Second, time.Second, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	for _, opt := range []struct{ level, name, value int }{
+		{unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1},
+		{unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, 1},
+		{unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, 1},
+		{unix.IPPROTO_TCP, unix.TCP_KEEPCNT, 1},
+	} {
+		if v, err := unix.GetsockoptInt(fd, opt.level, opt.name); err != nil || v != opt.value {
+			t.Fatal("option not applied", opt, v, err)
+		}
+	}
+
+	// the peer drops every segment, so probes go unanswered
+	rawconn, _ := conn.(*net.TCPConn).SyscallConn()
+	rawconn.Control(func(s uintptr) {
+		drop := []unix.SockFilter{{Code: unix.BPF_RET | unix.BPF_K, K: 0}}
+		err = unix.SetsockoptSockFprog(int(s), unix.SOL_SOCKET, unix.SO_ATTACH_FILTER,
+			&unix.SockFprog{Len: 1, Filter: &drop[0]})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan OpResult, 1)
+	w.Read(fd, make([]byte, 64), done)
+	select {
+	case res := <-done:
+		if !errors.Is(res.Err, ErrKeepAliveTimeout) {
+			t.Fatal("expected ErrKeepAliveTimeout", res.Err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("dead peer not detected")
+	}
+}
+
+func TestBusyPoll(t *testing.T) {
+	w, err := CreateWatcher(WithBusyPoll(50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	err = w.SetBusyPoll(fd, 20)
+	if err == ErrBusyPollUnsupported {
+		t.Log(err)
+	} else if err != nil {
+		t.Fatal(err)
+	} else if v, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_BUSY_POLL); err != nil || v != 20 {
+		t.Fatal("option not applied", v, err)
+	}
+
+	// normal operation either way
+	done := make(chan OpResult, 1)
+	buf := make([]byte, 64)
+	conn.Write([]byte("ping"))
+	w.Read(fd, buf, done)
+	if res := <-done; res.Err != nil || string(buf[:res.Size]) != "ping" {
+		t.Fatal(res.Err)
+	}
+}
@@ -0,0 +1,56 @@
+package gaio
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// spinner decides whether an idle poller keeps polling without blocking, it
+// spins for budget after the last activity before parking, and accounts the
+// time spent spinning and blocked.
+type spinner struct {
+	budget time.Duration
+	start  time.Time // spinning since
+	parked time.Time // blocked since
+	stats  *pollStats
+}
+
+// wake is called when the poller resumes polling
+func (sp *spinner) wake() {
+	if !sp.parked.IsZero() {
+		atomic.AddInt64(&sp.stats.blocked, int64(time.Since(sp.parked)))
+		sp.parked = time.Time{}
+	}
+}
+
+// busy is called when there's work to do
+func (sp *spinner) busy() {
+	if !sp.start.IsZero() {
+		atomic.AddInt64(&sp.stats.spinning, int64(time.Since(sp.start)))
+		sp.start = time.Time{}
+	}
+}
+
+// spin returns true if the poller should poll again instead of parking
+func (sp *spinner) spin() bool {
+	if sp.budget <= 0 {
+		return false
+	}
+
+	now := time.Now()
+	if sp.start.IsZero() {
+		sp.start = now
+	} else if now.Sub(sp.start) >= sp.budget {
+		atomic.AddInt64(&sp.stats.spinning, int64(now.Sub(sp.start)))
+		sp.start = time.Time{}
+		return false
+	}
+	runtime.Gosched()
+	return true
+}
+
+// park is called before blocking
+func (sp *spinner) park() {
+	sp.parked = time.Now()
+}
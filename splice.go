@@ -0,0 +1,176 @@
+package gaio
+
+import "syscall"
+
+const (
+	// pipeSize is the capacity of a pipe used by splice
+	pipeSize = 64 * 1024
+	// maxIdlePipes limits the number of pipes kept for reuse
+	maxIdlePipes = 64
+)
+
+// spliceState is shared by the pending reader on src and the pending
+// writer on dst of a splice request.
+type spliceState struct {
+	src, dst int
+	max      int64 // <= 0 means unlimited
+	pipe     [2]int
+	hasPipe  bool
+	buffered int   // bytes in pipe, not yet written to dst
+	total    int64 // bytes written to dst
+	eof      bool
+	finished bool
+	foreign  bool // dst is on another shard, see watchForeign
+	done     chan OpResult
+}
+
+// Splice submits a request to move data from srcFd to dstFd inside the kernel
+// with splice(2) through a pipe, the data never passes through user space.
+// The request completes when maxBytes have been moved, EOF is read from
+// srcFd or error occurred on either side, maxBytes <= 0 means until EOF.
+// OpResult.Fd is srcFd and OpResult.Size is the total bytes moved.
+//
+// No other reads on srcFd or writes on dstFd should be submitted while the
+// splice is in progress. For fds on different shards, the splice is run by
+// the loop of srcFd, which watches the writability of dstFd as well.
+func (w *Watcher) Splice(srcFd, dstFd int, maxBytes int64, done chan OpResult) error {
+	s := &spliceState{src: srcFd, dst: dstFd, max: maxBytes, done: done}
+	return w.shardOf(srcFd).submit(aiocb{kind: kindRead, fd: srcFd, splice: s})
+}
+
+// watchForeign registers the dst of sp, a fd of another shard, to the
+// poller of s, so its writability resumes sp on the loop of s, see onEvent
+func (s *shard) watchForeign(sp *spliceState) error {
+	if err := s.pfd.Watch(sp.dst); err != nil {
+		return err
+	}
+	if s.foreign == nil {
+		s.foreign = make(map[int]*spliceState)
+	}
+	s.foreign[sp.dst] = sp
+	sp.foreign = true
+	return nil
+}
+
+// unwatchForeign removes the dst of sp from the poller of s
+func (s *shard) unwatchForeign(sp *spliceState) {
+	if !sp.foreign || s.foreign[sp.dst] != sp {
+		return
+	}
+	sp.foreign = false
+	delete(s.foreign, sp.dst)
+	// it fails if dst is closed already, which removed it
+	s.pfd.Unwatch(sp.dst)
+}
+
+// resumeSplice continues sp on writability of its foreign dst, the reader
+// of sp on src is popped by the next round of src once it's finished
+func (s *shard) resumeSplice(sp *spliceState) {
+	s.resetBudget()
+	if s.trySplice(sp) {
+		if d := s.w.fds.watched(sp.src); d != nil {
+			s.markDirty(d, true, false)
+		}
+	}
+}
+
+// trySplice moves data until either side blocks, it's called on readiness of
+// both ends, and returns true if the request has completed.
+func (s *shard) trySplice(sp *spliceState) (complete bool) {
+	if sp.finished { // completed by the other end
+		return true
+	}
+
+	if !sp.hasPipe {
+		p, err := s.getPipe()
+		if err != nil {
+			return s.finishSplice(sp, err)
+		}
+		sp.pipe = p
+		sp.hasPipe = true
+	}
+
+	for {
+		// flush buffered data in pipe to dst first
+		for sp.buffered > 0 {
+			n, err := spliceMove(sp.pipe[0], sp.dst, sp.buffered)
+			if err == syscall.EAGAIN {
+				return false
+			} else if err != nil {
+				return s.finishSplice(sp, err)
+			}
+			sp.buffered -= n
+			sp.total += int64(n)
+		}
+
+		if sp.eof || (sp.max > 0 && sp.total >= sp.max) {
+			return s.finishSplice(sp, nil)
+		}
+
+		// continued on the next round if the budget of the fd is exhausted
+		if s.exhausted() {
+			return false
+		}
+
+		// fill the pipe from src
+		want := int64(pipeSize)
+		if sp.max > 0 && sp.max-sp.total < want {
+			want = sp.max - sp.total
+		}
+
+		n, err := spliceMove(sp.src, sp.pipe[1], int(want))
+		if err == syscall.EAGAIN {
+			return false
+		} else if err != nil {
+			return s.finishSplice(sp, err)
+		} else if n == 0 {
+			sp.eof = true
+		}
+		sp.buffered += n
+		s.consume(n)
+	}
+}
+
+func (s *shard) finishSplice(sp *spliceState, err error) bool {
+	sp.finished = true
+	s.unwatchForeign(sp)
+	if sp.hasPipe {
+		s.putPipe(sp.pipe, sp.buffered == 0)
+		sp.hasPipe = false
+	}
+
+	if sp.done != nil {
+		res := OpResult{Fd: sp.src, Size: int(sp.total), Err: err}
+		res.Err = s.w.opError(&res)
+		s.deliver(sp.done, res)
+	}
+	return true
+}
+
+// getPipe returns a pipe from the idle list or creates a new one
+func (s *shard) getPipe() ([2]int, error) {
+	if n := len(s.pipes); n > 0 {
+		p := s.pipes[n-1]
+		s.pipes = s.pipes[:n-1]
+		return p, nil
+	}
+	return openPipe()
+}
+
+// putPipe recycles a pipe, pipes with data left are closed
+func (s *shard) putPipe(p [2]int, clean bool) {
+	if clean && len(s.pipes) < maxIdlePipes {
+		s.pipes = append(s.pipes, p)
+		return
+	}
+	syscall.Close(p[0])
+	syscall.Close(p[1])
+}
+
+func (s *shard) closePipes() {
+	for _, p := range s.pipes {
+		syscall.Close(p[0])
+		syscall.Close(p[1])
+	}
+	s.pipes = nil
+}
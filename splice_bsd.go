@@ -0,0 +1,9 @@
+// +build darwin netbsd freebsd openbsd dragonfly
+
+package gaio
+
+import "syscall"
+
+func openPipe() (p [2]int, err error) { return p, syscall.ENOSYS }
+
+func spliceMove(in, out int, n int) (int, error) { return 0, syscall.ENOSYS }
@@ -0,0 +1,21 @@
+// +build linux
+
+package gaio
+
+import "golang.org/x/sys/unix"
+
+func openPipe() (p [2]int, err error) {
+	var fds [2]int
+	if err := unix.Pipe2(fds[:], unix.O_NONBLOCK|unix.O_CLOEXEC); err != nil {
+		return p, err
+	}
+	return fds, nil
+}
+
+func spliceMove(in, out int, n int) (int, error) {
+	moved, err := unix.Splice(in, nil, out, nil, n, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+	if err != nil {
+		return 0, err
+	}
+	return int(moved), nil
+}
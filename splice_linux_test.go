@@ -0,0 +1,60 @@
+package gaio
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func TestSplice(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	src, upstream := tcpPair(t, w)
+	defer upstream.Close()
+	dst, downstream := tcpPair(t, w)
+	defer downstream.Close()
+
+	tx := make([]byte, 32*1024*1024)
+	io.ReadFull(rand.Reader, tx)
+
+	done := make(chan OpResult, 1)
+	half := int64(len(tx) / 2)
+	if err := w.Splice(src, dst, half, done); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		upstream.Write(tx)
+		upstream.Close()
+	}()
+
+	rx := make([]byte, len(tx))
+	if _, err := io.ReadFull(downstream, rx[:half]); err != nil {
+		t.Fatal(err)
+	}
+	res := <-done
+	if res.Err != nil || int64(res.Size) != half {
+		t.Fatal("splice:", res.Err, res.Size)
+	}
+
+	// the rest until EOF
+	if err := w.Splice(src, dst, 0, done); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(downstream, rx[half:]); err != nil {
+		t.Fatal(err)
+	}
+	res = <-done
+	if res.Err != nil || int64(res.Size) != int64(len(tx))-half {
+		t.Fatal("splice:", res.Err, res.Size)
+	}
+
+	if !bytes.Equal(tx, rx) {
+		t.Fatal("incorrect receiving")
+	}
+}
@@ -0,0 +1,68 @@
+package gaio
+
+import (
+	"container/heap"
+	"sync/atomic"
+	"time"
+)
+
+// ErrWriteStalled is the error of the write at the head of the queue of a
+// fd whose writes made no progress for the timeout of
+// WithWriteStallTimeout. It matches ErrPeerGone.
+var ErrWriteStalled = newKindError("write stalled", ErrPeerGone)
+
+// watchStall starts the stall clock of d when a write is queued to its
+// empty write queue, and the timer checking it
+func (s *shard) watchStall(d *fdDesc) {
+	if s.w.stallTimeout <= 0 || len(d.writers) > 0 {
+		return
+	}
+	atomic.StoreInt64(&d.wrote, s.now.UnixNano())
+	if d.stall == nil {
+		d.stall = &timer{deadline: s.now.Add(s.w.stallTimeout), d: d, stall: true}
+		heap.Push(&s.timers, d.stall)
+	}
+}
+
+// progressed restarts the stall clock and the intervals of the heartbeat
+// and the probe of fd after a write of n bytes, it's called by the executor
+// of the writes
+func (s *shard) progressed(fd int, n int) {
+	if n <= 0 {
+		return
+	}
+	if d := s.w.fds.get(fd); d != nil && (s.w.stallTimeout > 0 || d.has(fdHeartbeat|fdProbe)) {
+		atomic.StoreInt64(&d.wrote, time.Now().UnixNano())
+	}
+}
+
+// checkStall fails the head of the write queue of the fd of t if it made no
+// progress for the stall timeout, and rearms t while writes are queued
+func (s *shard) checkStall(t *timer, now time.Time) {
+	d := t.d
+	if len(d.writers) == 0 {
+		d.stall = nil
+		return
+	}
+	last := time.Unix(0, atomic.LoadInt64(&d.wrote))
+	if deadline := last.Add(s.w.stallTimeout); now.Before(deadline) {
+		t.deadline = deadline
+		heap.Push(&s.timers, t)
+		return
+	}
+
+	// a splice or a zerocopy send waiting for its notifications is left to
+	// its own end
+	if pcb := &d.writers[0]; pcb.splice == nil && !pcb.zcPending {
+		s.complete(pcb, OpResult{Operation: OpWrite, Fd: pcb.fd, Buffer: pcb.buffer, Size: pcb.size, Err: ErrWriteStalled})
+		d.writers = s.popFront(d.writers)
+	}
+	if len(d.writers) == 0 {
+		d.stall = nil
+		return
+	}
+	// the next write is given the timeout again
+	atomic.StoreInt64(&d.wrote, now.UnixNano())
+	t.deadline = now.Add(s.w.stallTimeout)
+	heap.Push(&s.timers, t)
+}
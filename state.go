@@ -0,0 +1,197 @@
+package gaio
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// State is a snapshot of the internals of a Watcher for debugging, see
+// DumpState.
+type State struct {
+	Name    string    // of the watcher, see WithName
+	Time    time.Time // when the snapshot was requested
+	Conns   int       // fds being watched
+	Pending int64     // requests submitted and not yet completed
+	Shards  []ShardState
+	Fds     []FdState // fds with pending requests, by fd
+}
+
+// ShardState is the state of the event loop of a shard.
+type ShardState struct {
+	Queued  int       // submissions waiting for the loop
+	Timers  int       // deadlines, rate limit resumptions, heartbeats and probes
+	Armed   time.Time // when the timer of the poller fires, zero if disarmed
+	Backlog int       // fds continued on the next round, see WithEventBudget
+	Batched int       // results held back, see WithCompletionBatching
+}
+
+// FdState is the state of a fd with pending requests. The queues of a fd
+// executing on a worker are owned by the worker, only its Pending and
+// Deferred are known then.
+type FdState struct {
+	Fd          int
+	Shard       int
+	Pending     int           // requests submitted and not yet completed
+	Reads       int           // reads queued, including urgent reads
+	Writes      int           // writes queued
+	QueuedBytes int           // bytes of the writes queued
+	Oldest      time.Duration // age of the oldest request queued
+	Busy        bool          // executing on a worker
+	Deferred    int           // requests waiting for the worker
+	Tags        []string      // see SetTags
+}
+
+// shardDump is the part of a State captured by the loop of a shard
+type shardDump struct {
+	shard ShardState
+	fds   []FdState
+}
+
+// DumpState returns a snapshot of the watcher, it's safe to call from any
+// goroutine while the loops run. Each loop captures its own part between two
+// rounds, so the loops only pause to copy their counters, and the parts of
+// different shards may be apart by a round.
+func (w *Watcher) DumpState() (*State, error) {
+	st := &State{Name: w.name, Time: time.Now()}
+	replies := make([]chan *shardDump, len(w.shards))
+	for i, s := range w.shards {
+		replies[i] = make(chan *shardDump, 1)
+		if err := s.submit(aiocb{kind: kindDump, fd: -1, dump: replies[i]}); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range replies {
+		select {
+		case dump := <-replies[i]:
+			st.Shards = append(st.Shards, dump.shard)
+			for _, fs := range dump.fds {
+				fs.Shard = i
+				st.Fds = append(st.Fds, fs)
+			}
+		case <-w.die:
+			return nil, ErrWatcherClosed
+		}
+	}
+	st.Conns, st.Pending = w.fds.len(), atomic.LoadInt64(&w.pending)
+	sort.Slice(st.Fds, func(i, j int) bool { return st.Fds[i].Fd < st.Fds[j].Fd })
+	return st, nil
+}
+
+// dumpState captures the state of s and its fds on the loop
+func (s *shard) dumpState() *shardDump {
+	dump := new(shardDump)
+	s.queueMu.Lock()
+	dump.shard.Queued = len(s.queue)
+	s.queueMu.Unlock()
+	dump.shard.Timers = len(s.timers)
+	dump.shard.Armed = s.armed
+	dump.shard.Backlog = len(s.backlog)
+	dump.shard.Batched = len(s.batch)
+
+	now := time.Now()
+	s.w.fds.each(func(fd int, d *fdDesc) bool {
+		if s.w.shardOf(fd) != s {
+			return true
+		}
+		fs := FdState{Fd: fd, Pending: int(atomic.LoadInt32(&d.pending)), Busy: d.busy, Deferred: len(d.deferred)}
+		if !d.busy {
+			fs.Reads = len(d.readers) + len(d.urgents)
+			fs.Writes = len(d.writers)
+			fs.QueuedBytes = d.queued
+			for _, q := range [][]aiocb{d.readers, d.writers, d.urgents} {
+				if len(q) > 0 && !q[0].since.IsZero() && now.Sub(q[0].since) > fs.Oldest {
+					fs.Oldest = now.Sub(q[0].since)
+				}
+			}
+		}
+		if fs.Pending > 0 || fs.Reads+fs.Writes+fs.Deferred > 0 || fs.Busy {
+			fs.Tags = s.w.fds.tags(fd)
+			dump.fds = append(dump.fds, fs)
+		}
+		return true
+	})
+	return dump
+}
+
+// PendingOp is a request queued on a fd, see Pending.
+type PendingOp struct {
+	Operation OpType
+	Len       int       // of the buffer, zero for a read into a pooled buffer
+	Done      int       // bytes written so far by a write
+	Queued    time.Time // when the loop queued it
+	Deadline  time.Time // of ReadTimeout and WriteTimeout, zero if none
+}
+
+// Pending returns the requests queued on the watched fd: urgent reads,
+// reads and writes, each in order. Like DumpState the loop of fd copies
+// them between two rounds, after the requests of fd executing on a worker
+// return, so it's cheap enough to be called on demand.
+func (w *Watcher) Pending(fd int) ([]PendingOp, error) {
+	reply := make(chan []PendingOp, 1)
+	if err := w.shardOf(fd).submit(aiocb{kind: kindPending, fd: fd, inspect: reply}); err != nil {
+		return nil, err
+	}
+	select {
+	case ops := <-reply:
+		if ops == nil {
+			return nil, ErrNotWatched
+		}
+		return ops, nil
+	case <-w.die:
+		return nil, ErrWatcherClosed
+	}
+}
+
+// pendingOps copies the requests queued on fd, nil if it's not watched
+func (s *shard) pendingOps(fd int) []PendingOp {
+	d := s.w.fds.watched(fd)
+	if d == nil {
+		return nil
+	}
+	ops := make([]PendingOp, 0, len(d.urgents)+len(d.readers)+len(d.writers))
+	for _, q := range [][]aiocb{d.urgents, d.readers, d.writers} {
+		for i := range q {
+			op := PendingOp{Operation: q[i].op(), Len: len(q[i].buffer), Queued: q[i].since, Deadline: q[i].deadline}
+			if q[i].kind == kindWrite {
+				op.Done = q[i].size
+			}
+			ops = append(ops, op)
+		}
+	}
+	return ops
+}
+
+// WriteTo writes st as text to wr, one line per shard and per fd.
+func (st *State) WriteTo(wr io.Writer) (int64, error) {
+	var total int64
+	printf := func(format string, args ...interface{}) error {
+		n, err := fmt.Fprintf(wr, format, args...)
+		total += int64(n)
+		return err
+	}
+
+	if err := printf("watcher %v at %v: %v conns, %v pending\n", st.Name, st.Time.Format(time.RFC3339Nano), st.Conns, st.Pending); err != nil {
+		return total, err
+	}
+	for i, ss := range st.Shards {
+		armed := "disarmed"
+		if !ss.Armed.IsZero() {
+			armed = ss.Armed.Sub(st.Time).String()
+		}
+		if err := printf("shard %v: queued=%v timers=%v armed=%v backlog=%v batched=%v\n",
+			i, ss.Queued, ss.Timers, armed, ss.Backlog, ss.Batched); err != nil {
+			return total, err
+		}
+	}
+	for _, fs := range st.Fds {
+		if err := printf("fd %v: shard=%v pending=%v reads=%v writes=%v queued=%vB oldest=%v busy=%v deferred=%v\n",
+			fs.Fd, fs.Shard, fs.Pending, fs.Reads, fs.Writes, fs.QueuedBytes, fs.Oldest, fs.Busy, fs.Deferred); err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,189 @@
+package gaio
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// Stats are the counters of a Watcher, summed over shards.
+type Stats struct {
+	Waits        uint64 // calls to epoll_wait or kevent
+	Events       uint64 // events returned by Waits
+	EventsBuf    int    // current size of the events buffers
+	EventsGrown  uint64 // times an events buffer has been doubled
+	EventsShrunk uint64 // times an events buffer has been halved
+
+	SpinTime  time.Duration // time polled without blocking, see WithSpin
+	BlockTime time.Duration // time blocked waiting for events
+
+	Wakeups      uint64 // rounds of the event loops
+	Submitted    uint64 // requests accepted by submissions
+	Reads        uint64 // results of reads delivered
+	Writes       uint64 // results of writes delivered
+	Errors       uint64 // results delivered with an error
+	Timeouts     uint64 // results delivered with ErrDeadline, also in Errors
+	BytesRead    uint64 // bytes of the results of reads
+	BytesWritten uint64 // bytes of the results of writes
+	Dropped      uint64 // results dropped from full channels, see SetDropOldest
+
+	// syscalls of reads and writes, see sizeBucket for the buckets of the
+	// bytes per syscall
+	ReadsAgain  uint64 // reads returning EAGAIN after readiness was reported
+	WritesAgain uint64 // writes returning EAGAIN after readiness was reported
+	ShortWrites uint64 // writes returning fewer bytes than given
+	ReadSizes   [SizeBuckets]uint64
+	WriteSizes  [SizeBuckets]uint64
+
+	Conns       int   // fds being watched
+	Pending     int64 // requests submitted and not yet completed
+	PinnedBytes int64 // bytes of the buffers held by pending requests
+
+	PoolFree      int    // free buffers in the read buffer pool
+	PoolFreeBytes int64  // bytes held by them
+	PoolAllocated uint64 // buffers allocated by the pool
+}
+
+// pollStats are updated by the loop and read by Stats, the 64-bit counters
+// come first for alignment on 32-bit platforms.
+type pollStats struct {
+	waits   uint64
+	events  uint64
+	grown   uint64
+	shrunk  uint64
+	bufSize int64
+
+	spinning int64 // nanoseconds
+	blocked  int64 // nanoseconds
+}
+
+// opStats are the counters of requests of a shard, updated by its loop and
+// the workers executing its fds
+type opStats struct {
+	wakeups      uint64
+	submitted    uint64
+	reads        uint64
+	writes       uint64
+	errors       uint64
+	timeouts     uint64
+	bytesRead    uint64
+	bytesWritten uint64
+	dropped      uint64
+	readsAgain   uint64
+	writesAgain  uint64
+	shortWrites  uint64
+	readSizes    [SizeBuckets]uint64
+	writeSizes   [SizeBuckets]uint64
+}
+
+// count accounts a result delivered
+func (st *opStats) count(res *OpResult) {
+	switch res.Operation {
+	case OpRead, OpUrgent:
+		atomic.AddUint64(&st.reads, 1)
+		atomic.AddUint64(&st.bytesRead, uint64(res.Size))
+	case OpWrite:
+		atomic.AddUint64(&st.writes, 1)
+		atomic.AddUint64(&st.bytesWritten, uint64(res.Size))
+	default:
+		return
+	}
+	if res.Err != nil {
+		atomic.AddUint64(&st.errors, 1)
+		if errors.Is(res.Err, ErrDeadline) {
+			atomic.AddUint64(&st.timeouts, 1)
+		}
+	}
+}
+
+// Stats returns a snapshot of the counters of w, they're updated with
+// atomic adds as requests progress, so sampling them periodically is the
+// way to export them to a metrics system.
+func (w *Watcher) Stats() (st Stats) {
+	for _, s := range w.shards {
+		ps := s.pfd.stats
+		st.Waits += atomic.LoadUint64(&ps.waits)
+		st.Events += atomic.LoadUint64(&ps.events)
+		st.EventsBuf += int(atomic.LoadInt64(&ps.bufSize))
+		st.EventsGrown += atomic.LoadUint64(&ps.grown)
+		st.EventsShrunk += atomic.LoadUint64(&ps.shrunk)
+		st.SpinTime += time.Duration(atomic.LoadInt64(&ps.spinning))
+		st.BlockTime += time.Duration(atomic.LoadInt64(&ps.blocked))
+
+		ops := s.ops
+		st.Wakeups += atomic.LoadUint64(&ops.wakeups)
+		st.Submitted += atomic.LoadUint64(&ops.submitted)
+		st.Reads += atomic.LoadUint64(&ops.reads)
+		st.Writes += atomic.LoadUint64(&ops.writes)
+		st.Errors += atomic.LoadUint64(&ops.errors)
+		st.Timeouts += atomic.LoadUint64(&ops.timeouts)
+		st.BytesRead += atomic.LoadUint64(&ops.bytesRead)
+		st.BytesWritten += atomic.LoadUint64(&ops.bytesWritten)
+		st.Dropped += atomic.LoadUint64(&ops.dropped)
+		st.ReadsAgain += atomic.LoadUint64(&ops.readsAgain)
+		st.WritesAgain += atomic.LoadUint64(&ops.writesAgain)
+		st.ShortWrites += atomic.LoadUint64(&ops.shortWrites)
+		for i := 0; i < SizeBuckets; i++ {
+			st.ReadSizes[i] += atomic.LoadUint64(&ops.readSizes[i])
+			st.WriteSizes[i] += atomic.LoadUint64(&ops.writeSizes[i])
+		}
+	}
+	st.Conns = w.fds.len()
+	st.Pending = atomic.LoadInt64(&w.pending)
+	st.PinnedBytes = atomic.LoadInt64(&w.pinned)
+	st.PoolFree, st.PoolFreeBytes, st.PoolAllocated = w.pool.stats()
+	return st
+}
+
+// SizeBuckets is the number of buckets of Stats.ReadSizes and
+// Stats.WriteSizes, the bytes per syscall are counted in buckets of 0, up
+// to 64, 256, 1K, 4K, 16K, 64K bytes, and more.
+const SizeBuckets = 8
+
+// sizeBucket returns the bucket of a syscall of n bytes
+func sizeBucket(n int) int {
+	if n <= 0 {
+		return 0
+	}
+	b := 1
+	for limit := 64; n > limit && b < SizeBuckets-1; limit *= 4 {
+		b++
+	}
+	return b
+}
+
+// countAgain accounts a syscall of fd returning EAGAIN, when it followed
+// readiness
+func (s *shard) countAgain(fd int, write bool) {
+	if !s.ready {
+		return
+	}
+	d := s.w.fds.get(fd)
+	if write {
+		atomic.AddUint64(&s.ops.writesAgain, 1)
+		if d != nil {
+			atomic.AddUint64(&d.stats.writesAgain, 1)
+		}
+	} else {
+		atomic.AddUint64(&s.ops.readsAgain, 1)
+		if d != nil {
+			atomic.AddUint64(&d.stats.readsAgain, 1)
+		}
+	}
+}
+
+// countRead accounts a read syscall of n bytes
+func (s *shard) countRead(n int) {
+	atomic.AddUint64(&s.ops.readSizes[sizeBucket(n)], 1)
+}
+
+// countWrite accounts a write syscall of fd of n bytes out of given
+func (s *shard) countWrite(fd int, n, given int) {
+	atomic.AddUint64(&s.ops.writeSizes[sizeBucket(n)], 1)
+	if n < given {
+		atomic.AddUint64(&s.ops.shortWrites, 1)
+		if d := s.w.fds.get(fd); d != nil {
+			atomic.AddUint64(&d.stats.shortWrites, 1)
+		}
+	}
+}
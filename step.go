@@ -0,0 +1,37 @@
+package gaio
+
+// withManualStep makes the watcher run without goroutines, its loops are
+// run by step, so tests interleave their actions with the progress of the
+// loops deterministically. The results are delivered by step, so they must
+// fit the done channels, and the requests answered by the loops, such as
+// DumpState or Migrate, block until a step by another goroutine. Workers,
+// the watchdog and the leak check are disabled.
+func withManualStep() Option {
+	return func(w *Watcher) {
+		w.manual = true
+	}
+}
+
+// step runs a round of the loops of a watcher created with withManualStep:
+// the submissions are handled, the events ready are processed without
+// waiting, and the requests queued meanwhile are handled. A failure of a
+// poller terminates the watcher like in its loop, ErrWatcherClosed is
+// returned once the watcher has terminated.
+func (w *Watcher) step() error {
+	for _, s := range w.shards {
+		select {
+		case <-w.die:
+			return ErrWatcherClosed
+		default:
+		}
+
+		s.drain()
+		if err := s.pfd.Poll(s.onEvent); err != nil {
+			s.w.logger.Log("poller failed", "err", err)
+			w.shutdown(err)
+			return ErrWatcherClosed
+		}
+		s.drain()
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package gaio
+
+// ErrSwitched is the error of the requests ended by SwitchToWrite and
+// SwitchToRead. It matches ErrCanceled.
+var ErrSwitched = newKindError("request ended by a switch of direction", ErrCanceled)
+
+// SwitchToWrite submits a write request like Write, which first ends the
+// pending reads of fd with ErrSwitched, their buffers returned in their
+// results, for protocols alternating reads and writes in strict phases.
+// The loop ends the reads and queues the write in one step, while fd stays
+// registered for both directions, so a reset or a close of the peer in the
+// meantime fails the write instead of going unnoticed. Splices and
+// offloaded reads go on, like with Drain.
+func (w *Watcher) SwitchToWrite(fd int, buf []byte, done chan OpResult) error {
+	return w.shardOf(fd).submit(aiocb{kind: kindWrite, fd: fd, buffer: buf, done: done, switching: true})
+}
+
+// SwitchToRead is the mirror of SwitchToWrite, it submits a read request
+// like Read which first ends the pending writes of fd with ErrSwitched,
+// OpResult.Size being the bytes they wrote. Splices, zero copy sends
+// waiting for their notifications, offloaded writes and dials go on.
+func (w *Watcher) SwitchToRead(fd int, buf []byte, done chan OpResult) error {
+	return w.shardOf(fd).submit(aiocb{kind: kindRead, fd: fd, buffer: buf, auto: buf == nil, done: done, switching: true})
+}
+
+// cancelWrites ends the writes of d with err, the writes which can't be
+// ended midway go on
+func (s *shard) cancelWrites(d *fdDesc, err error) {
+	writers := d.writers[:0]
+	for i := range d.writers {
+		pcb := &d.writers[i]
+		if pcb.splice != nil || pcb.zcPending || pcb.offload != nil || pcb.connect {
+			writers = append(writers, *pcb)
+			continue
+		}
+		s.complete(pcb, OpResult{Operation: OpWrite, Fd: pcb.fd, Buffer: pcb.buffer, Size: pcb.size, Err: err})
+	}
+	for i := len(writers); i < len(d.writers); i++ {
+		d.writers[i] = aiocb{}
+	}
+	d.writers = writers
+}
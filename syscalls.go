@@ -0,0 +1,57 @@
+package gaio
+
+import (
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// sysCalls are the syscalls of the requests and the pollers, made through
+// the watcher so tests can inject faults, see withSyscalls
+type sysCalls interface {
+	pollCalls
+	Read(fd int, p []byte) (int, error)
+	Write(fd int, p []byte) (int, error)
+	Writev(fd int, iovs []unix.Iovec) (int, error)
+	Recvfrom(fd int, p []byte, flags int) (int, unix.Sockaddr, error)
+	Recvmsg(fd int, p, oob []byte, flags int) (n, oobn, recvflags int, from unix.Sockaddr, err error)
+	Sendmsg(fd int, p, oob []byte, to unix.Sockaddr, flags int) (int, error)
+	Connect(fd int, sa unix.Sockaddr) error
+}
+
+// rawSyscalls makes the syscalls
+type rawSyscalls struct{}
+
+func (rawSyscalls) Read(fd int, p []byte) (int, error)  { return syscall.Read(fd, p) }
+func (rawSyscalls) Write(fd int, p []byte) (int, error) { return syscall.Write(fd, p) }
+
+func (rawSyscalls) Writev(fd int, iovs []unix.Iovec) (int, error) {
+	r, _, e := syscall.Syscall(unix.SYS_WRITEV, uintptr(fd), uintptr(unsafe.Pointer(&iovs[0])), uintptr(len(iovs)))
+	if e != 0 {
+		return 0, e
+	}
+	return int(r), nil
+}
+
+func (rawSyscalls) Recvfrom(fd int, p []byte, flags int) (int, unix.Sockaddr, error) {
+	return unix.Recvfrom(fd, p, flags)
+}
+
+func (rawSyscalls) Recvmsg(fd int, p, oob []byte, flags int) (int, int, int, unix.Sockaddr, error) {
+	return unix.Recvmsg(fd, p, oob, flags)
+}
+
+func (rawSyscalls) Sendmsg(fd int, p, oob []byte, to unix.Sockaddr, flags int) (int, error) {
+	return unix.SendmsgN(fd, p, oob, to, flags)
+}
+
+func (rawSyscalls) Connect(fd int, sa unix.Sockaddr) error { return unix.Connect(fd, sa) }
+
+// withSyscalls makes the watcher and its pollers make their syscalls
+// through sys, for tests
+func withSyscalls(sys sysCalls) Option {
+	return func(w *Watcher) {
+		w.sys = sys
+	}
+}
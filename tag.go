@@ -0,0 +1,29 @@
+package gaio
+
+// tagTable holds the tags of the requests of a TypedWatcher
+type tagTable interface {
+	drop(id uint64)
+}
+
+// tagRef is the tag of a request in its table, zero if untagged
+type tagRef struct {
+	table tagTable
+	id    uint64
+}
+
+// moveTag moves the tag of cb to its result, a request without a receiver
+// keeps it to be released with the request
+func (cb *aiocb) moveTag(res *OpResult) {
+	if cb.tag.table != nil && cb.done != nil {
+		res.tag = cb.tag.id
+		cb.tag = tagRef{}
+	}
+}
+
+// releaseTag releases the tag of a request dropped without a result
+func (cb *aiocb) releaseTag() {
+	if cb.tag.table != nil {
+		cb.tag.table.drop(cb.tag.id)
+		cb.tag = tagRef{}
+	}
+}
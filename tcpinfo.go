@@ -0,0 +1,31 @@
+package gaio
+
+import "time"
+
+// TCPInfo is a snapshot of TCP_INFO of a connection.
+type TCPInfo struct {
+	State        uint8
+	Retransmits  uint8         // unrecovered timeouts in a row
+	RTT          time.Duration // smoothed round trip time
+	RTTVar       time.Duration
+	MinRTT       time.Duration
+	RTO          time.Duration
+	SndMSS       uint32
+	SndCwnd      uint32 // congestion window in segments
+	SndSsthresh  uint32
+	Unacked      uint32
+	Lost         uint32
+	TotalRetrans uint32
+	NotSent      uint32 // bytes not yet sent
+	BytesAcked   uint64
+	BytesRecv    uint64
+	DeliveryRate uint64 // bytes per second
+}
+
+// TCPInfo retrieves TCP_INFO of a watched TCP fd.
+func (w *Watcher) TCPInfo(fd int) (*TCPInfo, error) {
+	if !w.watched(fd) {
+		return nil, ErrNotWatched
+	}
+	return getTCPInfo(fd)
+}
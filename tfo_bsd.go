@@ -0,0 +1,22 @@
+// +build darwin netbsd freebsd openbsd dragonfly
+
+package gaio
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// EnableFastOpen enables TCP Fast Open on the listener, linux only.
+func EnableFastOpen(ln net.Listener, qlen int) error { return syscall.ENOPROTOOPT }
+
+// sendFastOpen falls back to normal connect
+func sendFastOpen(sys sysCalls, fd int, p []byte, sa unix.Sockaddr) (int, error) {
+	err := sys.Connect(fd, sa)
+	if err == syscall.EINPROGRESS {
+		return 0, syscall.EAGAIN
+	}
+	return 0, err
+}
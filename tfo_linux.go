@@ -0,0 +1,48 @@
+// +build linux
+
+package gaio
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// EnableFastOpen enables TCP Fast Open on the listener, qlen limits the
+// pending fast open requests which have not completed the handshake. It has
+// no effect if the server side is disabled by sysctl net.ipv4.tcp_fastopen.
+func EnableFastOpen(ln net.Listener, qlen int) error {
+	c, ok := ln.(syscall.Conn)
+	if !ok {
+		return ErrNoRawConn
+	}
+
+	rawconn, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var operr error
+	if err := rawconn.Control(func(fd uintptr) {
+		operr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN, qlen)
+	}); err != nil {
+		return err
+	}
+	return operr
+}
+
+// sendFastOpen sends p with the SYN, EAGAIN is returned if the connection is
+// in progress without data sent.
+func sendFastOpen(sys sysCalls, fd int, p []byte, sa unix.Sockaddr) (int, error) {
+	n, err := sys.Sendmsg(fd, p, nil, sa, unix.MSG_FASTOPEN)
+	if err == syscall.EOPNOTSUPP {
+		// disabled by sysctl, fallback to normal connect
+		n, err = 0, sys.Connect(fd, sa)
+	}
+
+	if err == syscall.EINPROGRESS {
+		return 0, syscall.EAGAIN
+	}
+	return n, err
+}
@@ -0,0 +1,479 @@
+package gaio
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrTLSClosed is returned by the requests of a TLSConn after Close, and
+// is the error of the requests it ended.
+var ErrTLSClosed = errors.New("tls connection closed")
+
+// errWouldBlock is returned to the TLS engine by the conduit when no
+// ciphertext is buffered. It's temporary, so the engine keeps its state and
+// is driven again once the ciphertext arrives.
+var errWouldBlock error = wouldBlock{}
+
+type wouldBlock struct{}
+
+func (wouldBlock) Error() string   { return "tls: no ciphertext buffered" }
+func (wouldBlock) Timeout() bool   { return true }
+func (wouldBlock) Temporary() bool { return true }
+
+// TLSConn drives a TLS session over a watched fd, the ciphertext is read and
+// written through the Watcher.
+//
+// crypto/tls has no explicit I/O interface for TLS over TCP, so the
+// handshake runs on a goroutine, started by a client right away and by a
+// server once the first ciphertext arrived, which ends with the handshake.
+// After it the TLS engine is driven by the results of the reads and writes
+// of the ciphertext, on the goroutines of the watcher routing them, and
+// only decrypts the ciphertext received already, so idle connections and
+// pending reads hold no goroutines. The reads and the writes are executed
+// in the order of their submissions.
+type TLSConn struct {
+	w    *Watcher
+	fd   int
+	conn *tls.Conn
+	ch   chan OpResult // the results of the ciphertext requests, see attach
+
+	// serializes the engine after the handshake, between the routing of the
+	// results and Close
+	engine sync.Mutex
+
+	mu          sync.Mutex
+	handshaking bool          // the handshake is in progress, on its goroutine
+	accepting   chan OpResult // a server waits for the first ciphertext
+	closed      bool          // see Close
+	detached    bool
+	err         error // ends the requests, see end
+	reading     bool  // a read of ciphertext is pending
+	held        OpResult
+	pending     []byte // ciphertext of held not consumed yet
+	rerr        error  // of the reads of ciphertext
+	werr        error  // of the writes of ciphertext
+	sent, acked int    // writes of ciphertext submitted and completed
+	reads       []tlsRequest
+	writes      []tlsRequest
+	acks        []tlsAck // results waiting for the writes of ciphertext
+	out         []result // results to deliver, in order
+	delivering  sync.Mutex
+	signal      chan struct{} // ciphertext arrived during the handshake
+}
+
+// tlsRequest is a request of ReadTLS or WriteTLS
+type tlsRequest struct {
+	buf  []byte
+	done chan OpResult
+}
+
+// tlsAck is a result delivered once after writes of ciphertext completed
+type tlsAck struct {
+	after int
+	res   result
+}
+
+// StartTLS starts a TLS handshake on the watched fd, as client or server.
+// The completion is delivered to done with the connection state in
+// OpResult.TLS after the handshake has finished, and the ciphertext it
+// wrote. ErrNotWatched is returned for a fd not watched, and ErrFdBusy for
+// a fd driven by another helper.
+func (w *Watcher) StartTLS(fd int, config *tls.Config, client bool, done chan OpResult) (*TLSConn, error) {
+	if !w.watched(fd) {
+		return nil, ErrNotWatched
+	}
+	tc := &TLSConn{w: w, fd: fd, handshaking: true, signal: make(chan struct{}, 1)}
+	if client {
+		tc.conn = tls.Client(&tlsConduit{tc}, config)
+	} else {
+		tc.conn = tls.Server(&tlsConduit{tc}, config)
+	}
+	ch, err := w.attach(tc, fd)
+	if err != nil {
+		return nil, err
+	}
+	tc.ch = ch
+
+	if client {
+		go tc.handshake(done)
+		return tc, nil
+	}
+	// idle until the ClientHello arrives
+	tc.mu.Lock()
+	tc.accepting = done
+	tc.fetch()
+	tc.mu.Unlock()
+	return tc, nil
+}
+
+// ReadTLS submits a request to read decrypted data into buf. It completes
+// once a record is received, the ciphertext received already is decrypted
+// without waiting. ErrTLSClosed is returned after Close.
+func (tc *TLSConn) ReadTLS(buf []byte, done chan OpResult) error {
+	return tc.submit(&tc.reads, buf, done)
+}
+
+// WriteTLS submits a request to encrypt and write buf, it completes once
+// the ciphertext is written. ErrTLSClosed is returned after Close.
+func (tc *TLSConn) WriteTLS(buf []byte, done chan OpResult) error {
+	return tc.submit(&tc.writes, buf, done)
+}
+
+// submit queues a request, which is executed by the routing of the results
+func (tc *TLSConn) submit(q *[]tlsRequest, buf []byte, done chan OpResult) error {
+	tc.mu.Lock()
+	if tc.closed {
+		tc.mu.Unlock()
+		return ErrTLSClosed
+	} else if tc.err != nil {
+		tc.mu.Unlock()
+		return tc.err
+	}
+	*q = append(*q, tlsRequest{buf, done})
+	tc.mu.Unlock()
+	tc.w.wake(tc.fd)
+	return nil
+}
+
+// Close sends a close_notify alert, which is written before the requests
+// submitted to fd after Close, and ends the requests of the TLSConn left
+// with ErrTLSClosed. The fd stays watched, it belongs to the caller. A
+// handshake in progress fails with ErrTLSClosed instead.
+func (tc *TLSConn) Close() error {
+	tc.engine.Lock()
+	tc.mu.Lock()
+	if tc.closed {
+		tc.mu.Unlock()
+		tc.engine.Unlock()
+		return nil
+	}
+	tc.closed = true
+	handshaking := tc.handshaking
+	if handshaking && tc.rerr == nil {
+		tc.rerr = ErrTLSClosed
+	}
+	tc.mu.Unlock()
+
+	var err error
+	if handshaking {
+		tc.notify()
+	} else {
+		err = tc.conn.Close()
+	}
+	tc.engine.Unlock()
+
+	// the requests left are ended by the routing of the results
+	tc.w.wake(tc.fd)
+	return err
+}
+
+// ConnectionState returns basic TLS details about the connection
+func (tc *TLSConn) ConnectionState() tls.ConnectionState { return tc.conn.ConnectionState() }
+
+// handshake runs the handshake, and hands the engine over to the routing of
+// the results
+func (tc *TLSConn) handshake(done chan OpResult) {
+	err := tc.conn.Handshake()
+	state := tc.conn.ConnectionState()
+	tc.mu.Lock()
+	tc.handshaking = false
+	tc.ack(done, OpResult{Fd: tc.fd, Err: err, TLS: &state})
+	tc.mu.Unlock()
+	tc.flush()
+	tc.w.wake(tc.fd)
+}
+
+func (tc *TLSConn) onResult(res OpResult) {
+	tc.mu.Lock()
+	switch res.Operation {
+	case OpRead:
+		tc.reading = false
+		if res.Err != nil || res.Size == 0 {
+			tc.rerr = res.Err
+			if tc.rerr == nil {
+				tc.rerr = io.EOF
+			}
+			res.Release()
+		} else {
+			tc.held, tc.pending = res, res.Buffer[:res.Size]
+		}
+		if done := tc.accepting; done != nil {
+			tc.accepting = nil
+			go tc.handshake(done)
+		}
+	case OpWrite:
+		res.Release()
+		tc.acked++
+		if res.Err != nil && tc.werr == nil {
+			tc.werr = res.Err
+		}
+		tc.settle()
+	}
+	handshaking := tc.handshaking
+	tc.mu.Unlock()
+
+	if handshaking {
+		tc.notify()
+	} else {
+		tc.drive()
+	}
+	tc.flush()
+}
+
+func (tc *TLSConn) onClose() {
+	tc.mu.Lock()
+	tc.end(ErrWatcherClosed)
+	tc.mu.Unlock()
+	tc.notify()
+	tc.flush()
+}
+
+// drive executes the requests queued with the ciphertext received, the
+// reads left wait for more
+func (tc *TLSConn) drive() {
+	tc.engine.Lock()
+	defer tc.engine.Unlock()
+	for {
+		tc.mu.Lock()
+		if tc.handshaking {
+			tc.mu.Unlock()
+			return
+		} else if tc.closed {
+			tc.fail(ErrTLSClosed)
+			if tc.acked < tc.sent && tc.werr == nil {
+				// detached once the close_notify is written
+				tc.mu.Unlock()
+				return
+			}
+			if !tc.detached {
+				tc.detached = true
+				tc.held.Release()
+				tc.held, tc.pending = OpResult{}, nil
+				tc.w.detach(tc.fd)
+			}
+			tc.mu.Unlock()
+			return
+		}
+
+		if len(tc.writes) > 0 {
+			r := tc.writes[0]
+			tc.writes[0] = tlsRequest{}
+			tc.writes = tc.writes[1:]
+			tc.mu.Unlock()
+			n, err := tc.conn.Write(r.buf)
+			tc.mu.Lock()
+			tc.ack(r.done, OpResult{Operation: OpWrite, Fd: tc.fd, Buffer: r.buf, Size: n, Err: err})
+			tc.mu.Unlock()
+			continue
+		} else if len(tc.reads) == 0 {
+			tc.mu.Unlock()
+			return
+		}
+
+		r := tc.reads[0]
+		tc.mu.Unlock()
+		n, err := tc.conn.Read(r.buf)
+		if err == errWouldBlock {
+			if n == 0 {
+				// driven again by the read of ciphertext submitted
+				return
+			}
+			err = nil
+		}
+		tc.mu.Lock()
+		tc.reads[0] = tlsRequest{}
+		tc.reads = tc.reads[1:]
+		tc.out = append(tc.out, result{r.done, OpResult{Fd: tc.fd, Buffer: r.buf, Size: n, Err: err}})
+		tc.mu.Unlock()
+	}
+}
+
+// fetch submits a read of ciphertext unless one is pending, tc.mu is held
+func (tc *TLSConn) fetch() {
+	if tc.reading || tc.rerr != nil {
+		return
+	}
+	if err := tc.w.Read(tc.fd, nil, tc.ch); err != nil {
+		tc.rerr = err
+		return
+	}
+	tc.reading = true
+}
+
+// ack queues res to be delivered once the ciphertext written so far is,
+// tc.mu is held
+func (tc *TLSConn) ack(done chan OpResult, res OpResult) {
+	after := tc.sent
+	if res.Err != nil {
+		after = 0
+	}
+	tc.acks = append(tc.acks, tlsAck{after, result{done, res}})
+	tc.settle()
+}
+
+// settle moves the results whose ciphertext is written to out, they fail
+// with the error of a write of ciphertext failed before, tc.mu is held
+func (tc *TLSConn) settle() {
+	for len(tc.acks) > 0 && (tc.acks[0].after <= tc.acked || tc.werr != nil) {
+		a := tc.acks[0]
+		if a.after > tc.acked && a.res.res.Err == nil {
+			a.res.res.Err = tc.werr
+		}
+		tc.out = append(tc.out, a.res)
+		tc.acks[0] = tlsAck{}
+		tc.acks = tc.acks[1:]
+	}
+}
+
+// end fails the requests left with err, those waiting for their ciphertext
+// to be written included, tc.mu is held
+func (tc *TLSConn) end(err error) {
+	if tc.err != nil {
+		return
+	}
+	tc.err = err
+	if tc.rerr == nil {
+		tc.rerr = err
+	}
+	if tc.werr == nil {
+		tc.werr = err
+	}
+	tc.settle()
+	tc.fail(err)
+}
+
+// fail ends the requests queued with err, tc.mu is held
+func (tc *TLSConn) fail(err error) {
+	for _, q := range []*[]tlsRequest{&tc.writes, &tc.reads} {
+		op := OpRead
+		if q == &tc.writes {
+			op = OpWrite
+		}
+		for _, r := range *q {
+			tc.out = append(tc.out, result{r.done, OpResult{Operation: op, Fd: tc.fd, Buffer: r.buf, Err: err}})
+		}
+		*q = nil
+	}
+}
+
+// notify wakes the handshake up waiting for ciphertext
+func (tc *TLSConn) notify() {
+	select {
+	case tc.signal <- struct{}{}:
+	default:
+	}
+}
+
+// flush delivers the results of out in order, it's never called by the
+// submitters, who may receive from the done channels
+func (tc *TLSConn) flush() {
+	tc.delivering.Lock()
+	defer tc.delivering.Unlock()
+	for {
+		tc.mu.Lock()
+		if len(tc.out) == 0 {
+			tc.mu.Unlock()
+			return
+		}
+		r := tc.out[0]
+		tc.out[0] = result{}
+		tc.out = tc.out[1:]
+		tc.mu.Unlock()
+		if r.done != nil {
+			tc.deliver(r.done, r.res)
+		}
+	}
+}
+
+// deliver sends res to done, once the watcher has terminated only if done
+// has room, as it may not be received anymore
+func (tc *TLSConn) deliver(done chan OpResult, res OpResult) {
+	select {
+	case done <- res:
+	case <-tc.w.die:
+		select {
+		case done <- res:
+		default:
+		}
+	}
+}
+
+// tlsConduit is a net.Conn for the TLS engine, which reads and writes
+// ciphertext through the Watcher
+type tlsConduit struct {
+	tc *TLSConn
+}
+
+// Read consumes the ciphertext received, which is read into a buffer of the
+// pool of the watcher, where it's delivered with WithCopyBuffers anyway.
+// The handshake waits for it, after the handshake errWouldBlock is
+// returned until it arrives.
+func (c *tlsConduit) Read(p []byte) (int, error) {
+	tc := c.tc
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	for len(tc.pending) == 0 {
+		tc.fetch()
+		if tc.rerr != nil {
+			return 0, tc.rerr
+		} else if !tc.handshaking {
+			return 0, errWouldBlock
+		}
+		tc.mu.Unlock()
+		select {
+		case <-tc.signal:
+			tc.mu.Lock()
+		case <-tc.w.die:
+			tc.mu.Lock()
+			tc.end(ErrWatcherClosed)
+		}
+	}
+
+	n := copy(p, tc.pending)
+	tc.pending = tc.pending[n:]
+	if len(tc.pending) == 0 {
+		tc.held.Release()
+		tc.held = OpResult{}
+	}
+	return n, nil
+}
+
+// Write submits the ciphertext without waiting, its completion is tracked
+// by ack
+func (c *tlsConduit) Write(p []byte) (int, error) {
+	tc := c.tc
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.werr != nil {
+		return 0, tc.werr
+	}
+	// the engine reuses p for the next record
+	if err := tc.w.Write(tc.fd, append([]byte(nil), p...), tc.ch); err != nil {
+		tc.werr = err
+		return 0, err
+	}
+	tc.sent++
+	return len(p), nil
+}
+
+func (c *tlsConduit) Close() error { return nil }
+
+func (c *tlsConduit) LocalAddr() net.Addr {
+	sa, err := unix.Getsockname(c.tc.fd)
+	if err != nil {
+		return nil
+	}
+	return sockaddrToAddr(sa, true)
+}
+
+func (c *tlsConduit) RemoteAddr() net.Addr { return remoteAddr(c.tc.fd, nil) }
+
+func (c *tlsConduit) SetDeadline(t time.Time) error      { return nil }
+func (c *tlsConduit) SetReadDeadline(t time.Time) error  { return nil }
+func (c *tlsConduit) SetWriteDeadline(t time.Time) error { return nil }
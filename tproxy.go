@@ -0,0 +1,21 @@
+package gaio
+
+import (
+	"errors"
+	"net"
+)
+
+// ErrNotRedirected is returned by OriginalDst for connections which were not
+// redirected by netfilter.
+var ErrNotRedirected = errors.New("connection is not redirected")
+
+// OriginalDst returns the destination of a watched TCP connection before it
+// was redirected by iptables REDIRECT/DNAT, the result is a *net.TCPAddr.
+// Connections intercepted by TPROXY keep their original destination as the
+// local address, which is returned as is if the listener is transparent.
+func (w *Watcher) OriginalDst(fd int) (net.Addr, error) {
+	if !w.watched(fd) {
+		return nil, ErrNotWatched
+	}
+	return originalDst(fd)
+}
@@ -0,0 +1,13 @@
+// +build darwin netbsd freebsd openbsd dragonfly
+
+package gaio
+
+import (
+	"net"
+	"syscall"
+)
+
+// SetTransparent is not supported on this platform.
+func SetTransparent(ln net.Listener) error { return syscall.ENOPROTOOPT }
+
+func originalDst(fd int) (net.Addr, error) { return nil, syscall.ENOPROTOOPT }
@@ -0,0 +1,104 @@
+// +build linux
+
+package gaio
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// SO_ORIGINAL_DST of netfilter, IP6T_SO_ORIGINAL_DST has the same value
+const soOriginalDst = 80
+
+// SetTransparent sets IP_TRANSPARENT(and IPV6_TRANSPARENT for IPv6 sockets)
+// on the listener, so it accepts connections intercepted by TPROXY for
+// foreign addresses. CAP_NET_ADMIN is required.
+func SetTransparent(ln net.Listener) error {
+	c, ok := ln.(syscall.Conn)
+	if !ok {
+		return ErrNoRawConn
+	}
+
+	rawconn, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var operr error
+	if err := rawconn.Control(func(s uintptr) {
+		fd := int(s)
+		if sa, err := unix.Getsockname(fd); err != nil {
+			operr = err
+		} else if _, ok := sa.(*unix.SockaddrInet6); ok {
+			operr = unix.SetsockoptInt(fd, unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+		} else {
+			operr = unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+		}
+	}); err != nil {
+		return err
+	}
+	return os.NewSyscallError("setsockopt", operr)
+}
+
+func originalDst(fd int) (net.Addr, error) {
+	local, err := unix.Getsockname(fd)
+	if err != nil {
+		return nil, os.NewSyscallError("getsockname", err)
+	}
+
+	level := unix.SOL_IP
+	if sa, ok := local.(*unix.SockaddrInet6); ok && net.IP(sa.Addr[:]).To4() == nil {
+		level = unix.SOL_IPV6
+	}
+
+	var rsa unix.RawSockaddrAny
+	size := uint32(unix.SizeofSockaddrAny)
+	_, _, e := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), soOriginalDst,
+		uintptr(unsafe.Pointer(&rsa)), uintptr(unsafe.Pointer(&size)), 0)
+	switch e {
+	case 0:
+	case unix.ENOENT:
+		// no conntrack entry
+		return nil, ErrNotRedirected
+	case unix.ENOPROTOOPT:
+		if transparent(fd, level) {
+			return sockaddrToAddr(local, true), nil
+		}
+		return nil, ErrNotRedirected
+	default:
+		return nil, os.NewSyscallError("getsockopt", e)
+	}
+
+	var addr *net.TCPAddr
+	switch rsa.Addr.Family {
+	case unix.AF_INET:
+		pp := (*unix.RawSockaddrInet4)(unsafe.Pointer(&rsa))
+		p := (*[2]byte)(unsafe.Pointer(&pp.Port))
+		addr = &net.TCPAddr{IP: append(net.IP(nil), pp.Addr[:]...), Port: int(p[0])<<8 + int(p[1])}
+	case unix.AF_INET6:
+		pp := (*unix.RawSockaddrInet6)(unsafe.Pointer(&rsa))
+		p := (*[2]byte)(unsafe.Pointer(&pp.Port))
+		addr = &net.TCPAddr{IP: append(net.IP(nil), pp.Addr[:]...), Port: int(p[0])<<8 + int(p[1])}
+	default:
+		return nil, ErrUnsupportedAddr
+	}
+
+	if addr.String() == sockaddrToAddr(local, true).String() && !transparent(fd, level) {
+		// conntrack tracks it, but the destination was never rewritten
+		return nil, ErrNotRedirected
+	}
+	return addr, nil
+}
+
+func transparent(fd int, level int) bool {
+	opt := unix.IP_TRANSPARENT
+	if level == unix.SOL_IPV6 {
+		opt = unix.IPV6_TRANSPARENT
+	}
+	v, err := unix.GetsockoptInt(fd, level, opt)
+	return err == nil && v != 0
+}
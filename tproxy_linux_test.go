@@ -0,0 +1,54 @@
+package gaio
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestOriginalDst(t *testing.T) {
+	w, err := CreateWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+
+	if _, err := w.OriginalDst(fd); err != ErrNotRedirected {
+		t.Fatal("expected ErrNotRedirected", err)
+	}
+
+	w.StopWatch(fd)
+	if _, err := w.OriginalDst(fd); err != ErrNotWatched {
+		t.Fatal("expected ErrNotWatched", err)
+	}
+}
+
+func TestSetTransparent(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	err = SetTransparent(ln)
+	if se, ok := err.(*os.SyscallError); ok && se.Err == syscall.EPERM {
+		t.Skip("CAP_NET_ADMIN required")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	rawconn, _ := ln.(*net.TCPListener).SyscallConn()
+	var v int
+	rawconn.Control(func(fd uintptr) {
+		v, err = unix.GetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT)
+	})
+	if err != nil || v != 1 {
+		t.Fatal("option not applied", v, err)
+	}
+}
@@ -0,0 +1,49 @@
+package gaio
+
+// Tracer observes the requests of a watcher, see WithTracer. OnSubmit is
+// called when a read or write request is accepted, its return value is
+// passed to OnComplete when the request leaves the watcher, once for every
+// request: on completion, failure, deadline, StopWatch and Close. A request
+// dropped by StopWatch ends with ErrNotWatched and one dropped by Close with
+// ErrWatcherClosed, without a result delivered.
+//
+// OnSubmit is called from the submitting goroutine and OnComplete from the
+// loops and workers, so both must be safe for concurrent use and must not
+// block.
+type Tracer interface {
+	OnSubmit(fd int, op OpType, size int) interface{}
+	OnComplete(span interface{}, res OpResult)
+}
+
+// traceSubmit starts the trace of an accepted request, splices are not
+// traced
+func (w *Watcher) traceSubmit(cb *aiocb) {
+	if cb.kind >= kindStop || cb.splice != nil {
+		return
+	}
+	cb.span = w.tracer.OnSubmit(cb.fd, cb.op(), len(cb.buffer))
+	cb.traced = true
+}
+
+// traceEnd ends the trace of a request with res, once
+func (s *shard) traceEnd(cb *aiocb, res OpResult) {
+	if !cb.traced {
+		return
+	}
+	cb.traced = false
+	defer s.w.recoverCallback("Tracer.OnComplete")
+	span := cb.span
+	cb.span = nil
+	s.w.tracer.OnComplete(span, res)
+}
+
+// dropped is the result traced for a request ended without one
+func (cb *aiocb) dropped(err error) OpResult {
+	return OpResult{Operation: cb.op(), Fd: cb.fd, Buffer: cb.buffer, Size: cb.size, Err: err}
+}
+
+// drop ends a request without a result
+func (s *shard) drop(cb *aiocb, err error) {
+	s.traceEnd(cb, cb.dropped(err))
+	s.retire(cb)
+}
@@ -0,0 +1,136 @@
+//go:build go1.21
+// +build go1.21
+
+package gaio
+
+import (
+	"sync"
+	"time"
+)
+
+// TypedWatcher submits the requests of a Watcher with a tag of type T, which
+// comes back with their result, to correlate a result with the state of its
+// request without a map or a type assertion:
+//
+//	tw := gaio.NewTypedWatcher[*session](w)
+//	tw.Read(fd, nil, sess, done)
+//	res := tw.Result(<-done)
+//	res.Tag.onRead(res.Buffer[:res.Size])
+//
+// The tags are held by the TypedWatcher until the result is passed to
+// Result, or the request is dropped, so tags of any type are submitted
+// without an allocation. Every result of its requests must be passed to
+// its Result once.
+type TypedWatcher[T any] struct {
+	w *Watcher
+
+	mu    sync.Mutex
+	slots []tagSlot[T]
+	free  []uint32
+}
+
+// tagSlot holds the tag of a request, gen tells the requests using the slot
+// apart
+type tagSlot[T any] struct {
+	tag  T
+	gen  uint32
+	used bool
+}
+
+// TypedResult is the result of a request of a TypedWatcher with its tag.
+type TypedResult[T any] struct {
+	OpResult
+	Tag T
+}
+
+// NewTypedWatcher returns a TypedWatcher submitting the requests to w.
+func NewTypedWatcher[T any](w *Watcher) *TypedWatcher[T] {
+	return &TypedWatcher[T]{w: w}
+}
+
+// Watcher returns the watcher of tw, for the requests without a tag.
+func (tw *TypedWatcher[T]) Watcher() *Watcher { return tw.w }
+
+// Read submits a read request like Watcher.Read with tag.
+func (tw *TypedWatcher[T]) Read(fd int, buf []byte, tag T, done chan OpResult) error {
+	return tw.submit(aiocb{kind: kindRead, fd: fd, buffer: buf, auto: buf == nil, done: done}, tag)
+}
+
+// ReadTimeout submits a read request like Watcher.ReadTimeout with tag.
+func (tw *TypedWatcher[T]) ReadTimeout(fd int, buf []byte, tag T, done chan OpResult, deadline time.Time) error {
+	return tw.submit(aiocb{kind: kindRead, fd: fd, buffer: buf, auto: buf == nil, done: done, deadline: deadline}, tag)
+}
+
+// Write submits a write request like Watcher.Write with tag.
+func (tw *TypedWatcher[T]) Write(fd int, buf []byte, tag T, done chan OpResult) error {
+	return tw.submit(aiocb{kind: kindWrite, fd: fd, buffer: buf, done: done}, tag)
+}
+
+// WriteTimeout submits a write request like Watcher.WriteTimeout with tag.
+func (tw *TypedWatcher[T]) WriteTimeout(fd int, buf []byte, tag T, done chan OpResult, deadline time.Time) error {
+	return tw.submit(aiocb{kind: kindWrite, fd: fd, buffer: buf, done: done, deadline: deadline}, tag)
+}
+
+// Result returns res of a request of tw with its tag, and releases the tag.
+// The tag of an untagged request is the zero value of T.
+func (tw *TypedWatcher[T]) Result(res OpResult) TypedResult[T] {
+	tag, _ := tw.release(res.tag)
+	return TypedResult[T]{OpResult: res, Tag: tag}
+}
+
+func (tw *TypedWatcher[T]) submit(cb aiocb, tag T) error {
+	if cb.done == nil {
+		// no result to return the tag with
+		return tw.w.shardOf(cb.fd).submit(cb)
+	}
+	id := tw.hold(tag)
+	cb.tag = tagRef{table: tw, id: id}
+	if err := tw.w.shardOf(cb.fd).submit(cb); err != nil {
+		tw.release(id)
+		return err
+	}
+	return nil
+}
+
+// hold stores tag in a free slot, its id is the slot from 1 and its
+// generation
+func (tw *TypedWatcher[T]) hold(tag T) uint64 {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	var i uint32
+	if n := len(tw.free); n > 0 {
+		i = tw.free[n-1]
+		tw.free = tw.free[:n-1]
+	} else {
+		i = uint32(len(tw.slots))
+		tw.slots = append(tw.slots, tagSlot[T]{})
+	}
+	slot := &tw.slots[i]
+	slot.tag = tag
+	slot.used = true
+	return uint64(slot.gen)<<32 | uint64(i+1)
+}
+
+// release frees the slot of id once, a stale id is ignored
+func (tw *TypedWatcher[T]) release(id uint64) (tag T, ok bool) {
+	i := uint32(id) - 1
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if id == 0 || int(i) >= len(tw.slots) {
+		return
+	}
+	slot := &tw.slots[i]
+	if !slot.used || slot.gen != uint32(id>>32) {
+		return
+	}
+	tag = slot.tag
+	var zero T
+	slot.tag = zero
+	slot.used = false
+	slot.gen++
+	tw.free = append(tw.free, i)
+	return tag, true
+}
+
+// drop releases the tag of a request dropped without a result
+func (tw *TypedWatcher[T]) drop(id uint64) { tw.release(id) }
@@ -0,0 +1,91 @@
+//go:build go1.21
+// +build go1.21
+
+package gaio
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type typedTag struct {
+	id   int
+	name string
+}
+
+func TestTypedWatcher(t *testing.T) {
+	w, err := CreateWatcher(withManualStep())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	fd, conn := tcpPair(t, w)
+	defer conn.Close()
+	done := make(chan OpResult, 4)
+
+	// struct tags come back with the results of their requests
+	tw := NewTypedWatcher[typedTag](w)
+	tw.Write(fd, []byte("a"), typedTag{1, "a"}, done)
+	tw.Write(fd, []byte("bc"), typedTag{2, "bc"}, done)
+	stepUntil(t, w, func() bool { return len(done) == 2 })
+	for _, want := range []typedTag{{1, "a"}, {2, "bc"}} {
+		res := tw.Result(<-done)
+		if res.Err != nil || res.Tag != want || res.Size != len(want.name) {
+			t.Fatal("incorrect write:", res.Err, res.Tag, res.Size)
+		}
+	}
+
+	// so do pointers, and the zero value is a tag like any other
+	ptw := NewTypedWatcher[*typedTag](w)
+	p := &typedTag{3, "read"}
+	ptw.ReadTimeout(fd, nil, nil, done, time.Now())
+	w.step()
+	if res := ptw.Result(<-done); !errors.Is(res.Err, ErrDeadline) || res.Tag != nil {
+		t.Fatal("incorrect expired read:", res.Err, res.Tag)
+	}
+	ptw.Read(fd, nil, p, done)
+	conn.Write([]byte("x"))
+	stepUntil(t, w, func() bool { return len(done) == 1 })
+	if res := ptw.Result(<-done); res.Err != nil || res.Tag != p {
+		t.Fatal("incorrect read:", res.Err, res.Tag)
+	}
+
+	// the tag of a dropped request is released, so is the one of a
+	// rejected submission
+	tw.Read(fd, nil, typedTag{4, "dropped"}, done)
+	w.step()
+	w.StopWatch(fd)
+	w.step()
+	if len(done) != 0 {
+		t.Fatal("result of a dropped read:", (<-done).Err)
+	}
+	w.Close()
+	if err := tw.Read(fd, nil, typedTag{5, "rejected"}, done); err != ErrWatcherClosed {
+		t.Fatal("read of a closed watcher:", err)
+	}
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	for _, slot := range tw.slots {
+		if slot.used || slot.tag != (typedTag{}) {
+			t.Fatal("tag not released:", slot.tag)
+		}
+	}
+}
+
+func TestTypedWatcherNoAllocs(t *testing.T) {
+	tw := NewTypedWatcher[typedTag](nil)
+	tw.release(tw.hold(typedTag{}))
+	allocs := testing.AllocsPerRun(100, func() {
+		id := tw.hold(typedTag{1, "a"})
+		if tag, ok := tw.release(id); !ok || tag.id != 1 {
+			t.Fatal("incorrect tag:", tag)
+		}
+		if _, ok := tw.release(id); ok {
+			t.Fatal("tag released twice")
+		}
+	})
+	if allocs != 0 {
+		t.Fatal("allocations of a tag:", allocs)
+	}
+}
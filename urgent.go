@@ -0,0 +1,27 @@
+package gaio
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ReadUrgent submits a request to receive the out-of-band byte of TCP urgent
+// data on fd into buf, it completes with Operation OpUrgent once the peer has
+// sent urgent data, independent of the in-band reads on fd, which never see
+// the byte. The request stays pending until urgent data arrives or StopWatch,
+// it has no effect with SO_OOBINLINE.
+func (w *Watcher) ReadUrgent(fd int, buf []byte, done chan OpResult) error {
+	return w.shardOf(fd).submit(aiocb{kind: kindUrgent, fd: fd, buffer: buf, done: done})
+}
+
+func (s *shard) tryReadUrgent(pcb *aiocb) (complete bool) {
+	nr, _, er := s.w.sys.Recvfrom(pcb.fd, pcb.buffer, unix.MSG_OOB)
+	if er == syscall.EINVAL || er == syscall.EAGAIN {
+		// no urgent data yet
+		return false
+	}
+
+	s.complete(pcb, OpResult{Operation: OpUrgent, Fd: pcb.fd, Buffer: pcb.buffer, Size: nr, Err: er})
+	return true
+}
@@ -0,0 +1,82 @@
+package gaio
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// defaultStuckAfter is the progress Healthy expects of a loop without
+// WithWatchdog
+const defaultStuckAfter = 10 * time.Second
+
+// Healthy returns an error if a loop has work but hasn't finished a round
+// within the interval of WithWatchdog, such as a loop blocked delivering to
+// a done nobody receives. A loop waiting for events is healthy however long
+// it waits. The error of a terminated watcher is returned, see Err.
+func (w *Watcher) Healthy() error {
+	if err := w.Err(); err != nil {
+		return err
+	}
+	now := time.Now().UnixNano()
+	for i, s := range w.shards {
+		if stalled := s.stalled(now); stalled > 0 {
+			return fmt.Errorf("poller of shard %v of watcher %v made no progress for %v", i, w.name, stalled)
+		}
+	}
+	return nil
+}
+
+// stalled returns how long the loop of s has been in a round for, past the
+// interval, 0 if it's healthy
+func (s *shard) stalled(now int64) time.Duration {
+	after := s.w.stuckAfter
+	if after <= 0 {
+		after = defaultStuckAfter
+	}
+	if atomic.LoadInt32(&s.parked) != 0 {
+		return 0
+	}
+	if d := time.Duration(now - atomic.LoadInt64(&s.beat)); d > after {
+		return d
+	}
+	return 0
+}
+
+// heartbeat marks the start of a round of the loop
+func (s *shard) heartbeat(now time.Time) {
+	atomic.StoreInt64(&s.beat, now.UnixNano())
+	if atomic.LoadInt32(&s.parked) != 0 {
+		atomic.StoreInt32(&s.parked, 0)
+	}
+}
+
+// watchdog logs the loops which stall, once per stall, until the watcher
+// terminates
+func (w *Watcher) watchdog() {
+	ticker := time.NewTicker(w.stuckAfter / 2)
+	defer ticker.Stop()
+	reported := make([]int64, len(w.shards))
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.die:
+			return
+		}
+
+		now := time.Now().UnixNano()
+		for i, s := range w.shards {
+			stalled := s.stalled(now)
+			beat := atomic.LoadInt64(&s.beat)
+			if stalled == 0 || reported[i] == beat {
+				continue
+			}
+			reported[i] = beat
+			s.queueMu.Lock()
+			queued, finished := len(s.queue), len(s.finished)
+			s.queueMu.Unlock()
+			w.logger.Log("poller stuck", "shard", i, "stalled", stalled, "queued", queued, "finished", finished,
+				"pending", atomic.LoadInt64(&w.pending), "wakeups", atomic.LoadUint64(&s.ops.wakeups))
+		}
+	}
+}
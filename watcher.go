@@ -1,86 +1,659 @@
 package gaio
 
 import (
-	"errors"
+	"crypto/tls"
 	"net"
+	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
-var (
-	ErrNoRawConn     = errors.New("net.Conn does implement net.RawConn")
-	ErrWatcherClosed = errors.New("watcher closed")
+// kinds of submissions to a shard
+const (
+	kindRead   int8 = iota
+	kindWrite       // queued in order with writes
+	kindUrgent      // out-of-band byte via recv(MSG_OOB)
+
+	// the kinds below are not counted as pending requests
+	kindStop      // StopWatch
+	kindFlush     // Flush
+	kindWatermark // SetWriteWatermarks
+	kindRateLimit // SetWriteRateLimit
+	kindHeartbeat // SetHeartbeat
+	kindProbe     // WithProbe and SetTagProbe
+	kindDump      // DumpState
+	kindMigrate   // Migrate and Export
+	kindDrain     // Drain
+	kindPending   // Pending
+	kindCancel    // cancelReads
 )
 
 // aiocb contains all info for a request
 type aiocb struct {
+	kind   int8
 	fd     int
 	buffer []byte
 	size   int
-	done   chan OpResult
+	auto   bool          // buffer borrowed from the pool of the watcher
+	copied bool          // buffer is a pooled copy, see WithCopyBuffers
+	plain  []byte        // the buffer of an encoded write, see SetCodec
+	from   bool          // report source address via recvfrom
+	addr   unix.Sockaddr // destination address for sendto
+	sctp   bool          // sctp message with stream id
+	stream uint16
+
+	// splice
+	splice *spliceState
+
+	// offload
+	offload *offloadState
+
+	// the armed read of WatchNotify
+	notify bool
+
+	// corkOn or corkOff
+	cork int8
+
+	// StopWatch of a watched fd, its conn and context, see WithOnClosed,
+	// of a fd owned by the watcher, see WatchDup, and of CloseConn
+	closing   bool
+	owned     bool
+	closeConn bool
+	conn      net.Conn
+	ctx       interface{}
+	reason    error // of CloseTag, the queued requests fail with it
+
+	// bytes of buffer and request accounted to the watcher and the fd,
+	// see admit
+	pinned      int64
+	pinnedDesc  *fdDesc
+	counted     bool
+	countedDesc *fdDesc
+
+	// a read into the buffer of the fd, see SetBuffer
+	boundDesc *fdDesc
+
+	// ends the requests in the other direction first, see SwitchToWrite
+	switching bool
+
+	// dial
+	connect  bool // connect to addr
+	fastopen bool // send buffer to addr with the SYN
+
+	// zerocopy
+	zerocopy  bool
+	zcPending bool   // waiting for notifications of zerocopy sends
+	zcLast    uint32 // sequence number of the last zerocopy send
+
+	// sendfile, file is held for fileFd
+	file   *os.File
+	fileFd int
+	offset int64
+	count  int64 // bytes remaining
+	sent   int64 // bytes transferred, see OpResult.Sent
+
+	// progress of WriteProgress and SendFileProgress
+	progress *progressState
+
+	// rate limit of SetWriteRateLimit
+	rate *tokenBucket
+
+	// heartbeat of SetHeartbeat
+	beat *heartbeat
+
+	// probe of WithProbe and SetTagProbe
+	probe *probeConfig
+
+	// watermarks of SetWriteWatermarks, and the fd the bytes of a write are
+	// queued on
+	water      *watermarks
+	queuedDesc *fdDesc
+
+	// deadline of ReadTimeout and WriteTimeout, and its timer on the loop
+	deadline time.Time
+	timer    *timer
+
+	// when the request was queued by the loop, and the reply of DumpState
+	since time.Time
+	dump  chan *shardDump
+
+	// the value of OnSubmit of the tracer, see WithTracer
+	span   interface{}
+	traced bool
+
+	// the tag of a TypedWatcher, see moveTag
+	tag tagRef
+
+	// the replies of Migrate and Pending
+	migrate chan *migration
+	inspect chan []PendingOp
+
+	done chan OpResult
+}
+
+// op returns the type of the result of a request
+func (cb *aiocb) op() OpType {
+	switch cb.kind {
+	case kindWrite:
+		return OpWrite
+	case kindUrgent:
+		return OpUrgent
+	}
+	return OpRead
+}
+
+// OpType is the kind of operation an OpResult completes
+type OpType int
+
+const (
+	OpRead OpType = iota
+	OpWrite
+	OpUrgent        // out-of-band data, see ReadUrgent
+	OpWatermarkHigh // queued writes reached the high watermark, see SetWriteWatermarks
+	OpWatermarkLow  // queued writes drained to the low watermark
+	OpProbe         // a probe of an idle fd failed, see WithProbe
+)
+
+func (op OpType) String() string {
+	switch op {
+	case OpRead:
+		return "read"
+	case OpWrite:
+		return "write"
+	case OpUrgent:
+		return "urgent read"
+	case OpWatermarkHigh:
+		return "high watermark"
+	case OpWatermarkLow:
+		return "low watermark"
+	case OpProbe:
+		return "probe"
+	}
+	return "op " + strconv.Itoa(int(op))
 }
 
 // OpResult of operation
 type OpResult struct {
-	Fd     int
-	Buffer []byte // the original committed buffer
-	Size   int
-	Err    error
+	Operation OpType
+	Fd        int
+	Buffer    []byte // the original committed buffer, or a copy, see WithCopyBuffers
+	Size      int
+	Addr      net.Addr // remote address, set for ReadFrom
+	Stream    uint16   // sctp stream id, set for ReadSCTP
+	Flags     int      // flags returned by recvmsg, set for ReadSCTP
+	WireSize  int      // size on the wire with a codec, see SetCodec
+	Count     uint64   // counter read from a notification fd, see WatchNotify
+	Sent      int64    // bytes transferred by SendFile, Size is clamped to int
+	Err       error
+
+	// state of the TLS connection, set for TLS handshake
+	TLS *tls.ConnectionState
+
+	// pool of Buffer, see Release
+	pool *bufferPool
+
+	// the tag of the request in its TypedWatcher, see Result
+	tag uint64
+
+	// transformed by a codec, see SetCodec
+	coded bool
 }
 
 // Watcher will monitor events and process Request(s)
 type Watcher struct {
-	pfd *poller // poll fd
+	// bytes held by pending requests and their number, accessed
+	// atomically, first for alignment on 32-bit platforms
+	pinned  int64
+	pending int64
 
-	// loop
-	chReadableNotify  chan int
-	chWritableNotify  chan int
-	chStopWatchNotify chan int
-	chReaders         chan aiocb
-	chWriters         chan aiocb
+	// reads are rejected, see Drain, requests are rejected and the ones
+	// left at termination fail, see CloseWait, and the number failed,
+	// accessed atomically
+	draining int32
+	closing  int32
+	aborted  int64
 
-	// internal buffer for reading
-	buffer []byte
+	// fds are distributed over shards by fd % len(shards)
+	shards []*shard
+
+	// sockmap for offloading, created on first use
+	sockmap     *sockmap
+	sockmapErr  error
+	sockmapOnce sync.Once
 
+	// closed on termination, with the cause in err, and the loops which
+	// haven't ended their requests yet, see exit
 	die     chan struct{}
 	dieOnce sync.Once
+	err     error
+	loops   sync.WaitGroup
+
+	// signaled by the loops as the pending requests of a fd drop to zero
+	// while draining, and those of the watcher while closing, see Drain and
+	// CloseWait
+	settled chan struct{}
+
+	// descriptors of fds, and the limit of watched fds
+	fds      fdTable
+	maxConns int
+
+	// number of shards, and the expected number of connections for the
+	// derived defaults
+	numShards     int
+	expectedConns int
+
+	// buffers of requests are copied, see WithCopyBuffers
+	copyBuffers bool
+
+	// name in logs, errors and pprof labels, see WithName
+	name string
+
+	// warnings, see WithLogger
+	logger Logger
+
+	// the syscalls of the requests and the pollers, see withSyscalls
+	sys sysCalls
+
+	// the loops are run by step instead of goroutines, see withManualStep
+	manual bool
+
+	// the loop is run by Poll, see WithEmbedded
+	embedded bool
+
+	// the loop is run by the loop of group, see CreateWatcherInGroup
+	group *PollerGroup
+
+	// the progress expected of the loops, see WithWatchdog
+	stuckAfter time.Duration
+
+	// the interval conns closed while watched are checked at, see
+	// WithLeakCheck
+	leakInterval time.Duration
+
+	// whether Watch duplicates the fds of conns, see WithWatchMode
+	watchMode WatchMode
+
+	// called once for each fd the watcher is done with, see WithOnClosed
+	onClosed func(fd int, conn net.Conn, ctx interface{}, reason error)
+
+	// failed results without a done channel, see WithErrorSink
+	errorSink func(res OpResult)
+
+	// observer of requests, see WithTracer
+	tracer Tracer
+
+	// results delivered in batches of batchMax, within batchWindow
+	batchMax    int
+	batchWindow time.Duration
+
+	// consumers slower than slowAfter are reported to slowHook, see
+	// WithSlowConsumer, and the channels dropped from, see SetDropOldest
+	slowAfter  time.Duration
+	slowHook   func(fd int, wait time.Duration)
+	dropMu     sync.RWMutex
+	dropOldest map[chan OpResult]struct{}
+	dropping   int32 // len(dropOldest), accessed atomically
+
+	// workers executing syscalls, nil if disabled, numWorkers is negative
+	// for the derived parallelism until it's applied
+	jobs        chan job
+	numWorkers  int
+	parallelism int // derived default of the workers and of Dispatch
+
+	// the helpers driven by the results of their requests, see attach
+	helpers helperTable
+
+	// writes fail once stalled for stallTimeout, see WithWriteStallTimeout
+	stallTimeout time.Duration
+
+	// probe of the idle fds, see WithProbe
+	probe *probeConfig
+
+	// workers executing the syscalls of regular files, see WithFileWorkers
+	files          fileQueue
+	numFileWorkers int
+
+	// cap of the events buffer and events per round of each poller
+	maxEvents   int
+	eventBudget int
+
+	// the quotas of bytes held by pending requests
+	quota   int64
+	fdQuota int64
+
+	// limits of pending requests, submitters wait on pendingCond for
+	// capacity with pendingWait
+	maxPending     int
+	maxPendingFd   int
+	pendingWait    bool
+	pendingWaiters int32
+	pendingMu      sync.Mutex
+	pendingCond    *sync.Cond
+
+	// bounds of the buffers allocated for reads, and their pool
+	minReadBuf int
+	maxReadBuf int
+	poolLow    int
+	poolHigh   int
+	pool       *bufferPool
+
+	// polling without blocking after activity
+	spin time.Duration
+
+	// pollers locked to threads, and bound to cpus if any
+	lockOSThread bool
+	cpus         []int
+	affinityErr  error
+
+	// socket buffers applied to new fds
+	defaultRcvBuf int
+	defaultSndBuf int
+
+	// keepalive and busy polling applied to new fds
+	defaultKeepAlive *keepAliveConfig
+	defaultBusyPoll  int
+}
+
+// shard is a poller with its own event loop, which owns the pending
+// requests of the fds assigned to it. Requests are submitted through a queue
+// and the loop is woken up by the poller, so no lock is held by the loop
+// while doing syscalls.
+type shard struct {
+	// the start of the last round in unix nanoseconds, and whether the loop
+	// is waiting for events, accessed atomically, first for alignment, see
+	// Healthy
+	beat   int64
+	parked int32
+
+	w     *Watcher
+	pfd   *poller // poll fd
+	index int     // in w.shards, which the loop may start before it's filled
+
+	// submissions, the poller is woken up on the first one after it went idle
+	queue    []aiocb
+	finished []*fdDesc // handed back by workers
+	// spares for swapping with the submissions, owned by loop
+	spare         []aiocb
+	spareFinished []*fdDesc
+	// the submissions of the round not handled yet, see endPending
+	unhandled []aiocb
+	closed    bool // requests ended, see endPending
+	notified  bool
+	queueMu   sync.Mutex
+
+	// internal buffer for reading
+	buffer []byte
+
+	// idle pipes for splice, owned by loop
+	pipes [][2]int
+
+	// splices by dst, a fd of another shard whose writability is watched
+	// by the poller of the shard too, owned by loop
+	foreign map[int]*spliceState
+
+	// fds with new requests, processed after a batch of submissions
+	dirty []*fdDesc
+
+	// scratch for coalescing writes
+	iovecs []unix.Iovec
+
+	// read budget of the fd being processed, and fds to continue on the
+	// next round as they exhausted it
+	budgetBytes  int
+	budgetOps    int
+	backlog      []*fdDesc
+	spareBacklog []*fdDesc
+
+	// the CPU the loop is bound to, -1 if none
+	cpu int
+
+	// counters of requests, shared with the workers executing its fds
+	ops *opStats
+
+	// the start of the round, the time requests are queued at
+	now time.Time
+
+	// the I/O in progress follows readiness, see Stats.ReadsAgain
+	ready bool
+
+	// deadlines of requests, and the deadline the poller timer is armed
+	// for, owned by loop
+	timers timerHeap
+	armed  time.Time
+
+	// bytes the writes of the fd being processed may take, if limited by
+	// SetWriteRateLimit
+	limited    bool
+	writeLimit int
 
-	// hold net.Conn to prevent from GC
-	conns     map[int]net.Conn
-	connsLock sync.Mutex
+	// results held back by WithCompletionBatching, and the end of the
+	// window of the first one
+	batch         []result
+	batchDeadline time.Time
+
+	// results returned by Poll, see WithEmbedded, and the slice of the last
+	// call, reused by the next one
+	polled   []OpResult
+	returned []OpResult
 }
 
 // CreateWatcher creates a management object for monitoring events of net.Conn
-func CreateWatcher() (*Watcher, error) {
+func CreateWatcher(opts ...Option) (*Watcher, error) {
 	w := new(Watcher)
-	pfd, err := openPoll()
-	if err != nil {
-		return nil, err
+	w.logger = nopLogger{}
+	w.sys = rawSyscalls{}
+	w.eventBudget = defaultEventBudget
+	w.minReadBuf = defaultMinReadBuf
+	w.maxReadBuf = defaultMaxReadBuf
+	w.poolHigh = defaultPoolHigh
+	w.numFileWorkers = defaultFileWorkers
+	for _, opt := range opts {
+		opt(w)
+	}
+	if w.group != nil {
+		w.numShards, w.embedded, w.lockOSThread = 1, false, false
+	}
+	if w.embedded {
+		w.manual, w.numShards = true, 1
+	}
+	w.applyDerivedDefaults()
+	if w.manual {
+		w.numWorkers, w.lockOSThread, w.stuckAfter, w.leakInterval = 0, false, 0, 0
+	}
+	if w.name == "" {
+		w.name = defaultName()
+	}
+	if _, ok := w.logger.(nopLogger); !ok {
+		w.logger = namedLogger{w.logger, w.name}
 	}
-	w.pfd = pfd
 
-	w.buffer = make([]byte, 4096)
+	w.die = make(chan struct{})
+	w.settled = make(chan struct{}, 1)
+	w.pendingCond = sync.NewCond(&w.pendingMu)
+	w.pool = newBufferPool(w.minReadBuf, w.maxReadBuf, w.poolLow, w.poolHigh)
+	w.files.wake = make(chan struct{}, w.numFileWorkers)
 
-	w.chReadableNotify = make(chan int)
-	w.chWritableNotify = make(chan int)
-	w.chStopWatchNotify = make(chan int)
-	w.chReaders = make(chan aiocb)
-	w.chWriters = make(chan aiocb)
+	if w.numWorkers > 0 {
+		w.jobs = make(chan job, w.numWorkers)
+		for i := 0; i < w.numWorkers; i++ {
+			w.goLabeled("worker", -1, w.worker)
+		}
+	}
 
-	w.conns = make(map[int]net.Conn)
-	w.die = make(chan struct{})
+	for i := 0; i < w.numShards; i++ {
+		pfd := w.group.poller()
+		if pfd == nil {
+			var err error
+			if pfd, err = openPoll(); err != nil {
+				w.Close()
+				return nil, err
+			}
+			if w.maxEvents > 0 {
+				pfd.maxEvents = w.maxEvents
+			}
+			pfd.budget = w.eventBudget
+			pfd.spin = w.spin
+			pfd.sys = w.sys
+		}
+
+		s := &shard{w: w, pfd: pfd, index: i, cpu: -1, ops: new(opStats), beat: time.Now().UnixNano()}
+		s.buffer = make([]byte, 4096)
+		if len(w.cpus) > 0 {
+			s.cpu = w.cpus[i%len(w.cpus)]
+		}
+		w.shards = append(w.shards, s)
+		w.loops.Add(1)
 
-	go w.pfd.Wait(w.chReadableNotify, w.chWritableNotify, w.die)
-	go w.loop()
+		if w.group != nil {
+			if err := w.group.join(s); err != nil {
+				w.shards = nil
+				w.Close()
+				return nil, err
+			}
+		} else if w.manual {
+			continue
+		} else if w.lockOSThread {
+			pinned := make(chan error, 1)
+			w.goLabeled("poller", i, func() {
+				pinned <- s.pin()
+				s.loop()
+			})
+			if err := <-pinned; err != nil {
+				w.logger.Log("binding poller to cpu failed", "shard", i, "cpu", s.cpu, "err", err)
+				if w.affinityErr == nil {
+					w.affinityErr = err
+				}
+			}
+		} else {
+			w.goLabeled("poller", i, s.loop)
+		}
+	}
+	if w.stuckAfter > 0 {
+		w.goLabeled("watchdog", -1, w.watchdog)
+	}
+	if w.leakInterval > 0 {
+		w.goLabeled("leakcheck", -1, w.leakCheck)
+	}
 	return w, nil
 }
 
 // Close stops monitoring on events for all connections
 func (w *Watcher) Close() error {
+	return w.shutdown(ErrWatcherClosed)
+}
+
+// Done returns a channel closed when the watcher has terminated, by Close
+// or a fatal error of a poller, see Err.
+func (w *Watcher) Done() <-chan struct{} {
+	return w.die
+}
+
+// Err returns nil until Done is closed, then ErrWatcherClosed if the
+// watcher was closed, or the fatal error which terminated it.
+func (w *Watcher) Err() error {
+	select {
+	case <-w.die:
+		return w.err
+	default:
+		return nil
+	}
+}
+
+// shutdown terminates the watcher with err, only the first call has effect
+func (w *Watcher) shutdown(cause error) (err error) {
+	first := false
 	w.dieOnce.Do(func() {
+		first = true
+		w.err = cause
 		close(w.die)
+		w.pendingMu.Lock()
+		w.pendingCond.Broadcast()
+		w.pendingMu.Unlock()
+		w.sockmapOnce.Do(func() { w.sockmapErr = ErrWatcherClosed })
+		if w.sockmap != nil {
+			w.sockmap.close()
+		}
+		for _, s := range w.shards {
+			if e := s.pfd.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
 	})
-	return w.pfd.Close()
+	if first && w.manual {
+		// no loop is left to end the shards, see withManualStep
+		for _, s := range w.shards {
+			s.pfd.closeFds()
+			s.exit()
+		}
+	}
+	return err
+}
+
+// submit queues a request to s and wakes up its poller if needed
+func (s *shard) submit(cb aiocb) error {
+	select {
+	case <-s.w.die:
+		return ErrWatcherClosed
+	default:
+	}
+
+	if s.w.copyBuffers {
+		s.w.copyBuffer(&cb)
+	}
+	if s.w.embedded && cb.done == nil && cb.kind < kindStop {
+		cb.done = embeddedDone
+	}
+	if err := s.w.admit(&cb); err != nil {
+		return err
+	}
+	if cb.auto && cb.kind == kindRead {
+		if d := s.w.fds.get(cb.fd); d != nil && d.has(fdBuffer) {
+			s.w.fds.bindBuffer(&cb)
+		}
+	}
+	if cb.kind < kindStop {
+		atomic.AddUint64(&s.ops.submitted, 1)
+	}
+	if s.w.tracer != nil {
+		s.w.traceSubmit(&cb)
+	}
+
+	s.queueMu.Lock()
+	if s.closed {
+		// the loop ended its requests already
+		s.queueMu.Unlock()
+		s.drop(&cb, ErrWatcherClosed)
+		return ErrWatcherClosed
+	} else if (cb.kind == kindRead || cb.kind == kindUrgent) && atomic.LoadInt32(&s.w.draining) != 0 {
+		// checked under the lock, so the reads queued before the
+		// submission of Drain are ended by it
+		s.queueMu.Unlock()
+		s.drop(&cb, ErrDraining)
+		return ErrDraining
+	} else if cb.kind < kindStop && atomic.LoadInt32(&s.w.closing) != 0 {
+		s.queueMu.Unlock()
+		s.drop(&cb, ErrWatcherClosed)
+		return ErrWatcherClosed
+	}
+	s.queue = append(s.queue, cb)
+	wakeup := !s.notified
+	s.notified = true
+	s.queueMu.Unlock()
+
+	if wakeup {
+		return s.pfd.Wakeup()
+	}
+	return nil
+}
+
+// shardOf returns the shard owning fd
+func (w *Watcher) shardOf(fd int) *shard {
+	return w.shards[fd%len(w.shards)]
 }
 
 // Watch starts watching events on connection `conn`
@@ -101,6 +674,9 @@ func (w *Watcher) Watch(conn net.Conn) (fd int, err error) {
 	var operr error
 	if err := rawconn.Control(func(s uintptr) {
 		fd = int(s)
+		if w.watchMode == WatchDup {
+			fd, operr = unix.FcntlInt(s, unix.F_DUPFD_CLOEXEC, 0)
+		}
 	}); err != nil {
 		return 0, err
 	}
@@ -108,133 +684,786 @@ func (w *Watcher) Watch(conn net.Conn) (fd int, err error) {
 		return 0, operr
 	}
 
-	// poll this fd
-	w.pfd.Watch(fd)
+	var flags uint32
+	if w.watchMode == WatchDup {
+		// the duplicate is owned by the watcher, conn by the caller
+		conn, flags = nil, fdOwned
+		dupfd := fd
+		defer func() {
+			if err != nil {
+				unix.Close(dupfd)
+			}
+		}()
+	}
+
+	typ, err := typeFlags(fd)
+	if err != nil {
+		return 0, err
+	}
+	flags |= typ
 
 	// prevent GC net.Conn
-	w.connsLock.Lock()
-	w.conns[fd] = conn
-	w.connsLock.Unlock()
+	d, err := w.fds.register(fd, conn, w.maxConns, flags)
+	if err != nil {
+		return 0, err
+	}
+	if w.leakInterval > 0 {
+		w.fds.setStack(d, watchStack())
+	}
+	if err := w.applyDefaults(fd); err != nil {
+		w.fds.unregister(fd)
+		return 0, err
+	}
+
+	// poll this fd
+	if err := w.poll(d); err != nil {
+		w.fds.unregister(fd)
+		return 0, err
+	}
+	if w.terminatedWatching(fd) {
+		return 0, ErrWatcherClosed
+	}
 	return fd, nil
 }
 
-// StopWatch events related to this fd
-func (w *Watcher) StopWatch(fd int) {
-	w.pfd.Unwatch(fd)
-	w.connsLock.Lock()
-	delete(w.conns, fd)
-	w.connsLock.Unlock()
+// WatchFd starts watching events on a raw file descriptor, such as sockets
+// not supported by package net, inherited fds or device files. The
+// descriptor will be set to non-blocking mode and the returned fd should be
+// used in subsequent requests, it's fd unless opts duplicate it, see DupFd.
+// The fd belongs to the caller unless given by OwnFd. Without a conn, the
+// addresses of its results and AsyncConn are those of the socket, if any.
+// The socket options of w, like WithSockBuf, apply to sockets only, regular
+// files are executed by the file workers and directories are rejected with
+// ErrNotPollable.
+func (w *Watcher) WatchFd(fd int, opts ...WatchOption) (_ int, err error) {
+	var o watchOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	var flags uint32
+	if o.dup {
+		if fd, err = unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, 0); err != nil {
+			return 0, err
+		}
+		dupfd := fd
+		defer func() {
+			if err != nil {
+				unix.Close(dupfd)
+			}
+		}()
+	}
+	if o.dup || o.own {
+		flags = fdOwned
+	}
+	typ, err := typeFlags(fd)
+	if err != nil {
+		return 0, err
+	}
+	flags |= typ
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		return 0, err
+	}
 
-	select {
-	case w.chStopWatchNotify <- fd:
-	case <-w.die:
+	d, err := w.fds.register(fd, nil, w.maxConns, flags)
+	if err != nil {
+		return 0, err
+	}
+	if err := w.applyDefaults(fd); err != nil {
+		w.fds.unregister(fd)
+		return 0, err
+	}
+
+	if err := w.poll(d); err != nil {
+		w.fds.unregister(fd)
+		return 0, err
+	}
+	if w.terminatedWatching(fd) {
+		return 0, ErrWatcherClosed
 	}
+	return fd, nil
 }
 
-// Read submits a read requests and notify with done
-func (w *Watcher) Read(fd int, buf []byte, done chan OpResult) error {
+// terminatedWatching undoes the registration of fd if the watcher
+// terminated meanwhile, unless the termination ended fd already
+func (w *Watcher) terminatedWatching(fd int) bool {
 	select {
-	case w.chReaders <- aiocb{fd: fd, buffer: buf, done: done}:
-		return nil
 	case <-w.die:
-		return ErrWatcherClosed
+		_, _, flags := w.fds.unregister(fd)
+		return flags&fdWatched != 0
+	default:
+		return false
 	}
 }
 
+// Len returns the number of watched fds.
+func (w *Watcher) Len() int {
+	return w.fds.len()
+}
+
+// Range calls f with the watched fds and their connections, nil for fds
+// watched by WatchFd, until f returns false. f is called without locks
+// held, so it may call Watch and StopWatch, and fds watched or stopped
+// concurrently may or may not be seen.
+func (w *Watcher) Range(f func(fd int, conn net.Conn) bool) {
+	w.fds.rangeConns(f)
+}
+
+// Conns returns the number of watched fds, and the number which can be
+// watched before Watch fails with ErrMaxConns, -1 if unlimited.
+func (w *Watcher) Conns() (count, headroom int) {
+	count = w.fds.len()
+	if w.maxConns <= 0 {
+		return count, -1
+	}
+	if headroom = w.maxConns - count; headroom < 0 {
+		headroom = 0
+	}
+	return count, headroom
+}
+
+// SetContext associates v with the watched fd, replacing the previous one,
+// to find the state of fd when its results arrive. It's cleared when fd is
+// deregistered, by StopWatch, Close or a failure, and passed to the callback
+// of WithOnClosed then. ErrNotWatched is returned if fd isn't watched.
+func (w *Watcher) SetContext(fd int, v interface{}) error {
+	if !w.fds.setContext(fd, v) {
+		return ErrNotWatched
+	}
+	return nil
+}
+
+// Context returns the value associated with fd by SetContext, ok is false
+// if fd isn't watched or has none.
+func (w *Watcher) Context(fd int) (v interface{}, ok bool) {
+	v = w.fds.context(fd)
+	return v, v != nil
+}
+
+// watched reports whether fd is being watched by w
+func (w *Watcher) watched(fd int) bool {
+	return w.fds.watched(fd) != nil
+}
+
+// StopWatch events related to this fd
+func (w *Watcher) StopWatch(fd int) {
+	w.stopWatch(fd, false, nil)
+}
+
+// CloseConn stops watching fd like StopWatch, and closes its conn after its
+// requests are dropped, so fd isn't reused while the watcher still knows
+// it. The conn of a fd watched by WatchDup or WatchFd is the caller's, and
+// isn't closed.
+func (w *Watcher) CloseConn(fd int) {
+	w.stopWatch(fd, true, nil)
+}
+
+// stopWatch stops watching fd, its queued requests fail with reason, or are
+// dropped if it's nil
+func (w *Watcher) stopWatch(fd int, closeConn bool, reason error) {
+	w.shardOf(fd).pfd.Unwatch(fd)
+	conn, ctx, flags := w.fds.unregister(fd)
+	w.submitStop(aiocb{kind: kindStop, fd: fd, conn: conn, ctx: ctx, closeConn: closeConn, reason: reason}, flags)
+}
+
+// submitStop submits the StopWatch cb of a fd deregistered with flags
+func (w *Watcher) submitStop(cb aiocb, flags uint32) {
+	cb.closing, cb.owned = flags&fdWatched != 0, flags&fdOwned != 0
+	if flags&fdOffloaded != 0 {
+		w.unoffloadFd(cb.fd)
+	}
+	if err := w.shardOf(cb.fd).submit(cb); err != nil {
+		if cb.closing {
+			w.notifyClosed(cb.fd, cb.conn, cb.ctx, cb.reason)
+		}
+		cb.closeStopped()
+	}
+}
+
+// closeStopped closes the fd of a StopWatch owned by the watcher, and the
+// conn of a CloseConn
+func (cb *aiocb) closeStopped() {
+	if cb.owned {
+		unix.Close(cb.fd)
+	}
+	if cb.closeConn && cb.conn != nil {
+		cb.conn.Close()
+	}
+}
+
+// Read submits a read requests and notify with done. If buf is nil, the
+// read is into the buffer of SetBuffer, or a buffer is borrowed from the
+// pool of the watcher only while fd is readable, and returned in
+// OpResult.Buffer to be released with OpResult.Release. Its size adapts to
+// the recent reads of fd, see WithReadBufferSize.
+func (w *Watcher) Read(fd int, buf []byte, done chan OpResult) error {
+	return w.shardOf(fd).submit(aiocb{kind: kindRead, fd: fd, buffer: buf, auto: buf == nil, done: done})
+}
+
 // Write submits a write requests and notify with done
 func (w *Watcher) Write(fd int, buf []byte, done chan OpResult) error {
-	select {
-	case w.chWriters <- aiocb{fd: fd, buffer: buf, done: done}:
-		return nil
-	case <-w.die:
-		return ErrWatcherClosed
+	return w.shardOf(fd).submit(aiocb{kind: kindWrite, fd: fd, buffer: buf, done: done})
+}
+
+// ReadFrom submits a read requests like Read, and reports the remote address
+// of the received data in OpResult.Addr
+func (w *Watcher) ReadFrom(fd int, buf []byte, done chan OpResult) error {
+	return w.shardOf(fd).submit(aiocb{kind: kindRead, fd: fd, buffer: buf, from: true, done: done})
+}
+
+// WriteTo submits a write requests to the address `addr` and notify with done,
+// a nil addr is equivalent to Write
+func (w *Watcher) WriteTo(fd int, buf []byte, addr net.Addr, done chan OpResult) error {
+	var sa unix.Sockaddr
+	if addr != nil {
+		var err error
+		if sa, err = addrToSockaddr(addr); err != nil {
+			return err
+		}
 	}
+
+	return w.shardOf(fd).submit(aiocb{kind: kindWrite, fd: fd, buffer: buf, addr: sa, done: done})
 }
 
 // tryRead will try to read data on aiocb and notify
 // returns true if io has completed, false means EAGAIN
-func (w *Watcher) tryRead(pcb *aiocb) (complete bool) {
-	size := len(pcb.buffer)
-	if len(w.buffer) < size {
-		size = len(w.buffer)
+func (s *shard) tryRead(pcb *aiocb) (complete bool) {
+	if pcb.splice != nil {
+		return s.trySplice(pcb.splice)
+	} else if pcb.offload != nil {
+		return s.tryOffload(pcb)
+	} else if pcb.notify {
+		return s.tryNotify(pcb)
+	}
+	d := s.w.fds.get(pcb.fd)
+	if d != nil && len(d.decoded) > 0 && !pcb.sctp && !pcb.from {
+		// decoded data left by the previous read
+		s.completeDecoded(pcb, d, 0)
+		return true
+	}
+
+	var buf []byte
+	if pcb.auto {
+		// read into a pooled buffer directly, it's returned on EAGAIN so
+		// idle fds hold no buffer
+		buf = s.w.pool.get(s.w.readBufferSize(pcb.fd))
+	} else {
+		size := len(pcb.buffer)
+		if len(s.buffer) < size {
+			size = len(s.buffer)
+		}
+		buf = s.buffer[:size]
+	}
+
+	var nr, flags int
+	var er error
+	var from unix.Sockaddr
+	var stream uint16
+	if pcb.sctp {
+		nr, stream, flags, er = recvSCTP(s.w.sys, pcb.fd, buf)
+	} else if pcb.from {
+		nr, from, er = s.w.sys.Recvfrom(pcb.fd, buf, 0)
+	} else {
+		if d != nil && d.has(fdRcvLowat) && !readable(pcb.fd) {
+			// nonblocking reads ignore SO_RCVLOWAT, wait for epoll
+			if pcb.auto {
+				s.w.pool.put(buf)
+			}
+			return false
+		}
+		nr, er = s.w.sys.Read(pcb.fd, buf)
+		if er == syscall.EIO && d != nil && d.has(fdKTLS) {
+			// control record on kernel TLS socket
+			nr, er = readTLSRecord(s.w.sys, pcb.fd, buf)
+		}
 	}
-	nr, er := syscall.Read(pcb.fd, w.buffer[:size])
 	if er == syscall.EAGAIN {
+		if pcb.auto {
+			s.w.pool.put(buf)
+		}
+		s.countAgain(pcb.fd, false)
 		return false
+	} else if er == nil {
+		s.countRead(nr)
+	}
+	er = s.w.keepAliveErr(pcb.fd, er)
+	if er == nil {
+		if d != nil && d.has(fdQuickAck) {
+			setQuickAck(pcb.fd, true)
+		}
+	}
+	s.consume(nr)
+	if er == nil && nr > 0 && d != nil && d.has(fdCodec) && !pcb.sctp && !pcb.from {
+		complete := s.decodeRead(pcb, d, buf, nr)
+		if pcb.auto {
+			s.w.pool.put(buf)
+		}
+		if !complete {
+			// no data decoded yet
+			return s.tryRead(pcb)
+		}
+		return true
 	}
-	copy(pcb.buffer, w.buffer)
+	var pool *bufferPool
+	if s.w.copyBuffers && !pcb.auto {
+		// the data is delivered in a pooled copy, the buffer of the caller
+		// is never written
+		if nr > 0 && pcb.done != nil {
+			buf := s.w.pool.get(len(pcb.buffer))
+			copy(buf, s.buffer[:nr])
+			pcb.buffer = buf
+			pool = s.w.pool
+		}
+	} else if !pcb.auto {
+		copy(pcb.buffer, s.buffer)
+	} else {
+		if er == nil {
+			s.w.adaptReadBuffer(pcb.fd, nr, len(buf))
+		}
+		if er == nil && nr > 0 && pcb.done != nil {
+			pcb.buffer = buf
+			pool = s.w.pool
+		} else {
+			s.w.pool.put(buf)
+		}
+	}
+	res := OpResult{Operation: OpRead, Fd: pcb.fd, Buffer: pcb.buffer, Size: nr, Err: er, pool: pool}
+	res.Err = s.w.opError(&res)
+	if pcb.from && er == nil && pcb.done != nil {
+		res.Addr = remoteAddr(pcb.fd, from)
+	}
+	if pcb.sctp {
+		res.Stream = stream
+		res.Flags = flags
+	}
+	pcb.moveTag(&res)
+	s.traceEnd(pcb, res)
+	s.retire(pcb)
 	if pcb.done != nil {
-		pcb.done <- OpResult{Fd: pcb.fd, Buffer: pcb.buffer, Size: nr, Err: er}
+		s.deliver(pcb.done, res)
+	} else {
+		s.w.sinkError(res)
 	}
 	return true
 }
 
-func (w *Watcher) tryWrite(pcb *aiocb) (complete bool) {
-	nw, ew := syscall.Write(pcb.fd, pcb.buffer[pcb.size:])
+func (s *shard) tryWrite(pcb *aiocb) (complete bool) {
+	if pcb.connect {
+		return s.tryConnect(pcb)
+	} else if pcb.cork != 0 {
+		err := setCork(pcb.fd, pcb.cork == corkOn)
+		if d := s.w.fds.get(pcb.fd); d != nil && err == nil {
+			d.set(fdCorked, pcb.cork == corkOn)
+		}
+		s.complete(pcb, OpResult{Operation: OpWrite, Fd: pcb.fd, Err: err})
+		return true
+	} else if pcb.zerocopy {
+		return s.tryWriteZeroCopy(pcb)
+	} else if pcb.file != nil {
+		return s.trySendfile(pcb)
+	} else if pcb.splice != nil {
+		return s.trySplice(pcb.splice)
+	}
+
+	if pcb.plain == nil && len(pcb.buffer) > 0 && pcb.addr == nil && !pcb.fastopen && !pcb.sctp {
+		if d := s.w.fds.get(pcb.fd); d != nil && d.has(fdCodec) && !s.encode(pcb) {
+			return true
+		}
+	}
+
+	var nw int
+	var ew error
+	b := pcb.buffer[pcb.size:]
+	if len(pcb.buffer) == 0 && !pcb.fastopen && pcb.addr == nil && !pcb.sctp {
+		// zero-length write completes on writability, which honours
+		// TCP_NOTSENT_LOWAT set by SetNotSentLowat
+		if !writable(pcb.fd) {
+			return false
+		}
+	} else if pcb.fastopen {
+		nw, ew = sendFastOpen(s.w.sys, pcb.fd, b, pcb.addr)
+		pcb.fastopen = false
+		pcb.addr = nil
+	} else if b = s.limit(b); pcb.sctp {
+		nw, ew = sendSCTP(s.w.sys, pcb.fd, b, pcb.stream)
+	} else if pcb.addr != nil {
+		nw, ew = s.w.sys.Sendmsg(pcb.fd, b, nil, pcb.addr, 0)
+	} else {
+		nw, ew = s.w.sys.Write(pcb.fd, b)
+	}
 	if ew == syscall.EAGAIN {
+		s.countAgain(pcb.fd, true)
 		return false
 	}
+	ew = s.w.keepAliveErr(pcb.fd, ew)
 
 	if ew == nil {
+		if len(b) > 0 {
+			s.countWrite(pcb.fd, nw, len(b))
+			s.progressed(pcb.fd, nw)
+		}
 		pcb.size += nw
+		s.reportProgress(pcb)
+		if s.limited {
+			s.writeLimit -= nw
+		}
 	}
 
 	if pcb.size == len(pcb.buffer) || ew != nil {
-		if pcb.done != nil {
-			pcb.done <- OpResult{Fd: pcb.fd, Buffer: pcb.buffer, Size: nw, Err: ew}
-		}
+		s.complete(pcb, OpResult{Operation: OpWrite, Fd: pcb.fd, Buffer: pcb.buffer, Size: pcb.size, Err: ew})
 		return true
 	}
 	return false
 }
 
-func (w *Watcher) loop() {
-	pendingReaders := make(map[int][]aiocb)
-	pendingWriters := make(map[int][]aiocb)
+// popFront removes the head of a pending queue, the backing array is kept
+// when the queue drains, so steady request flows don't allocate
+func (s *shard) popFront(q []aiocb) []aiocb {
+	s.retire(&q[0])
+	q[0] = aiocb{}
+	if len(q) == 1 {
+		return q[:0]
+	}
+	return q[1:]
+}
 
-	for {
-		select {
-		case cb := <-w.chReaders:
-			pendingReaders[cb.fd] = append(pendingReaders[cb.fd], cb)
+// fail completes a request which can't be queued
+func (s *shard) fail(cb *aiocb, err error) {
+	res := OpResult{Operation: cb.op(), Fd: cb.fd, Buffer: cb.buffer, Err: err}
+	cb.plainResult(&res)
+	res.Err = s.w.opError(&res)
+	err = res.Err
+	cb.moveTag(&res)
+	s.traceEnd(cb, res)
+	s.retire(cb)
+	if cb.splice != nil {
+		s.finishSplice(cb.splice, err)
+	} else if cb.done != nil {
+		if cb.copied {
+			res.pool = s.w.pool
+		}
+		s.deliver(cb.done, res)
+	} else {
+		s.w.sinkError(res)
+		if cb.copied {
+			s.w.pool.put(cb.buffer)
+		}
+	}
+}
 
-			if w.tryRead(&pendingReaders[cb.fd][0]) {
-				pendingReaders[cb.fd] = pendingReaders[cb.fd][1:]
-			}
-		case cb := <-w.chWriters:
-			pendingWriters[cb.fd] = append(pendingWriters[cb.fd], cb)
+// process pending requests of fd in order until EAGAIN or the budget of fd
+// is exhausted
+func (s *shard) doReads(d *fdDesc) {
+	s.resetBudget()
+	for len(d.readers) > 0 {
+		if !s.tryRead(&d.readers[0]) {
+			d.moreRead = s.exhausted()
+			break
+		}
+		if d.readers[0].splice != nil {
+			d.splices--
+		}
+		d.readers = s.popFront(d.readers)
+		if len(d.readers) > 0 && s.exhausted() {
+			d.moreRead = true
+			break
+		}
+	}
+}
+
+func (s *shard) doUrgents(d *fdDesc) {
+	for len(d.urgents) > 0 {
+		if !s.tryReadUrgent(&d.urgents[0]) {
+			break
+		}
+		d.urgents = s.popFront(d.urgents)
+	}
+}
 
-			if w.tryWrite(&pendingWriters[cb.fd][0]) {
-				pendingWriters[cb.fd] = pendingWriters[cb.fd][1:]
+func (s *shard) doWrites(d *fdDesc) {
+	s.resetBudget() // for splice
+	if len(d.writers) == 0 || !s.limitWrites(d) {
+		return
+	}
+	defer s.endWrites(d)
+	wrote := false
+	for len(d.writers) > 0 {
+		if s.limited && s.writeLimit == 0 {
+			break
+		}
+		if !s.limited && len(d.writers) > 1 && coalescable(&d.writers[0]) && coalescable(&d.writers[1]) {
+			if !s.tryWritev(d) {
+				break
 			}
-		case fd := <-w.chReadableNotify:
-			for {
-				if len(pendingReaders[fd]) == 0 {
-					break
-				}
+			wrote = true
+			continue
+		}
+		if !s.tryWrite(&d.writers[0]) {
+			d.moreWrite = s.exhausted()
+			break
+		}
+		if d.writers[0].splice != nil {
+			d.splices--
+		}
+		wrote = wrote || d.writers[0].cork == 0
+		d.writers = s.popFront(d.writers)
+	}
 
-				if w.tryRead(&pendingReaders[fd][0]) {
-					pendingReaders[fd] = pendingReaders[fd][1:]
-				} else {
-					break
+	// the queue drained, the last bytes written under a cork are sent now
+	// instead of after the cork timeout
+	if wrote && len(d.writers) == 0 && d.has(fdCorked) {
+		setCork(d.fd, false)
+		d.set(fdCorked, false)
+	}
+}
+
+func (s *shard) doIO(d *fdDesc, readable, writable bool) {
+	if readable {
+		s.doUrgents(d)
+		s.doReads(d)
+	}
+	if writable {
+		s.doWrites(d)
+	}
+}
+
+// handle queues a submitted request to its fd, the fd is processed by flush
+// after the batch, so consecutive requests on it are processed together
+func (s *shard) handle(cb *aiocb) {
+	if cb.kind == kindFlush {
+		// the results of the requests before it are delivered
+		s.flush()
+		s.flushBatch()
+		return
+	} else if cb.kind == kindDump {
+		cb.dump <- s.dumpState()
+		return
+	} else if cb.kind == kindDrain && cb.fd < 0 {
+		s.drainShard()
+		return
+	}
+	if cb.since.IsZero() {
+		cb.since = s.now
+	}
+
+	fds := &s.w.fds
+	if d := fds.get(cb.fd); d != nil && (d.dirtyRead || d.dirtyWrite) && cb.kind == kindStop {
+		// the requests before StopWatch are tried first
+		s.flushOne(d)
+	}
+	if d := fds.get(cb.fd); d != nil {
+		s.startTimer(cb, d)
+	}
+	if d := fds.get(cb.fd); d != nil && d.busy {
+		// in order with the requests on the worker
+		d.deferred = append(d.deferred, *cb)
+		return
+	}
+	if cb.kind == kindMigrate {
+		cb.migrate <- s.migrateOut(cb.fd)
+		return
+	} else if cb.kind == kindDrain {
+		if d := fds.get(cb.fd); d != nil {
+			s.drainReads(d)
+		}
+		return
+	} else if cb.kind == kindCancel {
+		if d := fds.get(cb.fd); d != nil {
+			s.endReads(d, errReadCanceled)
+		}
+		return
+	} else if cb.kind == kindPending {
+		cb.inspect <- s.pendingOps(cb.fd)
+		return
+	}
+
+	d := fds.watched(cb.fd)
+	if cb.kind == kindStop {
+		if d := fds.get(cb.fd); d != nil {
+			d.water, d.rate, d.decoded = nil, nil, nil
+			s.setHeartbeat(d, nil)
+			s.setProbe(d, nil)
+			for _, q := range [][]aiocb{d.readers, d.writers, d.urgents} {
+				for i := range q {
+					if cb.reason != nil {
+						s.abort(&q[i], cb.reason)
+					} else {
+						s.retire(&q[i])
+					}
 				}
 			}
-		case fd := <-w.chWritableNotify:
-			for {
-				if len(pendingWriters[fd]) == 0 {
+			d.readers, d.writers, d.urgents, d.zc = nil, nil, nil, nil
+			d.splices = 0
+		}
+		if cb.closing && s.w.onClosed != nil {
+			s.flushBatch()
+			s.w.notifyClosed(cb.fd, cb.conn, cb.ctx, cb.reason)
+		}
+		cb.closeStopped()
+	} else if d == nil {
+		s.fail(cb, ErrNotWatched)
+	} else {
+		switch cb.kind {
+		case kindRead:
+			if cb.switching {
+				s.cancelWrites(d, ErrSwitched)
+			}
+			if cb.splice != nil {
+				// a splice request waits on both ends
+				dst := fds.watched(cb.splice.dst)
+				if dst == nil {
+					s.finishSplice(cb.splice, ErrNotWatched)
 					break
-				}
-
-				if w.tryWrite(&pendingWriters[fd][0]) {
-					pendingWriters[fd] = pendingWriters[fd][1:]
-				} else {
+				} else if s.w.shardOf(cb.splice.dst) != s {
+					if err := s.watchForeign(cb.splice); err != nil {
+						s.finishSplice(cb.splice, err)
+						break
+					}
+					d.splices++
+					d.readers = append(d.readers, *cb)
+					s.markDirty(d, true, false)
+					break
+				} else if dst.busy {
+					dst.deferred = append(dst.deferred, *cb)
 					break
 				}
+				dst.writers = append(dst.writers, *cb)
+				dst.splices++
+				d.splices++
+			}
+			d.readers = append(d.readers, *cb)
+			s.markDirty(d, true, false)
+		case kindUrgent:
+			// urgent reads are independent of in-band reads
+			d.urgents = append(d.urgents, *cb)
+			s.markDirty(d, true, false)
+		case kindWrite:
+			if d.has(fdReadOnly) {
+				s.fail(cb, ErrReadOnly)
+				break
 			}
-		case fd := <-w.chStopWatchNotify:
-			delete(pendingReaders, fd)
-			delete(pendingWriters, fd)
-		case <-w.die:
-			return
+			if cb.switching {
+				s.endReads(d, ErrSwitched)
+			}
+			s.watchStall(d)
+			s.enqueued(d, cb)
+			d.writers = append(d.writers, *cb)
+			s.markDirty(d, false, true)
+		case kindWatermark:
+			s.setWatermarks(d, cb)
+		case kindRateLimit:
+			d.rate = cb.rate
+			s.markDirty(d, false, true)
+		case kindHeartbeat:
+			s.setHeartbeat(d, cb.beat)
+		case kindProbe:
+			s.setProbe(d, cb.probe)
+		}
+	}
+}
+
+func (s *shard) markDirty(d *fdDesc, read, write bool) {
+	if !d.dirtyRead && !d.dirtyWrite {
+		s.dirty = append(s.dirty, d)
+	}
+	d.dirtyRead = d.dirtyRead || read
+	d.dirtyWrite = d.dirtyWrite || write
+}
+
+// flush processes the fds with new requests
+func (s *shard) flush() {
+	for i, d := range s.dirty {
+		s.flushOne(d)
+		s.dirty[i] = nil
+	}
+	s.dirty = s.dirty[:0]
+}
+
+func (s *shard) flushOne(d *fdDesc) {
+	if d.dirtyRead || d.dirtyWrite {
+		read, write := d.dirtyRead, d.dirtyWrite
+		d.dirtyRead, d.dirtyWrite = false, false
+		s.dispatch(d, read, write)
+	}
+}
+
+func (s *shard) loop() {
+	if err := s.wait(s.onEvent, s.drain, s.idle); err != nil {
+		s.w.logger.Log("poller failed", "err", err)
+		s.w.shutdown(err)
+	}
+	s.exit()
+}
+
+// drain handles the submissions and the fds handed back by workers, after
+// each round of events
+func (s *shard) drain() {
+	atomic.AddUint64(&s.ops.wakeups, 1)
+	s.now = time.Now()
+	s.heartbeat(s.now)
+	s.queueMu.Lock()
+	queue, finished := s.queue, s.finished
+	s.queue, s.finished = s.spare, s.spareFinished
+	s.queueMu.Unlock()
+
+	for i, d := range finished {
+		s.release(d)
+		finished[i] = nil
+	}
+	s.spareFinished = finished[:0]
+
+	for i := range queue {
+		s.unhandled = queue[i+1:]
+		s.handle(&queue[i])
+		queue[i] = aiocb{}
+	}
+	s.unhandled = nil
+	s.spare = queue[:0]
+	s.flush()
+	s.continueBacklog()
+	s.expire()
+}
+
+// onEvent dispatches the readiness of fd
+func (s *shard) onEvent(fd int, readable, writable bool) {
+	if atomic.LoadInt32(&s.parked) != 0 {
+		s.heartbeat(time.Now())
+	}
+	if fd%s.w.numShards != s.index {
+		// the dst of a splice of s, or one removed in this round
+		if sp := s.foreign[fd]; sp != nil && writable {
+			s.resumeSplice(sp)
 		}
+		return
+	}
+	if d := s.w.fds.get(fd); d != nil {
+		s.ready = true
+		s.dispatch(d, readable, writable)
+		s.ready = false
+	} else {
+		s.w.logger.Log("event on fd not watched", "fd", fd, "readable", readable, "writable", writable)
+	}
+}
+
+// idle reports whether the loop may park, submitters skip the wakeup while
+// the loop is busy
+func (s *shard) idle() bool {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	if len(s.queue) > 0 || len(s.finished) > 0 || len(s.backlog) > 0 {
+		return false
+	}
+	s.w.pool.trim()
+	s.notified = false
+	atomic.StoreInt32(&s.parked, 1)
+	return true
+}
+
+// exit ends the loop once its poller returned
+func (s *shard) exit() {
+	defer s.w.loops.Done()
+	if err := s.w.Err(); err != ErrWatcherClosed || s.w.tracer != nil || s.w.onClosed != nil || s.w.watchMode == WatchDup || atomic.LoadInt32(&s.w.closing) != 0 {
+		s.endPending(err)
 	}
+	s.flushBatch()
+	s.closePipes()
 }
@@ -0,0 +1,38 @@
+package gaio
+
+// WatchMode sets how Watch takes the fd of a net.Conn, see WithWatchMode.
+type WatchMode int
+
+const (
+	// WatchShared watches the fd of the conn, which is shared with the
+	// conn, so a Close of the conn or its deadlines affect the requests.
+	// The conn is referenced by the watcher until StopWatch.
+	WatchShared WatchMode = iota
+
+	// WatchDup watches a duplicate of the fd of the conn, owned by the
+	// watcher and closed on StopWatch and Close. The caller may close the
+	// conn at any time without affecting the requests, the peer sees the
+	// connection closed once both are. It costs a fd per watched conn.
+	WatchDup
+)
+
+// WatchOption sets how WatchFd takes its fd.
+type WatchOption func(*watchOptions)
+
+type watchOptions struct {
+	dup bool // watch a duplicate owned by the watcher
+	own bool // the watcher owns the fd
+}
+
+// DupFd makes WatchFd watch a duplicate of the fd, owned by the watcher and
+// closed on StopWatch and Close like in WatchDup mode, the returned fd is
+// the duplicate. The caller may close its fd at any time.
+func DupFd() WatchOption {
+	return func(o *watchOptions) { o.dup = true }
+}
+
+// OwnFd transfers the ownership of the fd to WatchFd, the watcher closes it
+// on StopWatch and Close, and the caller must not close it.
+func OwnFd() WatchOption {
+	return func(o *watchOptions) { o.own = true }
+}
@@ -0,0 +1,72 @@
+package gaio
+
+// SetWriteWatermarks submits a request to report the bytes of the writes
+// queued on fd crossing high and low. A result with Operation
+// OpWatermarkHigh is delivered to done once the bytes reach high, and one
+// with OpWatermarkLow once they drain back to low, Size is the bytes queued
+// then. A zero high disables the reports.
+//
+// The bytes of a write are counted from the time it's queued on fd until
+// it completes or is dropped.
+func (w *Watcher) SetWriteWatermarks(fd int, low, high int, done chan OpResult) error {
+	var wm *watermarks
+	if high > 0 {
+		wm = &watermarks{low: low, high: high, done: done}
+	}
+	return w.shardOf(fd).submit(aiocb{kind: kindWatermark, fd: fd, water: wm})
+}
+
+// watermarks of the bytes queued on a fd, owned by the owner of the
+// descriptor like its queues
+type watermarks struct {
+	low, high int
+	above     bool
+	done      chan OpResult
+}
+
+// setWatermarks applies a request of SetWriteWatermarks to d
+func (s *shard) setWatermarks(d *fdDesc, cb *aiocb) {
+	d.water = cb.water
+	s.checkWatermarks(d, cb.fd)
+}
+
+// enqueued counts the bytes of a write queued on d
+func (s *shard) enqueued(d *fdDesc, cb *aiocb) {
+	if cb.kind != kindWrite || len(cb.buffer) == 0 || cb.queuedDesc != nil {
+		return
+	}
+	cb.queuedDesc = d
+	d.queued += len(cb.buffer)
+	s.checkWatermarks(d, cb.fd)
+}
+
+// dequeued releases the bytes of a write which completed or was dropped
+func (s *shard) dequeued(cb *aiocb) {
+	d := cb.queuedDesc
+	if d == nil {
+		return
+	}
+	cb.queuedDesc = nil
+	d.queued -= len(cb.buffer)
+	s.checkWatermarks(d, cb.fd)
+}
+
+// checkWatermarks reports a crossing of the watermarks of d
+func (s *shard) checkWatermarks(d *fdDesc, fd int) {
+	wm := d.water
+	if wm == nil {
+		return
+	}
+	if !wm.above && d.queued >= wm.high {
+		wm.above = true
+		s.w.logger.Log("write queue reached high watermark", "fd", fd, "tags", s.w.fds.tags(fd), "queued", d.queued, "high", wm.high)
+		if wm.done != nil {
+			s.deliver(wm.done, OpResult{Operation: OpWatermarkHigh, Fd: fd, Size: d.queued})
+		}
+	} else if wm.above && d.queued <= wm.low {
+		wm.above = false
+		if wm.done != nil {
+			s.deliver(wm.done, OpResult{Operation: OpWatermarkLow, Fd: fd, Size: d.queued})
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package gaio
+
+// job is the I/O of a fd executed by a worker
+type job struct {
+	s        *shard
+	d        *fdDesc
+	readable bool
+	writable bool
+	ready    bool // see shard.ready
+}
+
+// worker executes the syscalls of fds dispatched by the loops, with its own
+// buffer and pipes, the descriptor is owned by the worker until it's handed
+// back to the loop through finish. Batched results are delivered at the end
+// of each job. A fd its loop no longer takes back is ended by the worker.
+func (w *Watcher) worker() {
+	ws := &shard{w: w, buffer: make([]byte, 4096)}
+	defer ws.closePipes()
+	for {
+		select {
+		case j := <-w.jobs:
+			w.runJob(ws, j)
+		case <-w.die:
+			return
+		}
+	}
+}
+
+// runJob executes j on the worker ws and hands its fd back to its loop
+func (w *Watcher) runJob(ws *shard, j job) {
+	if err := ws.doJob(j); err != nil {
+		w.logger.Log("worker panicked", "err", err)
+		w.shutdown(err)
+	}
+	ws.flushBatch()
+	if !j.s.finish(j.d) {
+		ws.endQueues(j.d, w.Err())
+		ws.flushBatch()
+	}
+}
+
+// dispatch processes the pending requests of d on readiness, on a worker if
+// enabled, or inline on the loop. Requests shared with another fd(splice)
+// are always processed on the loop, and those of regular files on the file
+// workers.
+func (s *shard) dispatch(d *fdDesc, readable, writable bool) {
+	if d.busy {
+		d.pendingRead = d.pendingRead || readable
+		d.pendingWrite = d.pendingWrite || writable
+		return
+	}
+
+	file := d.has(fdFile) && !s.w.manual
+	if (s.w.jobs == nil && !file) || d.splices > 0 {
+		s.doIO(d, readable, writable)
+		s.remember(d)
+		return
+	}
+
+	readable = readable && len(d.readers)+len(d.urgents) > 0
+	writable = writable && len(d.writers) > 0
+	if !readable && !writable {
+		return
+	}
+
+	// the results held back by the loop are delivered before the results
+	// of the worker
+	s.flushBatch()
+	d.busy = true
+	if file {
+		s.w.files.push(job{s, d, readable, writable, s.ready})
+		return
+	}
+	select {
+	case s.w.jobs <- job{s, d, readable, writable, s.ready}:
+	case <-s.w.die:
+		d.busy = false
+	}
+}
+
+// finish hands d back to the loop of s, it returns false if the loop ended
+// its requests already, see endPending
+func (s *shard) finish(d *fdDesc) bool {
+	s.queueMu.Lock()
+	if s.closed {
+		s.queueMu.Unlock()
+		return false
+	}
+	s.finished = append(s.finished, d)
+	wakeup := !s.notified
+	s.notified = true
+	s.queueMu.Unlock()
+
+	if wakeup {
+		s.pfd.Wakeup()
+	}
+	return true
+}
+
+// release makes d available to the loop again, the requests submitted and
+// the readiness seen while d was on a worker are processed in order.
+func (s *shard) release(d *fdDesc) {
+	d.busy = false
+	s.releaseTimers(d)
+	s.remember(d)
+	deferred := d.deferred
+	d.deferred = nil
+	readable, writable := d.pendingRead, d.pendingWrite
+	d.pendingRead, d.pendingWrite = false, false
+
+	for i := range deferred {
+		s.handle(&deferred[i])
+	}
+	if readable || writable {
+		s.dispatch(d, readable, writable)
+	}
+}
@@ -0,0 +1,78 @@
+package gaio
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// maxIovecs is IOV_MAX on linux and the bsds
+	maxIovecs = 1024
+	// writevBudget limits the bytes gathered into a writev
+	writevBudget = 256 * 1024
+)
+
+// coalescable reports whether pcb is a plain write which can be gathered
+// with its neighbours into a writev
+func coalescable(pcb *aiocb) bool {
+	return pcb.kind == kindWrite && len(pcb.buffer) > pcb.size &&
+		!pcb.connect && pcb.cork == 0 && !pcb.zerocopy && pcb.file == nil &&
+		pcb.splice == nil && !pcb.fastopen && pcb.addr == nil && !pcb.sctp &&
+		pcb.progress == nil
+}
+
+// tryWritev writes the consecutive plain writes at the head of the queue of
+// d with a single writev, the bytes written are attributed to the requests
+// in order and the fully written ones are completed. It returns false if fd
+// is not writable anymore.
+func (s *shard) tryWritev(d *fdDesc) bool {
+	iovs := s.iovecs[:0]
+	var total int
+	for i := range d.writers {
+		pcb := &d.writers[i]
+		if !coalescable(pcb) || len(iovs) == maxIovecs || total >= writevBudget {
+			break
+		}
+		b := pcb.buffer[pcb.size:]
+		var v unix.Iovec
+		v.Base = &b[0]
+		v.SetLen(len(b))
+		iovs = append(iovs, v)
+		total += len(b)
+	}
+	s.iovecs = iovs
+
+	fd := d.writers[0].fd
+	r, e := s.w.sys.Writev(fd, iovs)
+	for i := range iovs {
+		iovs[i] = unix.Iovec{} // don't pin the buffers
+	}
+	if e == syscall.EAGAIN {
+		s.countAgain(fd, true)
+		return false
+	} else if e != nil {
+		pcb := &d.writers[0]
+		s.complete(pcb, OpResult{Operation: OpWrite, Fd: fd, Buffer: pcb.buffer, Size: pcb.size, Err: s.w.keepAliveErr(fd, e)})
+		d.writers = s.popFront(d.writers)
+		return true
+	}
+
+	s.countWrite(fd, int(r), total)
+	s.progressed(fd, int(r))
+	n := int(r)
+	for n > 0 {
+		pcb := &d.writers[0]
+		left := len(pcb.buffer) - pcb.size
+		if n < left {
+			// partially written, resumed on the next writability
+			pcb.size += n
+			return false
+		}
+		n -= left
+		pcb.size = len(pcb.buffer)
+		s.complete(pcb, OpResult{Operation: OpWrite, Fd: fd, Buffer: pcb.buffer, Size: pcb.size})
+		d.writers = s.popFront(d.writers)
+	}
+	return int(r) == total
+}
@@ -0,0 +1,22 @@
+package gaio
+
+// zeroCopyThreshold is the minimal size of a buffer to be sent with
+// MSG_ZEROCOPY, page pinning and notification costs more than copying
+// for small buffers.
+const zeroCopyThreshold = 16 * 1024
+
+// zcState tracks MSG_ZEROCOPY sends of a fd, owned by loop
+type zcState struct {
+	enabled     bool   // SO_ZEROCOPY has been set
+	unsupported bool   // fallback to normal writes
+	next        uint32 // sequence number of the next zerocopy send
+	acked       uint32 // sends before this sequence number have completed
+}
+
+// WriteZeroCopy submits a write request like Write, but the data is sent with
+// MSG_ZEROCOPY to avoid copying the payload into kernel, the completion is
+// delivered after the kernel has released the buffer. It falls back to
+// normal writes silently for small buffers or on unsupported systems.
+func (w *Watcher) WriteZeroCopy(fd int, buf []byte, done chan OpResult) error {
+	return w.shardOf(fd).submit(aiocb{kind: kindWrite, fd: fd, buffer: buf, zerocopy: len(buf) >= zeroCopyThreshold, done: done})
+}
@@ -0,0 +1,9 @@
+// +build darwin netbsd freebsd openbsd dragonfly
+
+package gaio
+
+// MSG_ZEROCOPY is linux only, fallback to normal writes
+func (s *shard) tryWriteZeroCopy(pcb *aiocb) (complete bool) {
+	pcb.zerocopy = false
+	return s.tryWrite(pcb)
+}
@@ -0,0 +1,104 @@
+// +build linux
+
+package gaio
+
+import (
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const sizeofSockExtendedErr = int(unsafe.Sizeof(unix.SockExtendedErr{}))
+
+// tryWriteZeroCopy sends the buffer with MSG_ZEROCOPY, the request completes
+// after all zerocopy sends of it have been notified through the error queue.
+func (s *shard) tryWriteZeroCopy(pcb *aiocb) (complete bool) {
+	d := s.w.fds.get(pcb.fd)
+	if d == nil {
+		s.complete(pcb, OpResult{Operation: OpWrite, Fd: pcb.fd, Buffer: pcb.buffer, Err: ErrNotWatched})
+		return true
+	}
+	if d.zc == nil {
+		d.zc = new(zcState)
+	}
+	zc := d.zc
+
+	if !zc.enabled && !zc.unsupported {
+		if err := unix.SetsockoptInt(pcb.fd, unix.SOL_SOCKET, unix.SO_ZEROCOPY, 1); err != nil {
+			zc.unsupported = true
+		} else {
+			zc.enabled = true
+		}
+	}
+
+	if zc.unsupported && !pcb.zcPending {
+		pcb.zerocopy = false
+		return s.tryWrite(pcb)
+	}
+
+	for pcb.size < len(pcb.buffer) {
+		nw, ew := s.w.sys.Sendmsg(pcb.fd, pcb.buffer[pcb.size:], nil, nil, unix.MSG_ZEROCOPY)
+		if ew == syscall.ENOBUFS {
+			// out of optmem, copy this part instead
+			nw, ew = s.w.sys.Write(pcb.fd, pcb.buffer[pcb.size:])
+		} else if ew == nil {
+			pcb.zcPending = true
+			pcb.zcLast = zc.next
+			zc.next++
+		}
+
+		if ew == syscall.EAGAIN {
+			return false
+		} else if ew != nil {
+			s.complete(pcb, OpResult{Operation: OpWrite, Fd: pcb.fd, Buffer: pcb.buffer, Size: pcb.size, Err: ew})
+			return true
+		}
+		pcb.size += nw
+	}
+
+	// all data sent, wait for the kernel to release the buffer
+	s.readZeroCopyNotifications(pcb.fd, zc)
+	if pcb.zcPending && int32(zc.acked-pcb.zcLast) <= 0 {
+		return false
+	}
+
+	s.complete(pcb, OpResult{Operation: OpWrite, Fd: pcb.fd, Buffer: pcb.buffer, Size: pcb.size})
+	return true
+}
+
+// readZeroCopyNotifications drains the error queue of fd, and records the
+// completed sequence range
+func (s *shard) readZeroCopyNotifications(fd int, zc *zcState) {
+	oob := s.buffer[:unix.CmsgSpace(sizeofSockExtendedErr)]
+	for {
+		_, oobn, _, _, err := s.w.sys.Recvmsg(fd, nil, oob, unix.MSG_ERRQUEUE)
+		if err != nil {
+			return
+		}
+
+		msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			continue
+		}
+
+		for _, m := range msgs {
+			if !(m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_RECVERR) &&
+				!(m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_RECVERR) {
+				continue
+			}
+			if len(m.Data) < sizeofSockExtendedErr {
+				continue
+			}
+
+			serr := (*unix.SockExtendedErr)(unsafe.Pointer(&m.Data[0]))
+			if serr.Origin != unix.SO_EE_ORIGIN_ZEROCOPY {
+				continue
+			}
+			// [Info, Data] is the range of completed sends
+			if int32(serr.Data+1-zc.acked) > 0 {
+				zc.acked = serr.Data + 1
+			}
+		}
+	}
+}